@@ -19,8 +19,9 @@ func DeleteBucket(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Lo
 	bucketID := c.Args().Get(0)
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	store.Naming = cfg.ShardNaming
 
-	err := datastorage.DeleteBucket(db, bucketID, store, logger)
+	err := datastorage.DeleteBucket(c.Context, db, bucketID, store, cfg, logger)
 	if err != nil {
 		return fmt.Errorf("failed to delete bucket")
 	}
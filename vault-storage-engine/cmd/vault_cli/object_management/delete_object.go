@@ -12,21 +12,21 @@ import (
 )
 
 func DeleteObject(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
-	if c.NArg() != 3 {
-		return fmt.Errorf("usage: delete-object <bucket_id> <object_id> <initial_version_id>")
+	if c.NArg() != 2 {
+		return fmt.Errorf("usage: delete-object <bucket_id> <object_id>")
 	}
 
 	bucketID := c.Args().Get(0)
 	objectID := c.Args().Get(1)
-	versionID := c.Args().Get(2)
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	err := datastorage.DeleteObject(db, bucketID, objectID, versionID, store, logger)
+	store.Naming = cfg.ShardNaming
+	err := datastorage.DeleteObject(c.Context, db, bucketID, objectID, store, cfg, logger)
 	if err != nil {
-		return fmt.Errorf("failed to delete object")
+		return fmt.Errorf("failed to delete object, %w", err)
 	}
 
-	fmt.Printf("Successfully deleted object %s version (%s)\n", objectID, versionID)
+	fmt.Printf("Successfully deleted object %s\n", objectID)
 
 	return nil
 }
@@ -21,9 +21,10 @@ func DeleteObjectByVersion(c *cli.Context, db *sql.DB, cfg *config.Config, logge
 	versionID := c.Args().Get(2)
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	err := datastorage.DeleteObjectByVersion(db, bucketID, objectID, versionID, store, logger)
+	store.Naming = cfg.ShardNaming
+	err := datastorage.DeleteVersion(c.Context, db, bucketID, objectID, versionID, store, cfg, logger)
 	if err != nil {
-		return fmt.Errorf("failed to delete object")
+		return fmt.Errorf("failed to delete object, %w", err)
 	}
 
 	fmt.Printf("Successfully deleted object %s version (%s)\n", objectID, versionID)
@@ -22,7 +22,8 @@ func RetrieveCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap
 	versionID := c.Args().Get(2)
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	data, filename, err := datastorage.RetrieveData(db, bucketID, objectID, versionID, store, cfg, logger)
+	store.Naming = cfg.ShardNaming
+	data, filename, err := datastorage.RetrieveData(c.Context, db, bucketID, objectID, versionID, store, cfg, logger)
 	if err != nil {
 		return fmt.Errorf("retrieve failed: %w", err)
 	}
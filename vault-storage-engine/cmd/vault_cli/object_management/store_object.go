@@ -9,6 +9,7 @@ import (
 	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
 	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
 	"github.com/getvaultapp/vault-storage-engine/pkg/utils"
 	"github.com/google/uuid"
@@ -16,6 +17,24 @@ import (
 	"go.uber.org/zap"
 )
 
+// storeLocations are the locations the store-object and update-object commands write shards to
+var storeLocations = []string{
+	"/mnt/disk1/shards",
+	"/mnt/disk2/shards",
+	"/mnt/disk3/shards",
+	"/mnt/disk4/shards",
+	"/mnt/disk5/shards",
+	"/mnt/disk6/shards",
+	"/mnt/disk7/shards",
+	"/mnt/disk8/shards",
+}
+
+// ValidateLayout checks storeLocations against cfg, so a bad layout fails when the CLI starts rather than on the
+// first store
+func ValidateLayout(cfg *config.Config) error {
+	return config.ValidateLayout(cfg, storeLocations, erasurecoding.EncodingParams{})
+}
+
 func StoreCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) error {
 	if c.NArg() < 2 {
 		return fmt.Errorf("usage: store-object <bucket_id> <file_path>")
@@ -30,20 +49,13 @@ func StoreCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Lo
 	}
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	locations := []string{
-		"/mnt/disk1/shards",
-		"/mnt/disk2/shards",
-		"/mnt/disk3/shards",
-		"/mnt/disk4/shards",
-		"/mnt/disk5/shards",
-		"/mnt/disk6/shards",
-		"/mnt/disk7/shards",
-		"/mnt/disk8/shards",
-	}
+	store.Naming = cfg.ShardNaming
+	store.Durable = cfg.Durable
+	store.TempPath = cfg.ShardStoreTempPath
 	objectID := uuid.New().String() // Generate a unique object ID
 
 	// Shard and store data
-	_, shardLocations, proofs, err := datastorage.StoreData(db, data, bucketID, objectID, filepath.Base(filePath), store, cfg, locations, logger)
+	_, shardLocations, proofs, err := datastorage.StoreData(c.Context, db, data, bucketID, objectID, filepath.Base(filePath), store, cfg, storeLocations, erasurecoding.EncodingParams{}, logger)
 	if err != nil {
 		return fmt.Errorf("store failed: %w", err)
 	}
@@ -76,7 +88,7 @@ func StoreCommand(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap.Lo
 	}
 	*/
 	/* err = datastorage.Retry(3, 2*time.Second, logger, func() error {
-		versionID, shardLocations, proofs, err := datastorage.StoreData(db, data, bucketID, objectID, filepath.Base(filePath), store, cfg, locations, logger)
+		versionID, shardLocations, proofs, err := datastorage.StoreData(c.Context, db, data, bucketID, objectID, filepath.Base(filePath), store, cfg, storeLocations, erasurecoding.EncodingParams{}, logger)
 		if err != nil {
 			return fmt.Errorf("attempts exausted, failed to store data")
 		}
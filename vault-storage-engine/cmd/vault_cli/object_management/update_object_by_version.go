@@ -9,6 +9,7 @@ import (
 	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
 	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
@@ -42,19 +43,12 @@ func UpdateByVersion(c *cli.Context, db *sql.DB, cfg *config.Config, logger *zap
 
 		// Setup a storage component for handling shards
 		store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-		locations := []string{
-			"/mnt/disk1/shards",
-			"/mnt/disk2/shards",
-			"/mnt/disk3/shards",
-			"/mnt/disk4/shards",
-			"/mnt/disk5/shards",
-			"/mnt/disk6/shards",
-			"/mnt/disk7/shards",
-			"/mnt/disk8/shards",
-		}
+		store.Naming = cfg.ShardNaming
+		store.Durable = cfg.Durable
+		store.TempPath = cfg.ShardStoreTempPath
 
 		// make use of the predefined versionID returned by UpdateFileVersionIfItExists
-		_, _, _, err = datastorage.StoreDataWithVersion(db, data, bucketID, objectID, version, filepath.Base(originalFile), store, cfg, locations, logger)
+		_, _, _, err = datastorage.StoreDataWithVersion(c.Context, db, data, bucketID, objectID, version, filepath.Base(originalFile), store, cfg, storeLocations, erasurecoding.EncodingParams{}, logger)
 		if err != nil {
 			return fmt.Errorf("failed to store updated object, %w", err)
 		}
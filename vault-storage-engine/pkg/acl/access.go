@@ -0,0 +1,165 @@
+package acl
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+)
+
+// ErrAccessDenied is returned, possibly wrapped, when a principal lacks a permission it needs
+var ErrAccessDenied = errors.New("access denied")
+
+// Permission is a set of operations a principal may perform on an object, combined with bitwise OR
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+
+	// PermAll grants every operation, and is what the owner of a bucket holds over it and its objects
+	PermAll = PermRead | PermWrite | PermDelete
+)
+
+// String lists the operations in p, such as "read|write"
+func (p Permission) String() string {
+	var names []string
+	for _, perm := range []struct {
+		bit  Permission
+		name string
+	}{{PermRead, "read"}, {PermWrite, "write"}, {PermDelete, "delete"}} {
+		if p&perm.bit != 0 {
+			names = append(names, perm.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Resource types entries are recorded against in the acls table
+const (
+	resourceObject = "object"
+	resourceBucket = "bucket"
+)
+
+// GrantAccess grants a principal perm on an object, in addition to whatever it already holds
+func GrantAccess(db *sql.DB, objectID, principal string, perm Permission) error {
+	return grant(db, resourceObject, objectID, principal, perm)
+}
+
+// RevokeAccess withdraws perm on an object from a principal, leaving any other permissions it holds in place
+// Permissions inherited from the object's bucket are not affected, and must be revoked with RevokeBucketAccess
+func RevokeAccess(db *sql.DB, objectID, principal string, perm Permission) error {
+	return revoke(db, resourceObject, objectID, principal, perm)
+}
+
+// GrantBucketAccess grants a principal perm on a bucket, which every object in the bucket inherits
+func GrantBucketAccess(db *sql.DB, bucketID, principal string, perm Permission) error {
+	return grant(db, resourceBucket, bucketID, principal, perm)
+}
+
+// RevokeBucketAccess withdraws perm on a bucket from a principal, leaving grants on its objects in place
+func RevokeBucketAccess(db *sql.DB, bucketID, principal string, perm Permission) error {
+	return revoke(db, resourceBucket, bucketID, principal, perm)
+}
+
+// CheckAccess reports whether a principal holds every permission in perm on an object, either granted on the object
+// itself or inherited from its bucket; the bucket's owner holds them all
+// bucket.ErrObjectNotFound is returned for an object that does not exist
+func CheckAccess(db *sql.DB, objectID, principal string, perm Permission) (bool, error) {
+	var bucketID string
+	err := db.QueryRow(`SELECT bucket_id FROM objects WHERE id = ?`, objectID).Scan(&bucketID)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("%w: %s", bucket.ErrObjectNotFound, objectID)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve object, %w", err)
+	}
+	return checkAccess(db, bucketID, objectID, principal, perm)
+}
+
+// CheckBucketAccess reports whether a principal holds every permission in perm on a bucket, as its owner or by a grant
+// Permissions granted on individual objects are not taken into account
+func CheckBucketAccess(db *sql.DB, bucketID, principal string, perm Permission) (bool, error) {
+	return checkAccess(db, bucketID, "", principal, perm)
+}
+
+// checkAccess combines what a principal holds on a bucket and, unless objectID is empty, on an object in it
+func checkAccess(db *sql.DB, bucketID, objectID, principal string, perm Permission) (bool, error) {
+	var owner string
+	err := db.QueryRow(`SELECT owner FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("%w: %s", bucket.ErrBucketNotFound, bucketID)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve bucket owner, %w", err)
+	}
+	if owner == principal {
+		return true, nil
+	}
+
+	rows, err := db.Query(`SELECT permissions FROM acls WHERE principal = ?
+		AND ((resource_type = ? AND resource_id = ?) OR (resource_type = ? AND resource_id = ?))`,
+		principal, resourceBucket, bucketID, resourceObject, objectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve access control entries, %w", err)
+	}
+	defer rows.Close()
+
+	var held Permission
+	for rows.Next() {
+		var granted Permission
+		if err := rows.Scan(&granted); err != nil {
+			return false, fmt.Errorf("failed to scan access control entry: %w", err)
+		}
+		held |= granted
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to retrieve access control entries, %w", err)
+	}
+	return held&perm == perm, nil
+}
+
+// grant adds perm to what a principal holds on a resource
+func grant(db *sql.DB, resourceType, resourceID, principal string, perm Permission) error {
+	if principal == "" {
+		return fmt.Errorf("no principal given")
+	}
+	_, err := db.Exec(`INSERT INTO acls (resource_type, resource_id, principal, permissions) VALUES (?, ?, ?, ?)
+		ON CONFLICT (resource_type, resource_id, principal) DO UPDATE SET permissions = permissions | excluded.permissions`,
+		resourceType, resourceID, principal, perm)
+	if err != nil {
+		return fmt.Errorf("failed to grant %s access to %s %s, %w", perm, resourceType, resourceID, err)
+	}
+	return nil
+}
+
+// revoke clears perm from what a principal holds on a resource, dropping the entry once nothing is left
+func revoke(db *sql.DB, resourceType, resourceID, principal string, perm Permission) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE acls SET permissions = permissions & ? WHERE resource_type = ? AND resource_id = ? AND principal = ?`,
+		^perm, resourceType, resourceID, principal)
+	if err != nil {
+		return fmt.Errorf("failed to revoke %s access to %s %s, %w", perm, resourceType, resourceID, err)
+	}
+	_, err = tx.Exec(`DELETE FROM acls WHERE resource_type = ? AND resource_id = ? AND principal = ? AND permissions = 0`,
+		resourceType, resourceID, principal)
+	if err != nil {
+		return fmt.Errorf("failed to revoke %s access to %s %s, %w", perm, resourceType, resourceID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit access revocation, %w", err)
+	}
+	return nil
+}
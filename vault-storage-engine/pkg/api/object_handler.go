@@ -2,23 +2,45 @@ package api
 
 import (
 	"database/sql"
+	"errors"
 	//"fmt"
 	"github.com/gin-gonic/gin"
 	//"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
 	"io/ioutil"
+	"mime"
 	"net/http"
 
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
 	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
 	"github.com/getvaultapp/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/vault-storage-engine/pkg/datastorage"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
 	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+// storeLocations are the locations the object handlers write shards to
+var storeLocations = []string{
+	"/mnt/disk1/shards",
+	"/mnt/disk2/shards",
+	"/mnt/disk3/shards",
+	"/mnt/disk4/shards",
+	"/mnt/disk5/shards",
+	"/mnt/disk6/shards",
+	"/mnt/disk7/shards",
+	"/mnt/disk8/shards",
+}
+
+// ValidateLayout checks storeLocations against cfg, so a bad layout fails when the server starts rather than on the
+// first store
+func ValidateLayout(cfg *config.Config) error {
+	return config.ValidateLayout(cfg, storeLocations, erasurecoding.EncodingParams{})
+}
+
 func StoreObjectHandler(c *gin.Context, db *sql.DB, cfg *config.Config, logger *zap.Logger) {
 	bucketID := c.Param("bucket_id")
-	file, _, err := c.Request.FormFile("file")
+	file, header, err := c.Request.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
 		return
@@ -32,19 +54,29 @@ func StoreObjectHandler(c *gin.Context, db *sql.DB, cfg *config.Config, logger *
 	}
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	// Initialize locations with actual paths
-	locations := []string{
-		"/mnt/disk1/shards",
-		"/mnt/disk2/shards",
-		"/mnt/disk3/shards",
-		"/mnt/disk4/shards",
-		"/mnt/disk5/shards",
-		"/mnt/disk6/shards",
-		"/mnt/disk7/shards",
-		"/mnt/disk8/shards",
-	}
+	store.Naming = cfg.ShardNaming
+	store.Durable = cfg.Durable
+	store.TempPath = cfg.ShardStoreTempPath
 	objectID := uuid.New().String() // Generate a unique object ID
-	versionID, _, _, err := datastorage.StoreData(db, data, bucketID, objectID, "uploaded_file", store, cfg, locations, logger)
+	// Record the name and type the client uploaded the file with
+	ctx := datastorage.WithStoreOptions(c.Request.Context(), datastorage.StoreOptions{Filename: header.Filename, ContentType: header.Header.Get("Content-Type")})
+	versionID, _, _, err := datastorage.StoreData(ctx, db, data, bucketID, objectID, "uploaded_file", store, cfg, storeLocations, erasurecoding.EncodingParams{}, logger)
+	if errors.Is(err, bucket.ErrBucketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+		return
+	}
+	if errors.Is(err, acl.ErrAccessDenied) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	if errors.Is(err, bucket.ErrQuotaExceeded) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Bucket quota exceeded"})
+		return
+	}
+	if errors.Is(err, datastorage.ErrObjectTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Object too large"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Store failed"})
 		return
@@ -59,15 +91,33 @@ func RetrieveObjectHandler(c *gin.Context, db *sql.DB, cfg *config.Config, logge
 	versionID := c.Param("version_id")
 
 	store := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
-	data, filename, err := datastorage.RetrieveData(db, bucketID, objectID, versionID, store, cfg, logger)
+	store.Naming = cfg.ShardNaming
+	data, metadata, err := datastorage.RetrieveWithMetadata(c.Request.Context(), db, bucketID, objectID, versionID, store, cfg, logger)
 
-	if err != nil {
+	switch {
+	case errors.Is(err, bucket.ErrVersionNotFound), errors.Is(err, bucket.ErrObjectNotFound), errors.Is(err, bucket.ErrObjectDeleted):
 		c.JSON(http.StatusNotFound, gin.H{"error": "Object not found"})
 		return
+	case errors.Is(err, acl.ErrAccessDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	case errors.Is(err, datastorage.ErrInsufficientShards):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Object cannot be reconstructed"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Retrieve failed"})
+		return
 	}
 
-	c.Data(http.StatusOK, "application/octet-stream", data)
-	c.Header("Content-Disposition", "attachement; filename="+filename)
+	contentType := metadata.ContentType
+	if contentType == "" && metadata.Format != "" {
+		contentType = mime.TypeByExtension("." + metadata.Format)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", "attachement; filename="+metadata.Filename)
+	c.Data(http.StatusOK, contentType, data)
 }
 
 func UploadObjectHandler(c *gin.Context, db *sql.DB) {
@@ -87,7 +137,23 @@ func UploadObjectHandler(c *gin.Context, db *sql.DB) {
 	data := []byte(req.Data)
 
 	// Store data using Vault's storage system
-	versionID, _, _, err := datastorage.StoreData(db, data, bucketID, req.ObjectID, "uploaded_file", store, cfg, []string{}, logger)
+	versionID, _, _, err := datastorage.StoreData(c.Request.Context(), db, data, bucketID, req.ObjectID, "uploaded_file", store, cfg, storeLocations, erasurecoding.EncodingParams{}, logger)
+	if errors.Is(err, bucket.ErrBucketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+		return
+	}
+	if errors.Is(err, acl.ErrAccessDenied) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	if errors.Is(err, bucket.ErrQuotaExceeded) {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Bucket quota exceeded"})
+		return
+	}
+	if errors.Is(err, datastorage.ErrObjectTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Object too large"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store object"})
 		return
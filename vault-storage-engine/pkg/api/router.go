@@ -2,6 +2,7 @@ package api
 
 /* import (
 	"database/sql"
+	"log"
 
 	"github.com/getvault-mvp/vault-base/pkg/auth"
 	"github.com/getvault-mvp/vault-base/pkg/config"
@@ -15,7 +16,14 @@ func SetupRouter(db *sql.DB) *gin.Engine {
 
 	// Initialize store, cfg, and logger
 	cfg = config.LoadConfig()
-	store = sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	if err := ValidateLayout(cfg); err != nil {
+		log.Fatalf("invalid storage layout: %v", err)
+	}
+	localStore := sharding.NewLocalShardStore(cfg.ShardStoreBasePath)
+	localStore.Naming = cfg.ShardNaming
+	localStore.Durable = cfg.Durable
+	localStore.TempPath = cfg.ShardStoreTempPath
+	store = localStore
 	logger, _ = zap.NewProduction()
 
 	r.POST("/buckets", auth.JWTMiddleware(), auth.RBACMiddleware("owner"), func(c *gin.Context) {
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Operations recorded in audit events
+const (
+	OpStore         = "store"
+	OpRetrieve      = "retrieve"
+	OpDeleteObject  = "delete_object"
+	OpDeleteVersion = "delete_version"
+	OpDeleteBucket  = "delete_bucket"
+	OpExpire        = "expire"
+	OpCopy          = "copy"
+	OpPurge         = "purge"
+	OpCompact       = "compact"
+)
+
+// Event is a single entry of the audit trail
+type Event struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal,omitempty"`
+	Operation string    `json:"operation"`
+	BucketID  string    `json:"bucket_id"`
+	ObjectID  string    `json:"object_id,omitempty"`
+	VersionID string    `json:"version_id,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLogger receives audit events
+// It is kept separate from the diagnostic zap logger so the trail can be shipped on its own, for example to a SIEM
+// Implementations must be safe for concurrent use
+type AuditLogger interface {
+	LogEvent(event Event)
+}
+
+// NopLogger discards every event, and is used until SetLogger is called
+type NopLogger struct{}
+
+func (NopLogger) LogEvent(Event) {}
+
+// JSONLogger writes each event to a writer as a single line of JSON
+type JSONLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger creates a new JSONLogger writing to w
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+func (l *JSONLogger) LogEvent(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s\n", line)
+}
+
+var (
+	mu     sync.RWMutex
+	logger AuditLogger = NopLogger{}
+)
+
+// SetLogger sets the logger every audit event is sent to
+// A nil logger discards events
+func SetLogger(l AuditLogger) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l == nil {
+		l = NopLogger{}
+	}
+	logger = l
+}
+
+// principalKey is the context key under which WithPrincipal records the caller's identity
+type principalKey struct{}
+
+// WithPrincipal returns a context that attributes the operations performed with it to principal
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal set on ctx, or an empty string if none was set
+func PrincipalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// Record completes event with the time, the principal from ctx and the outcome of the operation, then sends it to the logger
+func Record(ctx context.Context, event Event, err error) {
+	event.Time = time.Now().UTC()
+	event.Principal = PrincipalFrom(ctx)
+	event.Success = err == nil
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	mu.RLock()
+	l := logger
+	mu.RUnlock()
+	l.LogEvent(event)
+}
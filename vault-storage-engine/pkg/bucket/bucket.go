@@ -46,7 +46,7 @@ func GetBucket(db *sql.DB, bucketID string) (*Bucket, error) {
 	err := row.Scan(&bucket.ID, &bucket.Owner, &bucket.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("bucket not found")
+			return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
 		}
 		return nil, fmt.Errorf("failed to get bucket: %w", err)
 	}
@@ -54,8 +54,25 @@ func GetBucket(db *sql.DB, bucketID string) (*Bucket, error) {
 	return &bucket, nil
 }
 
+// ListAllBuckets returns the ID of every bucket, as ListBuckets does, and prints them
 func ListAllBuckets(db *sql.DB) ([]string, error) {
-	rows, err := db.Query("SELECT bucket_id FROM buckets")
+	bucketIDs, err := ListBuckets(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket_id := range bucketIDs {
+		fmt.Println("* ", bucket_id)
+	}
+	if bucketIDs == nil {
+		fmt.Println("no active buckets")
+	}
+
+	return bucketIDs, nil
+}
+
+// ListBuckets returns the ID of every bucket, in order
+func ListBuckets(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT bucket_id FROM buckets ORDER BY bucket_id")
 	if err != nil {
 		return nil, fmt.Errorf("error reading row, %w", err)
 	}
@@ -71,13 +88,9 @@ func ListAllBuckets(db *sql.DB) ([]string, error) {
 
 		bucketIDs = append(bucketIDs, bucket_id)
 	}
-	for _, bucket_id := range bucketIDs {
-		fmt.Println("* ", bucket_id)
-	}
-	if bucketIDs == nil {
-		fmt.Println("no active buckets")
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading row, %w", err)
 	}
-
 	return bucketIDs, nil
 }
 
@@ -103,13 +116,14 @@ func GetObjectsInBucket(db *sql.DB, bucketID string) ([]string, error) {
 }
 
 // Deletes all the contents of a bucket
-func DeleteBucket(db *sql.DB, bucketID string) error {
+// Retention locks are checked at now, and a bucket holding a locked version is not deleted
+func DeleteBucket(db *sql.DB, bucketID string, now time.Time) error {
 	objects, err := GetObjectsInBucket(db, bucketID)
 	if err != nil {
 		return fmt.Errorf("failed to get objects in bucket, %w", err)
 	}
 	for _, objectID := range objects {
-		err := DeleteObject(db, bucketID, objectID)
+		err := DeleteObject(db, bucketID, objectID, now)
 		if err != nil {
 			return fmt.Errorf("failed to delete object, %w", err)
 		}
@@ -121,5 +135,9 @@ func DeleteBucket(db *sql.DB, bucketID string) error {
 	if err != nil {
 		return fmt.Errorf("failed to delete bucket, %w", err)
 	}
+	_, err = db.Exec("DELETE FROM acls WHERE resource_type = 'bucket' AND resource_id = ?", bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to delete bucket access control entries, %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,96 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// AddContentRef registers the shards of a newly stored version as the shared copy of content with the given checksum
+// The metadata recorded is copied into every later version with the same content
+// It reports false if another version registered the same content first, in which case nothing is changed
+func AddContentRef(db Querier, checksum, objectID, versionID string, metadata VersionMetadata) (bool, error) {
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	query := `INSERT INTO content_refs (checksum, object_id, version_id, metadata, refcount) VALUES (?, ?, ?, ?, 1) ON CONFLICT (checksum) DO NOTHING`
+	res, err := db.Exec(query, checksum, objectID, versionID, metadataJSON)
+	if err != nil {
+		return false, fmt.Errorf("failed to add content reference: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to add content reference: %w", err)
+	}
+	return n == 1, nil
+}
+
+// AcquireContentRef takes a reference to existing content with the given checksum
+// It returns the metadata of the shared copy, or nil if no content with that checksum is stored
+func AcquireContentRef(db *sql.DB, checksum string) (*VersionMetadata, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE content_refs SET refcount = refcount + 1 WHERE checksum = ?`, checksum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire content reference: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+
+	var metadataJSON string
+	err = tx.QueryRow(`SELECT metadata FROM content_refs WHERE checksum = ?`, checksum).Scan(&metadataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve content reference: %w", err)
+	}
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit content reference, %w", err)
+	}
+	return &metadata, nil
+}
+
+// ReleaseContentRef drops a reference to shared content and returns the number of references left
+// The reference is removed entirely once the count reaches zero, at which point the caller owns the shards
+func ReleaseContentRef(db *sql.DB, checksum string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE content_refs SET refcount = refcount - 1 WHERE checksum = ?`, checksum)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release content reference: %w", err)
+	}
+
+	var refcount int
+	err = tx.QueryRow(`SELECT refcount FROM content_refs WHERE checksum = ?`, checksum).Scan(&refcount)
+	switch {
+	case err == sql.ErrNoRows:
+		// Nothing else references the content
+		refcount = 0
+	case err != nil:
+		return 0, fmt.Errorf("failed to retrieve content reference: %w", err)
+	case refcount <= 0:
+		refcount = 0
+		if _, err := tx.Exec(`DELETE FROM content_refs WHERE checksum = ?`, checksum); err != nil {
+			return 0, fmt.Errorf("failed to delete content reference: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit content reference, %w", err)
+	}
+	return refcount, nil
+}
@@ -0,0 +1,74 @@
+package bucket
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrContentIDNotFound is returned by ResolveContentID for identifiers that name no stored version
+var ErrContentIDNotFound = errors.New("content id not found")
+
+// contentIDEncoding encodes content identifiers as unpadded lowercase base32, so they can be used as they are in URLs
+// and host names alike
+var contentIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// ContentID returns the content identifier of an object version, for building immutable URLs that ResolveContentID
+// maps back to it, and records it so it can be
+// The identifier is the base32 SHA-256 hash of the checksum of the version's plaintext, or of its Merkle root for
+// versions stored before checksums were recorded, together with the version it belongs to, so that versions holding
+// the same content still each get one of their own; since a version never changes once stored, neither does its
+// identifier, and calling ContentID again returns the same one, including after the object is moved with MoveObject
+func ContentID(db *sql.DB, bucketID, objectID, versionID string) (string, error) {
+	metadata, err := GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return "", err
+	}
+	if metadata.BucketID != bucketID {
+		return "", fmt.Errorf("%w: %s (version %s) in bucket %s", ErrVersionNotFound, objectID, versionID, bucketID)
+	}
+
+	// A version keeps the identifier it was first given, even once moved to a key it would now be derived under
+	var id string
+	err = db.QueryRow(`SELECT content_id FROM content_ids WHERE object_id = ? AND version_id = ?`, objectID, versionID).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to look up content id: %w", err)
+	}
+
+	content := metadata.Checksum
+	if content == "" {
+		content = metadata.MerkleRoot
+	}
+	if content == "" {
+		return "", fmt.Errorf("%s (version %s) was stored before checksums or Merkle roots were recorded, so it has no content to identify it by", objectID, versionID)
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{content, bucketID, objectID, versionID}, "\x00")))
+	id = contentIDEncoding.EncodeToString(sum[:])
+
+	query := `INSERT OR IGNORE INTO content_ids (content_id, bucket_id, object_id, version_id) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(query, id, bucketID, objectID, versionID); err != nil {
+		return "", fmt.Errorf("failed to record content id: %w", err)
+	}
+	return id, nil
+}
+
+// ResolveContentID returns the bucket, object and version a content identifier returned by ContentID was derived
+// from, matching it case-insensitively
+// Identifiers of versions that have since been deleted fail with ErrContentIDNotFound, as do ones never returned
+func ResolveContentID(db *sql.DB, id string) (bucketID, objectID, versionID string, err error) {
+	query := `SELECT bucket_id, object_id, version_id FROM content_ids WHERE content_id = ?`
+	err = db.QueryRow(query, strings.ToLower(id)).Scan(&bucketID, &objectID, &versionID)
+	if err == sql.ErrNoRows {
+		return "", "", "", fmt.Errorf("%w: %s", ErrContentIDNotFound, id)
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to resolve content id: %w", err)
+	}
+	return bucketID, objectID, versionID, nil
+}
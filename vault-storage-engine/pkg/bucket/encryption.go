@@ -1,9 +1,13 @@
 package bucket
 
 import (
+	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"sync"
 
 	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
 )
 
 // GetEncryptionKey retrieves the encryption key from the configuration
@@ -14,3 +18,63 @@ func GetEncryptionKey(cfg *config.Config) ([]byte, error) {
 	}
 	return []byte(key), nil
 }
+
+// derivedKeys caches the master keys derived from passphrases, keyed by salt and passphrase, since deriving one is
+// deliberately slow
+var derivedKeys sync.Map
+
+// GetBucketEncryptionKey returns the master key that wraps the data keys of the versions in a bucket
+// With a passphrase configured, each bucket's key is derived from the passphrase and a salt of the bucket's own,
+// which is generated and recorded the first time the bucket needs one; otherwise every bucket shares the configured key
+func GetBucketEncryptionKey(db Querier, cfg *config.Config, bucketID string) ([]byte, error) {
+	if cfg.EncryptionPassphrase == "" {
+		return GetEncryptionKey(cfg)
+	}
+
+	salt, err := getKeySalt(db, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := string(salt) + "\x00" + cfg.EncryptionPassphrase
+	if key, ok := derivedKeys.Load(cacheKey); ok {
+		return key.([]byte), nil
+	}
+	key, err := encryption.DeriveKey(cfg.EncryptionPassphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+	derivedKeys.Store(cacheKey, key)
+	return key, nil
+}
+
+// getKeySalt returns the key derivation salt of a bucket, generating and recording one if the bucket has none yet
+// When callers race to record a salt, the first one recorded wins and is returned to every caller
+func getKeySalt(db Querier, bucketID string) ([]byte, error) {
+	var saltHex string
+	err := db.QueryRow(`SELECT key_salt FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&saltHex)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key salt of bucket, %w", err)
+	}
+
+	if saltHex == "" {
+		salt, err := encryption.GenerateSalt()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(`UPDATE buckets SET key_salt = ? WHERE bucket_id = ? AND key_salt = ''`, hex.EncodeToString(salt), bucketID); err != nil {
+			return nil, fmt.Errorf("failed to record key salt of bucket, %w", err)
+		}
+		if err := db.QueryRow(`SELECT key_salt FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&saltHex); err != nil {
+			return nil, fmt.Errorf("failed to get key salt of bucket, %w", err)
+		}
+	}
+
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key salt recorded for bucket %s: %w", bucketID, err)
+	}
+	return salt, nil
+}
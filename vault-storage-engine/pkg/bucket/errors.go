@@ -0,0 +1,12 @@
+package bucket
+
+import "errors"
+
+// Sentinel errors returned, possibly wrapped, by metadata lookups
+// Callers should match them with errors.Is
+var (
+	ErrBucketNotFound  = errors.New("bucket not found")
+	ErrObjectNotFound  = errors.New("object not found")
+	ErrVersionNotFound = errors.New("object version not found")
+	ErrObjectExists    = errors.New("object already exists")
+)
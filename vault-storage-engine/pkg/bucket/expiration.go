@@ -0,0 +1,92 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ListExpiredVersions returns the metadata of every version whose expiration time is at or before now
+// Versions stored without an expiration time never expire, and versions still under a retention lock are left out
+func ListExpiredVersions(db *sql.DB, now time.Time) ([]VersionMetadata, error) {
+	// Versions without an expiration time record the zero time, so they are filtered out before being decoded
+	query := `SELECT metadata FROM versions WHERE json_extract(metadata, '$.expires_at') NOT IN ('', '0001-01-01T00:00:00Z')`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expiring versions: %w", err)
+	}
+	defer rows.Close()
+
+	var expired []VersionMetadata
+	for rows.Next() {
+		var metadataJSON string
+		if err := rows.Scan(&metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		var metadata VersionMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata: %w", err)
+		}
+		if isExpired(metadata, now) && !metadata.IsLockedAt(now) {
+			expired = append(expired, metadata)
+		}
+	}
+	return expired, rows.Err()
+}
+
+// ClaimExpiredVersion removes the metadata of a version if it is still expired at now, and returns it so its shards can be deleted
+// It returns nil if the version is gone, no longer expired, under a retention lock, or locked by another writer,
+// so callers can simply skip it
+func ClaimExpiredVersion(db *sql.DB, bucketID, objectID, versionID string, now time.Time) (*VersionMetadata, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	// The version is read again inside the transaction, since it may have changed since it was listed
+	var metadataJSON string
+	err = tx.QueryRow(`SELECT metadata FROM versions WHERE object_id = ? AND version_id = ?`, objectID, versionID).Scan(&metadataJSON)
+	if err == sql.ErrNoRows || isLocked(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	if !isExpired(metadata, now) || metadata.IsLockedAt(now) {
+		return nil, nil
+	}
+
+	if err := deleteVersion(tx, bucketID, objectID, versionID, now); err != nil {
+		if isLocked(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if isLocked(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to commit version deletion, %w", err)
+	}
+	return &metadata, nil
+}
+
+// isExpired reports whether a version has an expiration time at or before now
+func isExpired(metadata VersionMetadata, now time.Time) bool {
+	return !metadata.ExpiresAt.IsZero() && !metadata.ExpiresAt.After(now)
+}
+
+// isLocked reports whether err means the database is held by another writer
+func isLocked(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
@@ -0,0 +1,71 @@
+package bucket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrIdempotencyKeyReused is returned when an idempotency key is presented for another object than the one whose
+	// store first recorded it
+	ErrIdempotencyKeyReused = errors.New("idempotency key already used for another object")
+	// ErrIdempotencyKeyInUse is returned when two stores record the same idempotency key at once, and the other one
+	// recorded it first
+	ErrIdempotencyKeyInUse = errors.New("idempotency key recorded by a concurrent store")
+)
+
+// LookupIdempotencyKey returns the version recorded under an idempotency key of a bucket since the given time, along
+// with its metadata, or nil if no version was recorded under it since then or the version it names no longer exists
+// A key recorded for another object fails with ErrIdempotencyKeyReused
+func LookupIdempotencyKey(db Querier, bucketID, key, objectID string, since time.Time) (*VersionMetadata, error) {
+	var recordedObjectID, versionID string
+	query := `SELECT object_id, version_id FROM idempotency_keys WHERE bucket_id = ? AND idempotency_key = ? AND recorded_at >= ?`
+	err := db.QueryRow(query, bucketID, key, since.UnixNano()).Scan(&recordedObjectID, &versionID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up idempotency key: %w", err)
+	}
+	if recordedObjectID != objectID {
+		return nil, fmt.Errorf("%w: %q was recorded for object %s", ErrIdempotencyKeyReused, key, recordedObjectID)
+	}
+
+	metadata, err := GetObjectMetadata(db, objectID, versionID)
+	if errors.Is(err, ErrVersionNotFound) {
+		// A version deleted since leaves nothing to return, so the store goes ahead again
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// RecordIdempotencyKey records the version a store created under an idempotency key of a bucket, replacing the
+// record of any earlier store under the key that was recorded before since, and so has expired, or whose version has
+// been deleted; keys that expired across every bucket are dropped at the same time, so they never pile up
+// A key already recorded since then, by a concurrent store, fails with ErrIdempotencyKeyInUse
+func RecordIdempotencyKey(db Querier, bucketID, key, objectID, versionID string, now, since time.Time) error {
+	if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE recorded_at < ?`, since.UnixNano()); err != nil {
+		return fmt.Errorf("failed to expire idempotency keys: %w", err)
+	}
+
+	query := `INSERT INTO idempotency_keys (bucket_id, idempotency_key, object_id, version_id, recorded_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (bucket_id, idempotency_key) DO UPDATE SET object_id = excluded.object_id, version_id = excluded.version_id, recorded_at = excluded.recorded_at
+		WHERE NOT EXISTS (SELECT 1 FROM versions WHERE object_id = idempotency_keys.object_id AND version_id = idempotency_keys.version_id)`
+	res, err := db.Exec(query, bucketID, key, objectID, versionID, now.UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to record idempotency key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to record idempotency key: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %q", ErrIdempotencyKeyInUse, key)
+	}
+	return nil
+}
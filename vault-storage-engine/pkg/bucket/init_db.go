@@ -2,15 +2,53 @@ package bucket
 
 import (
 	"database/sql"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// DBOptions controls how the connections to the SQLite database are opened
+// For many goroutines storing objects at once, WAL mode with a busy timeout of a few seconds is recommended; that is
+// the equivalent of running "PRAGMA journal_mode=WAL" and "PRAGMA busy_timeout=5000" on every connection
+type DBOptions struct {
+	// WAL switches the database to write-ahead logging, in which readers never block the writer or each other
+	// The setting is persistent, so the database stays in WAL mode when it is next opened without it
+	WAL bool
+	// BusyTimeout is how long a connection waits for a lock held by another connection before failing with
+	// "database is locked"; zero keeps the driver's default of five seconds
+	BusyTimeout time.Duration
+}
+
 // InitDB initializes the SQLite database
 // InitDB initializes the database if it doesn't exist and returns a connection to it.
+// Transactions take the write lock as soon as they begin, as with InitDBWithOptions
 func InitDB() (*sql.DB, error) {
-	dbPath := "metadata.db"
+	return InitDBWithOptions("metadata.db", DBOptions{})
+}
+
+// InitDBWithOptions initializes the database at dbPath if it doesn't exist, and returns a connection to it opened with opts
+// Transactions take the write lock as soon as they begin rather than on their first write, so concurrent writers wait
+// for each other for up to the busy timeout, instead of failing when a read inside a transaction can no longer be
+// upgraded to a write
+func InitDBWithOptions(dbPath string, opts DBOptions) (*sql.DB, error) {
+	// The driver applies these to every connection it opens, not just the first
+	params := url.Values{}
+	params.Set("_txlock", "immediate")
+	if opts.WAL {
+		params.Set("_journal_mode", "WAL")
+	}
+	if opts.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10))
+	}
+	return initDB(dbPath, dbPath+"?"+params.Encode())
+}
+
+// initDB creates the database file at dbPath if needed, then opens it with the driver data source name dsn
+func initDB(dbPath, dsn string) (*sql.DB, error) {
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		// Database file does not exist, create and initialize it
 		file, err := os.Create(dbPath)
@@ -23,7 +61,7 @@ func InitDB() (*sql.DB, error) {
 		//log.Println("Database file already exists.")
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -43,13 +81,18 @@ func initializeSchema(db *sql.DB) error {
 	CREATE TABLE IF NOT EXISTS buckets (
 		id TEXT PRIMARY KEY,
 		bucket_id NOT NULL,
-		owner TEXT NOT NULL
+		owner TEXT NOT NULL,
+		quota_bytes INTEGER NOT NULL DEFAULT 0,
+		key_salt TEXT NOT NULL DEFAULT '',
+		trash_retention_seconds INTEGER NOT NULL DEFAULT 0,
+		settings TEXT NOT NULL DEFAULT '{}'
 	);
 	CREATE TABLE IF NOT EXISTS objects (
 		id TEXT PRIMARY KEY,
 		filename TEXT NOT NULL,
 		bucket_id TEXT NOT NULL,
 		latest_version TEXT,
+		deleted_at TEXT NOT NULL DEFAULT '',
 		FOREIGN KEY (bucket_id) REFERENCES buckets(id)
 	);
 	CREATE TABLE IF NOT EXISTS versions (
@@ -69,7 +112,89 @@ func initializeSchema(db *sql.DB) error {
 		permission TEXT,
 		PRIMARY KEY (resource_id, resource_type, user_id)
 	);
+	CREATE TABLE IF NOT EXISTS acls (
+		resource_type TEXT NOT NULL,
+		resource_id TEXT NOT NULL,
+		principal TEXT NOT NULL,
+		permissions INTEGER NOT NULL,
+		PRIMARY KEY (resource_type, resource_id, principal)
+	);
+	CREATE TABLE IF NOT EXISTS content_refs (
+		checksum TEXT PRIMARY KEY,
+		object_id TEXT NOT NULL,
+		version_id TEXT NOT NULL,
+		metadata TEXT NOT NULL,
+		refcount INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS tags (
+		object_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (object_id, key)
+	);
+	CREATE TABLE IF NOT EXISTS multipart_uploads (
+		upload_id TEXT PRIMARY KEY,
+		bucket_id TEXT NOT NULL,
+		object_id TEXT NOT NULL,
+		metadata TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS multipart_parts (
+		upload_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		metadata TEXT NOT NULL,
+		PRIMARY KEY (upload_id, part_number)
+	);
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		bucket_id TEXT NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		object_id TEXT NOT NULL,
+		version_id TEXT NOT NULL,
+		recorded_at INTEGER NOT NULL,
+		PRIMARY KEY (bucket_id, idempotency_key)
+	);
+	CREATE TABLE IF NOT EXISTS content_ids (
+		content_id TEXT PRIMARY KEY,
+		bucket_id TEXT NOT NULL,
+		object_id TEXT NOT NULL,
+		version_id TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_objects_bucket ON objects(bucket_id);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_recorded ON idempotency_keys(recorded_at);
+	CREATE INDEX IF NOT EXISTS idx_versions_object ON versions(object_id);
+	CREATE INDEX IF NOT EXISTS idx_content_ids_version ON content_ids(object_id, version_id);
 	`
-	_, err := db.Exec(schema)
-	return err
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Databases created before quotas, key salts, the trash and bucket settings were added need the columns added to
+	// their existing tables
+	for _, column := range []struct{ table, name, definition string }{
+		{"buckets", "quota_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"buckets", "key_salt", "TEXT NOT NULL DEFAULT ''"},
+		{"buckets", "trash_retention_seconds", "INTEGER NOT NULL DEFAULT 0"},
+		{"buckets", "settings", "TEXT NOT NULL DEFAULT '{}'"},
+		{"objects", "deleted_at", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumnIfMissing(db, column.table, column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless the table already has it
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`
+	if err := db.QueryRow(query, table, column).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s to table %s: %w", column, table, err)
+	}
+	return nil
 }
@@ -0,0 +1,138 @@
+package bucket
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// ObjectSummary describes one object in a bucket listing
+type ObjectSummary struct {
+	ObjectID      string
+	Filename      string
+	LatestVersion string
+	// Size is the original size in bytes of the latest version
+	Size int64
+	// CreationDate is when the oldest version of the object still stored was created
+	CreationDate string
+}
+
+// ObjectPage is one page of a bucket listing
+type ObjectPage struct {
+	Objects []ObjectSummary
+	// Total is the number of objects in the bucket, across every page
+	Total int
+	// NextCursor continues the listing after the last object of the page, and is empty once there are no more objects
+	NextCursor string
+}
+
+// objectSummaryQuery selects the summary of each object, followed by the conditions and ordering of a listing
+// The latest version is the one recorded most recently, as with GetLatestMetadata, and objects in the trash are left out
+const objectSummaryQuery = `SELECT o.rowid, o.id, o.filename,
+	COALESCE((SELECT version_id FROM versions WHERE object_id = o.id ORDER BY rowid DESC LIMIT 1), ''),
+	COALESCE((SELECT CAST(json_extract(metadata, '$.filesize') AS INTEGER) FROM versions WHERE object_id = o.id ORDER BY rowid DESC LIMIT 1), 0),
+	COALESCE((SELECT json_extract(metadata, '$.creation_date') FROM versions WHERE object_id = o.id ORDER BY rowid ASC LIMIT 1), '')
+	FROM objects o WHERE o.bucket_id = ? AND o.deleted_at = ''`
+
+// ListObjects returns up to limit objects of a bucket, skipping the first offset
+// Objects are listed in the order they were created, which never changes as objects are added, so pages do not
+// overlap; objects deleted between pages shift later pages forward, which ListObjectsPage avoids
+// Deep pages get slower as offset grows, since every skipped object is still read
+func ListObjects(db *sql.DB, bucketID string, limit, offset int) ([]ObjectSummary, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit: %d, must be positive", limit)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset: %d, must not be negative", offset)
+	}
+	if err := checkBucket(db, bucketID); err != nil {
+		return nil, err
+	}
+
+	objects, _, err := listObjects(db, objectSummaryQuery+` ORDER BY o.rowid LIMIT ? OFFSET ?`, bucketID, limit, offset)
+	return objects, err
+}
+
+// ListObjectsPage returns the page of up to limit objects of a bucket that follows cursor
+// An empty cursor starts at the first object; each page's NextCursor continues after it
+// Pages are found by key rather than by position, so they stay fast however deep the listing goes, and objects
+// deleted between pages never cause others to be skipped
+func ListObjectsPage(db *sql.DB, bucketID, cursor string, limit int) (*ObjectPage, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit: %d, must be positive", limit)
+	}
+	var after int64
+	if cursor != "" {
+		var err error
+		after, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || after < 0 {
+			return nil, fmt.Errorf("invalid cursor: %q", cursor)
+		}
+	}
+	if err := checkBucket(db, bucketID); err != nil {
+		return nil, err
+	}
+
+	total, err := CountObjects(db, bucketID)
+	if err != nil {
+		return nil, err
+	}
+	// One object more than asked for is read to find out whether another page follows
+	objects, keys, err := listObjects(db, objectSummaryQuery+` AND o.rowid > ? ORDER BY o.rowid LIMIT ?`, bucketID, after, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ObjectPage{Objects: objects, Total: total}
+	if len(objects) > limit {
+		page.Objects = objects[:limit]
+		page.NextCursor = strconv.FormatInt(keys[limit-1], 10)
+	}
+	return page, nil
+}
+
+// CountObjects returns the number of objects in a bucket, not counting those in the trash
+func CountObjects(db *sql.DB, bucketID string) (int, error) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM objects WHERE bucket_id = ? AND deleted_at = ''`, bucketID).Scan(&total); err != nil {
+		return 0, fmt.Errorf("failed to count objects in bucket, %w", err)
+	}
+	return total, nil
+}
+
+// listObjects runs a listing query, returning the summaries alongside the key each object is ordered by
+func listObjects(db *sql.DB, query string, args ...any) ([]ObjectSummary, []int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list objects in bucket, %w", err)
+	}
+	defer rows.Close()
+
+	objects := []ObjectSummary{}
+	var keys []int64
+	for rows.Next() {
+		var key int64
+		var object ObjectSummary
+		if err := rows.Scan(&key, &object.ObjectID, &object.Filename, &object.LatestVersion, &object.Size, &object.CreationDate); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan object: %w", err)
+		}
+		objects = append(objects, object)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list objects in bucket, %w", err)
+	}
+	return objects, keys, nil
+}
+
+// checkBucket returns an error wrapping ErrBucketNotFound unless the bucket exists
+func checkBucket(db Querier, bucketID string) error {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM buckets WHERE bucket_id = ?)`, bucketID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check if bucket exists, %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	return nil
+}
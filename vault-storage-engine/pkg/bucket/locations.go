@@ -0,0 +1,117 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// UpdateShardLocations records new locations for shards of a version, keyed "shard_<index>" as in ShardLocations,
+// whether they belong to the version as a whole or to one of its chunks
+// Versions that share deduplicated content share its shards, so every version referencing the content, and the
+// copy of its metadata later references are made from, is updated along with it in a single transaction
+func UpdateShardLocations(db *sql.DB, objectID, versionID string, locations map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	var metadataJSON string
+	err = tx.QueryRow(`SELECT metadata FROM versions WHERE object_id = ? AND version_id = ?`, objectID, versionID).Scan(&metadataJSON)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s (version %s)", ErrVersionNotFound, objectID, versionID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	refs := []versionKey{{objectID, versionID}}
+	if metadata.ContentRef != "" {
+		refs, err = contentRefVersions(tx, metadata.ContentRef)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ref := range refs {
+		err := updateMetadata(tx, `SELECT metadata FROM versions WHERE object_id = ? AND version_id = ?`,
+			`UPDATE versions SET metadata = ? WHERE object_id = ? AND version_id = ?`, locations, ref.objectID, ref.versionID)
+		if err != nil {
+			return fmt.Errorf("failed to update shard locations of %s (version %s), %w", ref.objectID, ref.versionID, err)
+		}
+	}
+	if metadata.ContentRef != "" {
+		err := updateMetadata(tx, `SELECT metadata FROM content_refs WHERE checksum = ?`,
+			`UPDATE content_refs SET metadata = ? WHERE checksum = ?`, locations, metadata.ContentRef)
+		// The content may have been released by every other version since, leaving nothing to update
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to update shard locations of shared content %s, %w", metadata.ContentRef, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit shard locations, %w", err)
+	}
+	return nil
+}
+
+// versionKey identifies a single row of the versions table
+type versionKey struct {
+	objectID  string
+	versionID string
+}
+
+// contentRefVersions returns every version that references the deduplicated content with the given checksum
+func contentRefVersions(tx *sql.Tx, checksum string) ([]versionKey, error) {
+	rows, err := tx.Query(`SELECT object_id, version_id FROM versions WHERE json_extract(metadata, '$.content_ref') = ?`, checksum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions sharing content, %w", err)
+	}
+	defer rows.Close()
+
+	var refs []versionKey
+	for rows.Next() {
+		var ref versionKey
+		if err := rows.Scan(&ref.objectID, &ref.versionID); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// updateMetadata reads the metadata selected by query and args, points the shards it records at their new locations,
+// and writes it back with update, which takes the metadata followed by args
+func updateMetadata(tx *sql.Tx, query, update string, locations map[string]string, args ...any) error {
+	var metadataJSON string
+	if err := tx.QueryRow(query, args...).Scan(&metadataJSON); err != nil {
+		return err
+	}
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	relocate := func(recorded map[string]string) {
+		for shardKey := range recorded {
+			if location, ok := locations[shardKey]; ok {
+				recorded[shardKey] = location
+			}
+		}
+	}
+	relocate(metadata.ShardLocations)
+	for _, chunk := range metadata.Chunks {
+		relocate(chunk.ShardLocations)
+	}
+
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	_, err = tx.Exec(update, append([]any{updated}, args...)...)
+	return err
+}
@@ -0,0 +1,118 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrVersionLocked is returned, possibly wrapped, when removing a version that is still under a retention lock,
+// or when trying to shorten its lock
+var ErrVersionLocked = errors.New("version is locked")
+
+// LockVersion makes a version immutable until the given time, so it cannot be deleted or expired before then
+// Locks can only be extended: locking a version until a time before its current lock fails with ErrVersionLocked,
+// and locking it until the same time again does nothing
+func LockVersion(db *sql.DB, versionID string, until time.Time) error {
+	if until.IsZero() {
+		return fmt.Errorf("lock time must be set")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	var objectID, metadataJSON string
+	err = tx.QueryRow(`SELECT object_id, metadata FROM versions WHERE version_id = ?`, versionID).Scan(&objectID, &metadataJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: version %s", ErrVersionNotFound, versionID)
+		}
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	if until.Before(metadata.LockedUntil) {
+		return fmt.Errorf("%w: version %s is locked until %s, which cannot be shortened to %s", ErrVersionLocked, versionID, metadata.LockedUntil.Format(time.RFC3339), until.Format(time.RFC3339))
+	}
+	if until.Equal(metadata.LockedUntil) {
+		return nil
+	}
+	metadata.LockedUntil = until.UTC()
+
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE versions SET metadata = ? WHERE object_id = ? AND version_id = ?`, updated, objectID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to lock version, %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit version lock, %w", err)
+	}
+	return nil
+}
+
+// IsLockedAt reports whether the version is still under a retention lock at now
+func (m *VersionMetadata) IsLockedAt(now time.Time) bool {
+	return m.LockedUntil.After(now)
+}
+
+// CheckVersionUnlocked returns an error wrapping ErrVersionLocked if the version is still under a retention lock at now
+func CheckVersionUnlocked(metadata *VersionMetadata, now time.Time) error {
+	if metadata.IsLockedAt(now) {
+		return fmt.Errorf("%w: %s (version %s) is locked until %s", ErrVersionLocked, metadata.ObjectID, metadata.VersionID, metadata.LockedUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkObjectUnlocked returns an error wrapping ErrVersionLocked if any version of an object is still under a retention
+// lock at now
+func checkObjectUnlocked(db Querier, objectID string, now time.Time) error {
+	rows, err := db.Query(`SELECT metadata FROM versions WHERE object_id = ?`, objectID)
+	if err != nil {
+		return fmt.Errorf("failed to list object versions, %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var metadataJSON string
+		if err := rows.Scan(&metadataJSON); err != nil {
+			return fmt.Errorf("failed to scan version: %w", err)
+		}
+		var metadata VersionMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+			return fmt.Errorf("failed to decode metadata: %w", err)
+		}
+		if err := CheckVersionUnlocked(&metadata, now); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// checkVersionUnlocked returns an error wrapping ErrVersionLocked if a version is still under a retention lock at now
+// A version that does not exist is not locked
+func checkVersionUnlocked(db Querier, objectID, versionID string, now time.Time) error {
+	var metadataJSON string
+	err := db.QueryRow(`SELECT metadata FROM versions WHERE object_id = ? AND version_id = ?`, objectID, versionID).Scan(&metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	return CheckVersionUnlocked(&metadata, now)
+}
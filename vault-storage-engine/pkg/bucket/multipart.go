@@ -0,0 +1,139 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrUploadNotFound is returned when a multipart upload does not exist, or has already been completed or aborted
+var ErrUploadNotFound = errors.New("multipart upload not found")
+
+// MultipartUpload is an upload in progress whose parts are stored independently until it is completed
+// The version ID, data key and encoding settings are fixed when the upload starts, so every part is encoded alike
+type MultipartUpload struct {
+	UploadID     string `json:"upload_id"`
+	BucketID     string `json:"bucket_id"`
+	ObjectID     string `json:"object_id"`
+	VersionID    string `json:"version_id"`
+	WrappedKey   string `json:"wrapped_key"`
+	Cipher       string `json:"cipher"`
+	Compression  string `json:"compression"`
+	ErasureCoder string `json:"erasure_coder"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	CreationDate string `json:"creation_date"`
+}
+
+// AddMultipartUpload records a new multipart upload
+func AddMultipartUpload(db *sql.DB, upload MultipartUpload) error {
+	metadataJSON, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %w", err)
+	}
+	query := `INSERT INTO multipart_uploads (upload_id, bucket_id, object_id, metadata) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(query, upload.UploadID, upload.BucketID, upload.ObjectID, metadataJSON); err != nil {
+		return fmt.Errorf("failed to add multipart upload: %w", err)
+	}
+	return nil
+}
+
+// GetMultipartUpload returns a multipart upload in progress
+func GetMultipartUpload(db Querier, uploadID string) (*MultipartUpload, error) {
+	var metadataJSON string
+	err := db.QueryRow(`SELECT metadata FROM multipart_uploads WHERE upload_id = ?`, uploadID).Scan(&metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve multipart upload: %w", err)
+	}
+	var upload MultipartUpload
+	if err := json.Unmarshal([]byte(metadataJSON), &upload); err != nil {
+		return nil, fmt.Errorf("failed to decode upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// PutMultipartPart records a stored part of an upload, replacing any earlier copy of the same part
+func PutMultipartPart(db *sql.DB, uploadID string, partNumber int, part ChunkMetadata) error {
+	metadataJSON, err := json.Marshal(part)
+	if err != nil {
+		return fmt.Errorf("failed to encode part: %w", err)
+	}
+	query := `INSERT INTO multipart_parts (upload_id, part_number, metadata) VALUES (?, ?, ?)
+		ON CONFLICT (upload_id, part_number) DO UPDATE SET metadata = excluded.metadata`
+	if _, err := db.Exec(query, uploadID, partNumber, metadataJSON); err != nil {
+		return fmt.Errorf("failed to add part %d: %w", partNumber, err)
+	}
+	return nil
+}
+
+// GetMultipartPart returns a stored part of an upload, or nil if the part has not been stored
+func GetMultipartPart(db *sql.DB, uploadID string, partNumber int) (*ChunkMetadata, error) {
+	var metadataJSON string
+	err := db.QueryRow(`SELECT metadata FROM multipart_parts WHERE upload_id = ? AND part_number = ?`, uploadID, partNumber).Scan(&metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve part %d: %w", partNumber, err)
+	}
+	var part ChunkMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &part); err != nil {
+		return nil, fmt.Errorf("failed to decode part: %w", err)
+	}
+	return &part, nil
+}
+
+// DeleteMultipartPart removes the record of a stored part of an upload
+func DeleteMultipartPart(db *sql.DB, uploadID string, partNumber int) error {
+	if _, err := db.Exec(`DELETE FROM multipart_parts WHERE upload_id = ? AND part_number = ?`, uploadID, partNumber); err != nil {
+		return fmt.Errorf("failed to delete part %d: %w", partNumber, err)
+	}
+	return nil
+}
+
+// ListMultipartParts returns the stored parts of an upload, ordered by part number
+func ListMultipartParts(db Querier, uploadID string) ([]ChunkMetadata, error) {
+	rows, err := db.Query(`SELECT metadata FROM multipart_parts WHERE upload_id = ? ORDER BY part_number`, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parts: %w", err)
+	}
+	defer rows.Close()
+
+	var parts []ChunkMetadata
+	for rows.Next() {
+		var metadataJSON string
+		if err := rows.Scan(&metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan part: %w", err)
+		}
+		var part ChunkMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &part); err != nil {
+			return nil, fmt.Errorf("failed to decode part: %w", err)
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+// DeleteMultipartUpload removes an upload and the records of its parts
+// It returns ErrUploadNotFound if the upload was already completed or aborted
+func DeleteMultipartUpload(db Querier, uploadID string) error {
+	res, err := db.Exec(`DELETE FROM multipart_uploads WHERE upload_id = ?`, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to delete multipart upload: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete multipart upload: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+	}
+	if _, err := db.Exec(`DELETE FROM multipart_parts WHERE upload_id = ?`, uploadID); err != nil {
+		return fmt.Errorf("failed to delete parts: %w", err)
+	}
+	return nil
+}
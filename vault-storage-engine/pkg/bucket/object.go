@@ -3,11 +3,22 @@ package bucket
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
 	"github.com/google/uuid"
 )
 
+// Querier is implemented by both *sql.DB and *sql.Tx, so the functions that take one can run inside a transaction
+type Querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 // Object represents a stored file
 type Object struct {
 	ID            string
@@ -16,36 +27,124 @@ type Object struct {
 	LatestVersion string
 }
 
+// Storage modes recorded in version metadata
+// Versions stored before the mode was recorded are erasure coded
+const (
+	StorageErasureCoded = "erasure"
+	StorageReplicated   = "replicated"
+)
+
 // VersionMetadata represents the metadata for a version
 type VersionMetadata struct {
 	BucketID       string            `json:"bucket_id"`
 	ObjectID       string            `json:"object_id"`
 	VersionID      string            `json:"file_version"`
+	ParentVersion  string            `json:"parent_version,omitempty"`
+	RootVersion    string            `json:"root_version,omitempty"`
 	Filename       string            `json:"filename"`
 	Filesize       string            `json:"filesize"`
+	Checksum       string            `json:"checksum,omitempty"`
+	ContentRef     string            `json:"content_ref,omitempty"`
+	ShardObjectID  string            `json:"shard_object_id,omitempty"`
+	ShardVersionID string            `json:"shard_version_id,omitempty"`
+	Compression    string            `json:"compression,omitempty"`
+	Compressed     bool              `json:"compressed,omitempty"`
+	CompressedSize int64             `json:"compressed_size,omitempty"`
+	EncryptedSize  int64             `json:"encrypted_size,omitempty"`
+	WrappedKey     string            `json:"wrapped_key,omitempty"`
+	Cipher         string            `json:"cipher,omitempty"`
+	StoredSize     int64             `json:"stored_size,omitempty"`
 	Format         string            `json:"file_formart"`
+	ContentType    string            `json:"content_type,omitempty"`
+	UserMetadata   map[string]string `json:"user_metadata,omitempty"`
 	CreationDate   string            `json:"creation_date"`
+	ExpiresAt      time.Time         `json:"expires_at"`
+	LockedUntil    time.Time         `json:"locked_until"`
 	Data           []byte            `json:"data"`
 	ShardLocations map[string]string `json:"shard_locations"`
 	Proofs         map[string]string `json:"proofs"`
+	MerkleRoot     string            `json:"merkle_root,omitempty"`
+	StorageMode    string            `json:"storage_mode,omitempty"`
+	ErasureCoder   string            `json:"erasure_coder,omitempty"`
+	DataShards     int               `json:"data_shards,omitempty"`
+	ParityShards   int               `json:"parity_shards,omitempty"`
+	ChunkSize      int64             `json:"chunk_size,omitempty"`
+	Chunks         []ChunkMetadata   `json:"chunks,omitempty"`
+	// ShardHashes holds the hex-encoded Merkle leaf hash of each shard, keyed "shard_<index>" as in ShardLocations,
+	// so a shard's integrity can be checked without its proof; versions stored before they were recorded have none
+	ShardHashes map[string]string `json:"shard_hashes,omitempty"`
+	// MerkleHash names the hash the Merkle root, proofs and shard hashes were computed with, as passed to
+	// proofofinclusion.NewHash; versions stored before it was recorded used SHA-256. Chunks record their own
+	MerkleHash string `json:"merkle_hash,omitempty"`
+}
+
+// ChunkMetadata represents one independently encoded chunk of a streamed version
+// Shard keys use the shard index across the whole version, so they never collide between chunks
+type ChunkMetadata struct {
+	Index          int               `json:"index"`
+	Size           int64             `json:"size"`
+	EncryptedSize  int64             `json:"encrypted_size"`
+	Uncompressed   bool              `json:"uncompressed,omitempty"`
+	StoredSize     int64             `json:"stored_size"`
+	ShardLocations map[string]string `json:"shard_locations"`
+	Proofs         map[string]string `json:"proofs"`
+	MerkleRoot     string            `json:"merkle_root,omitempty"`
+	ShardHashes    map[string]string `json:"shard_hashes,omitempty"`
+	MerkleHash     string            `json:"merkle_hash,omitempty"`
+}
+
+// EncodingParams returns the redundancy scheme the version was encoded with
+// Versions stored before the scheme was recorded use the default scheme
+func (m *VersionMetadata) EncodingParams() erasurecoding.EncodingParams {
+	return erasurecoding.EncodingParams{DataShards: m.DataShards, ParityShards: m.ParityShards}.OrDefault()
+}
+
+// ShardOwner returns the object and version IDs the version's shards are stored under
+// Deduplicated versions reference the shards of the version that first stored their content
+func (m *VersionMetadata) ShardOwner() (string, string) {
+	if m.ShardObjectID != "" {
+		return m.ShardObjectID, m.ShardVersionID
+	}
+	return m.ObjectID, m.VersionID
+}
+
+// IsCompressed reports whether the stored payload of the version is compressed
+// Versions stored before the flag was recorded are compressed whenever a codec other than none is named
+func (m *VersionMetadata) IsCompressed() bool {
+	return m.Compressed || (m.Compression != "" && m.Compression != "none")
+}
+
+// AllShardLocations returns the locations of every shard of the version, including chunked shards
+func (m *VersionMetadata) AllShardLocations() map[string]string {
+	locations := make(map[string]string, len(m.ShardLocations))
+	for shardKey, location := range m.ShardLocations {
+		locations[shardKey] = location
+	}
+	for _, chunk := range m.Chunks {
+		for shardKey, location := range chunk.ShardLocations {
+			locations[shardKey] = location
+		}
+	}
+	return locations
 }
 
 // AddObject adds an object to the database if it doesn't already exist
-func AddObject(db *sql.DB, bucketID, objectID, filename string) error {
+// An object that already exists keeps the filename it has now, which may differ from filename after RenameObject
+func AddObject(db Querier, bucketID, objectID, filename string) error {
 	var objectExists bool
-	query := "SELECT EXISTS(SELECT 1 FROM objects WHERE id = ? AND bucket_id = ? AND filename = ?)"
-	err := db.QueryRow(query, objectID, bucketID, filename).Scan(&objectExists)
+	query := "SELECT EXISTS(SELECT 1 FROM objects WHERE id = ? AND bucket_id = ?)"
+	err := db.QueryRow(query, objectID, bucketID).Scan(&objectExists)
 	if err != nil {
 		return fmt.Errorf("failed to check if object exists: %w", err)
 	}
 
 	if objectExists {
-		latest_version_id, err := getLatestVersion(db, objectID)
+		latest_version_id, err := GetLatestVersion(db, objectID)
 		if err != nil {
 			return fmt.Errorf("error getting latest version, %w", err)
 		}
-		query := "UPDATE objects SET latest_version = ? WHERE id = ? AND bucket_id = ? AND filename = ?"
-		_, err = db.Exec(query, latest_version_id, objectID, bucketID, filename)
+		query := "UPDATE objects SET latest_version = ? WHERE id = ? AND bucket_id = ?"
+		_, err = db.Exec(query, latest_version_id, objectID, bucketID)
 		if err != nil {
 			return fmt.Errorf("failed to update object version, %s", err)
 		}
@@ -53,8 +152,10 @@ func AddObject(db *sql.DB, bucketID, objectID, filename string) error {
 		return nil
 	}
 
-	query = "INSERT INTO objects (id, bucket_id, filename) VALUES (?, ?, ?)"
-	_, err = db.Exec(query, objectID, bucketID, filename)
+	// The version is recorded before the object, so the new object can point at it straight away
+	latest_version_id, _ := GetLatestVersion(db, objectID)
+	query = "INSERT INTO objects (id, bucket_id, filename, latest_version) VALUES (?, ?, ?, ?)"
+	_, err = db.Exec(query, objectID, bucketID, filename, latest_version_id)
 	if err != nil {
 		return fmt.Errorf("failed to add object: %w", err)
 	}
@@ -63,7 +164,7 @@ func AddObject(db *sql.DB, bucketID, objectID, filename string) error {
 }
 
 // AddVersion inserts a new version for an object
-func AddVersion(db *sql.DB, bucketID, objectID, versionID, rootVersion string, metadata VersionMetadata, data []byte) error {
+func AddVersion(db Querier, bucketID, objectID, versionID, rootVersion string, metadata VersionMetadata, data []byte) error {
 	metadataJSON, err := json.Marshal(metadata)
 	if err != nil {
 		return fmt.Errorf("failed to encode metadata: %w", err)
@@ -75,27 +176,17 @@ func AddVersion(db *sql.DB, bucketID, objectID, versionID, rootVersion string, m
 		return fmt.Errorf("failed to add version: %w", err)
 	}
 
+	// The version just inserted is the latest, so the object is pointed at it without reading it back
 	_, err = db.Exec(`UPDATE objects SET latest_version = ? WHERE id = ?`, versionID, objectID)
 	if err != nil {
 		return fmt.Errorf("failed to update object latest version: %w", err)
 	}
 
-	latest_version_id, err := getLatestVersion(db, objectID)
-	if err != nil {
-		return fmt.Errorf("error getting latest version, %w", err)
-	}
-	// Update the latest version for the object
-	updateQuery := `UPDATE objects SET latest_version = ? WHERE id = ?`
-	_, err = db.Exec(updateQuery, latest_version_id, objectID)
-	if err != nil {
-		return fmt.Errorf("failed to update object latest version: %w", err)
-	}
-
 	return nil
 }
 
 // GetObjectMetadata retrieves metadata for an object version
-func GetObjectMetadata(db *sql.DB, objectID, versionID string) (*VersionMetadata, error) {
+func GetObjectMetadata(db Querier, objectID, versionID string) (*VersionMetadata, error) {
 	query := `SELECT metadata FROM versions WHERE object_id = ? AND version_id = ?`
 	row := db.QueryRow(query, objectID, versionID)
 
@@ -103,7 +194,7 @@ func GetObjectMetadata(db *sql.DB, objectID, versionID string) (*VersionMetadata
 	err := row.Scan(&metadataJSON)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("object version not found")
+			return nil, fmt.Errorf("%w: %s (version %s)", ErrVersionNotFound, objectID, versionID)
 		}
 		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
 	}
@@ -117,8 +208,54 @@ func GetObjectMetadata(db *sql.DB, objectID, versionID string) (*VersionMetadata
 	return &metadata, nil
 }
 
-func getLatestVersion(db *sql.DB, objectID string) (string, error) {
-	query := `SELECT version_id FROM versions WHERE object_id = ? ORDER BY version_id DESC LIMIT 1`
+// ErrNoMerkleRoot is returned by GetMerkleRoot for versions that have no single Merkle root recorded
+var ErrNoMerkleRoot = errors.New("no merkle root recorded")
+
+// GetMerkleRoot returns the Merkle root recorded over the shards of an object version when it was stored, so its
+// integrity can be anchored outside the database, such as in a transparency log, without keeping the proofs
+// Streamed versions have a root per chunk rather than one over the whole version, and versions stored before roots
+// were recorded have none; both fail with ErrNoMerkleRoot, and the roots of chunks are exported with their proofs
+func GetMerkleRoot(db *sql.DB, objectID, versionID string) (string, error) {
+	metadata, err := GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return "", err
+	}
+	if len(metadata.Chunks) > 0 {
+		return "", fmt.Errorf("%w: %s (version %s) was stored in %d chunks, each with a root of its own", ErrNoMerkleRoot, objectID, versionID, len(metadata.Chunks))
+	}
+	if metadata.MerkleRoot == "" {
+		return "", fmt.Errorf("%w: %s (version %s) was stored before Merkle roots were recorded", ErrNoMerkleRoot, objectID, versionID)
+	}
+	return metadata.MerkleRoot, nil
+}
+
+// ObjectExists reports whether an object is stored in a bucket
+// A missing bucket is not an error; it holds no objects, and an object in the trash does not exist until it is restored
+func ObjectExists(db *sql.DB, bucketID, objectID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM objects WHERE id = ? AND bucket_id = ? AND deleted_at = '')", objectID, bucketID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if object exists, %w", err)
+	}
+	return exists, nil
+}
+
+// VersionExists reports whether a version of an object is stored
+// Versions of an object in the trash do not exist until the object is restored
+func VersionExists(db *sql.DB, objectID, versionID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM versions WHERE object_id = ? AND version_id = ?)
+		AND NOT EXISTS(SELECT 1 FROM objects WHERE id = ? AND deleted_at != '')`, objectID, versionID, objectID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if version exists, %w", err)
+	}
+	return exists, nil
+}
+
+// GetLatestVersion returns the most recently stored version of an object
+// Version IDs are random, so versions are ordered by insertion rather than by ID
+func GetLatestVersion(db Querier, objectID string) (string, error) {
+	query := `SELECT version_id FROM versions WHERE object_id = ? ORDER BY rowid DESC LIMIT 1`
 	row := db.QueryRow(query, objectID)
 	var latestVersionID string
 	err := row.Scan(&latestVersionID)
@@ -131,51 +268,240 @@ func getLatestVersion(db *sql.DB, objectID string) (string, error) {
 
 	return latestVersionID, nil
 }
-func GetRootVersion(db *sql.DB, objectID string) (string, error) {
-	// Do nothing yet
+
+// GetLatestMetadata returns the metadata of the latest version of an object in a bucket
+// The latest version is the head of the version chain, the version recorded most recently, which the next version
+// stored takes as its parent
+// Versions are ordered by when they were recorded rather than by creation date, so there are never ties, even between
+// versions created within the same second
+func GetLatestMetadata(db *sql.DB, bucketID, objectID string) (VersionMetadata, error) {
+	query := `SELECT metadata FROM versions WHERE bucket_id = ? AND object_id = ? ORDER BY rowid DESC LIMIT 1`
+	var metadataJSON string
+	err := db.QueryRow(query, bucketID, objectID).Scan(&metadataJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return VersionMetadata{}, fmt.Errorf("%w: %s in bucket %s", ErrObjectNotFound, objectID, bucketID)
+		}
+		return VersionMetadata{}, fmt.Errorf("failed to retrieve latest metadata: %w", err)
+	}
+
+	var metadata VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return VersionMetadata{}, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// initialVersion is the root recorded for the first version of an object, which is the root of the chain itself
+const initialVersion = "initial_version"
+
+// GetRootVersion returns the root a new version of an object is recorded with: the first version stored, or
+// "initial_version" when the object has no versions yet and the new version starts the chain
+func GetRootVersion(db Querier, objectID string) (string, error) {
 	var rootVersion string
-	query := `SELECT version_id FROM versions WHERE object_id = ? ORDER BY version_id ASC LIMIT 1`
-	row := db.QueryRow(query, objectID)
-	err := row.Scan(&rootVersion)
+	query := `SELECT version_id FROM versions WHERE object_id = ? ORDER BY rowid ASC LIMIT 1`
+	err := db.QueryRow(query, objectID).Scan(&rootVersion)
+	if err == sql.ErrNoRows {
+		return initialVersion, nil
+	}
 	if err != nil {
-		// Handle error or set default root version
-		rootVersion = "initial_version"
+		return "", fmt.Errorf("failed to get root version: %w", err)
 	}
 	return rootVersion, nil
 }
 
-func DeleteObject(db *sql.DB, bucketID, objectID string) error {
+// ResolveVersionChain returns the root and the parent a new version of an object is recorded with inside tx, as
+// GetRootVersion and GetLatestVersion would; the first version of an object has no parent
+// It takes the database write lock first, even in a transaction begun without it, so concurrent stores of the same
+// object resolve their place in the chain one after another, each seeing the version recorded before it, rather than
+// both taking the same parent; the lock is held until tx ends, so the version must be added inside tx as well
+func ResolveVersionChain(tx Querier, objectID string) (string, string, error) {
+	// Any write takes the lock; this one changes nothing, and matches no row for an object stored for the first time
+	if _, err := tx.Exec(`UPDATE objects SET latest_version = latest_version WHERE id = ?`, objectID); err != nil {
+		return "", "", fmt.Errorf("failed to lock version chain, %w", err)
+	}
+	rootVersion, err := GetRootVersion(tx, objectID)
+	if err != nil {
+		return "", "", err
+	}
+	if rootVersion == initialVersion {
+		return rootVersion, "", nil
+	}
+	parentVersion, err := GetLatestVersion(tx, objectID)
+	if err != nil {
+		return "", "", err
+	}
+	return rootVersion, parentVersion, nil
+}
+
+// ListVersions returns every version of an object, oldest first, ordered by creation date
+// RootVersion is set on each version, and is the version's own ID for the first version of an object
+// Versions stored before parents were recorded are linked to the version stored just before them
+// An object in the trash has no versions to list, and ErrObjectDeleted is returned
+func ListVersions(db *sql.DB, bucketID, objectID string) ([]VersionMetadata, error) {
+	if err := CheckObjectNotDeleted(db, objectID); err != nil {
+		return nil, err
+	}
+	query := `SELECT root_version, metadata FROM versions WHERE bucket_id = ? AND object_id = ? ORDER BY rowid ASC`
+	rows, err := db.Query(query, bucketID, objectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list object versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []VersionMetadata
+	for rows.Next() {
+		var rootVersion, metadataJSON string
+		if err := rows.Scan(&rootVersion, &metadataJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+
+		var metadata VersionMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata: %w", err)
+		}
+		metadata.RootVersion = rootVersion
+		if rootVersion == initialVersion {
+			metadata.RootVersion = metadata.VersionID
+		}
+		versions = append(versions, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list object versions: %w", err)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+	}
+
+	// Rows are in insertion order, which breaks ties between versions created within the same second
+	sort.SliceStable(versions, func(i, j int) bool {
+		return creationTime(versions[i]).Before(creationTime(versions[j]))
+	})
+	for i := 1; i < len(versions); i++ {
+		if versions[i].ParentVersion == "" {
+			versions[i].ParentVersion = versions[i-1].VersionID
+		}
+	}
+	return versions, nil
+}
+
+// creationTime parses the creation date of a version, treating unparsable dates as the zero time
+func creationTime(metadata VersionMetadata) time.Time {
+	t, _ := time.Parse(time.RFC3339, metadata.CreationDate)
+	return t
+}
+
+// DeleteObject removes an object and all of its versions in a single transaction
+// Retention locks are checked at now
+func DeleteObject(db *sql.DB, bucketID, objectID string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	// An object cannot be removed while any of its versions is locked
+	if err := checkObjectUnlocked(tx, objectID, now); err != nil {
+		return err
+	}
+
 	// Remove the object versions
 	query := "DELETE FROM versions WHERE object_id = ?"
-	_, err := db.Exec(query, objectID)
+	_, err = tx.Exec(query, objectID)
 	if err != nil {
 		return fmt.Errorf("failed to delete objects: %w", err)
 	}
 
 	// Remove the objects
 	query = "DELETE FROM objects WHERE id = ?"
-	_, err = db.Exec(query, objectID)
+	_, err = tx.Exec(query, objectID)
 	if err != nil {
 		return fmt.Errorf("failed to delete the object, %w", err)
 	}
+
+	// Tags, access control entries and content identifiers belong to the object, so they go with it
+	_, err = tx.Exec("DELETE FROM tags WHERE object_id = ?", objectID)
+	if err != nil {
+		return fmt.Errorf("failed to delete object tags, %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM content_ids WHERE object_id = ?", objectID)
+	if err != nil {
+		return fmt.Errorf("failed to delete object content ids, %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM acls WHERE resource_type = 'object' AND resource_id = ?", objectID)
+	if err != nil {
+		return fmt.Errorf("failed to delete object access control entries, %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit object deletion, %w", err)
+	}
 	return nil
 }
 
-func DeleteObjectByVersion(db *sql.DB, bucketID, objectID, versionID string) error {
-	query := "DELETE FROM versions WHERE object_id = ? AND version_id = ?"
-	_, err := db.Exec(query, objectID, versionID)
+// DeleteObjectByVersion removes a single version of an object in a single transaction
+// The object's latest version is moved to the newest remaining version, and the object itself
+// is removed once its last version is gone
+// Retention locks are checked at now
+func DeleteObjectByVersion(db *sql.DB, bucketID, objectID, versionID string, now time.Time) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to delete object version, %w", err)
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteVersion(tx, bucketID, objectID, versionID, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit version deletion, %w", err)
+	}
+	return nil
+}
+
+// deleteVersion removes a version inside tx, repointing the object at its new latest version or removing it with its last version
+// A version that is still locked at now is left in place, and ErrVersionLocked is returned
+func deleteVersion(tx *sql.Tx, bucketID, objectID, versionID string, now time.Time) error {
+	if err := checkVersionUnlocked(tx, objectID, versionID, now); err != nil {
+		return err
 	}
 
-	latest_version_id, err := getLatestVersion(db, objectID)
+	query := "DELETE FROM versions WHERE object_id = ? AND version_id = ?"
+	_, err := tx.Exec(query, objectID, versionID)
 	if err != nil {
-		return fmt.Errorf("error getting latest version, %w", err)
+		return fmt.Errorf("failed to delete object version, %w", err)
 	}
-	query = "UPDATE objects SET latest_version = ? WHERE id = ? AND bucket_id = ?"
-	_, err = db.Exec(query, latest_version_id, objectID, bucketID)
+	_, err = tx.Exec("DELETE FROM content_ids WHERE object_id = ? AND version_id = ?", objectID, versionID)
 	if err != nil {
-		return fmt.Errorf("failed to update object version, %s", err)
+		return fmt.Errorf("failed to delete version content id, %w", err)
+	}
+
+	var latest_version_id string
+	query = `SELECT version_id FROM versions WHERE object_id = ? ORDER BY rowid DESC LIMIT 1`
+	err = tx.QueryRow(query, objectID).Scan(&latest_version_id)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("DELETE FROM objects WHERE id = ? AND bucket_id = ?", objectID, bucketID)
+		if err != nil {
+			return fmt.Errorf("failed to delete the object, %w", err)
+		}
+		_, err = tx.Exec("DELETE FROM tags WHERE object_id = ?", objectID)
+		if err != nil {
+			return fmt.Errorf("failed to delete object tags, %w", err)
+		}
+		_, err = tx.Exec("DELETE FROM acls WHERE resource_type = 'object' AND resource_id = ?", objectID)
+		if err != nil {
+			return fmt.Errorf("failed to delete object access control entries, %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("error getting latest version, %w", err)
+	default:
+		query = "UPDATE objects SET latest_version = ? WHERE id = ? AND bucket_id = ?"
+		_, err = tx.Exec(query, latest_version_id, objectID, bucketID)
+		if err != nil {
+			return fmt.Errorf("failed to update object version, %s", err)
+		}
 	}
 
 	return nil
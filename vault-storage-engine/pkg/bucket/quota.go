@@ -0,0 +1,60 @@
+package bucket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrQuotaExceeded is returned when storing an object would take a bucket over its quota
+var ErrQuotaExceeded = errors.New("bucket quota exceeded")
+
+// SetBucketQuota caps the combined size of every version stored in a bucket at bytes
+// A quota of zero means the bucket is unlimited
+func SetBucketQuota(db *sql.DB, bucketID string, bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("invalid quota: %d bytes", bytes)
+	}
+	res, err := db.Exec(`UPDATE buckets SET quota_bytes = ? WHERE bucket_id = ?`, bytes, bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to set bucket quota: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to set bucket quota: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	return nil
+}
+
+// GetBucketUsage returns the combined size of every version stored in a bucket, and the bucket's quota
+// Usage is the original size of each version, so deduplicated and compressed versions count in full
+func GetBucketUsage(db Querier, bucketID string) (used, quota int64, err error) {
+	err = db.QueryRow(`SELECT quota_bytes FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&quota)
+	if err == sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get bucket quota: %w", err)
+	}
+
+	query := `SELECT COALESCE(SUM(CAST(json_extract(metadata, '$.filesize') AS INTEGER)), 0) FROM versions WHERE bucket_id = ?`
+	if err := db.QueryRow(query, bucketID).Scan(&used); err != nil {
+		return 0, 0, fmt.Errorf("failed to get bucket usage: %w", err)
+	}
+	return used, quota, nil
+}
+
+// CheckBucketQuota returns ErrQuotaExceeded if storing size more bytes would take a bucket over its quota
+func CheckBucketQuota(db Querier, bucketID string, size int64) error {
+	used, quota, err := GetBucketUsage(db, bucketID)
+	if err != nil {
+		return err
+	}
+	if quota > 0 && used+size > quota {
+		return fmt.Errorf("%w: bucket %s uses %d of %d bytes, cannot store %d more", ErrQuotaExceeded, bucketID, used, quota, size)
+	}
+	return nil
+}
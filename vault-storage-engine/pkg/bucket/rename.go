@@ -0,0 +1,162 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// RenameObject changes the filename an object is retrieved under
+// Filenames are unique within a bucket, so renaming onto the filename of another object fails with ErrObjectExists
+// Each version keeps the filename it was stored with in its metadata
+func RenameObject(db *sql.DB, bucketID, objectID, newFilename string) error {
+	if newFilename == "" {
+		return fmt.Errorf("filename must not be empty")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkObjectInBucket(tx, bucketID, objectID); err != nil {
+		return err
+	}
+	var taken bool
+	query := "SELECT EXISTS(SELECT 1 FROM objects WHERE bucket_id = ? AND filename = ? AND id != ?)"
+	if err := tx.QueryRow(query, bucketID, newFilename, objectID).Scan(&taken); err != nil {
+		return fmt.Errorf("failed to check filename, %w", err)
+	}
+	if taken {
+		return fmt.Errorf("%w: filename %s is already used in bucket %s", ErrObjectExists, newFilename, bucketID)
+	}
+
+	_, err = tx.Exec("UPDATE objects SET filename = ? WHERE id = ? AND bucket_id = ?", newFilename, objectID, bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to rename object, %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit object rename, %w", err)
+	}
+	return nil
+}
+
+// MoveObject changes the key of an object, keeping all of its versions, tags and content identifiers, and the access
+// granted on it with acl.GrantAccess, which CheckAccess then finds under the new key
+// Grants left on the old key would otherwise apply to whatever object is next stored under it
+// Only metadata changes: the shards stay where they are, under the names they were written with, and each version
+// records the key they belong to
+// The new key must not be in use by any object, or ErrObjectExists is returned
+// Multipart uploads still in progress complete under the old key
+func MoveObject(db *sql.DB, bucketID, objectID, newObjectID string) error {
+	if newObjectID == "" {
+		return fmt.Errorf("object ID must not be empty")
+	}
+	if newObjectID == objectID {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkObjectInBucket(tx, bucketID, objectID); err != nil {
+		return err
+	}
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM objects WHERE id = ?)", newObjectID).Scan(&taken); err != nil {
+		return fmt.Errorf("failed to check object ID, %w", err)
+	}
+	if taken {
+		return fmt.Errorf("%w: %s", ErrObjectExists, newObjectID)
+	}
+
+	if err := moveVersions(tx, objectID, newObjectID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE objects SET id = ? WHERE id = ? AND bucket_id = ?", newObjectID, objectID, bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to move object, %w", err)
+	}
+	_, err = tx.Exec("UPDATE tags SET object_id = ? WHERE object_id = ?", newObjectID, objectID)
+	if err != nil {
+		return fmt.Errorf("failed to move object tags, %w", err)
+	}
+	// Grants are moved in both the acls table CheckAccess reads and the older acl table
+	_, err = tx.Exec("UPDATE acls SET resource_id = ? WHERE resource_type = 'object' AND resource_id = ?", newObjectID, objectID)
+	if err != nil {
+		return fmt.Errorf("failed to move object access grants, %w", err)
+	}
+	_, err = tx.Exec("UPDATE acl SET resource_id = ? WHERE resource_id = ? AND resource_type = 'object'", newObjectID, objectID)
+	if err != nil {
+		return fmt.Errorf("failed to move object permissions, %w", err)
+	}
+	// Content identifiers keep resolving to the versions they were made for, though they were derived under the old key
+	_, err = tx.Exec("UPDATE content_ids SET object_id = ? WHERE object_id = ?", newObjectID, objectID)
+	if err != nil {
+		return fmt.Errorf("failed to move object content ids, %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit object move, %w", err)
+	}
+	return nil
+}
+
+// moveVersions records every version of an object under newObjectID inside tx
+// Versions that own their shards are pointed at them under the old key, so the shards never have to be renamed
+func moveVersions(tx *sql.Tx, objectID, newObjectID string) error {
+	rows, err := tx.Query("SELECT version_id, metadata FROM versions WHERE object_id = ?", objectID)
+	if err != nil {
+		return fmt.Errorf("failed to list object versions, %w", err)
+	}
+	updates := make(map[string][]byte)
+	for rows.Next() {
+		var versionID, metadataJSON string
+		if err := rows.Scan(&versionID, &metadataJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan version: %w", err)
+		}
+		var metadata VersionMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to decode metadata: %w", err)
+		}
+		metadata.ShardObjectID, metadata.ShardVersionID = metadata.ShardOwner()
+		metadata.ObjectID = newObjectID
+		updated, err := json.Marshal(metadata)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to encode metadata: %w", err)
+		}
+		updates[versionID] = updated
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list object versions, %w", err)
+	}
+
+	for versionID, updated := range updates {
+		query := "UPDATE versions SET object_id = ?, metadata = ? WHERE object_id = ? AND version_id = ?"
+		if _, err := tx.Exec(query, newObjectID, updated, objectID, versionID); err != nil {
+			return fmt.Errorf("failed to move version %s, %w", versionID, err)
+		}
+	}
+	return nil
+}
+
+// checkObjectInBucket returns an error wrapping ErrObjectNotFound unless the object exists in the bucket
+func checkObjectInBucket(db Querier, bucketID, objectID string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM objects WHERE id = ? AND bucket_id = ?)", objectID, bucketID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check if object exists, %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s in bucket %s", ErrObjectNotFound, objectID, bucketID)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+)
+
+// BucketSettings overrides the configuration for the versions stored in a bucket
+// Fields left at their zero value fall back to the configuration, so an archive bucket and a hot bucket can be
+// served side by side with different codecs and redundancy schemes
+type BucketSettings struct {
+	Compression string `json:"compression,omitempty"`
+	// CompressionLevel is only applied when set, since zero is a level of its own
+	CompressionLevel *int   `json:"compression_level,omitempty"`
+	Cipher           string `json:"cipher,omitempty"`
+	// DataShards and ParityShards are the bucket's redundancy scheme, used by stores that leave theirs to the default
+	DataShards   int `json:"data_shards,omitempty"`
+	ParityShards int `json:"parity_shards,omitempty"`
+	// QuotaBytes is the bucket's quota, as set by SetBucketQuota
+	QuotaBytes int64 `json:"-"`
+}
+
+// EncodingParams returns the bucket's redundancy scheme, which is the zero value if it has none
+func (s BucketSettings) EncodingParams() erasurecoding.EncodingParams {
+	return erasurecoding.EncodingParams{DataShards: s.DataShards, ParityShards: s.ParityShards}
+}
+
+// Apply returns a copy of cfg with the settings applied over it
+func (s BucketSettings) Apply(cfg *config.Config) *config.Config {
+	merged := *cfg
+	if s.Compression != "" {
+		merged.Compression = s.Compression
+	}
+	if s.CompressionLevel != nil {
+		merged.CompressionLevel = *s.CompressionLevel
+	}
+	if s.Cipher != "" {
+		merged.Cipher = s.Cipher
+	}
+	return &merged
+}
+
+// validate checks that the settings name a known codec and cipher, and a usable redundancy scheme
+func (s BucketSettings) validate() error {
+	if s.Compression != "" {
+		level := 0
+		if s.CompressionLevel != nil {
+			level = *s.CompressionLevel
+		}
+		if _, err := compression.NewWithLevel(s.Compression, level); err != nil {
+			return err
+		}
+	}
+	if s.Cipher != "" {
+		if _, err := encryption.NewCipher(s.Cipher); err != nil {
+			return err
+		}
+	}
+	if params := s.EncodingParams(); params != (erasurecoding.EncodingParams{}) {
+		if err := params.Validate(); err != nil {
+			return fmt.Errorf("invalid encoding parameters: %w", err)
+		}
+	}
+	if s.QuotaBytes < 0 {
+		return fmt.Errorf("invalid quota: %d bytes", s.QuotaBytes)
+	}
+	return nil
+}
+
+// SetBucketSettings replaces the settings of a bucket, including its quota
+// Versions already stored keep the codec, cipher and redundancy scheme they were stored with
+func SetBucketSettings(db *sql.DB, bucketID string, settings BucketSettings) error {
+	if err := settings.validate(); err != nil {
+		return fmt.Errorf("invalid bucket settings: %w", err)
+	}
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode bucket settings: %w", err)
+	}
+
+	res, err := db.Exec(`UPDATE buckets SET settings = ?, quota_bytes = ? WHERE bucket_id = ?`, settingsJSON, settings.QuotaBytes, bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to set bucket settings: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to set bucket settings: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	return nil
+}
+
+// GetBucketSettings returns the settings of a bucket, which are the zero value for a bucket that has none
+func GetBucketSettings(db Querier, bucketID string) (BucketSettings, error) {
+	var settingsJSON string
+	var quota int64
+	err := db.QueryRow(`SELECT settings, quota_bytes FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&settingsJSON, &quota)
+	if err == sql.ErrNoRows {
+		return BucketSettings{}, fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	if err != nil {
+		return BucketSettings{}, fmt.Errorf("failed to get bucket settings: %w", err)
+	}
+
+	var settings BucketSettings
+	if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+		return BucketSettings{}, fmt.Errorf("failed to decode bucket settings: %w", err)
+	}
+	settings.QuotaBytes = quota
+	return settings, nil
+}
@@ -0,0 +1,85 @@
+package bucket
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SetObjectTags replaces every tag of an object with tags
+// Tags are attached to the object rather than to a version, so they survive new versions being stored
+// An empty map removes all tags
+func SetObjectTags(db *sql.DB, objectID string, tags map[string]string) error {
+	var objectExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM objects WHERE id = ?)", objectID).Scan(&objectExists)
+	if err != nil {
+		return fmt.Errorf("failed to check if object exists: %w", err)
+	}
+	if !objectExists {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, objectID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM tags WHERE object_id = ?", objectID)
+	if err != nil {
+		return fmt.Errorf("failed to clear object tags, %w", err)
+	}
+	for key, value := range tags {
+		if key == "" {
+			return fmt.Errorf("tag key must not be empty")
+		}
+		_, err = tx.Exec("INSERT INTO tags (object_id, key, value) VALUES (?, ?, ?)", objectID, key, value)
+		if err != nil {
+			return fmt.Errorf("failed to add tag %s: %w", key, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit object tags, %w", err)
+	}
+	return nil
+}
+
+// GetObjectTags returns the tags of an object
+// An object without tags returns an empty map
+func GetObjectTags(db *sql.DB, objectID string) (map[string]string, error) {
+	rows, err := db.Query("SELECT key, value FROM tags WHERE object_id = ?", objectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve object tags, %w", err)
+	}
+	defer rows.Close()
+
+	tags := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags[key] = value
+	}
+	return tags, rows.Err()
+}
+
+// ListObjectsByTag returns the IDs of the objects in a bucket that carry the tag key=value, leaving out objects in the trash
+func ListObjectsByTag(db *sql.DB, bucketID, key, value string) ([]string, error) {
+	query := `SELECT o.id FROM objects o JOIN tags t ON t.object_id = o.id WHERE o.bucket_id = ? AND o.deleted_at = '' AND t.key = ? AND t.value = ? ORDER BY o.id`
+	rows, err := db.Query(query, bucketID, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects by tag, %w", err)
+	}
+	defer rows.Close()
+
+	var objectIDs []string
+	for rows.Next() {
+		var objectID string
+		if err := rows.Scan(&objectID); err != nil {
+			return nil, fmt.Errorf("failed to scan object ID: %w", err)
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+	return objectIDs, rows.Err()
+}
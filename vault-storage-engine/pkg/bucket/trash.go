@@ -0,0 +1,260 @@
+package bucket
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrObjectDeleted is returned when an object is in the trash, and stays hidden until it is restored
+	ErrObjectDeleted = errors.New("object is in the trash")
+	// ErrObjectNotDeleted is returned when restoring an object that is not in the trash
+	ErrObjectNotDeleted = errors.New("object is not in the trash")
+	// ErrRestoreWindowExpired is returned when restoring an object that has been in the trash for longer than its
+	// bucket's retention
+	ErrRestoreWindowExpired = errors.New("object has been in the trash for longer than the bucket retains deleted objects")
+)
+
+// SetTrashRetention makes deleting an object in a bucket move it to the trash, where it can be restored with
+// RestoreObject for retention, rather than removing it with its shards straight away
+// A retention of zero turns the trash off, so objects are removed as soon as they are deleted
+func SetTrashRetention(db *sql.DB, bucketID string, retention time.Duration) error {
+	if retention < 0 {
+		return fmt.Errorf("invalid trash retention: %s", retention)
+	}
+	res, err := db.Exec(`UPDATE buckets SET trash_retention_seconds = ? WHERE bucket_id = ?`, int64(retention/time.Second), bucketID)
+	if err != nil {
+		return fmt.Errorf("failed to set trash retention: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to set trash retention: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	return nil
+}
+
+// GetTrashRetention returns how long deleted objects in a bucket are kept in the trash, or zero if they are not
+func GetTrashRetention(db Querier, bucketID string) (time.Duration, error) {
+	var seconds int64
+	err := db.QueryRow(`SELECT trash_retention_seconds FROM buckets WHERE bucket_id = ?`, bucketID).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", ErrBucketNotFound, bucketID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get trash retention: %w", err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// CheckObjectNotDeleted returns an error wrapping ErrObjectDeleted if an object is in the trash
+// An object that does not exist is not in the trash
+func CheckObjectNotDeleted(db Querier, objectID string) error {
+	var deleted bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM objects WHERE id = ? AND deleted_at != '')`, objectID).Scan(&deleted)
+	if err != nil {
+		return fmt.Errorf("failed to check if object is deleted, %w", err)
+	}
+	if deleted {
+		return fmt.Errorf("%w: %s", ErrObjectDeleted, objectID)
+	}
+	return nil
+}
+
+// TrashObject moves an object to the trash at now, hiding it from listings and retrieval while keeping every version
+// and shard, and returns the combined size of its versions
+// If any version is still under a retention lock the object is left as it is, and ErrVersionLocked is returned
+// Objects in the trash still count towards the bucket's quota, since their shards are still stored
+func TrashObject(db *sql.DB, bucketID, objectID string, now time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	var deletedAt string
+	err = tx.QueryRow(`SELECT deleted_at FROM objects WHERE id = ? AND bucket_id = ?`, objectID, bucketID).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s in bucket %s", ErrObjectNotFound, objectID, bucketID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get object, %w", err)
+	}
+	if deletedAt != "" {
+		return 0, fmt.Errorf("%w: %s", ErrObjectDeleted, objectID)
+	}
+	if err := checkObjectUnlocked(tx, objectID, now); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	query := `SELECT COALESCE(SUM(CAST(json_extract(metadata, '$.filesize') AS INTEGER)), 0) FROM versions WHERE object_id = ?`
+	if err := tx.QueryRow(query, objectID).Scan(&size); err != nil {
+		return 0, fmt.Errorf("failed to get object size, %w", err)
+	}
+
+	// Dates are recorded in UTC so they compare in time order as strings
+	_, err = tx.Exec(`UPDATE objects SET deleted_at = ? WHERE id = ? AND bucket_id = ?`, now.UTC().Format(time.RFC3339), objectID, bucketID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move object to the trash, %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit object deletion, %w", err)
+	}
+	return size, nil
+}
+
+// RestoreObject takes an object back out of the trash at now, with every version it had when it was deleted
+// Objects can only be restored within their bucket's trash retention, measured from when they were deleted; after
+// that ErrRestoreWindowExpired is returned, whether or not the object has been purged yet
+func RestoreObject(db *sql.DB, bucketID, objectID string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	var deletedAt string
+	err = tx.QueryRow(`SELECT deleted_at FROM objects WHERE id = ? AND bucket_id = ?`, objectID, bucketID).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s in bucket %s", ErrObjectNotFound, objectID, bucketID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get object, %w", err)
+	}
+	if deletedAt == "" {
+		return fmt.Errorf("%w: %s", ErrObjectNotDeleted, objectID)
+	}
+
+	deletedTime, err := time.Parse(time.RFC3339, deletedAt)
+	if err != nil {
+		return fmt.Errorf("invalid deletion time %q recorded for object %s: %w", deletedAt, objectID, err)
+	}
+	retention, err := GetTrashRetention(tx, bucketID)
+	if err != nil {
+		return err
+	}
+	if now.Sub(deletedTime) > retention {
+		return fmt.Errorf("%w: %s was deleted at %s", ErrRestoreWindowExpired, objectID, deletedAt)
+	}
+
+	if _, err := tx.Exec(`UPDATE objects SET deleted_at = '' WHERE id = ? AND bucket_id = ?`, objectID, bucketID); err != nil {
+		return fmt.Errorf("failed to restore object, %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit object restore, %w", err)
+	}
+	return nil
+}
+
+// DeletedObject identifies an object in the trash
+type DeletedObject struct {
+	BucketID  string
+	ObjectID  string
+	DeletedAt time.Time
+}
+
+// ListDeletedObjects returns every object, in any bucket, that was moved to the trash at or before before
+func ListDeletedObjects(db *sql.DB, before time.Time) ([]DeletedObject, error) {
+	query := `SELECT bucket_id, id, deleted_at FROM objects WHERE deleted_at != '' AND deleted_at <= ? ORDER BY deleted_at`
+	rows, err := db.Query(query, before.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deleted objects, %w", err)
+	}
+	defer rows.Close()
+
+	var deleted []DeletedObject
+	for rows.Next() {
+		var object DeletedObject
+		var deletedAt string
+		if err := rows.Scan(&object.BucketID, &object.ObjectID, &deletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan object: %w", err)
+		}
+		object.DeletedAt, _ = time.Parse(time.RFC3339, deletedAt)
+		deleted = append(deleted, object)
+	}
+	return deleted, rows.Err()
+}
+
+// ClaimDeletedObject removes the metadata of an object if it is still in the trash and was deleted at or before
+// before, and returns the metadata of its versions so their shards can be deleted
+// It returns nil if the object is gone, was restored, was deleted again later, has a version under a retention lock at
+// now, or is locked by another writer, so callers can simply skip it
+func ClaimDeletedObject(db *sql.DB, bucketID, objectID string, before, now time.Time) ([]VersionMetadata, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	// The object is read again inside the transaction, since it may have been restored since it was listed
+	var deletedAt string
+	err = tx.QueryRow(`SELECT deleted_at FROM objects WHERE id = ? AND bucket_id = ?`, objectID, bucketID).Scan(&deletedAt)
+	if err == sql.ErrNoRows || isLocked(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object, %w", err)
+	}
+	if deletedAt == "" || deletedAt > before.UTC().Format(time.RFC3339) {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(`SELECT metadata FROM versions WHERE object_id = ?`, objectID)
+	if err != nil {
+		if isLocked(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list object versions, %w", err)
+	}
+	versions := []VersionMetadata{}
+	for rows.Next() {
+		var metadataJSON string
+		if err := rows.Scan(&metadataJSON); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		var metadata VersionMetadata
+		if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to decode metadata: %w", err)
+		}
+		if CheckVersionUnlocked(&metadata, now) != nil {
+			rows.Close()
+			return nil, nil
+		}
+		versions = append(versions, metadata)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list object versions, %w", err)
+	}
+
+	for _, query := range []string{
+		`DELETE FROM versions WHERE object_id = ?`,
+		`DELETE FROM objects WHERE id = ?`,
+		`DELETE FROM tags WHERE object_id = ?`,
+		`DELETE FROM content_ids WHERE object_id = ?`,
+		`DELETE FROM acls WHERE resource_type = 'object' AND resource_id = ?`,
+	} {
+		if _, err := tx.Exec(query, objectID); err != nil {
+			if isLocked(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to purge object, %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		if isLocked(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to commit object purge, %w", err)
+	}
+	return versions, nil
+}
@@ -0,0 +1,250 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported codec names, as recorded in version metadata
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Compressor compresses and decompresses whole payloads
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// ErrDecompressionTooLarge is returned, possibly wrapped, when a payload decompresses to more than the limit it is
+// decompressed under
+var ErrDecompressionTooLarge = errors.New("decompressed data too large")
+
+// LimitedDecompressor is implemented by compressors that can stop decompressing a payload as soon as it grows past
+// a limit, rather than holding all of it first
+type LimitedDecompressor interface {
+	DecompressLimit(data []byte, limit int64) ([]byte, error)
+}
+
+// DecompressLimit decompresses data with c, failing with ErrDecompressionTooLarge if it decompresses to more than
+// limit bytes; a negative limit decompresses it whatever its size, as Decompress does
+// Compressors that do not implement LimitedDecompressor decompress the whole payload before it is checked
+func DecompressLimit(c Compressor, data []byte, limit int64) ([]byte, error) {
+	if limit < 0 {
+		return c.Decompress(data)
+	}
+	if limited, ok := c.(LimitedDecompressor); ok {
+		return limited.DecompressLimit(data, limit)
+	}
+	out, err := c.Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	return out, checkDecompressed(len(out), limit)
+}
+
+// checkDecompressed returns ErrDecompressionTooLarge if n bytes exceed limit
+func checkDecompressed(n int, limit int64) error {
+	if int64(n) > limit {
+		return fmt.Errorf("%w: more than %d bytes", ErrDecompressionTooLarge, limit)
+	}
+	return nil
+}
+
+// readLimit reads r to its end, failing with ErrDecompressionTooLarge once it has yielded more than limit bytes
+func readLimit(r io.Reader, limit int64) ([]byte, error) {
+	// One byte past the limit is read, so a payload of exactly limit bytes is told apart from a larger one
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	return out, checkDecompressed(len(out), limit)
+}
+
+// StreamCompressor is implemented by compressors that can compress into a writer as data is written to them,
+// producing the same format Decompress reads
+type StreamCompressor interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// New returns the Compressor for a codec name, using the codec's default level
+// An empty name selects no compression
+func New(name string) (Compressor, error) {
+	return NewWithLevel(name, gzip.DefaultCompression)
+}
+
+// NewWithLevel returns the Compressor for a codec name, compressing at the given level
+// The level follows compress/gzip and is validated up front; other codecs ignore it
+func NewWithLevel(name string, level int) (Compressor, error) {
+	switch name {
+	case "", None:
+		return NoneCompressor{}, nil
+	case Gzip:
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid gzip compression level: %d", level)
+		}
+		return GzipCompressor{Level: level}, nil
+	case Zstd:
+		return ZstdCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression codec: %s", name)
+	}
+}
+
+// NoneCompressor stores payloads as-is
+type NoneCompressor struct{}
+
+func (NoneCompressor) Name() string { return None }
+
+func (NoneCompressor) Compress(data []byte) ([]byte, error) { return data, nil }
+
+func (NoneCompressor) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+func (NoneCompressor) DecompressLimit(data []byte, limit int64) ([]byte, error) {
+	return data, checkDecompressed(len(data), limit)
+}
+
+// GzipCompressor compresses payloads with gzip at the given level
+type GzipCompressor struct {
+	Level int
+}
+
+func (GzipCompressor) Name() string { return Gzip }
+
+// Compress compresses data with gzip
+func (c GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to gzip data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize gzip stream: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// NewWriter returns a writer that gzips everything written to it into w until it is closed
+func (c GzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw, err := gzip.NewWriterLevel(w, c.Level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+	return zw, nil
+}
+
+// Decompress decompresses gzip data
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to gunzip data: %w", err)
+	}
+	return out, nil
+}
+
+// DecompressLimit decompresses gzip data, stopping as soon as it grows past limit bytes
+func (GzipCompressor) DecompressLimit(data []byte, limit int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer r.Close()
+
+	out, err := readLimit(r, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to gunzip data: %w", err)
+	}
+	return out, nil
+}
+
+// ZstdCompressor compresses payloads with zstd
+type ZstdCompressor struct{}
+
+func (ZstdCompressor) Name() string { return Zstd }
+
+// Compress compresses data with zstd
+func (ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil), nil
+}
+
+// NewWriter returns a writer that compresses everything written to it into w with zstd until it is closed
+// It encodes on a single goroutine, as Compress does, so it holds no more buffers than Compress
+func (ZstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	return enc, nil
+}
+
+// Decompress decompresses zstd data
+func (ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	defer dec.Close()
+
+	out, err := dec.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd data: %w", err)
+	}
+	return out, nil
+}
+
+// DecompressLimit decompresses zstd data, stopping as soon as it grows past limit bytes
+func (ZstdCompressor) DecompressLimit(data []byte, limit int64) ([]byte, error) {
+	dec, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	defer dec.Close()
+
+	out, err := readLimit(dec, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd data: %w", err)
+	}
+	return out, nil
+}
+
+// Magic numbers that gzip and zstd frames start with
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Detect returns the codec whose framing data starts with, or None if it is not compressed with a supported codec
+// It only looks at the magic number, so it tells compressed payloads apart from plain ones rather than checking that
+// they decompress
+func Detect(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, zstdMagic):
+		return Zstd
+	case bytes.HasPrefix(data, gzipMagic):
+		return Gzip
+	default:
+		return None
+	}
+}
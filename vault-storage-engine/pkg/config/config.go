@@ -1,20 +1,114 @@
 package config
 
 import (
+	"compress/gzip"
 	"encoding/hex"
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// DefaultChunkSize is the chunk size used by streaming stores when none is configured
+const DefaultChunkSize = 4 << 20
+
+// DefaultShardConcurrency is the number of shards stored or retrieved in parallel when none is configured
+const DefaultShardConcurrency = 4
+
+// DefaultMaxRetries is the number of times a transient shard store failure is retried when none is configured
+const DefaultMaxRetries = 3
+
+// DefaultRetryBackoff is the delay before the first retry of a transient shard store failure when none is configured
+const DefaultRetryBackoff = 200 * time.Millisecond
+
+// DefaultMaxUserMetadataSize is the most bytes of user metadata a version takes when no limit is configured
+const DefaultMaxUserMetadataSize = 8 << 10
+
+// DefaultObjectLockTimeout is how long a write waits for another writer of the same object when no timeout is configured
+const DefaultObjectLockTimeout = 30 * time.Second
+
+// DefaultIdempotencyWindow is how long the idempotency key of a store is remembered when no window is configured
+const DefaultIdempotencyWindow = 24 * time.Hour
+
 // Config holds the configuration settings
 type Config struct {
-	ServerAddress      string `yaml:"server_address"`
-	ShardStoreBasePath string `yaml:"shard_store_base_path"`
-	EncryptionKey      []byte `yaml:"-"`
-	EncryptionKeyHex   string `yaml:"encryption_key"`
-	Database           string `yaml:"database"`
+	ServerAddress      string        `yaml:"server_address"`
+	ShardStoreBasePath string        `yaml:"shard_store_base_path"`
+	EncryptionKey      []byte        `yaml:"-"`
+	EncryptionKeyHex   string        `yaml:"encryption_key"`
+	Database           string        `yaml:"database"`
+	ChunkSize          int64         `yaml:"chunk_size"`
+	ShardConcurrency   int           `yaml:"shard_concurrency"`
+	VerifyOnRead       bool          `yaml:"verify_on_read"`
+	Compression        string        `yaml:"compression"`
+	CompressionLevel   int           `yaml:"compression_level"`
+	MaxRetries         int           `yaml:"max_retries"`
+	RetryBackoff       time.Duration `yaml:"retry_backoff"`
+	Dedup              bool          `yaml:"dedup"`
+	Placement          string        `yaml:"placement"`
+	Cipher             string        `yaml:"cipher"`
+	ErasureCoder       string        `yaml:"erasure_coder"`
+	ErasureMinSize     int64         `yaml:"erasure_min_size"`
+	Durable            bool          `yaml:"durable"`
+	ShardNaming        string        `yaml:"shard_naming"`
+	DBWAL              bool          `yaml:"db_wal"`
+	DBBusyTimeout      time.Duration `yaml:"db_busy_timeout"`
+	// ShardStoreTempPath is the directory local shards are staged in before they are renamed into place, on the same
+	// filesystem as ShardStoreBasePath, which Validate checks; shards are staged next to their destination when it is empty
+	ShardStoreTempPath string `yaml:"shard_store_temp_path"`
+	// AzureAccessTier is the access tier Azure shards are uploaded to, for sharding.NewAzureBlobShardStore
+	AzureAccessTier string `yaml:"azure_access_tier"`
+	// EncryptionPassphrase replaces EncryptionKeyHex, deriving a master key for each bucket from the passphrase
+	EncryptionPassphrase string `yaml:"encryption_passphrase"`
+	// CacheBytes bounds the memory used to cache retrieved versions; zero turns the cache off
+	CacheBytes int64 `yaml:"cache_bytes"`
+	// ShardCompression is the codec shards are compressed with after erasure coding, which can only be "none": shards
+	// are ciphertext, which does not compress, and the plaintext is already compressed once with Compression
+	ShardCompression string `yaml:"shard_compression"`
+	// MaxObjectSize is the largest object, in bytes, a store accepts, so no single upload can exhaust memory; zero
+	// means no limit
+	MaxObjectSize int64 `yaml:"max_object_size"`
+	// MaxUserMetadataSize caps the user metadata recorded with a version, counting the bytes of every key and value,
+	// so metadata cannot bloat the database; DefaultMaxUserMetadataSize applies when it is zero
+	MaxUserMetadataSize int `yaml:"max_user_metadata_size"`
+	// MaxDecompressedSize caps what a payload may decompress to when its size was not recorded, as for versions stored
+	// before sizes were, so a corrupt or malicious payload cannot exhaust memory; MaxObjectSize applies when it is
+	// zero, and nothing does when both are. Payloads whose size was recorded may decompress to exactly that size
+	MaxDecompressedSize int64 `yaml:"max_decompressed_size"`
+	// ObjectLockTimeout is how long a store waits for another writer of the same object to finish before giving up;
+	// DefaultObjectLockTimeout applies when it is zero
+	ObjectLockTimeout time.Duration `yaml:"object_lock_timeout"`
+	// MerkleHash is the hash algorithm new versions build their Merkle trees and shard hashes with, one of those of
+	// proofofinclusion.NewHash; proofofinclusion.DefaultHashAlgorithm applies when it is empty. The algorithm is
+	// recorded with each version, so versions stored under an earlier setting are still verified with their own
+	MerkleHash string `yaml:"merkle_hash"`
+	// IdempotencyWindow is how long the idempotency key of a store is remembered, so a retry within it returns the
+	// version the store created; DefaultIdempotencyWindow applies when it is zero
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+	// Clock stamps the creation date of every version stored, in place of the system clock, when set
+	Clock Clock `yaml:"-"`
+}
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+// FixedClock is a Clock that always tells the same time, for tests and for backfilling versions with their original
+// creation dates
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// Now returns the time on cfg.Clock, or the system time if no clock is set
+func (cfg *Config) Now() time.Time {
+	if cfg.Clock == nil {
+		return time.Now()
+	}
+	return cfg.Clock.Now()
 }
 
 // LoadConfig loads the configuration from a YAML file
@@ -25,24 +119,43 @@ func LoadConfig() *Config {
 	}
 	defer f.Close()
 
-	var cfg Config
+	// Shards are verified against their Merkle proofs on read unless the config turns it off
+	// Payloads are gzip-compressed at the default level unless another codec (or "none") is configured
+	// Transient shard store failures are retried unless max_retries is explicitly set to 0
+	cfg := Config{VerifyOnRead: true, Compression: "gzip", CompressionLevel: gzip.DefaultCompression, MaxRetries: DefaultMaxRetries}
 	decoder := yaml.NewDecoder(f)
 	if err := decoder.Decode(&cfg); err != nil {
 		log.Fatalf("failed to decode config file: %v", err)
 	}
 
-	// Decode the hex-encoded encryption key
-	key, err := hex.DecodeString(cfg.EncryptionKeyHex)
-	if err != nil {
-		log.Fatalf("failed to decode encryption key: %v", err)
+	// Master keys are either derived from a passphrase, bucket by bucket, or given directly
+	if cfg.EncryptionPassphrase == "" {
+		// Decode the hex-encoded encryption key
+		key, err := hex.DecodeString(cfg.EncryptionKeyHex)
+		if err != nil {
+			log.Fatalf("failed to decode encryption key: %v", err)
+		}
+		cfg.EncryptionKey = key
 	}
 
-	// Ensure the key length is valid for AES (16, 24, or 32 bytes)
-	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
-		log.Fatalf("invalid encryption key size: %d bytes", len(key))
+	// Streaming stores read the source in chunks of this many bytes
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = DefaultChunkSize
 	}
 
-	cfg.EncryptionKey = key
+	// Shards are written to and read from their locations by a bounded pool of workers
+	if cfg.ShardConcurrency <= 0 {
+		cfg.ShardConcurrency = DefaultShardConcurrency
+	}
 
+	// Retries back off exponentially from this delay
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+
+	// Every setting is checked here, so a bad config fails at startup rather than on the first store
+	if err := Validate(&cfg); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
 	return &cfg
 }
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+)
+
+// Validate checks cfg once, up front, for every setting that would otherwise only fail deep inside the first store
+// or retrieval, and returns every problem it finds joined into one error
+// The master key wraps the data key of every version with AES-GCM whichever cipher encrypts the payloads, so it must
+// be an AES key of 16, 24 or 32 bytes for every cipher; the data keys themselves are generated to suit each of them
+func Validate(cfg *Config) error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.EncryptionPassphrase != "" {
+		if cfg.EncryptionKeyHex != "" || len(cfg.EncryptionKey) > 0 {
+			check(fmt.Errorf("encryption_key and encryption_passphrase are mutually exclusive"))
+		}
+	} else if n := len(cfg.EncryptionKey); n != 16 && n != 24 && n != 32 {
+		check(fmt.Errorf("invalid encryption key size: %d bytes, need 16, 24 or 32", n))
+	}
+	_, err := encryption.NewCipher(cfg.Cipher)
+	check(err)
+
+	_, err = compression.NewWithLevel(cfg.Compression, cfg.CompressionLevel)
+	check(err)
+	if cfg.ShardCompression != "" && cfg.ShardCompression != compression.None {
+		check(fmt.Errorf("unsupported shard compression %q: shards are stored raw once encrypted, and only the plaintext is compressed", cfg.ShardCompression))
+	}
+
+	// The default scheme is what stores fall back on when they are given no shard counts of their own
+	if err := erasurecoding.DefaultParams().Validate(); err != nil {
+		check(fmt.Errorf("invalid default redundancy scheme: %w", err))
+	}
+	_, err = erasurecoding.NewCoder(cfg.ErasureCoder, erasurecoding.DefaultParams())
+	check(err)
+	_, err = proofofinclusion.NewHash(cfg.MerkleHash)
+	check(err)
+	_, err = sharding.NewPlacement(cfg.Placement)
+	check(err)
+	switch cfg.ShardNaming {
+	case "", sharding.NamingPlain, sharding.NamingHex:
+	default:
+		check(fmt.Errorf("unsupported shard naming: %s", cfg.ShardNaming))
+	}
+	// Shards staged on another filesystem could never be renamed into place, so every local store would fail
+	if cfg.ShardStoreTempPath != "" {
+		check(sharding.CheckSameFilesystem(cfg.ShardStoreTempPath, cfg.ShardStoreBasePath))
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value int64
+	}{
+		{"chunk_size", cfg.ChunkSize},
+		{"shard_concurrency", int64(cfg.ShardConcurrency)},
+		{"max_retries", int64(cfg.MaxRetries)},
+		{"retry_backoff", int64(cfg.RetryBackoff)},
+		{"erasure_min_size", cfg.ErasureMinSize},
+		{"cache_bytes", cfg.CacheBytes},
+		{"max_object_size", cfg.MaxObjectSize},
+		{"max_user_metadata_size", int64(cfg.MaxUserMetadataSize)},
+		{"max_decompressed_size", cfg.MaxDecompressedSize},
+		{"object_lock_timeout", int64(cfg.ObjectLockTimeout)},
+		{"idempotency_window", int64(cfg.IdempotencyWindow)},
+	} {
+		if setting.value < 0 {
+			check(fmt.Errorf("invalid %s: %d must not be negative", setting.name, setting.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateLayout checks the locations and redundancy scheme stores will be given under cfg, which are passed to each
+// store rather than configured, so callers can check them once before the first store too; the zero value of params
+// stands for the default scheme
+// Every location must be named once, and there must be at least one; placements other than round-robin, the default,
+// need a location for every shard, while round-robin deals shards out again from the first location when there are fewer
+func ValidateLayout(cfg *Config, locations []string, params erasurecoding.EncodingParams) error {
+	params = params.OrDefault()
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	if len(locations) == 0 {
+		return fmt.Errorf("no storage locations configured")
+	}
+	seen := make(map[string]bool, len(locations))
+	for _, location := range locations {
+		if location == "" {
+			return fmt.Errorf("empty storage location")
+		}
+		if seen[location] {
+			return fmt.Errorf("storage location %s is listed more than once", location)
+		}
+		seen[location] = true
+	}
+	if cfg.Placement != "" && cfg.Placement != sharding.RoundRobin && len(locations) < params.TotalShards() {
+		return fmt.Errorf("%d storage locations configured for %d shards, and %s placement needs one per shard", len(locations), params.TotalShards(), cfg.Placement)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+)
+
+// TestValidateShardCompression checks that shards may only be stored raw, so a config asking for any other shard
+// compression is rejected up front
+func TestValidateShardCompression(t *testing.T) {
+	for _, tc := range []struct {
+		codec string
+		ok    bool
+	}{
+		{"", true},
+		{"none", true},
+		{"gzip", false},
+		{"zstd", false},
+	} {
+		cfg := &Config{EncryptionKey: bytes.Repeat([]byte{1}, 32), ShardCompression: tc.codec}
+		err := Validate(cfg)
+		if tc.ok && err != nil {
+			t.Errorf("shard compression %q: %v", tc.codec, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("shard compression %q was accepted", tc.codec)
+		}
+	}
+}
+
+// TestValidateShardStoreTempPath checks that a temporary shard directory is accepted on the filesystem of the shard
+// store, even before either directory exists, and rejected on any other
+func TestValidateShardStoreTempPath(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		EncryptionKey:      bytes.Repeat([]byte{1}, 32),
+		ShardStoreBasePath: filepath.Join(dir, "shards"),
+		ShardStoreTempPath: filepath.Join(dir, "staging", "tmp"),
+	}
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("temporary directory beside the store was rejected: %v", err)
+	}
+
+	// Another filesystem is only known to be available where one is mounted apart from the test's temporary directory
+	other := os.TempDir()
+	if shm, err := os.Stat("/dev/shm"); err == nil && shm.IsDir() {
+		other = "/dev/shm"
+	}
+	if sharding.CheckSameFilesystem(other, dir) == nil {
+		t.Skip("no second filesystem available")
+	}
+	cfg.ShardStoreTempPath = other
+	if err := Validate(cfg); err == nil {
+		t.Fatal("temporary directory on another filesystem was accepted")
+	}
+}
@@ -0,0 +1,52 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+)
+
+// authorize checks that the principal set on ctx with audit.WithPrincipal holds perm on an object, as granted with
+// acl.GrantAccess or inherited from its bucket, and returns an error wrapping acl.ErrAccessDenied if it does not
+// An object that does not exist yet, as when it is first stored, takes the permissions of the bucket it is stored in
+// Calls made without a principal are trusted, as they were before access control lists, and are not checked
+func authorize(ctx context.Context, db *sql.DB, bucketID, objectID string, perm acl.Permission) error {
+	principal := audit.PrincipalFrom(ctx)
+	if principal == "" {
+		return nil
+	}
+
+	allowed, err := acl.CheckAccess(db, objectID, principal, perm)
+	if errors.Is(err, bucket.ErrObjectNotFound) {
+		allowed, err = acl.CheckBucketAccess(db, bucketID, principal, perm)
+	}
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s may not %s object %s", acl.ErrAccessDenied, principal, perm, objectID)
+	}
+	return nil
+}
+
+// authorizeBucket checks that the principal set on ctx holds perm on a bucket itself, like authorize
+func authorizeBucket(ctx context.Context, db *sql.DB, bucketID string, perm acl.Permission) error {
+	principal := audit.PrincipalFrom(ctx)
+	if principal == "" {
+		return nil
+	}
+
+	allowed, err := acl.CheckBucketAccess(db, bucketID, principal, perm)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s may not %s bucket %s", acl.ErrAccessDenied, principal, perm, bucketID)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// AppendData stores a new version of an object holding the content of its latest version followed by extra, and
+// returns the ID of the new version
+// Streamed versions are not re-encoded: full chunks are carried over by copying their shards as they are, server-side
+// for stores that implement sharding.ShardCopier and as hard links on a LocalShardStore, and only a partial last chunk
+// is reconstructed and stored again along with extra; the data key, codec and redundancy scheme carry over too
+// Versions that were not stored in chunks, or whose shards cannot be copied as they are, are retrieved and stored again
+// The new version becomes the latest, with the version it extends as its parent and the object's root as its own, like
+// any other new version; the version it extends is left as it was, and since each owns its shards, either can be
+// deleted, expired or rolled back without affecting the other
+// Versions extended in chunks record no whole-object checksum, as for multipart uploads, since computing one would mean
+// reading every chunk back; each chunk is still verified against its shard hashes
+// Every append is recorded in the audit trail as a store, and the quota and cfg.MaxObjectSize are checked against the
+// size of the whole new version
+// The lock of the object is held from reading the latest version to recording the new one, so concurrent appends in
+// this process each extend the version the other stored rather than racing to extend the same one
+func AppendData(db *sql.DB, bucketID, objectID string, extra []byte, store sharding.ShardStore, cfg *config.Config) (string, error) {
+	ctx := context.Background()
+	versionID, size, err := appendData(ctx, db, bucketID, objectID, extra, store, cfg)
+	audit.Record(ctx, audit.Event{Operation: audit.OpStore, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: size}, err)
+	return versionID, err
+}
+
+// appendData stores an appended version for AppendData, which records it in the audit trail
+// The size of the new version is returned alongside its ID
+func appendData(ctx context.Context, db *sql.DB, bucketID, objectID string, extra []byte, store sharding.ShardStore, cfg *config.Config) (string, int64, error) {
+	start := time.Now()
+	logger := zap.L()
+
+	// The latest version is read and extended under the lock of the object, so no concurrent write is lost
+	unlock, err := lockObject(ctx, objectID, cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	defer unlock()
+
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return "", 0, err
+	}
+	if err := authorize(ctx, db, bucketID, objectID, acl.PermWrite); err != nil {
+		return "", 0, err
+	}
+	if err := bucket.CheckObjectNotDeleted(db, objectID); err != nil {
+		return "", 0, err
+	}
+	latest, err := bucket.GetLatestMetadata(db, bucketID, objectID)
+	if err != nil {
+		return "", 0, err
+	}
+	metadata := &latest
+	size := versionSize(metadata) + int64(len(extra))
+
+	bucketCfg, _, err := bucketConfig(db, cfg, bucketID, metadata.EncodingParams())
+	if err != nil {
+		return "", size, err
+	}
+	if len(metadata.Chunks) == 0 || !canCopyShards(metadata, bucketCfg) {
+		versionID, err := reencodeAppend(ctx, db, metadata, bucketID, objectID, extra, store, cfg, logger)
+		return versionID, size, err
+	}
+
+	if err := checkObjectSize(bucketCfg, size); err != nil {
+		return "", size, err
+	}
+	if err := bucket.CheckBucketQuota(db, bucketID, size); err != nil {
+		return "", size, err
+	}
+
+	params := metadata.EncodingParams()
+	coder, err := erasurecoding.NewCoder(metadata.ErasureCoder, params)
+	if err != nil {
+		return "", size, err
+	}
+	payloadCipher, err := encryption.NewCipher(metadata.Cipher)
+	if err != nil {
+		return "", size, err
+	}
+	key, err := versionKey(db, cfg, bucketID, metadata)
+	if err != nil {
+		return "", size, err
+	}
+	// Chunks written before are decompressed with the codec recorded for the version, so new chunks must use it too,
+	// unless no chunk was compressed at all
+	sourceCompressor, err := compression.New(metadata.Compression)
+	if err != nil {
+		return "", size, err
+	}
+	compressor := sourceCompressor
+	uncompressedSource := sourceCompressor.Name() == compression.None
+	if uncompressedSource {
+		compressor, err = compression.NewWithLevel(bucketCfg.Compression, bucketCfg.CompressionLevel)
+		if err != nil {
+			return "", size, err
+		}
+	}
+
+	chunkSize := metadata.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = config.DefaultChunkSize
+	}
+
+	versionID := uuid.New().String()
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+	locations := versionLocations(metadata)
+	totalShards := params.TotalShards()
+
+	var chunks []bucket.ChunkMetadata
+	// Until the metadata is committed nothing refers to the shards, so every shard copied or written is removed again
+	committed := false
+	defer func() {
+		if !committed {
+			cleanupVersionShards(store, &bucket.VersionMetadata{ObjectID: objectID, VersionID: versionID, Chunks: chunks}, logger)
+		}
+	}()
+
+	// Full chunks are carried over as they are; a partial last chunk is reconstructed to be stored again with extra
+	carried := metadata.Chunks
+	tail := extra
+	if last := carried[len(carried)-1]; last.Size < chunkSize && len(extra) > 0 {
+		data, err := decodeChunk(ctx, last, shardObjectID, shardVersionID, store, payloadCipher, key, coder, sourceCompressor, shardProgress{}, cfg, logger)
+		if err != nil {
+			return "", size, err
+		}
+		carried = carried[:len(carried)-1]
+		tail = append(data, extra...)
+	}
+	for _, chunk := range carried {
+		if err := ctx.Err(); err != nil {
+			return "", size, fmt.Errorf("append aborted before chunk %d: %w", chunk.Index, err)
+		}
+		copied, err := copyChunk(ctx, store, chunk, shardObjectID, shardVersionID, objectID, versionID, cfg, logger)
+		// The appended version records the codec of its new chunks, so chunks carried over from a version that
+		// compressed none are flagged as raw, including those written before the flag was recorded
+		if uncompressedSource {
+			copied.Uncompressed = true
+		}
+		chunks = append(chunks, copied)
+		if err != nil {
+			return "", size, err
+		}
+	}
+	// Chunks of a multipart upload are numbered by part and may leave gaps, so new chunks are numbered after the
+	// last chunk of the version rather than by their position, keeping their shards clear of those carried over
+	idx := metadata.Chunks[len(metadata.Chunks)-1].Index + 1
+	for ; len(tail) > 0; idx++ {
+		if err := ctx.Err(); err != nil {
+			return "", size, fmt.Errorf("append aborted before chunk %d: %w", idx, err)
+		}
+		n := min(int64(len(tail)), chunkSize)
+		chunk, err := storeChunk(ctx, tail[:n], idx, objectID, versionID, store, cfg, locations, coder, compressor, payloadCipher, key, idx*totalShards, nil, nil, logger)
+		chunks = append(chunks, chunk)
+		if err != nil {
+			return "", size, err
+		}
+		tail = tail[n:]
+	}
+
+	var compressedSize, encryptedSize, storedSize int64
+	anyCompressed := false
+	for _, chunk := range chunks {
+		compressedSize += chunk.EncryptedSize - int64(payloadCipher.Overhead())
+		anyCompressed = anyCompressed || !chunk.Uncompressed
+		encryptedSize += chunk.EncryptedSize
+		storedSize += chunk.StoredSize
+	}
+	codec := compressor.Name()
+	if !anyCompressed {
+		codec = compression.None
+	}
+
+	// The new version is described like the one it extends, but owns its shards and starts without an expiration or lock
+	appended := *metadata
+	appended.VersionID = versionID
+	appended.Filesize = strconv.FormatInt(size, 10)
+	appended.Checksum = ""
+	appended.Compression = codec
+	appended.Compressed = anyCompressed
+	appended.CompressedSize = compressedSize
+	appended.EncryptedSize = encryptedSize
+	appended.StoredSize = storedSize
+	appended.CreationDate = cfg.Now().Format(time.RFC3339)
+	appended.ParentVersion, appended.RootVersion = "", ""
+	appended.ContentRef = ""
+	appended.ShardObjectID, appended.ShardVersionID = "", ""
+	appended.ExpiresAt = time.Time{}
+	appended.LockedUntil = time.Time{}
+	appended.ChunkSize = chunkSize
+	appended.Chunks = chunks
+
+	if err := commitVersionTx(ctx, db, cfg, bucketID, objectID, versionID, appended, []byte{}); err != nil {
+		return "", size, err
+	}
+	committed = true
+
+	metrics.ObserveStore(bucketID, int64(len(extra)), compressedSize, len(chunks)*totalShards, time.Since(start))
+	fmt.Printf("Appended %d bytes to object %s (version %s) in bucket %s as version %s, carrying over %d of %d chunks\n",
+		len(extra), objectID, metadata.VersionID, bucketID, versionID, len(carried), len(chunks))
+	return versionID, size, nil
+}
+
+// copyChunk copies every shard of a chunk to dstObjectID and versionID, keeping each in its location
+// The proofs and hashes of the chunk carry over unchanged, since the shards are byte-for-byte identical; the returned
+// chunk records the shards copied so far even on failure, so they can be cleaned up
+func copyChunk(ctx context.Context, store sharding.ShardStore, chunk bucket.ChunkMetadata, srcObjectID, srcVersionID, dstObjectID, versionID string, cfg *config.Config, logger *zap.Logger) (bucket.ChunkMetadata, error) {
+	copied := chunk
+	copied.ShardLocations = make(map[string]string, len(chunk.ShardLocations))
+	for shardKey, location := range chunk.ShardLocations {
+		shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_"))
+		if err != nil {
+			return copied, fmt.Errorf("invalid shard index %s: %w", shardKey, err)
+		}
+		err = withRetry(ctx, store, cfg, logger, func() error {
+			return sharding.CopyShard(ctx, store, srcObjectID, srcVersionID, dstObjectID, versionID, shardIdx, location)
+		})
+		if err != nil {
+			return copied, fmt.Errorf("failed to copy shard %d of chunk %d: %w", shardIdx, chunk.Index, err)
+		}
+		copied.ShardLocations[shardKey] = location
+	}
+	return copied, nil
+}
+
+// reencodeAppend appends to a version by retrieving it and storing it again with extra, for versions whose shards
+// cannot be carried over as they are
+// The new version keeps the redundancy scheme and locations of the version it extends, and is named and described like it
+func reencodeAppend(ctx context.Context, db *sql.DB, metadata *bucket.VersionMetadata, bucketID, objectID string, extra []byte, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (string, error) {
+	params := metadata.EncodingParams()
+	locations := versionLocations(metadata)
+	ctx = WithStoreOptions(ctx, StoreOptions{Filename: metadata.Filename, Format: metadata.Format, ContentType: metadata.ContentType, Metadata: metadata.UserMetadata})
+
+	// Chunked versions are streamed so the append never holds the whole object in memory
+	if len(metadata.Chunks) > 0 {
+		r, _, size, err := retrieveDataStream(ctx, db, bucketID, objectID, metadata.VersionID, store, cfg, logger)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		src := io.MultiReader(r, bytes.NewReader(extra))
+		versionID, _, err := storeDataStream(ctx, db, src, size+int64(len(extra)), bucketID, objectID, metadata.Filename, store, cfg, locations, params, logger)
+		return versionID, err
+	}
+
+	data, _, err := retrieveData(ctx, db, bucketID, objectID, metadata.VersionID, store, cfg, logger)
+	if err != nil {
+		return "", err
+	}
+	versionID, _, _, err := storeDataWithVersion(ctx, db, append(data, extra...), bucketID, objectID, uuid.New().String(), metadata.Filename, store, cfg, locations, params, logger)
+	return versionID, err
+}
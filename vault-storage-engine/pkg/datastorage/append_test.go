@@ -0,0 +1,58 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// TestAppendAfterGappedMultipart checks that appending to a version completed from parts with a gap in their numbers
+// stores the new chunk clear of the shards of the last part, so the appended version reads back whole
+func TestAppendAfterGappedMultipart(t *testing.T) {
+	db, cfg := newTestVault(t)
+	store := sharding.NewMemoryShardStore()
+
+	uploader, err := NewMultipartUploader(db, store, cfg, testLocations, erasurecoding.DefaultParams(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadID, err := uploader.InitMultipart("b1", "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bytes.Repeat([]byte("first part "), config.DefaultChunkSize/11+1)[:config.DefaultChunkSize]
+	third := bytes.Repeat([]byte("third part "), config.DefaultChunkSize/11+1)[:config.DefaultChunkSize]
+	if err := uploader.UploadPart(uploadID, 1, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploader.UploadPart(uploadID, 3, third); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploader.CompleteMultipart(uploadID); err != nil {
+		t.Fatal(err)
+	}
+
+	versionID, err := AppendData(db, "b1", "o1", []byte("tail"), store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := RetrieveDataStream(context.Background(), db, "b1", "o1", versionID, store, cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte(nil), first...), third...), "tail"...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("appended version read back as %d bytes, want %d", len(got), len(want))
+	}
+}
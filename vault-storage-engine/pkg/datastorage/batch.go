@@ -0,0 +1,172 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// ErrBatchAborted is reported for the items of a batch that were rolled back because another item, or the batch transaction, failed
+var ErrBatchAborted = errors.New("batch aborted")
+
+// StoreItem is a single object to store with StoreBatch
+type StoreItem struct {
+	ObjectID string
+	FilePath string
+	Data     []byte
+	// ExpiresAt makes the stored version expire, as with WithExpiration; the zero value never expires
+	ExpiresAt time.Time
+}
+
+// BatchOptions controls how StoreBatch handles failures
+type BatchOptions struct {
+	// Atomic rolls back the whole batch, and removes every shard written for it, if any item fails
+	Atomic bool
+}
+
+// BatchResult is the outcome of storing one item of a batch
+// VersionID is only set when Err is nil
+type BatchResult struct {
+	VersionID string
+	Err       error
+}
+
+// StoreBatch stores many objects in a bucket, recording all of their metadata in a single SQLite transaction
+// Each item is encoded and sharded exactly as StoreData would, and the results are returned in the order of items
+// Unless opts.Atomic is set, a failed item is reported in its result and the rest of the batch is still committed
+// Shards written for an item that is not committed are deleted again
+// Batched items are never deduplicated, even when cfg.Dedup is set
+// Items are checked against the bucket quota as they are committed, so the items that would exceed it fail with bucket.ErrQuotaExceeded
+// Items larger than cfg.MaxObjectSize fail with ErrObjectTooLarge without being encoded
+func StoreBatch(db *sql.DB, items []StoreItem, bucketID string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, opts BatchOptions, logger *zap.Logger) ([]BatchResult, error) {
+	ctx := context.Background()
+	start := time.Now()
+
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return nil, err
+	}
+
+	cfg, params, err := bucketConfig(db, cfg, bucketID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(items))
+	encoded := make([]*batchVersion, len(items))
+
+	// Shards are written before the transaction is opened, so no write lock is held while the store is busy
+	for i, item := range items {
+		if err := checkObjectSize(cfg, int64(len(item.Data))); err != nil {
+			results[i].Err = err
+			if opts.Atomic {
+				return abortBatch(results, encoded, i, store, logger), fmt.Errorf("failed to store item %d: %w", i, err)
+			}
+			continue
+		}
+		versionID := uuid.New().String()
+		metadata, cipherText, _, err := encodeVersion(WithExpiration(ctx, item.ExpiresAt), db, item.Data, "", bucketID, item.ObjectID, versionID, item.FilePath, store, cfg, locations, params, nil, logger)
+		if err != nil {
+			cleanupVersionShards(store, &metadata, logger)
+			results[i].Err = err
+			if opts.Atomic {
+				return abortBatch(results, encoded, i, store, logger), fmt.Errorf("failed to store item %d: %w", i, err)
+			}
+			continue
+		}
+		encoded[i] = &batchVersion{metadata: metadata, cipherText: cipherText}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return abortBatch(results, encoded, -1, store, logger), fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, v := range encoded {
+		if v == nil {
+			continue
+		}
+		// Each item is committed under its own savepoint, so a failed item can be undone without losing the others
+		if err := commitBatchVersion(tx, bucketID, v.metadata, v.cipherText); err != nil {
+			results[i].Err = err
+			if opts.Atomic {
+				return abortBatch(results, encoded, i, store, logger), fmt.Errorf("failed to record item %d: %w", i, err)
+			}
+			cleanupVersionShards(store, &v.metadata, logger)
+			encoded[i] = nil
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return abortBatch(results, encoded, -1, store, logger), fmt.Errorf("failed to commit batch, %w", err)
+	}
+
+	stored := 0
+	for i, v := range encoded {
+		if v != nil {
+			results[i].VersionID = v.metadata.VersionID
+			stored++
+		}
+		audit.Record(ctx, audit.Event{Operation: audit.OpStore, BucketID: bucketID, ObjectID: items[i].ObjectID, VersionID: results[i].VersionID, Bytes: int64(len(items[i].Data))}, results[i].Err)
+	}
+	// The batch runs as one operation, so each stored item is recorded with an equal share of its latency
+	elapsed := time.Since(start)
+	for i, v := range encoded {
+		if v != nil {
+			metrics.ObserveStore(bucketID, int64(len(items[i].Data)), v.metadata.CompressedSize, v.metadata.EncodingParams().TotalShards(), elapsed/time.Duration(stored))
+		}
+	}
+	logger.Info("Stored batch", zap.String("bucket_id", bucketID), zap.Int("items", len(items)), zap.Int("stored", stored), zap.Duration("elapsed", elapsed))
+	return results, nil
+}
+
+// batchVersion is an item of a batch whose shards have been written but whose metadata is not yet committed
+type batchVersion struct {
+	metadata   bucket.VersionMetadata
+	cipherText []byte
+}
+
+// commitBatchVersion records one version of a batch inside a savepoint of the batch transaction
+func commitBatchVersion(tx *sql.Tx, bucketID string, metadata bucket.VersionMetadata, cipherText []byte) error {
+	// Items committed earlier in the transaction already count towards the quota
+	if err := bucket.CheckBucketQuota(tx, bucketID, versionSize(&metadata)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`SAVEPOINT batch_item`); err != nil {
+		return fmt.Errorf("failed to create savepoint, %w", err)
+	}
+	if err := commitVersion(tx, bucketID, metadata.ObjectID, metadata.VersionID, metadata, cipherText); err != nil {
+		tx.Exec(`ROLLBACK TO batch_item`)
+		tx.Exec(`RELEASE batch_item`)
+		return err
+	}
+	if _, err := tx.Exec(`RELEASE batch_item`); err != nil {
+		return fmt.Errorf("failed to release savepoint, %w", err)
+	}
+	return nil
+}
+
+// abortBatch deletes the shards of every encoded item and marks all items without an error of their own as aborted
+// failed is the index of the item that caused the abort, or -1 if the batch as a whole failed
+func abortBatch(results []BatchResult, encoded []*batchVersion, failed int, store sharding.ShardStore, logger *zap.Logger) []BatchResult {
+	for i, v := range encoded {
+		if v != nil {
+			cleanupVersionShards(store, &v.metadata, logger)
+		}
+		if i != failed && results[i].Err == nil {
+			results[i].Err = ErrBatchAborted
+		}
+	}
+	return results
+}
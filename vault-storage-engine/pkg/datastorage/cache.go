@@ -0,0 +1,110 @@
+package datastorage
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+)
+
+// retrieveCache holds the versions most recently reconstructed by RetrieveData and RetrieveWithMetadata, bounded by
+// cfg.CacheBytes, so hot versions are not read, decrypted and decompressed again on every retrieval
+// Versions stored in chunks are streamed rather than held whole, and are never cached
+// Versions never change once stored, so entries are only invalidated when their version is deleted; rolling back
+// stores a new version and leaves the entry of the version rolled back to valid
+var retrieveCache = newObjectCache()
+
+// cacheKey identifies a cached version
+// Versions are looked up by object and version, since the bucket a version is retrieved through is not checked
+// against the one it was stored in; the bucket is checked against the entry instead
+type cacheKey struct {
+	objectID  string
+	versionID string
+}
+
+// cacheEntry is a cached version, along with what it is checked against on every lookup
+type cacheEntry struct {
+	key      cacheKey
+	bucketID string
+	// checksum is the checksum recorded for the version, so content stored again under the same version ID never
+	// comes back from an entry left over from before
+	checksum string
+	data     []byte
+}
+
+// objectCache is a least-recently-used cache of reconstructed versions bounded by the bytes it holds
+// It is safe for use by multiple goroutines
+type objectCache struct {
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[cacheKey]*list.Element
+}
+
+// newObjectCache creates an empty objectCache
+func newObjectCache() *objectCache {
+	return &objectCache{order: list.New(), entries: make(map[cacheKey]*list.Element)}
+}
+
+// get returns a copy of the cached content of a version, if it is cached for bucketID with the recorded checksum
+func (c *objectCache) get(bucketID string, metadata *bucket.VersionMetadata) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey{metadata.ObjectID, metadata.VersionID}]
+	if !ok {
+		metrics.ObserveCacheLookup(bucketID, false)
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.bucketID != bucketID || entry.checksum != metadata.Checksum {
+		metrics.ObserveCacheLookup(bucketID, false)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	metrics.ObserveCacheLookup(bucketID, true)
+	// Callers own what they are returned, so they never see or change the cached bytes
+	return bytes.Clone(entry.data), true
+}
+
+// put caches a copy of the content of a version, evicting the least recently used versions until the cache holds at
+// most maxBytes; content larger than maxBytes is not cached at all
+func (c *objectCache) put(bucketID string, metadata *bucket.VersionMetadata, data []byte, maxBytes int64) {
+	if maxBytes <= 0 || int64(len(data)) > maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{metadata.ObjectID, metadata.VersionID}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{key: key, bucketID: bucketID, checksum: metadata.Checksum, data: bytes.Clone(data)}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += int64(len(entry.data))
+
+	for c.size > maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops the cached content of a version, if it is cached
+func (c *objectCache) invalidate(objectID, versionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[cacheKey{objectID, versionID}]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove drops an entry; the caller must hold c.mu
+func (c *objectCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
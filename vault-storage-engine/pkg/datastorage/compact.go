@@ -0,0 +1,151 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// CompactionPolicy selects the versions of an object that compaction keeps; every other version is removed
+// A version is kept if it is among the KeepLast newest, or was created after KeepNewerThan when that is set, and the
+// latest version is always kept, so compaction never removes an object
+// Retention locks are checked at Now, or at the system time when it is not set
+type CompactionPolicy struct {
+	KeepLast      int
+	KeepNewerThan time.Time
+	Now           time.Time
+}
+
+// CompactionReport describes what a compaction reclaimed
+type CompactionReport struct {
+	// Versions is the number of versions removed
+	Versions int
+	// Shards is the number of shards deleted, which leaves out the shards of deduplicated content still referenced
+	// by other versions
+	Shards int
+	// Bytes is the stored size of the versions whose shards were deleted
+	Bytes int64
+	// Locked is the number of versions the policy would have removed that are kept under a retention lock
+	Locked int
+}
+
+// add merges the counts of another report into r
+func (r *CompactionReport) add(other CompactionReport) {
+	r.Versions += other.Versions
+	r.Shards += other.Shards
+	r.Bytes += other.Bytes
+	r.Locked += other.Locked
+}
+
+// CompactObject removes every version of an object but the keepLast newest, along with their shards
+// Versions under a retention lock are kept and counted in the report, and objects in the trash are left for
+// PurgeDeleted, with bucket.ErrObjectDeleted returned
+// Each version is removed in its own transaction, metadata first, so readers never see a version whose shards are
+// already gone, and each is recorded in the audit trail
+func CompactObject(db *sql.DB, bucketID, objectID string, keepLast int, store sharding.ShardStore) (CompactionReport, error) {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return CompactionReport{}, err
+	}
+	cleanup := &ShardCleanupError{}
+	report, err := compactObject(db, bucketID, objectID, CompactionPolicy{KeepLast: keepLast}, store, cleanup, zap.L())
+	if err == nil && len(cleanup.Failed) > 0 {
+		return report, cleanup
+	}
+	return report, err
+}
+
+// CompactBucket applies policy to every object in a bucket, as CompactObject does, and returns the combined report
+// Objects in the trash are skipped, and a failure to compact any object stops the compaction there
+func CompactBucket(db *sql.DB, bucketID string, policy CompactionPolicy, store sharding.ShardStore) (CompactionReport, error) {
+	logger := zap.L()
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return CompactionReport{}, err
+	}
+	objects, err := bucket.GetObjectsInBucket(db, bucketID)
+	if err != nil {
+		return CompactionReport{}, fmt.Errorf("failed to retrieve objects from bucket: %w", err)
+	}
+
+	var report CompactionReport
+	cleanup := &ShardCleanupError{}
+	for _, objectID := range objects {
+		compacted, err := compactObject(db, bucketID, objectID, policy, store, cleanup, logger)
+		report.add(compacted)
+		// Objects deleted since the bucket was listed have nothing left to compact
+		if errors.Is(err, bucket.ErrObjectDeleted) || errors.Is(err, bucket.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	logger.Info("Compacted bucket", zap.String("bucket_id", bucketID), zap.Int("versions", report.Versions),
+		zap.Int("shards", report.Shards), zap.Int64("bytes", report.Bytes), zap.Int("locked", report.Locked))
+
+	if len(cleanup.Failed) > 0 {
+		return report, cleanup
+	}
+	return report, nil
+}
+
+// compactObject removes the versions of an object that policy does not keep, recording shards that could not be
+// deleted in cleanup
+func compactObject(db *sql.DB, bucketID, objectID string, policy CompactionPolicy, store sharding.ShardStore, cleanup *ShardCleanupError, logger *zap.Logger) (CompactionReport, error) {
+	var report CompactionReport
+	unlock, err := lockObject(context.Background(), objectID, nil)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	versions, err := bucket.ListVersions(db, bucketID, objectID)
+	if err != nil {
+		return report, err
+	}
+
+	keepLast := max(policy.KeepLast, 1)
+	now := policy.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	for i := 0; i < len(versions)-keepLast; i++ {
+		metadata := &versions[i]
+		if !policy.KeepNewerThan.IsZero() {
+			// A version whose creation date cannot be read is kept, since it cannot be shown to be old enough
+			created, err := time.Parse(time.RFC3339, metadata.CreationDate)
+			if err != nil || created.After(policy.KeepNewerThan) {
+				continue
+			}
+		}
+
+		// The lock is checked again as the version is removed, in case it was locked since it was listed
+		err := bucket.DeleteObjectByVersion(db, bucketID, objectID, metadata.VersionID, now)
+		if errors.Is(err, bucket.ErrVersionLocked) {
+			report.Locked++
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to delete version %s from database, %w", metadata.VersionID, err)
+		}
+		deleted, err := deleteVersionShards(db, metadata, store, cleanup, logger)
+		if err != nil {
+			return report, err
+		}
+
+		report.Versions++
+		report.Shards += deleted
+		if deleted > 0 {
+			report.Bytes += metadata.StoredSize
+		}
+		audit.Record(context.Background(), audit.Event{Operation: audit.OpCompact, BucketID: bucketID, ObjectID: objectID, VersionID: metadata.VersionID, Bytes: versionSize(metadata)}, nil)
+		logger.Info("Compacted version", zap.String("object_id", objectID), zap.String("version_id", metadata.VersionID), zap.Int("shards", deleted))
+	}
+	return report, nil
+}
@@ -0,0 +1,204 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// CopyObject copies a version of an object into another bucket and returns the ID of the new version in the destination
+// If the version was encrypted with the configured cipher under a data key of its own, its shards are copied as they are,
+// server-side for stores that implement sharding.ShardCopier, and the copy shares the source's data key
+// Otherwise the version is retrieved and stored again with the current configuration
+// Every copy is recorded in the audit trail as a copy into the destination bucket
+// A copy that would take the destination bucket over its quota fails with bucket.ErrQuotaExceeded
+// The copy holds the lock of the destination object, as a store of it would
+func CopyObject(db *sql.DB, srcBucketID, srcObjectID, srcVersionID, dstBucketID, dstObjectID string, store sharding.ShardStore, cfg *config.Config) (string, error) {
+	ctx := context.Background()
+	versionID, size, err := copyObject(ctx, db, srcBucketID, srcObjectID, srcVersionID, dstBucketID, dstObjectID, store, cfg)
+	audit.Record(ctx, audit.Event{Operation: audit.OpCopy, BucketID: dstBucketID, ObjectID: dstObjectID, VersionID: versionID, Bytes: size}, err)
+	return versionID, err
+}
+
+// copyObject copies a version for CopyObject, which records it in the audit trail
+// The size of the version is returned alongside the new version ID
+func copyObject(ctx context.Context, db *sql.DB, srcBucketID, srcObjectID, srcVersionID, dstBucketID, dstObjectID string, store sharding.ShardStore, cfg *config.Config) (string, int64, error) {
+	start := time.Now()
+	logger := zap.L()
+
+	unlock, err := lockObject(ctx, dstObjectID, cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	defer unlock()
+
+	if err := checkBucketExists(db, srcBucketID); err != nil {
+		return "", 0, err
+	}
+	if err := checkBucketExists(db, dstBucketID); err != nil {
+		return "", 0, err
+	}
+
+	if err := bucket.CheckObjectNotDeleted(db, srcObjectID); err != nil {
+		return "", 0, err
+	}
+	metadata, err := bucket.GetObjectMetadata(db, srcObjectID, srcVersionID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	size := versionSize(metadata)
+	if err := bucket.CheckBucketQuota(db, dstBucketID, size); err != nil {
+		return "", size, err
+	}
+
+	// The copy is encoded as the destination bucket would encode it
+	dstCfg, _, err := bucketConfig(db, cfg, dstBucketID, metadata.EncodingParams())
+	if err != nil {
+		return "", size, err
+	}
+	if !canCopyShards(metadata, dstCfg) {
+		versionID, err := reencodeCopy(ctx, db, metadata, srcBucketID, dstBucketID, dstObjectID, store, cfg, logger)
+		return versionID, size, err
+	}
+
+	versionID := uuid.New().String()
+	copied, err := copyShards(ctx, store, metadata, dstObjectID, versionID, cfg, logger)
+	if err != nil {
+		cleanupVersionShards(store, copied, logger)
+		return "", size, err
+	}
+
+	// The shards are byte-for-byte identical, so the proofs, data key and layout carry over unchanged, though the data
+	// key is re-wrapped when the destination bucket has a master key of its own
+	copyMetadata := *metadata
+	copyMetadata.BucketID = dstBucketID
+	copyMetadata.ObjectID = dstObjectID
+	copyMetadata.VersionID = versionID
+	copyMetadata.RootVersion = ""
+	copyMetadata.CreationDate = cfg.Now().Format(time.RFC3339)
+	// The copy owns its shards, and does not inherit the source's expiration time or lock
+	copyMetadata.ContentRef = ""
+	copyMetadata.ShardObjectID, copyMetadata.ShardVersionID = "", ""
+	copyMetadata.ExpiresAt = time.Time{}
+	copyMetadata.LockedUntil = time.Time{}
+	if err := rewrapDataKey(db, cfg, &copyMetadata, srcBucketID, dstBucketID); err != nil {
+		cleanupVersionShards(store, copied, logger)
+		return "", size, err
+	}
+
+	if err := commitVersionTx(ctx, db, cfg, dstBucketID, dstObjectID, versionID, copyMetadata, []byte{}); err != nil {
+		cleanupVersionShards(store, copied, logger)
+		return "", size, err
+	}
+
+	metrics.ObserveStore(dstBucketID, size, metadata.CompressedSize, len(copied.ShardLocations), time.Since(start))
+	fmt.Printf("Copied object %s (version %s) in bucket %s to object %s (version %s) in bucket %s\n", srcObjectID, srcVersionID, srcBucketID, dstObjectID, versionID, dstBucketID)
+	return versionID, size, nil
+}
+
+// canCopyShards reports whether the shards of a version can be copied as they are under cfg
+// That requires the version to be encrypted with the configured cipher under a data key of its own;
+// versions encrypted directly with the master key predate data keys, and are re-encrypted instead
+func canCopyShards(metadata *bucket.VersionMetadata, cfg *config.Config) bool {
+	if metadata.WrappedKey == "" {
+		return false
+	}
+	srcCipher, err := encryption.NewCipher(metadata.Cipher)
+	if err != nil {
+		return false
+	}
+	dstCipher, err := encryption.NewCipher(cfg.Cipher)
+	if err != nil {
+		return false
+	}
+	return srcCipher.Name() == dstCipher.Name()
+}
+
+// copyShards copies every shard of a version to dstObjectID and versionID, keeping each in its location
+// It returns the metadata of the shards copied so far, so they can be cleaned up if the copy fails
+func copyShards(ctx context.Context, store sharding.ShardStore, metadata *bucket.VersionMetadata, dstObjectID, versionID string, cfg *config.Config, logger *zap.Logger) (*bucket.VersionMetadata, error) {
+	// Deduplicated versions read the shards of the version that first stored the content
+	srcObjectID, srcVersionID := metadata.ShardOwner()
+	copied := &bucket.VersionMetadata{ObjectID: dstObjectID, VersionID: versionID, ShardLocations: map[string]string{}}
+
+	for shardKey, location := range metadata.AllShardLocations() {
+		if err := ctx.Err(); err != nil {
+			return copied, fmt.Errorf("copy aborted: %w", err)
+		}
+		shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_"))
+		if err != nil {
+			return copied, fmt.Errorf("invalid shard index %s: %w", shardKey, err)
+		}
+		err = withRetry(ctx, store, cfg, logger, func() error {
+			return sharding.CopyShard(ctx, store, srcObjectID, srcVersionID, dstObjectID, versionID, shardIdx, location)
+		})
+		if err != nil {
+			return copied, fmt.Errorf("failed to copy shard %d: %w", shardIdx, err)
+		}
+		copied.ShardLocations[shardKey] = location
+	}
+	return copied, nil
+}
+
+// reencodeCopy copies a version by retrieving it and storing it again with the current configuration
+// The copy keeps the source's redundancy scheme and is written to the locations the source uses
+func reencodeCopy(ctx context.Context, db *sql.DB, metadata *bucket.VersionMetadata, srcBucketID, dstBucketID, dstObjectID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (string, error) {
+	params := metadata.EncodingParams()
+	locations := versionLocations(metadata)
+	// The copy is named and described like the source, whatever options the caller set
+	ctx = WithStoreOptions(ctx, StoreOptions{Filename: metadata.Filename, Format: metadata.Format, ContentType: metadata.ContentType, Metadata: metadata.UserMetadata})
+
+	// Chunked versions are streamed so the copy never holds the whole object in memory
+	if len(metadata.Chunks) > 0 {
+		r, _, size, err := retrieveDataStream(ctx, db, srcBucketID, metadata.ObjectID, metadata.VersionID, store, cfg, logger)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		versionID, _, err := storeDataStream(ctx, db, r, size, dstBucketID, dstObjectID, metadata.Filename, store, cfg, locations, params, logger)
+		return versionID, err
+	}
+
+	data, _, err := retrieveData(ctx, db, srcBucketID, metadata.ObjectID, metadata.VersionID, store, cfg, logger)
+	if err != nil {
+		return "", err
+	}
+	versionID, _, _, err := storeDataWithVersion(ctx, db, data, dstBucketID, dstObjectID, uuid.New().String(), metadata.Filename, store, cfg, locations, params, logger)
+	return versionID, err
+}
+
+// versionLocations returns the distinct locations the shards of a version were written to, in shard order
+func versionLocations(metadata *bucket.VersionMetadata) []string {
+	shardLocations := metadata.AllShardLocations()
+	indexes := make([]int, 0, len(shardLocations))
+	for shardKey := range shardLocations {
+		if shardIdx, err := strconv.Atoi(strings.TrimPrefix(shardKey, "shard_")); err == nil {
+			indexes = append(indexes, shardIdx)
+		}
+	}
+	sort.Ints(indexes)
+
+	var locations []string
+	seen := make(map[string]bool)
+	for _, shardIdx := range indexes {
+		location := shardLocations[fmt.Sprintf("shard_%d", shardIdx)]
+		if !seen[location] {
+			seen[location] = true
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
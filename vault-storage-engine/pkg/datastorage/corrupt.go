@@ -0,0 +1,75 @@
+package datastorage
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"go.uber.org/zap"
+)
+
+// ErrCorrupted is returned when every shard needed to reconstruct a unit was read, but the shards hold corrupted data
+// that could not be worked around using parity
+var ErrCorrupted = errors.New("object data is corrupted")
+
+// decodeShards reconstructs the missing shards of a unit and turns them into its plaintext with decode
+// A shard can be subtly corrupted and still decode, which only shows up as a parity mismatch, or once the payload is
+// decompressed or checksummed
+// When that happens and the unit has Merkle proofs recorded, the shards that fail verification are set aside and the
+// unit is reconstructed again from parity without them; ErrCorrupted is returned if that is impossible or fails too
+// The complete set of shards the plaintext was decoded from is returned with it, for read repair
+func decodeShards(shards [][]byte, layout shardLayout, coder erasurecoding.ErasureCoder, decode func(shards [][]byte) ([]byte, error), logger *zap.Logger) ([]byte, [][]byte, error) {
+	// Reconstruction fills in the missing shards, so the shards as read are kept for a second attempt
+	read := append([][]byte(nil), shards...)
+	attempt := func(shards [][]byte) ([]byte, error) {
+		if err := reconstructShards(shards, coder); err != nil {
+			return nil, err
+		}
+		return decode(shards)
+	}
+	plainText, err := attempt(shards)
+	if err == nil {
+		return plainText, shards, nil
+	}
+	if !isCorruption(err) {
+		return nil, nil, err
+	}
+
+	if layout.root == "" {
+		return nil, nil, fmt.Errorf("%w: no proofs recorded to find the corrupted shards: %w", ErrCorrupted, err)
+	}
+	suspect := 0
+	for i, shard := range read {
+		if shard == nil {
+			continue
+		}
+		if verifyErr := layout.verify(i, shard); verifyErr != nil {
+			logger.Warn("Discarding corrupted shard", zap.Int("shard", layout.base+i), zap.Error(verifyErr))
+			read[i] = nil
+			suspect++
+		}
+	}
+	if suspect == 0 {
+		return nil, nil, fmt.Errorf("%w: every shard passed proof verification: %w", ErrCorrupted, err)
+	}
+	plainText, err = attempt(read)
+	if errors.Is(err, ErrInsufficientShards) {
+		return nil, nil, fmt.Errorf("%w: %d shards failed proof verification, too many to reconstruct from parity", ErrCorrupted, suspect)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: still failing after discarding %d shards: %w", ErrCorrupted, suspect, err)
+	}
+	return plainText, read, nil
+}
+
+// isCorruption reports whether err from decoding a unit points at corrupted data, rather than at missing shards or
+// a misconfiguration
+func isCorruption(err error) bool {
+	var flateErr flate.CorruptInputError
+	return errors.Is(err, erasurecoding.ErrParityMismatch) || errors.Is(err, ErrChecksumMismatch) ||
+		errors.Is(err, ErrSizeMismatch) || errors.Is(err, compression.ErrDecompressionTooLarge) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &flateErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -1,76 +1,230 @@
 package datastorage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
 	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
 	"go.uber.org/zap"
 )
 
+// ShardCleanupError reports shards that could not be removed from their store
+// It is returned after the metadata has already been removed, so the shards it lists are orphans
+type ShardCleanupError struct {
+	Failed []string
+	Errs   []error
+}
+
+func (e *ShardCleanupError) Error() string {
+	return fmt.Sprintf("metadata removed but %d shards could not be deleted: %v", len(e.Failed), errors.Join(e.Errs...))
+}
+
+func (e *ShardCleanupError) Unwrap() []error {
+	return e.Errs
+}
+
 // Delete a bucket
-func DeleteBucket(db *sql.DB, bucketID string, store sharding.ShardStore, logger *zap.Logger) error {
+// The bucket and each of its objects are recorded in the audit trail, attributed to the principal set on ctx
+// That principal needs acl.PermDelete on the bucket itself; grants on its objects are not enough
+// Retention locks are checked at cfg.Now(), as they are by DeleteObject and DeleteVersion
+func DeleteBucket(ctx context.Context, db *sql.DB, bucketID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	err := deleteBucket(ctx, db, bucketID, store, cfg, logger)
+	audit.Record(ctx, audit.Event{Operation: audit.OpDeleteBucket, BucketID: bucketID}, err)
+	return err
+}
+
+// deleteBucket deletes a bucket for DeleteBucket, which records it in the audit trail
+// Deleting a bucket is permanent, so its objects are removed with their shards rather than moved to the trash, and
+// so are the objects already in its trash
+func deleteBucket(ctx context.Context, db *sql.DB, bucketID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	if err := authorizeBucket(ctx, db, bucketID, acl.PermDelete); err != nil {
+		return err
+	}
 	objects, err := bucket.GetObjectsInBucket(db, bucketID)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve objects from bucket: %w", err)
 	}
 
 	for _, objectID := range objects {
-		versionID, err := bucket.GetRootVersion(db, objectID)
-		if err != nil {
-			return fmt.Errorf("failed to get object version, %w", err)
+		var size int64
+		unlock, err := lockObject(ctx, objectID, cfg)
+		if err == nil {
+			size, err = removeObject(db, bucketID, objectID, store, cfg.Now(), logger)
+			unlock()
 		}
-		err = DeleteObject(db, bucketID, objectID, versionID, store, logger)
+		audit.Record(ctx, audit.Event{Operation: audit.OpDeleteObject, BucketID: bucketID, ObjectID: objectID, Bytes: size}, err)
 		if err != nil {
-			logger.Warn("failed to delete object", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Error(err))
+			logger.Warn("failed to delete object", zap.String("object_id", objectID), zap.Error(err))
 		}
 	}
 
-	err = bucket.DeleteBucket(db, bucketID)
+	err = bucket.DeleteBucket(db, bucketID, cfg.Now())
 	if err != nil {
 		return fmt.Errorf("failed to delete bucket from database, %w", err)
 	}
 	return nil
 }
 
-// Deelete all versions of an object
-func DeleteObject(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, logger *zap.Logger) error {
-	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+// DeleteObject deletes all versions of an object, along with their shards
+// In a bucket with a trash retention set by bucket.SetTrashRetention, the object is moved to the trash instead, where
+// it stays hidden, with its shards, until it is restored with bucket.RestoreObject or reclaimed by PurgeDeleted
+// Shards that cannot be deleted are reported in a *ShardCleanupError, but the metadata is still removed
+// If any version is still under a retention lock nothing is deleted, and bucket.ErrVersionLocked is returned
+// The deletion is recorded in the audit trail with the combined size of the versions, attributed to the principal set on ctx,
+// which needs acl.PermDelete on the object
+// The lock of the object is held while it is deleted, as for StoreData, and so it is by DeleteVersion and DeleteBucket
+func DeleteObject(ctx context.Context, db *sql.DB, bucketID, objectID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	var size int64
+	err := authorize(ctx, db, bucketID, objectID, acl.PermDelete)
+	if err == nil {
+		size, err = deleteObject(ctx, db, bucketID, objectID, store, cfg, logger)
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpDeleteObject, BucketID: bucketID, ObjectID: objectID, Bytes: size}, err)
+	return err
+}
+
+// deleteObject deletes an object for DeleteObject and returns the combined size of its versions
+func deleteObject(ctx context.Context, db *sql.DB, bucketID, objectID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	unlock, err := lockObject(ctx, objectID, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to retieve metadata file, %w", err)
+		return 0, err
 	}
+	defer unlock()
 
-	for shardKey, location := range metadata.ShardLocations {
-		shardIdxStr := strings.TrimPrefix(shardKey, "shard_")
-		shardIdx, err := strconv.Atoi(shardIdxStr)
+	retention, err := bucket.GetTrashRetention(db, bucketID)
+	if err != nil {
+		return 0, err
+	}
+	if retention > 0 {
+		return bucket.TrashObject(db, bucketID, objectID, cfg.Now())
+	}
+	return removeObject(db, bucketID, objectID, store, cfg.Now(), logger)
+}
+
+// removeObject permanently removes an object and the shards of its versions, and returns their combined size
+// Retention locks are checked at now
+func removeObject(db *sql.DB, bucketID, objectID string, store sharding.ShardStore, now time.Time, logger *zap.Logger) (int64, error) {
+	versions, err := bucket.ListObjectVersions(db, objectID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list object versions, %w", err)
+	}
+
+	// Every version is checked for a lock before any shard is touched, so a locked object is left intact
+	metadatas := make([]*bucket.VersionMetadata, 0, len(versions))
+	for _, versionID := range versions {
+		metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
 		if err != nil {
-			logger.Warn("invalid shard index", zap.String("shardKey", shardKey), zap.Error(err))
-			continue
+			return 0, fmt.Errorf("failed to retieve metadata file, %w", err)
 		}
-		delShardErr := store.DeleteShard(objectID, shardIdx, location)
-		if delShardErr != nil {
-			logger.Warn("failed to delete shards", zap.String("shard", shardKey), zap.String("location", location), zap.Error(err))
+		if err := bucket.CheckVersionUnlocked(metadata, now); err != nil {
+			return 0, err
 		}
+		metadatas = append(metadatas, metadata)
 	}
 
-	err = bucket.DeleteObject(db, bucketID, objectID)
+	var size int64
+	cleanup := &ShardCleanupError{}
+	for _, metadata := range metadatas {
+		if _, err := deleteVersionShards(db, metadata, store, cleanup, logger); err != nil {
+			return size, err
+		}
+		size += versionSize(metadata)
+	}
+
+	err = bucket.DeleteObject(db, bucketID, objectID, now)
 	if err != nil {
-		return fmt.Errorf("failed to delete object from database, %w", err)
+		return size, fmt.Errorf("failed to delete object from database, %w", err)
 	}
 
-	return nil
+	if len(cleanup.Failed) > 0 {
+		return size, cleanup
+	}
+	return size, nil
+}
+
+// DeleteVersion deletes a single version of an object, along with its shards
+// Shards that cannot be deleted are reported in a *ShardCleanupError, but the metadata is still removed
+// A version still under a retention lock is not deleted, and bucket.ErrVersionLocked is returned
+// The deletion is recorded in the audit trail, attributed to the principal set on ctx, which needs acl.PermDelete as
+// for DeleteObject
+func DeleteVersion(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	var size int64
+	err := authorize(ctx, db, bucketID, objectID, acl.PermDelete)
+	if err == nil {
+		size, err = deleteVersion(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpDeleteVersion, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: size}, err)
+	return err
 }
 
-func DeleteObjectByVersion(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, logger *zap.Logger) error {
+// deleteVersion deletes a version for DeleteVersion and returns its size
+func deleteVersion(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	unlock, err := lockObject(ctx, objectID, cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
 	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
 	if err != nil {
-		return fmt.Errorf("failed to retieve metadata file, %w", err)
+		return 0, fmt.Errorf("failed to retieve metadata file, %w", err)
+	}
+	now := cfg.Now()
+	if err := bucket.CheckVersionUnlocked(metadata, now); err != nil {
+		return 0, err
+	}
+
+	cleanup := &ShardCleanupError{}
+	if _, err := deleteVersionShards(db, metadata, store, cleanup, logger); err != nil {
+		return 0, err
+	}
+
+	err = bucket.DeleteObjectByVersion(db, bucketID, objectID, versionID, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete object from database, %w", err)
+	}
+
+	size := versionSize(metadata)
+	if len(cleanup.Failed) > 0 {
+		return size, cleanup
 	}
+	return size, nil
+}
+
+// versionSize returns the original size of a version, or zero if it was not recorded
+func versionSize(metadata *bucket.VersionMetadata) int64 {
+	size, _ := strconv.ParseInt(metadata.Filesize, 10, 64)
+	return size
+}
+
+// deleteVersionShards deletes every shard of a version, recording failures in cleanup, and returns the number deleted
+// Shards shared by deduplicated versions are only deleted once the last version referencing them is gone
+// The version is dropped from the retrieve cache whether or not its shards go with it
+func deleteVersionShards(db *sql.DB, metadata *bucket.VersionMetadata, store sharding.ShardStore, cleanup *ShardCleanupError, logger *zap.Logger) (int, error) {
+	retrieveCache.invalidate(metadata.ObjectID, metadata.VersionID)
 
-	for shardKey, location := range metadata.ShardLocations {
+	if metadata.ContentRef != "" {
+		refs, err := bucket.ReleaseContentRef(db, metadata.ContentRef)
+		if err != nil {
+			return 0, err
+		}
+		if refs > 0 {
+			return 0, nil
+		}
+	}
+
+	objectID, versionID := metadata.ShardOwner()
+	deleted := 0
+	for shardKey, location := range metadata.AllShardLocations() {
 		shardIdxStr := strings.TrimPrefix(shardKey, "shard_")
 		shardIdx, err := strconv.Atoi(shardIdxStr)
 		if err != nil {
@@ -79,14 +233,12 @@ func DeleteObjectByVersion(db *sql.DB, bucketID, objectID, versionID string, sto
 		}
 		delShardErr := store.DeleteShardByVersion(objectID, versionID, shardIdx, location)
 		if delShardErr != nil {
-			logger.Warn("failed to delete shards", zap.String("shard", shardKey), zap.String("location", location), zap.Error(err))
+			logger.Warn("failed to delete shards", zap.String("shard", shardKey), zap.String("location", location), zap.Error(delShardErr))
+			cleanup.Failed = append(cleanup.Failed, fmt.Sprintf("%s/%s@%s", versionID, shardKey, location))
+			cleanup.Errs = append(cleanup.Errs, delShardErr)
+			continue
 		}
+		deleted++
 	}
-
-	err = bucket.DeleteObjectByVersion(db, bucketID, objectID, versionID)
-	if err != nil {
-		return fmt.Errorf("failed to delete object from database, %w", err)
-	}
-
-	return nil
+	return deleted, nil
 }
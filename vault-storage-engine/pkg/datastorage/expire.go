@@ -0,0 +1,64 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// expirationKey is the context key under which WithExpiration records an expiration time
+type expirationKey struct{}
+
+// WithExpiration returns a context that makes every version stored with it expire at expiresAt
+// Expired versions are removed by SweepExpired
+func WithExpiration(ctx context.Context, expiresAt time.Time) context.Context {
+	return context.WithValue(ctx, expirationKey{}, expiresAt)
+}
+
+// expirationFrom returns the expiration time set on ctx, or the zero time if the version should never expire
+func expirationFrom(ctx context.Context) time.Time {
+	expiresAt, _ := ctx.Value(expirationKey{}).(time.Time)
+	return expiresAt
+}
+
+// SweepExpired deletes every version whose expiration time is at or before now, along with its shards
+// It returns the number of versions reclaimed
+// Each version is removed in its own transaction after checking it is still expired, and versions locked by a
+// concurrent writer are skipped until the next sweep; versions still being stored are invisible until committed
+// The metadata is removed before the shards, so readers never see a version whose shards are already gone
+func SweepExpired(db *sql.DB, store sharding.ShardStore, now time.Time) (int, error) {
+	logger := zap.L()
+
+	expired, err := bucket.ListExpiredVersions(db, now)
+	if err != nil {
+		return 0, err
+	}
+
+	reclaimed := 0
+	cleanup := &ShardCleanupError{}
+	for _, candidate := range expired {
+		metadata, err := bucket.ClaimExpiredVersion(db, candidate.BucketID, candidate.ObjectID, candidate.VersionID, now)
+		if err != nil {
+			return reclaimed, err
+		}
+		if metadata == nil {
+			continue
+		}
+		if _, err := deleteVersionShards(db, metadata, store, cleanup, logger); err != nil {
+			return reclaimed, err
+		}
+		reclaimed++
+		audit.Record(context.Background(), audit.Event{Operation: audit.OpExpire, BucketID: metadata.BucketID, ObjectID: metadata.ObjectID, VersionID: metadata.VersionID, Bytes: versionSize(metadata)}, nil)
+		logger.Info("Reclaimed expired version", zap.String("object_id", metadata.ObjectID), zap.String("version_id", metadata.VersionID), zap.Time("expires_at", metadata.ExpiresAt))
+	}
+
+	if len(cleanup.Failed) > 0 {
+		return reclaimed, cleanup
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,297 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// fsListPageSize is the number of objects read per page when a directory of a FS is listed
+const fsListPageSize = 1000
+
+// FS is a read-only fs.FS over the vault, for code written against the standard filesystem interfaces
+// The root holds a directory per bucket, and each bucket a file per object, named by its object ID and holding the
+// content of its latest version; object IDs containing slashes appear in subdirectories, which exist only as long
+// as some object ID has them as a prefix, and an object named like such a directory hides it
+// Objects in the trash are left out, and so are objects whose ID is not a valid fs path, since no name could open them
+// Files are read with RetrieveDataStream, so every one opened is recorded in the audit trail, attributed to the
+// principal set on the context the FS was created with, which needs acl.PermRead on the object as for RetrieveData
+type FS struct {
+	ctx    context.Context
+	db     *sql.DB
+	store  sharding.ShardStore
+	cfg    *config.Config
+	logger *zap.Logger
+}
+
+// NewFS creates a FS reading from db and store under cfg, with ctx passed to every retrieval
+func NewFS(ctx context.Context, db *sql.DB, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) *FS {
+	return &FS{ctx: ctx, db: db, store: store, cfg: cfg, logger: logger}
+}
+
+// Open opens the named bucket, object or directory of object IDs
+// Files have the metadata of the version they read as the Sys of their fs.FileInfo, and directories implement
+// fs.ReadDirFile
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		entries, err := fsys.readDir(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &fsDir{info: info, entries: entries}, nil
+	}
+
+	bucketID, objectID, _ := strings.Cut(name, "/")
+	metadata := info.Sys().(*bucket.VersionMetadata)
+	r, _, err := RetrieveDataStream(fsys.ctx, fsys.db, bucketID, objectID, metadata.VersionID, fsys.store, fsys.cfg, fsys.logger)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fsError(err)}
+	}
+	return &fsFile{info: info, r: r}, nil
+}
+
+// Stat returns the fs.FileInfo of the named bucket, object or directory without retrieving anything
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := fsys.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadDir lists the named directory, sorted by name, through the listing API rather than by opening it
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := fsys.stat(name)
+	if err == nil && !info.IsDir() {
+		err = errors.New("not a directory")
+	}
+	var entries []fs.DirEntry
+	if err == nil {
+		entries, err = fsys.readDir(name)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// stat resolves a valid path to the directory or object it names
+func (fsys *FS) stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return &fsInfo{name: ".", dir: true}, nil
+	}
+	bucketID, objectID, nested := strings.Cut(name, "/")
+	if err := checkBucketExists(fsys.db, bucketID); err != nil {
+		return nil, fsError(err)
+	}
+	if !nested {
+		return &fsInfo{name: bucketID, dir: true}, nil
+	}
+
+	// An object of that ID wins over a directory of IDs under it
+	metadata, err := bucket.GetLatestMetadata(fsys.db, bucketID, objectID)
+	if err == nil {
+		err = bucket.CheckObjectNotDeleted(fsys.db, objectID)
+	}
+	if err == nil {
+		created, _ := time.Parse(time.RFC3339, metadata.CreationDate)
+		return &fsInfo{name: path.Base(objectID), size: versionSize(&metadata), modTime: created, metadata: &metadata}, nil
+	}
+	if !errors.Is(err, bucket.ErrObjectNotFound) && !errors.Is(err, bucket.ErrObjectDeleted) {
+		return nil, fsError(err)
+	}
+
+	entries, err := fsys.listObjects(bucketID, objectID+"/", 1)
+	if err != nil {
+		return nil, fsError(err)
+	}
+	if len(entries) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return &fsInfo{name: path.Base(objectID), dir: true}, nil
+}
+
+// readDir lists the entries of a directory stat has resolved
+func (fsys *FS) readDir(name string) ([]fs.DirEntry, error) {
+	if name == "." {
+		bucketIDs, err := bucket.ListBuckets(fsys.db)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]fs.DirEntry, 0, len(bucketIDs))
+		for _, bucketID := range bucketIDs {
+			if fs.ValidPath(bucketID) && !strings.Contains(bucketID, "/") {
+				entries = append(entries, &fsEntry{fsys: fsys, path: bucketID, dir: true})
+			}
+		}
+		return entries, nil
+	}
+
+	bucketID, prefix, nested := strings.Cut(name, "/")
+	if nested {
+		prefix += "/"
+	}
+	entries, err := fsys.listObjects(bucketID, prefix, -1)
+	if err != nil {
+		return nil, fsError(err)
+	}
+	return entries, nil
+}
+
+// listObjects returns the entries a directory of a bucket holds under prefix, sorted by name, reading no further
+// than needed to find limit of them, or every one for a negative limit
+// Each object whose ID extends prefix with a single element is a file, and each that extends it with several puts a
+// directory under the first of them
+func (fsys *FS) listObjects(bucketID, prefix string, limit int) ([]fs.DirEntry, error) {
+	seen := make(map[string]*fsEntry)
+	cursor := ""
+	for {
+		page, err := bucket.ListObjectsPage(fsys.db, bucketID, cursor, fsListPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Objects {
+			rest, ok := strings.CutPrefix(object.ObjectID, prefix)
+			if !ok || !fs.ValidPath(object.ObjectID) {
+				continue
+			}
+			elem, _, dir := strings.Cut(rest, "/")
+			// The file of an object wins over a directory of the same name, as when it is opened
+			if entry, ok := seen[elem]; ok && !entry.dir {
+				continue
+			}
+			seen[elem] = &fsEntry{fsys: fsys, path: bucketID + "/" + prefix + elem, dir: dir}
+		}
+		if page.NextCursor == "" || (limit >= 0 && len(seen) >= limit) {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	entries := make([]fs.DirEntry, 0, len(seen))
+	for _, entry := range seen {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fsError maps the errors of the vault onto those of the fs package, keeping the original error in the chain
+func fsError(err error) error {
+	switch {
+	case errors.Is(err, bucket.ErrBucketNotFound), errors.Is(err, bucket.ErrObjectNotFound), errors.Is(err, bucket.ErrObjectDeleted):
+		return fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	case errors.Is(err, acl.ErrAccessDenied):
+		return fmt.Errorf("%w: %w", fs.ErrPermission, err)
+	}
+	return err
+}
+
+// fsInfo is the fs.FileInfo of a bucket, object or directory of a FS
+type fsInfo struct {
+	name     string
+	size     int64
+	dir      bool
+	modTime  time.Time
+	metadata *bucket.VersionMetadata
+}
+
+func (i *fsInfo) Name() string       { return i.name }
+func (i *fsInfo) Size() int64        { return i.size }
+func (i *fsInfo) ModTime() time.Time { return i.modTime }
+func (i *fsInfo) IsDir() bool        { return i.dir }
+func (i *fsInfo) Sys() any           { return i.metadata }
+
+// Mode reports every file and directory as read-only, since a FS cannot write
+func (i *fsInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// fsEntry is an entry of a directory listing of a FS, whose info is only looked up when asked for
+type fsEntry struct {
+	fsys *FS
+	path string
+	dir  bool
+}
+
+func (e *fsEntry) Name() string { return path.Base(e.path) }
+func (e *fsEntry) IsDir() bool  { return e.dir }
+
+func (e *fsEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *fsEntry) Info() (fs.FileInfo, error) {
+	return e.fsys.Stat(e.path)
+}
+
+// fsFile is an object opened from a FS
+type fsFile struct {
+	info fs.FileInfo
+	r    io.ReadCloser
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *fsFile) Close() error               { return f.r.Close() }
+
+// fsDir is a directory opened from a FS, listed as it was when it was opened
+type fsDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of the directory, or all that remain for n <= 0, as fs.ReadDirFile describes
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,39 @@
+package datastorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+)
+
+// idempotencyCutoff returns the time before which idempotency keys have expired under cfg
+func idempotencyCutoff(cfg *config.Config, now time.Time) time.Time {
+	window := cfg.IdempotencyWindow
+	if window <= 0 {
+		window = config.DefaultIdempotencyWindow
+	}
+	return now.Add(-window)
+}
+
+// priorStore returns the version an earlier store of an object created under the idempotency key set on ctx, or nil
+// if no key is set or no store within the window recorded it
+func priorStore(ctx context.Context, db bucket.Querier, cfg *config.Config, bucketID, objectID string) (*bucket.VersionMetadata, error) {
+	key := storeOptionsFrom(ctx).IdempotencyKey
+	if key == "" {
+		return nil, nil
+	}
+	return bucket.LookupIdempotencyKey(db, bucketID, key, objectID, idempotencyCutoff(cfg, cfg.Now()))
+}
+
+// recordStore records the version a store created under the idempotency key set on ctx, if there is one
+// db should be the transaction the version is committed in, so the key is never recorded for a version that is not
+func recordStore(ctx context.Context, db bucket.Querier, cfg *config.Config, bucketID, objectID, versionID string) error {
+	key := storeOptionsFrom(ctx).IdempotencyKey
+	if key == "" {
+		return nil
+	}
+	now := cfg.Now()
+	return bucket.RecordIdempotencyKey(db, bucketID, key, objectID, versionID, now, idempotencyCutoff(cfg, now))
+}
@@ -0,0 +1,92 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+)
+
+// IterateShards retrieves every shard of an object version in shard index order and calls fn with each one, along
+// with its index and the location it was read from, stopping at the first error fn returns and returning it
+// Shards are yielded as they are stored, without being verified against their Merkle proofs; streamed versions yield
+// the shards of every chunk, indexed as they are recorded in the chunk metadata
+// Deduplicated versions yield the shards they share with the version that first stored the content, and a shard that
+// has no recorded location or cannot be read stops the iteration
+func IterateShards(db *sql.DB, store sharding.ShardStore, bucketID, objectID, versionID string, fn func(idx int, location string, shard []byte) error) error {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	ctx := context.Background()
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+
+	for _, layout := range versionLayouts(metadata) {
+		for i := 0; i < layout.params.TotalShards(); i++ {
+			shardIdx := layout.base + i
+			location, ok := layout.locations[fmt.Sprintf("shard_%d", shardIdx)]
+			if !ok {
+				return fmt.Errorf("no location recorded for shard %d", shardIdx)
+			}
+			shard, err := store.RetrieveShard(ctx, shardObjectID, shardVersionID, shardIdx, location)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve shard %d from location %s: %w", shardIdx, location, err)
+			}
+			if err := fn(shardIdx, location, shard); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ErrShardCorrupted is returned by GetRawShard, along with the shard, when the shard fails its Merkle proof
+var ErrShardCorrupted = errors.New("shard is corrupted")
+
+// GetRawShard reads a single shard of an object version as it is stored, and returns it with the location it was read
+// from, for inspecting damage when the version cannot be reconstructed
+// A shard that does not match its Merkle proof is still returned, with an error wrapping ErrShardCorrupted; shards of
+// versions stored before Merkle roots were recorded cannot be verified, and are returned as they are
+// Shards are indexed as in ShardLocations, across every chunk of a streamed version
+func GetRawShard(db *sql.DB, store sharding.ShardStore, bucketID, objectID, versionID string, shardIdx int) ([]byte, string, error) {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return nil, "", err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+
+	for _, layout := range versionLayouts(metadata) {
+		i := shardIdx - layout.base
+		if i < 0 || i >= layout.params.TotalShards() {
+			continue
+		}
+		location, ok := layout.locations[fmt.Sprintf("shard_%d", shardIdx)]
+		if !ok {
+			return nil, "", fmt.Errorf("no location recorded for shard %d", shardIdx)
+		}
+		shard, err := store.RetrieveShard(context.Background(), shardObjectID, shardVersionID, shardIdx, location)
+		if err != nil {
+			return nil, location, fmt.Errorf("failed to retrieve shard %d from location %s: %w", shardIdx, location, err)
+		}
+		if layout.root == "" {
+			return shard, location, nil
+		}
+		if err := layout.verify(i, shard); err != nil {
+			return shard, location, fmt.Errorf("%w: shard %d at location %s: %w", ErrShardCorrupted, shardIdx, location, err)
+		}
+		return shard, location, nil
+	}
+	return nil, "", fmt.Errorf("version %s of object %s has no shard %d", versionID, objectID, shardIdx)
+}
@@ -0,0 +1,69 @@
+package datastorage
+
+import (
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+)
+
+// newDataKey generates a data-encryption key for a new version in a bucket and wraps it with the bucket's master key
+// The payload is encrypted with the returned key, and only the wrapped form is recorded in metadata
+func newDataKey(db bucket.Querier, cfg *config.Config, bucketID string) ([]byte, string, error) {
+	masterKey, err := bucket.GetBucketEncryptionKey(db, cfg, bucketID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	dek, err := encryption.GenerateKey()
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := encryption.WrapKey(dek, masterKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return dek, wrapped, nil
+}
+
+// versionKey returns the key the payload of a version in a bucket was encrypted with
+// Versions stored before envelope encryption have no wrapped key and were encrypted with the master key directly
+func versionKey(db bucket.Querier, cfg *config.Config, bucketID string, metadata *bucket.VersionMetadata) ([]byte, error) {
+	masterKey, err := bucket.GetBucketEncryptionKey(db, cfg, bucketID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	if metadata.WrappedKey == "" {
+		return masterKey, nil
+	}
+
+	dek, err := encryption.UnwrapKey(metadata.WrappedKey, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dek, nil
+}
+
+// rewrapDataKey re-wraps the data key of a version taken from srcBucketID, such as a copy or a reference to shared
+// content, so it can be unwrapped with the master key of dstBucketID
+// Buckets only have master keys of their own when they are derived from a passphrase, so otherwise nothing changes
+func rewrapDataKey(db bucket.Querier, cfg *config.Config, metadata *bucket.VersionMetadata, srcBucketID, dstBucketID string) error {
+	if cfg.EncryptionPassphrase == "" || srcBucketID == dstBucketID || metadata.WrappedKey == "" {
+		return nil
+	}
+
+	dek, err := versionKey(db, cfg, srcBucketID, metadata)
+	if err != nil {
+		return err
+	}
+	dstKey, err := bucket.GetBucketEncryptionKey(db, cfg, dstBucketID)
+	if err != nil {
+		return fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	metadata.WrappedKey, err = encryption.WrapKey(dek, dstKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// ValidateObjectLocations checks that every location recorded in the metadata of an object version still holds the
+// shards recorded there
+// Shards are looked up under the location names they were stored with, so after locations are reconfigured, moved or
+// removed, the returned list names every location that is missing one or more of its shards, each once and sorted
+// An empty list means every recorded shard was found; shards are only looked up, not verified, which ScrubObject does
+// A location that cannot be checked, for a reason other than the shard not being there, fails the validation
+func ValidateObjectLocations(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore) ([]string, error) {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return nil, err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	ctx := context.Background()
+	// Deduplicated versions share the shards of the version that first stored the content
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+
+	drifted := make(map[string]bool)
+	for _, layout := range versionLayouts(metadata) {
+		for i := 0; i < layout.params.TotalShards(); i++ {
+			shardIdx := layout.base + i
+			location, ok := layout.locations[fmt.Sprintf("shard_%d", shardIdx)]
+			if !ok || drifted[location] {
+				continue
+			}
+			_, err := store.RetrieveShard(ctx, shardObjectID, shardVersionID, shardIdx, location)
+			if errors.Is(err, sharding.ErrShardNotFound) {
+				drifted[location] = true
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to check shard %d at location %s: %w", shardIdx, location, err)
+			}
+		}
+	}
+
+	locations := make([]string, 0, len(drifted))
+	for location := range drifted {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	if len(locations) > 0 {
+		zap.L().Warn("Recorded shard locations are missing shards", zap.String("object_id", objectID),
+			zap.String("version_id", versionID), zap.Strings("locations", locations))
+	}
+	return locations, nil
+}
@@ -0,0 +1,138 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// MigrateOptions controls what MigrateObject does with the shards it has moved
+type MigrateOptions struct {
+	// DeleteSource deletes each shard from the source store once the metadata points at its copy in the destination
+	DeleteSource bool
+}
+
+// migratedShard is a shard MigrateObject found or copied in the destination store
+type migratedShard struct {
+	idx          int
+	fromLocation string
+	toLocation   string
+}
+
+// MigrateObject moves the shards of an object version from src to dst, dealing them out to newLocations in order
+// Every shard is verified against its Merkle proof when it is read from src and again once it is read back from dst,
+// and ShardLocations is only pointed at the new locations once every shard is in dst, so the version stays readable
+// from src throughout; reads served through a sharding.MultiShardStore over dst and src keep working before and after
+// Shards already in dst at their new location and matching their proof are skipped, so an interrupted migration can
+// simply be run again; versions stored before Merkle roots were recorded cannot be checked, and are always copied
+// Versions sharing deduplicated content move the shared shards, and every version sharing them is updated
+func MigrateObject(db *sql.DB, bucketID, objectID, versionID string, src, dst sharding.ShardStore, newLocations []string, opts MigrateOptions) error {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return err
+	}
+	if len(newLocations) == 0 {
+		return fmt.Errorf("no storage locations configured")
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	ctx := context.Background()
+	logger := zap.L()
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+	placement := sharding.RoundRobinPlacement{}
+
+	locations := make(map[string]string)
+	var migrated []migratedShard
+	skipped := 0
+	for _, layout := range versionLayouts(metadata) {
+		totalShards := layout.params.TotalShards()
+		for i := 0; i < totalShards; i++ {
+			shardIdx := layout.base + i
+			shardKey := fmt.Sprintf("shard_%d", shardIdx)
+			location, ok := layout.locations[shardKey]
+			if !ok {
+				return fmt.Errorf("no location recorded for shard %d, the version must be repaired before it is migrated", shardIdx)
+			}
+			newLocation := placement.Assign(i, totalShards, newLocations)
+			if location != newLocation {
+				locations[shardKey] = newLocation
+			}
+
+			// checkShard verifies a copy of the shard against its proof, or against want where it has none
+			checkShard := func(shard, want []byte) error {
+				if layout.root == "" {
+					if want != nil && !bytes.Equal(shard, want) {
+						return fmt.Errorf("shard does not match the data written")
+					}
+					return nil
+				}
+				return layout.verify(i, shard)
+			}
+
+			// A shard copied by an earlier run is still deleted from src below, in case that run stopped before it was
+			moved := migratedShard{idx: shardIdx, fromLocation: location, toLocation: newLocation}
+			if layout.root != "" {
+				if shard, err := dst.RetrieveShard(ctx, shardObjectID, shardVersionID, shardIdx, newLocation); err == nil && checkShard(shard, nil) == nil {
+					migrated = append(migrated, moved)
+					skipped++
+					continue
+				}
+			}
+
+			shard, err := src.RetrieveShard(ctx, shardObjectID, shardVersionID, shardIdx, location)
+			if err != nil {
+				return fmt.Errorf("failed to read shard %d from location %s: %w", shardIdx, location, err)
+			}
+			if err := checkShard(shard, nil); err != nil {
+				return fmt.Errorf("shard %d at location %s is corrupt, the version must be repaired before it is migrated: %w", shardIdx, location, err)
+			}
+			if err := dst.StoreShard(ctx, shardObjectID, shardVersionID, shardIdx, shard, newLocation); err != nil {
+				return fmt.Errorf("failed to write shard %d to location %s: %w", shardIdx, newLocation, err)
+			}
+			copied, err := dst.RetrieveShard(ctx, shardObjectID, shardVersionID, shardIdx, newLocation)
+			if err != nil {
+				return fmt.Errorf("failed to read back shard %d from location %s: %w", shardIdx, newLocation, err)
+			}
+			if err := checkShard(copied, shard); err != nil {
+				return fmt.Errorf("shard %d written to location %s failed verification: %w", shardIdx, newLocation, err)
+			}
+			migrated = append(migrated, moved)
+		}
+	}
+
+	if len(locations) > 0 {
+		if err := bucket.UpdateShardLocations(db, objectID, versionID, locations); err != nil {
+			return err
+		}
+	}
+	logger.Info("Migrated object", zap.String("object_id", objectID), zap.String("version_id", versionID),
+		zap.Int("shards", len(migrated)-skipped), zap.Int("skipped", skipped))
+
+	if !opts.DeleteSource {
+		return nil
+	}
+	var failed []error
+	for _, shard := range migrated {
+		// A shard migrated within one store to the location it was already at is the copy now recorded
+		if src == dst && shard.fromLocation == shard.toLocation {
+			continue
+		}
+		if err := src.DeleteShardByVersion(shardObjectID, shardVersionID, shard.idx, shard.fromLocation); err != nil {
+			logger.Warn("failed to delete migrated shard", zap.Int("shard", shard.idx), zap.String("location", shard.fromLocation), zap.Error(err))
+			failed = append(failed, fmt.Errorf("shard %d at location %s: %w", shard.idx, shard.fromLocation, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("object migrated but %d shards could not be deleted from the source store: %w", len(failed), errors.Join(failed...))
+	}
+	return nil
+}
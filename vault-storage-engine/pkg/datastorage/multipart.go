@@ -0,0 +1,292 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// MaxMultipartParts is the highest part number a multipart upload accepts
+const MaxMultipartParts = 10000
+
+// MultipartUploader stores large objects as parts that are uploaded independently, in any order, and retried on their own
+// Each part is compressed, encrypted and erasure coded like a chunk of StoreDataStream, and its shards are written
+// under the version reserved for the upload; the version only becomes visible once the upload is completed
+type MultipartUploader struct {
+	db        *sql.DB
+	store     sharding.ShardStore
+	cfg       *config.Config
+	locations []string
+	params    erasurecoding.EncodingParams
+	logger    *zap.Logger
+}
+
+// NewMultipartUploader creates a new MultipartUploader
+// params selects the redundancy scheme of every upload; the zero value uses the scheme of the bucket uploaded to, or
+// the default one if it has none
+func NewMultipartUploader(db *sql.DB, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, logger *zap.Logger) (*MultipartUploader, error) {
+	if err := params.OrDefault().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid encoding parameters: %w", err)
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("no storage locations configured")
+	}
+	return &MultipartUploader{db: db, store: store, cfg: cfg, locations: locations, params: params, logger: logger}, nil
+}
+
+// InitMultipart starts a multipart upload of a new version of an object, and returns the ID parts are uploaded under
+func (u *MultipartUploader) InitMultipart(bucketID, objectID string) (string, error) {
+	if err := checkBucketExists(u.db, bucketID); err != nil {
+		return "", err
+	}
+	cfg, params, err := bucketConfig(u.db, u.cfg, bucketID, u.params)
+	if err != nil {
+		return "", err
+	}
+
+	// Validate the configured codec, cipher and coder now, rather than on the first part
+	compressor, err := compression.NewWithLevel(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return "", err
+	}
+	payloadCipher, err := encryption.NewCipher(cfg.Cipher)
+	if err != nil {
+		return "", err
+	}
+	coder, err := erasurecoding.NewCoder(cfg.ErasureCoder, params)
+	if err != nil {
+		return "", err
+	}
+	// Every part is encrypted with the same per-version data key
+	_, wrappedKey, err := newDataKey(u.db, u.cfg, bucketID)
+	if err != nil {
+		return "", err
+	}
+
+	upload := bucket.MultipartUpload{
+		UploadID:     uuid.New().String(),
+		BucketID:     bucketID,
+		ObjectID:     objectID,
+		VersionID:    uuid.New().String(),
+		WrappedKey:   wrappedKey,
+		Cipher:       payloadCipher.Name(),
+		Compression:  compressor.Name(),
+		ErasureCoder: coder.Name(),
+		DataShards:   params.DataShards,
+		ParityShards: params.ParityShards,
+		CreationDate: u.cfg.Now().Format(time.RFC3339),
+	}
+	if err := bucket.AddMultipartUpload(u.db, upload); err != nil {
+		return "", err
+	}
+	return upload.UploadID, nil
+}
+
+// UploadPart stores part partNumber of an upload, numbered from 1
+// Uploading a part again replaces the earlier copy, so a part that failed or was interrupted can simply be retried
+func (u *MultipartUploader) UploadPart(uploadID string, partNumber int, data []byte) error {
+	if partNumber < 1 || partNumber > MaxMultipartParts {
+		return fmt.Errorf("invalid part number %d: must be between 1 and %d", partNumber, MaxMultipartParts)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("part %d is empty", partNumber)
+	}
+	if err := checkObjectSize(u.cfg, int64(len(data))); err != nil {
+		return fmt.Errorf("part %d: %w", partNumber, err)
+	}
+
+	upload, err := bucket.GetMultipartUpload(u.db, uploadID)
+	if err != nil {
+		return err
+	}
+	key, err := versionKey(u.db, u.cfg, upload.BucketID, &bucket.VersionMetadata{WrappedKey: upload.WrappedKey})
+	if err != nil {
+		return err
+	}
+	// The level is not recorded with the upload, so it is taken from the bucket's settings as they are now
+	cfg, _, err := bucketConfig(u.db, u.cfg, upload.BucketID, u.params)
+	if err != nil {
+		return err
+	}
+	compressor, err := compression.NewWithLevel(upload.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	payloadCipher, err := encryption.NewCipher(upload.Cipher)
+	if err != nil {
+		return err
+	}
+	params := erasurecoding.EncodingParams{DataShards: upload.DataShards, ParityShards: upload.ParityShards}
+	coder, err := erasurecoding.NewCoder(upload.ErasureCoder, params)
+	if err != nil {
+		return err
+	}
+
+	// The shards of a replaced part are overwritten in place, so its old record is dropped before they change
+	if err := bucket.DeleteMultipartPart(u.db, uploadID, partNumber); err != nil {
+		return err
+	}
+
+	// Parts are laid out as chunks in part number order, whatever order they arrive in
+	idx := partNumber - 1
+	chunk, err := storeChunk(context.Background(), data, idx, upload.ObjectID, upload.VersionID, u.store, u.cfg, u.locations, coder, compressor, payloadCipher, key, idx*params.TotalShards(), nil, nil, u.logger)
+	if err != nil {
+		u.cleanupParts(upload, []bucket.ChunkMetadata{chunk})
+		return err
+	}
+	if err := bucket.PutMultipartPart(u.db, uploadID, partNumber, chunk); err != nil {
+		u.cleanupParts(upload, []bucket.ChunkMetadata{chunk})
+		return err
+	}
+	return nil
+}
+
+// CompleteMultipart stitches the stored parts of an upload, in part number order, into a new version of the object
+// Gaps in the part numbers are allowed; the missing parts are simply not part of the object
+// Multipart versions record no checksum of the whole object, but the shards of every part are still verified on read
+// An upload whose parts add up to more than cfg.MaxObjectSize fails with ErrObjectTooLarge, leaving the parts for
+// AbortMultipart to remove
+// Every completed upload is recorded in the audit trail as a store
+func (u *MultipartUploader) CompleteMultipart(uploadID string) (string, error) {
+	upload, err := bucket.GetMultipartUpload(u.db, uploadID)
+	if err != nil {
+		return "", err
+	}
+	versionID, size, err := u.completeMultipart(upload)
+	audit.Record(context.Background(), audit.Event{Operation: audit.OpStore, BucketID: upload.BucketID, ObjectID: upload.ObjectID, VersionID: versionID, Bytes: size}, err)
+	return versionID, err
+}
+
+// completeMultipart records the version for CompleteMultipart, which records it in the audit trail
+// The size of the object is returned alongside the version ID
+func (u *MultipartUploader) completeMultipart(upload *bucket.MultipartUpload) (string, int64, error) {
+	start := time.Now()
+
+	parts, err := bucket.ListMultipartParts(u.db, upload.UploadID)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(parts) == 0 {
+		return "", 0, fmt.Errorf("multipart upload %s has no parts", upload.UploadID)
+	}
+	payloadCipher, err := encryption.NewCipher(upload.Cipher)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var size, compressedSize, encryptedSize, storedSize int64
+	anyCompressed := false
+	for _, part := range parts {
+		size += part.Size
+		compressedSize += part.EncryptedSize - int64(payloadCipher.Overhead())
+		encryptedSize += part.EncryptedSize
+		storedSize += part.StoredSize
+		anyCompressed = anyCompressed || !part.Uncompressed
+	}
+
+	if err := checkObjectSize(u.cfg, size); err != nil {
+		return "", size, err
+	}
+	if err := bucket.CheckBucketQuota(u.db, upload.BucketID, size); err != nil {
+		return "", size, err
+	}
+
+	// Parts are compressed independently, so the codec is only recorded if at least one part used it
+	codec := upload.Compression
+	if !anyCompressed {
+		codec = compression.None
+	}
+
+	metadata := bucket.VersionMetadata{
+		BucketID:       upload.BucketID,
+		ObjectID:       upload.ObjectID,
+		VersionID:      upload.VersionID,
+		Filename:       upload.ObjectID,
+		Filesize:       strconv.FormatInt(size, 10),
+		Compression:    codec,
+		Compressed:     anyCompressed,
+		CompressedSize: compressedSize,
+		EncryptedSize:  encryptedSize,
+		WrappedKey:     upload.WrappedKey,
+		Cipher:         upload.Cipher,
+		StoredSize:     storedSize,
+		CreationDate:   u.cfg.Now().Format(time.RFC3339),
+		ShardLocations: map[string]string{},
+		Proofs:         map[string]string{},
+		StorageMode:    bucket.StorageErasureCoded,
+		ErasureCoder:   upload.ErasureCoder,
+		DataShards:     upload.DataShards,
+		ParityShards:   upload.ParityShards,
+		Chunks:         parts,
+	}
+
+	// The version is recorded and the upload removed together, so a completed upload can never be aborted
+	tx, err := u.db.Begin()
+	if err != nil {
+		return "", size, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+	if err := bucket.DeleteMultipartUpload(tx, upload.UploadID); err != nil {
+		return "", size, err
+	}
+	if err := commitVersion(tx, upload.BucketID, upload.ObjectID, upload.VersionID, metadata, []byte{}); err != nil {
+		return "", size, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", size, fmt.Errorf("failed to commit multipart upload, %w", err)
+	}
+
+	params := metadata.EncodingParams()
+	metrics.ObserveStore(upload.BucketID, size, compressedSize, len(parts)*params.TotalShards(), time.Since(start))
+	fmt.Printf("Stored object %s (version %s) in bucket %s from %d parts\n", upload.ObjectID, upload.VersionID, upload.BucketID, len(parts))
+	return upload.VersionID, size, nil
+}
+
+// AbortMultipart cancels an upload and deletes the shards of every part stored so far
+// Shards that cannot be deleted are reported in a *ShardCleanupError, but the upload is still removed
+func (u *MultipartUploader) AbortMultipart(uploadID string) error {
+	upload, err := bucket.GetMultipartUpload(u.db, uploadID)
+	if err != nil {
+		return err
+	}
+	parts, err := bucket.ListMultipartParts(u.db, uploadID)
+	if err != nil {
+		return err
+	}
+
+	// The upload is removed first, so it cannot be completed while its shards are being deleted
+	if err := bucket.DeleteMultipartUpload(u.db, uploadID); err != nil {
+		return err
+	}
+	if cleanup := u.cleanupParts(upload, parts); cleanup != nil {
+		return cleanup
+	}
+	return nil
+}
+
+// cleanupParts deletes the shards of parts of an upload that will never be part of a version
+// It returns the shards that could not be deleted, or nil if every shard was removed
+func (u *MultipartUploader) cleanupParts(upload *bucket.MultipartUpload, parts []bucket.ChunkMetadata) *ShardCleanupError {
+	metadata := &bucket.VersionMetadata{ObjectID: upload.ObjectID, VersionID: upload.VersionID, Chunks: parts}
+	cleanup := &ShardCleanupError{}
+	// The metadata carries no content reference, so the database is never consulted
+	deleteVersionShards(nil, metadata, u.store, cleanup, u.logger)
+	if len(cleanup.Failed) > 0 {
+		u.logger.Warn("failed to clean up shards of multipart upload", zap.String("upload_id", upload.UploadID), zap.Error(cleanup))
+		return cleanup
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+)
+
+// ErrObjectLockTimeout is returned when an object stays locked by another writer for longer than the lock timeout
+var ErrObjectLockTimeout = errors.New("timed out waiting for object lock")
+
+// objectLocks serializes the writers of each object within this process
+// The locks are advisory and held in memory only, so they do not extend to other processes sharing the database;
+// the version chain of an object is still kept linear there, since it is resolved under the database's write lock
+var objectLocks = newObjectLocker()
+
+// objectLock is the lock of a single object, counting the callers holding or waiting for it
+// The lock is a channel with room for one token rather than a mutex, so that waiting for it can time out
+type objectLock struct {
+	held chan struct{}
+	refs int
+}
+
+// objectLocker hands out a lock per object ID, dropping each once no caller holds or waits for it
+// It is safe for use by multiple goroutines
+type objectLocker struct {
+	mu    sync.Mutex
+	locks map[string]*objectLock
+}
+
+// newObjectLocker creates an objectLocker holding no locks
+func newObjectLocker() *objectLocker {
+	return &objectLocker{locks: make(map[string]*objectLock)}
+}
+
+// lock waits for the lock of an object until it is free, timeout passes or ctx is done, and returns the function that
+// unlocks it; a timeout of zero or less waits for as long as ctx allows
+func (l *objectLocker) lock(ctx context.Context, objectID string, timeout time.Duration) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[objectID]
+	if !ok {
+		lock = &objectLock{held: make(chan struct{}, 1)}
+		l.locks[objectID] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case lock.held <- struct{}{}:
+	case <-expired:
+		l.release(objectID, lock)
+		return nil, fmt.Errorf("%w: %s after %s", ErrObjectLockTimeout, objectID, timeout)
+	case <-ctx.Done():
+		l.release(objectID, lock)
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-lock.held
+			l.release(objectID, lock)
+		})
+	}, nil
+}
+
+// release drops a caller's reference to the lock of an object
+func (l *objectLocker) release(objectID string, lock *objectLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, objectID)
+	}
+}
+
+// LockObject locks an object against the stores, appends and deletes of other callers in this process, and returns
+// the function that unlocks it, which may be called more than once
+// Those functions take the same lock for the object they write, so holding it makes a sequence of reads and writes
+// of the object atomic with respect to them; they must not be called for the same object while it is held, since the
+// lock is not reentrant
+// A lock held for longer than config.DefaultObjectLockTimeout by another caller fails with ErrObjectLockTimeout
+// rather than waiting forever behind a stuck writer
+func LockObject(objectID string) (unlock func(), err error) {
+	return objectLocks.lock(context.Background(), objectID, config.DefaultObjectLockTimeout)
+}
+
+// lockObject locks an object for a write under cfg, waiting up to cfg.ObjectLockTimeout, or
+// config.DefaultObjectLockTimeout when cfg sets none, and no longer than ctx allows
+func lockObject(ctx context.Context, objectID string, cfg *config.Config) (func(), error) {
+	timeout := config.DefaultObjectLockTimeout
+	if cfg != nil && cfg.ObjectLockTimeout > 0 {
+		timeout = cfg.ObjectLockTimeout
+	}
+	return objectLocks.lock(ctx, objectID, timeout)
+}
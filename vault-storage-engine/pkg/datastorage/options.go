@@ -0,0 +1,97 @@
+package datastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+)
+
+// StoreOptions names and describes the version recorded by a single store
+// Fields left empty fall back to what is derived from the file path passed to the store, so data with no meaningful
+// path, such as a generated report, can still be stored under a proper name and type
+type StoreOptions struct {
+	// Filename is recorded instead of the base name of the file path
+	Filename string
+	// Format is recorded instead of the extension of the filename, without the leading dot
+	Format string
+	// DetectFormat records the content type sniffed from the data as the format when Format is empty, such as
+	// "image/png", falling back to the extension of the filename when nothing more specific than
+	// application/octet-stream is detected
+	DetectFormat bool
+	// ContentType is the MIME type of the data, such as "application/pdf"
+	ContentType string
+	// Metadata holds arbitrary key/values recorded with the version and returned unchanged with its metadata, such as
+	// EXIF or provenance details; a store fails with ErrMetadataTooLarge if its keys and values together take more than
+	// cfg.MaxUserMetadataSize bytes
+	Metadata map[string]string
+	// IdempotencyKey makes the store safe to retry: a store of the same object in the same bucket under a key recorded
+	// within cfg.IdempotencyWindow returns the version the first one created instead of storing another, so a
+	// request that timed out can be sent again without knowing whether it committed
+	IdempotencyKey string
+}
+
+// ErrMetadataTooLarge is returned when the user metadata of a version being stored exceeds cfg.MaxUserMetadataSize
+var ErrMetadataTooLarge = errors.New("user metadata too large")
+
+// storeOptionsKey is the context key under which WithStoreOptions records the options
+type storeOptionsKey struct{}
+
+// WithStoreOptions returns a context that applies opts to every version stored with it
+func WithStoreOptions(ctx context.Context, opts StoreOptions) context.Context {
+	return context.WithValue(ctx, storeOptionsKey{}, opts)
+}
+
+// storeOptionsFrom returns the options set on ctx, or the zero options if none were set
+func storeOptionsFrom(ctx context.Context) StoreOptions {
+	opts, _ := ctx.Value(storeOptionsKey{}).(StoreOptions)
+	return opts
+}
+
+// checkUserMetadata returns an error wrapping ErrMetadataTooLarge if the user metadata set on ctx exceeds
+// cfg.MaxUserMetadataSize, so an oversized store is rejected before anything is written
+func checkUserMetadata(ctx context.Context, cfg *config.Config) error {
+	limit := cfg.MaxUserMetadataSize
+	if limit <= 0 {
+		limit = config.DefaultMaxUserMetadataSize
+	}
+	size := 0
+	for key, value := range storeOptionsFrom(ctx).Metadata {
+		size += len(key) + len(value)
+	}
+	if size > limit {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrMetadataTooLarge, size, limit)
+	}
+	return nil
+}
+
+// sniffLen is the number of leading bytes of the data content types are detected from
+const sniffLen = 512
+
+// describeVersion records the filename, format, content type and user metadata of a version stored from filePath,
+// taking them from the options set on ctx where given
+// head holds the first bytes of the data, which are all that is looked at to detect its format
+func describeVersion(ctx context.Context, metadata *bucket.VersionMetadata, filePath string, head []byte) {
+	opts := storeOptionsFrom(ctx)
+	metadata.Filename = opts.Filename
+	if metadata.Filename == "" {
+		metadata.Filename = filepath.Base(filePath)
+	}
+	metadata.Format = opts.Format
+	if metadata.Format == "" && opts.DetectFormat {
+		if detected := http.DetectContentType(head); detected != "application/octet-stream" {
+			metadata.Format = detected
+		}
+	}
+	if metadata.Format == "" {
+		metadata.Format = strings.TrimPrefix(filepath.Ext(metadata.Filename), ".")
+	}
+	metadata.ContentType = opts.ContentType
+	metadata.UserMetadata = maps.Clone(opts.Metadata)
+}
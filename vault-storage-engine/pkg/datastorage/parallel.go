@@ -0,0 +1,280 @@
+package datastorage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/proofofinclusion"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// ErrShardCollision is returned, possibly wrapped, when two shards of a store would be written to the same place in
+// the shard store, where the second would silently overwrite the first
+var ErrShardCollision = errors.New("shard collision")
+
+// assignShards returns the location cfg.Placement chooses for each of count shards, numbered from base
+// Every shard must end up at a place of its own in store, which is checked before anything is written
+func assignShards(store sharding.ShardStore, placement sharding.Placement, objectID, versionID string, count int, locations []string, base int) ([]string, error) {
+	assigned := make([]string, count)
+	placed := make(map[string]int, count)
+	for idx := range assigned {
+		location := placement.Assign(idx, count, locations)
+		shardPath, err := sharding.ShardPath(store, objectID, versionID, base+idx, location)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := placed[shardPath]; ok {
+			return nil, fmt.Errorf("%w: shards %d and %d would both be stored at %s", ErrShardCollision, base+other, base+idx, shardPath)
+		}
+		placed[shardPath] = idx
+		assigned[idx] = location
+	}
+	return assigned, nil
+}
+
+// storeShards writes each shard to the location chosen by cfg.Placement using up to cfg.ShardConcurrency workers
+// Transient store failures are retried according to the configured retry policy
+// base offsets the shard index, so the shards of different chunks of a version never collide
+// progress is credited with each shard once it is written
+// If a shard fails, outstanding writes are cancelled and the shards already written are returned with the error,
+// so callers can clean them up; shards that would overwrite each other fail with ErrShardCollision before any is written
+func storeShards(ctx context.Context, store sharding.ShardStore, objectID, versionID string, shards [][]byte, locations []string, base int, progress shardProgress, cfg *config.Config, logger *zap.Logger) (map[string]string, error) {
+	// Validate the layout up front so nothing is written for a store that can never succeed
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("no storage locations configured")
+	}
+	placement, err := sharding.NewPlacement(cfg.Placement)
+	if err != nil {
+		return nil, err
+	}
+	assigned, err := assignShards(store, placement, objectID, versionID, len(shards), locations, base)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := cfg.ShardConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu             sync.Mutex
+		wg             sync.WaitGroup
+		firstErr       error
+		shardLocations = make(map[string]string)
+		workers        = make(chan struct{}, concurrency)
+	)
+
+	for idx, shard := range shards {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(idx int, shard []byte) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			if err := ctx.Err(); err != nil {
+				return
+			}
+			logger.Debug("Storing shard", zap.String("object_id", objectID), zap.Int("shard", base+idx), zap.Int("size", len(shard)))
+			location := assigned[idx]
+			err := withRetry(ctx, store, cfg, logger, func() error {
+				return store.StoreShard(ctx, objectID, versionID, base+idx, shard, location)
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// Only the first failure is reported; later ones are usually caused by the cancellation
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to store shard %d: %w", base+idx, err)
+					cancel()
+				}
+				return
+			}
+			shardLocations[fmt.Sprintf("shard_%d", base+idx)] = location
+			progress.shardDone(idx)
+		}(idx, shard)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return shardLocations, firstErr
+	}
+	if len(shardLocations) < len(shards) {
+		return shardLocations, fmt.Errorf("store aborted after %d of %d shards: %w", len(shardLocations), len(shards), ctx.Err())
+	}
+	return shardLocations, nil
+}
+
+// shardLayout describes where the shards of one erasure-coded unit (a whole version or one chunk) live
+// and how to verify them
+type shardLayout struct {
+	locations map[string]string
+	proofs    map[string]string
+	root      string
+	hashes    map[string]string
+	algorithm string
+	base      int
+	params    erasurecoding.EncodingParams
+}
+
+// versionLayout returns the layout of a version stored as a single unit
+func versionLayout(metadata *bucket.VersionMetadata) shardLayout {
+	return shardLayout{
+		locations: metadata.ShardLocations,
+		proofs:    metadata.Proofs,
+		root:      metadata.MerkleRoot,
+		hashes:    metadata.ShardHashes,
+		algorithm: metadata.MerkleHash,
+		params:    metadata.EncodingParams(),
+	}
+}
+
+// chunkLayout returns the layout of one chunk of a streamed version
+func chunkLayout(chunk bucket.ChunkMetadata, params erasurecoding.EncodingParams) shardLayout {
+	return shardLayout{
+		locations: chunk.ShardLocations,
+		proofs:    chunk.Proofs,
+		root:      chunk.MerkleRoot,
+		hashes:    chunk.ShardHashes,
+		algorithm: chunk.MerkleHash,
+		base:      chunk.Index * params.TotalShards(),
+		params:    params,
+	}
+}
+
+// versionLayouts returns the layouts of every unit a version is stored as, in shard index order: a single one for a
+// version stored whole, and one per chunk for a streamed version
+func versionLayouts(metadata *bucket.VersionMetadata) []shardLayout {
+	if len(metadata.Chunks) == 0 {
+		return []shardLayout{versionLayout(metadata)}
+	}
+	params := metadata.EncodingParams()
+	layouts := make([]shardLayout, len(metadata.Chunks))
+	for i, chunk := range metadata.Chunks {
+		layouts[i] = chunkLayout(chunk, params)
+	}
+	return layouts
+}
+
+// retrieveShards fetches the shards of a layout into a slice ordered by shard index using up to cfg.ShardConcurrency workers
+// When cfg.VerifyOnRead is set, shards that fail Merkle proof verification are discarded
+// The number of shards that are unrecorded, or could not be read or verified, is returned alongside the shards
+// progress is credited with each shard once it is read and verified
+func retrieveShards(ctx context.Context, store sharding.ShardStore, objectID, versionID string, layout shardLayout, progress shardProgress, cfg *config.Config, logger *zap.Logger) ([][]byte, int) {
+	concurrency := cfg.ShardConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	totalShards := layout.params.TotalShards()
+
+	// Versions stored before Merkle roots were recorded cannot be verified
+	verify := cfg.VerifyOnRead && layout.root != ""
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		shards  = make([][]byte, totalShards)
+		missing = 0
+		workers = make(chan struct{}, concurrency)
+	)
+
+	// Every expected shard is looked up, so shards with no recorded location count as missing too
+	for i := 0; i < totalShards; i++ {
+		shardIdx := layout.base + i
+		shardKey := fmt.Sprintf("shard_%d", shardIdx)
+		location, ok := layout.locations[shardKey]
+		if !ok {
+			logger.Warn("No location recorded for shard", zap.String("shard", shardKey))
+			missing++
+			continue
+		}
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(shardKey, location string, shardIdx int) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			var shard []byte
+			err := withRetry(ctx, store, cfg, logger, func() error {
+				var err error
+				shard, err = store.RetrieveShard(ctx, objectID, versionID, shardIdx, location)
+				return err
+			})
+			if err == nil && verify {
+				err = layout.verify(shardIdx-layout.base, shard)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Warn("Shard retrieval failed", zap.String("shard", shardKey), zap.String("location", location), zap.Error(err))
+				missing++
+				return
+			}
+			shards[shardIdx-layout.base] = shard
+			progress.shardDone(shardIdx - layout.base)
+		}(shardKey, location, shardIdx)
+	}
+	wg.Wait()
+
+	return shards, missing
+}
+
+// withRetry runs a shard store operation, retrying it while it fails with an error the store classifies as transient
+func withRetry(ctx context.Context, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger, fn func() error) error {
+	isTransient := func(err error) bool {
+		return sharding.IsTransient(store, err)
+	}
+	return RetryTransient(ctx, cfg.MaxRetries, cfg.RetryBackoff, isTransient, logger, fn)
+}
+
+// verify checks shard i of the layout, counted from its base, against the hash recorded for it
+// Comparing the hash is enough to catch corruption and saves walking the proof up to the root; shards of versions
+// stored before shard hashes were recorded are checked against their proof of inclusion instead
+func (l shardLayout) verify(i int, shard []byte) error {
+	want, ok := l.hashes[fmt.Sprintf("shard_%d", l.base+i)]
+	if !ok {
+		return verifyShard(shard, l.proofs[fmt.Sprintf("key_%d", i)], l.root, l.algorithm)
+	}
+	hash, err := proofofinclusion.HashShard(shard, l.algorithm)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash); got != want {
+		return fmt.Errorf("shard hash mismatch: expected %s, got %s", want, got)
+	}
+	return nil
+}
+
+// verifyShard checks a retrieved shard against its stored proof of inclusion in a tree built with the named algorithm
+func verifyShard(shard []byte, proof, root, algorithm string) error {
+	if proof == "" {
+		return fmt.Errorf("no proof recorded for shard")
+	}
+	shardHash, err := proofofinclusion.HashShard(shard, algorithm)
+	if err != nil {
+		return err
+	}
+	ok, err := proofofinclusion.VerifyProof(root, shardHash, proof, algorithm)
+	if err != nil {
+		return fmt.Errorf("failed to verify proof: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("shard failed proof verification")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package datastorage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+)
+
+// pipelineHeaderSize is the size of the header Pipeline puts before the ciphertext: its length, and whether the
+// payload it encrypts is compressed
+const pipelineHeaderSize = 8 + 1
+
+// pipelineCodec returns the compressor, cipher and coder Pipeline and Reassemble transform data with under cfg
+func pipelineCodec(cfg *config.Config) (compression.Compressor, encryption.Cipher, erasurecoding.ErasureCoder, error) {
+	if len(cfg.EncryptionKey) == 0 {
+		return nil, nil, nil, fmt.Errorf("the pipeline needs an encryption key, not a passphrase, since it has no bucket to derive one for")
+	}
+	compressor, err := compression.NewWithLevel(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	payloadCipher, err := encryption.NewCipher(cfg.Cipher)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	coder, err := erasurecoding.NewCoder(cfg.ErasureCoder, erasurecoding.DefaultParams())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return compressor, payloadCipher, coder, nil
+}
+
+// Pipeline runs data through the transform a store applies before writing shards, without a database or a shard
+// store: it is compressed with cfg.Compression, encrypted with cfg.Cipher and erasure coded with cfg.ErasureCoder
+// under the default redundancy scheme, and the shards are returned; Reassemble reverses it
+// It is meant for benchmarking and testing the transform in isolation, so the shards are those of the transform
+// alone: the payload is encrypted with cfg.EncryptionKey itself rather than a data key of its own, and what a store
+// records in the version metadata, the size of the ciphertext and whether the payload is compressed, is put in a
+// header before the ciphertext instead, so Reassemble needs nothing but the shards and cfg
+func Pipeline(data []byte, cfg *config.Config) ([][]byte, error) {
+	compressor, payloadCipher, coder, err := pipelineCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, _, compressed, err := sealPayload(compressor, payloadCipher, data, cfg.EncryptionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	framed := make([]byte, pipelineHeaderSize, pipelineHeaderSize+len(cipherText))
+	binary.BigEndian.PutUint64(framed, uint64(len(cipherText)))
+	if compressed {
+		framed[8] = 1
+	}
+	framed = append(framed, cipherText...)
+
+	shards, err := coder.Encode(framed)
+	if err != nil {
+		return nil, fmt.Errorf("erasure coding failed: %w", err)
+	}
+	return shards, nil
+}
+
+// Reassemble reverses Pipeline, returning the data the shards were made from under the same cfg
+// Missing shards are passed as nil and rebuilt from the others, as on retrieval, and the slice passed is left as it was
+func Reassemble(shards [][]byte, cfg *config.Config) ([]byte, error) {
+	compressor, payloadCipher, coder, err := pipelineCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+	shards = append([][]byte(nil), shards...)
+	if err := reconstructShards(shards, coder); err != nil {
+		return nil, err
+	}
+
+	header, err := coder.DecodeWithSize(shards, pipelineHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("erasure decoding failed: %w", err)
+	}
+	size := binary.BigEndian.Uint64(header)
+	if size > uint64(len(shards)*len(shards[0])) {
+		return nil, fmt.Errorf("%w: header records %d bytes of ciphertext, more than the shards hold", ErrCorrupted, size)
+	}
+	framed, err := coder.DecodeWithSize(shards, pipelineHeaderSize+int(size))
+	if err != nil {
+		return nil, fmt.Errorf("erasure decoding failed: %w", err)
+	}
+
+	payload, err := payloadCipher.Decrypt(framed[pipelineHeaderSize:], cfg.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	if header[8] == 0 {
+		return payload, nil
+	}
+	return decompressPayload(compressor, payload, -1, cfg)
+}
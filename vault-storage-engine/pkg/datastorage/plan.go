@@ -0,0 +1,120 @@
+package datastorage
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+)
+
+// StorePlan describes how StoreData would lay out an object, without anything having been written
+type StorePlan struct {
+	// Size is the original size of the object
+	Size int64
+	// Compression is the codec the payload would be recorded with, which is compression.None when compressing it
+	// does not make it smaller
+	Compression    string
+	CompressedSize int64
+	EncryptedSize  int64
+	StorageMode    string
+	ErasureCoder   string
+	DataShards     int
+	ParityShards   int
+	// ShardLocations maps each shard, keyed "shard_<index>" as in version metadata, to the location it would be stored in
+	ShardLocations map[string]string
+	// ShardSizes holds the size of each shard, indexed by shard
+	ShardSizes []int64
+	// StoredSize is the combined size of every shard, which is what the object would take up across the locations
+	StoredSize int64
+}
+
+// PlanStore works out how data would be stored under cfg across locations, without touching a shard store or the database
+// The payload is compressed, encrypted with a throwaway key and erasure coded exactly as StoreData would, so the sizes
+// are the ones a store would produce; it is laid out with the default redundancy scheme, as bucket settings need the database
+// Deduplication is not taken into account, since it depends on what is already stored
+func PlanStore(data []byte, cfg *config.Config, locations []string) (*StorePlan, error) {
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("no storage locations configured")
+	}
+	if err := checkShardCompression(cfg); err != nil {
+		return nil, err
+	}
+	placement, err := sharding.NewPlacement(cfg.Placement)
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := compression.NewWithLevel(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	payloadCipher, err := encryption.NewCipher(cfg.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	cipherText, payloadSize, compressed, err := sealPayload(compressor, payloadCipher, data, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	codec := compressor.Name()
+	if !compressed {
+		codec = compression.None
+	}
+
+	mode, coderName, params := storageScheme(cfg, int64(len(data)), erasurecoding.DefaultParams())
+	coder, err := erasurecoding.NewCoder(coderName, params)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := coder.Encode(cipherText)
+	if err != nil {
+		return nil, fmt.Errorf("erasure coding failed: %w", err)
+	}
+
+	plan := &StorePlan{
+		Size:           int64(len(data)),
+		Compression:    codec,
+		CompressedSize: int64(payloadSize),
+		EncryptedSize:  int64(len(cipherText)),
+		StorageMode:    mode,
+		ErasureCoder:   coder.Name(),
+		DataShards:     params.DataShards,
+		ParityShards:   params.ParityShards,
+		ShardLocations: make(map[string]string, len(shards)),
+		ShardSizes:     make([]int64, len(shards)),
+		StoredSize:     shardBytes(shards),
+	}
+	for idx, shard := range shards {
+		plan.ShardLocations[fmt.Sprintf("shard_%d", idx)] = placement.Assign(idx, len(shards), locations)
+		plan.ShardSizes[idx] = int64(len(shard))
+	}
+	return plan, nil
+}
+
+// StorageFootprint estimates the bytes an object of originalSize would take up across its shards under params, without
+// any data, for capacity planning; the zero value of params stands for the default redundancy scheme
+// compressionRatio is the compressed size over the original size, as in Stats; a ratio of 0 or above 1 counts the
+// object as stored uncompressed, since StoreData keeps the original when compressing it does not make it smaller
+// Every shard is rounded up as the erasure coder pads it; the few bytes encryption adds are left out, and so are
+// replication of small objects and deduplication, which depend on configuration and on what is already stored
+// 0 is returned for params that do not describe a usable scheme
+func StorageFootprint(originalSize int64, params erasurecoding.EncodingParams, compressionRatio float64) int64 {
+	params = params.OrDefault()
+	if params.Validate() != nil || originalSize <= 0 {
+		return 0
+	}
+	if compressionRatio <= 0 || compressionRatio > 1 {
+		compressionRatio = 1
+	}
+	payload := int64(math.Ceil(float64(originalSize) * compressionRatio))
+	shardSize := (payload + int64(params.DataShards) - 1) / int64(params.DataShards)
+	return shardSize * int64(params.TotalShards())
+}
@@ -0,0 +1,125 @@
+package datastorage
+
+import (
+	"context"
+	"sync"
+)
+
+// TransferOptions holds optional settings for a single store or retrieval
+type TransferOptions struct {
+	// Progress is called as shards are written or read, with the bytes of the object transferred so far and its total size
+	// The total is -1 while a store from a source of unknown size is still reading it
+	// Calls never overlap, so the callback does not need to be safe for concurrent use
+	Progress func(bytesDone, bytesTotal int64)
+	// BestEffort makes a retrieval of a version stored in chunks return the chunks it could reconstruct, up to the first
+	// one too many shards were lost from, along with an error wrapping ErrPartialReconstruction, rather than nothing
+	// Versions stored as a single unit have no prefix to fall back on, and stores ignore it
+	BestEffort bool
+	// ReadRepair makes a retrieval that reconstructed around missing or corrupted shards write the rebuilt shards back
+	// to their locations before it returns, as RepairObject would, so objects heal as they are read
+	// Only shards found missing or failing verification are rewritten, so cfg.VerifyOnRead finds more of them; a shard
+	// that cannot be rewritten is logged without failing the retrieval, and stores ignore it
+	ReadRepair bool
+}
+
+// transferOptionsKey is the context key under which WithTransferOptions records the options
+type transferOptionsKey struct{}
+
+// WithTransferOptions returns a context that applies opts to every store and retrieval performed with it
+func WithTransferOptions(ctx context.Context, opts TransferOptions) context.Context {
+	return context.WithValue(ctx, transferOptionsKey{}, opts)
+}
+
+// transferOptionsFrom returns the options set on ctx, or the zero options if none were set
+func transferOptionsFrom(ctx context.Context) TransferOptions {
+	opts, _ := ctx.Value(transferOptionsKey{}).(TransferOptions)
+	return opts
+}
+
+// progressTracker adds up the bytes transferred by concurrent shard workers and reports them to a Progress callback
+// A nil tracker reports nothing
+type progressTracker struct {
+	mu    sync.Mutex
+	fn    func(bytesDone, bytesTotal int64)
+	done  int64
+	total int64
+}
+
+// newProgressTracker returns a tracker for a transfer of total bytes, or nil if ctx sets no Progress callback
+func newProgressTracker(ctx context.Context, total int64) *progressTracker {
+	fn := transferOptionsFrom(ctx).Progress
+	if fn == nil {
+		return nil
+	}
+	return &progressTracker{fn: fn, total: total}
+}
+
+// add credits n transferred bytes and reports the new count
+// The callback is invoked with the lock held, which keeps calls from overlapping and their counts in order
+func (p *progressTracker) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += n
+	if p.total >= 0 && p.done > p.total {
+		p.done = p.total
+	}
+	p.fn(p.done, p.total)
+}
+
+// resolve sets the total of a transfer whose size was not known when it started, and reports it
+func (p *progressTracker) resolve(total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.total >= 0 {
+		return
+	}
+	p.total = total
+	p.fn(p.done, p.total)
+}
+
+// complete reports the whole transfer as done
+// Retrievals that reconstruct missing shards from parity never read every shard, so they finish short of the total
+func (p *progressTracker) complete() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done >= p.total {
+		return
+	}
+	p.done = p.total
+	p.fn(p.done, p.total)
+}
+
+// unit returns the progress of one erasure-coded unit holding size bytes of the object spread over shards shards
+func (p *progressTracker) unit(size int64, shards int) shardProgress {
+	return shardProgress{tracker: p, size: size, shards: shards}
+}
+
+// shardProgress credits a tracker with the bytes of one erasure-coded unit as its shards are transferred
+// Each shard accounts for an even share of the unit, so the unit is fully credited once all its shards are
+// The zero value reports nothing
+type shardProgress struct {
+	tracker *progressTracker
+	size    int64
+	shards  int
+}
+
+// shardDone credits the share of the unit's i-th shard
+func (s shardProgress) shardDone(i int) {
+	if s.tracker == nil || s.shards <= 0 {
+		return
+	}
+	n := int64(s.shards)
+	s.tracker.add(s.size*int64(i+1)/n - s.size*int64(i)/n)
+}
@@ -0,0 +1,76 @@
+package datastorage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/proofofinclusion"
+)
+
+// ExportProof returns the Merkle roots, shard hashes and proofs of inclusion recorded for an object version
+// The result marshals to JSON that proofofinclusion.VerifyExportedProof checks against the shards themselves, so a
+// third party can confirm the integrity of the shards without access to the database
+// Versions stored before Merkle roots were recorded have nothing to export, and fail
+// The proof names the hash algorithm recorded for the version, so it is verified with the one it was stored under
+func ExportProof(db *sql.DB, bucketID, objectID, versionID string) (*proofofinclusion.InclusionProof, error) {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return nil, err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	exported := &proofofinclusion.InclusionProof{
+		BucketID:      bucketID,
+		ObjectID:      objectID,
+		VersionID:     versionID,
+		HashAlgorithm: hashAlgorithm(metadata.MerkleHash),
+		Shards:        []proofofinclusion.ShardProof{},
+	}
+
+	if len(metadata.Chunks) == 0 {
+		exported.MerkleRoot = metadata.MerkleRoot
+	} else {
+		// Chunks record their own algorithm; the proof takes that of the first, and the shards of any chunk stored
+		// under another name theirs
+		exported.HashAlgorithm = hashAlgorithm(metadata.Chunks[0].MerkleHash)
+	}
+
+	for _, layout := range versionLayouts(metadata) {
+		if layout.root == "" {
+			return nil, fmt.Errorf("no Merkle root recorded for object %s version %s", objectID, versionID)
+		}
+		proofs := make([]string, layout.params.TotalShards())
+		for i := range proofs {
+			proofs[i] = layout.proofs[fmt.Sprintf("key_%d", i)]
+		}
+		// Shard hashes are recorded for newer versions, and recovered from the proofs for older ones
+		hashes := proofofinclusion.LeafHashes(layout.root, proofs, layout.algorithm)
+		for i := range hashes {
+			if hash, ok := layout.hashes[fmt.Sprintf("shard_%d", layout.base+i)]; ok {
+				hashes[i] = hash
+			}
+		}
+		var algorithm string
+		if name := hashAlgorithm(layout.algorithm); name != exported.HashAlgorithm {
+			algorithm = name
+		}
+		for i, proof := range proofs {
+			// Shards without a recorded proof cannot be verified by anyone, so they are left out
+			if proof == "" {
+				continue
+			}
+			exported.Shards = append(exported.Shards, proofofinclusion.ShardProof{
+				Index:         layout.base + i,
+				Hash:          hashes[i],
+				Proof:         proof,
+				MerkleRoot:    layout.root,
+				HashAlgorithm: algorithm,
+			})
+		}
+	}
+	return exported, nil
+}
@@ -0,0 +1,138 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidRange is returned by RetrieveRange when the requested range does not overlap the object
+var ErrInvalidRange = errors.New("invalid range")
+
+// RetrieveRange fetches length bytes of an object starting at offset
+// A negative length reads to the end of the object, and a range running past the end is clamped to it
+// An offset at or past the end of the object returns ErrInvalidRange
+// Only the chunks overlapping the range are reconstructed for objects stored with StoreDataStream;
+// other objects are reconstructed in full and then sliced
+// The whole-object checksum can only be verified for objects that are reconstructed in full
+// With TransferOptions.BestEffort, a chunk that cannot be reconstructed ends the range early, and the bytes before it
+// are returned with an error wrapping ErrPartialReconstruction
+// Every read is recorded in the audit trail with the number of bytes returned
+func RetrieveRange(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, offset, length int64, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, string, error) {
+	data, filename, err := retrieveRange(ctx, db, bucketID, objectID, versionID, offset, length, store, cfg, logger)
+	audit.Record(ctx, audit.Event{Operation: audit.OpRetrieve, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: int64(len(data))}, err)
+	return data, filename, err
+}
+
+// retrieveRange reads a range for RetrieveRange, which records it in the audit trail
+func retrieveRange(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, offset, length int64, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, string, error) {
+	if offset < 0 {
+		return nil, "", fmt.Errorf("%w: negative offset %d", ErrInvalidRange, offset)
+	}
+	if err := authorize(ctx, db, bucketID, objectID, acl.PermRead); err != nil {
+		return nil, "", err
+	}
+	if err := bucket.CheckObjectNotDeleted(db, objectID); err != nil {
+		return nil, "", err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	if len(metadata.Chunks) == 0 {
+		data, _, err := retrieveData(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+		if err != nil {
+			return nil, "", err
+		}
+		filename, err := getObjectFilename(db, objectID)
+		if err != nil {
+			return nil, "", err
+		}
+		start, end, err := clampRange(offset, length, int64(len(data)))
+		if err != nil {
+			return nil, "", err
+		}
+		return data[start:end], filename, nil
+	}
+
+	var size int64
+	for _, chunk := range metadata.Chunks {
+		size += chunk.Size
+	}
+	start, end, err := clampRange(offset, length, size)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := versionKey(db, cfg, bucketID, metadata)
+	if err != nil {
+		return nil, "", err
+	}
+	compressor, err := compression.New(metadata.Compression)
+	if err != nil {
+		return nil, "", err
+	}
+	payloadCipher, err := encryption.NewCipher(metadata.Cipher)
+	if err != nil {
+		return nil, "", err
+	}
+	coder, err := erasurecoding.NewCoder(metadata.ErasureCoder, metadata.EncodingParams())
+	if err != nil {
+		return nil, "", err
+	}
+	filename, err := getObjectFilename(db, objectID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+	bestEffort := transferOptionsFrom(ctx).BestEffort
+	out := make([]byte, 0, end-start)
+	var chunkStart int64
+	for _, chunk := range metadata.Chunks {
+		chunkEnd := chunkStart + chunk.Size
+		if chunkEnd > start && chunkStart < end {
+			data, err := decodeChunk(ctx, chunk, shardObjectID, shardVersionID, store, payloadCipher, key, coder, compressor, shardProgress{}, cfg, logger)
+			if err != nil {
+				if bestEffort && chunkLost(err) {
+					return out, filename, partialError(int64(len(out)), err)
+				}
+				return nil, "", err
+			}
+			from := max(start, chunkStart) - chunkStart
+			to := min(end, chunkEnd) - chunkStart
+			out = append(out, data[from:to]...)
+		}
+		if chunkEnd >= end {
+			break
+		}
+		chunkStart = chunkEnd
+	}
+
+	return out, filename, nil
+}
+
+// clampRange converts an offset and length into start and end positions within an object of the given size
+func clampRange(offset, length, size int64) (int64, int64, error) {
+	if offset >= size {
+		return 0, 0, fmt.Errorf("%w: offset %d is past the end of the object (%d bytes)", ErrInvalidRange, offset, size)
+	}
+	end := size
+	if length >= 0 && length < size-offset {
+		end = offset + length
+	}
+	return offset, end, nil
+}
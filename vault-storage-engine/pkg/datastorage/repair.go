@@ -0,0 +1,159 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// RepairObject regenerates the missing or corrupted shards of an object version from the surviving ones
+// The rebuilt shards are written back to their recorded locations and verified against their Merkle proofs
+// Repair is impossible, and an error is returned, if fewer than DataShards shards of any unit survive
+func RepairObject(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) error {
+	start := time.Now()
+
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return err
+	}
+
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	// Shards are always verified during repair, so corrupted shards are rewritten along with lost ones
+	repairCfg := *cfg
+	repairCfg.VerifyOnRead = true
+
+	ctx := context.Background()
+	params := metadata.EncodingParams()
+	coder, err := erasurecoding.NewCoder(metadata.ErasureCoder, params)
+	if err != nil {
+		return err
+	}
+	// Deduplicated versions share the shards of the version that first stored the content, so those are repaired
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+
+	if len(metadata.Chunks) == 0 {
+		repaired, err := repairLayout(ctx, store, shardObjectID, shardVersionID, versionLayout(metadata), coder, &repairCfg, logger)
+		if err != nil {
+			return err
+		}
+		metrics.ObserveRepair(bucketID, repaired, time.Since(start))
+		logger.Info("Repaired object", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Int("shards", repaired))
+		return nil
+	}
+
+	total := 0
+	for _, chunk := range metadata.Chunks {
+		repaired, err := repairLayout(ctx, store, shardObjectID, shardVersionID, chunkLayout(chunk, params), coder, &repairCfg, logger)
+		if err != nil {
+			return fmt.Errorf("failed to repair chunk %d: %w", chunk.Index, err)
+		}
+		total += repaired
+	}
+	metrics.ObserveRepair(bucketID, total, time.Since(start))
+	logger.Info("Repaired object", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Int("shards", total))
+	return nil
+}
+
+// repairLayout rebuilds and rewrites the missing shards of a single erasure-coded unit
+// It returns the number of shards that were rewritten
+func repairLayout(ctx context.Context, store sharding.ShardStore, objectID, versionID string, layout shardLayout, coder erasurecoding.ErasureCoder, cfg *config.Config, logger *zap.Logger) (int, error) {
+	shards, _ := retrieveShards(ctx, store, objectID, versionID, layout, shardProgress{}, cfg, logger)
+
+	var lost []int
+	for i, shard := range shards {
+		if shard == nil {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) == 0 {
+		return 0, nil
+	}
+
+	survived := len(shards) - len(lost)
+	if survived < layout.params.DataShards {
+		return 0, fmt.Errorf("%w: repair impossible, only %d of %d shards survive and %d are required", ErrInsufficientShards, survived, len(shards), layout.params.DataShards)
+	}
+
+	if err := coder.Reconstruct(shards); err != nil {
+		return 0, fmt.Errorf("failed to reconstruct shards: %w", err)
+	}
+
+	for _, i := range lost {
+		shardIdx := layout.base + i
+		location, ok := layout.locations[fmt.Sprintf("shard_%d", shardIdx)]
+		if !ok {
+			return 0, fmt.Errorf("no location recorded for shard %d", shardIdx)
+		}
+
+		// Versions stored before Merkle roots were recorded cannot be verified, so the rebuilt shard is trusted as-is
+		if layout.root != "" {
+			if err := layout.verify(i, shards[i]); err != nil {
+				return 0, fmt.Errorf("rebuilt shard %d does not match its proof: %w", shardIdx, err)
+			}
+		}
+
+		err := withRetry(ctx, store, cfg, logger, func() error {
+			return store.StoreShard(ctx, objectID, versionID, shardIdx, shards[i], location)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to rewrite shard %d: %w", shardIdx, err)
+		}
+		logger.Info("Rewrote shard", zap.Int("shard", shardIdx), zap.String("location", location))
+	}
+
+	// Read the unit back to confirm every shard is now present and passes verification
+	_, missing := retrieveShards(ctx, store, objectID, versionID, layout, shardProgress{}, cfg, logger)
+	if missing > 0 {
+		return len(lost), fmt.Errorf("%d shards still missing or invalid after repair", missing)
+	}
+	return len(lost), nil
+}
+
+// readRepair rewrites the shards of a unit that a retrieval had to reconstruct around, for TransferOptions.ReadRepair
+// read holds the shards as they were retrieved and rebuilt the complete set the unit was decoded from, so every shard
+// that was missing, or differs from what it was rebuilt as, is written back to its recorded location
+// The data has already been recovered by then, so shards that cannot be rewritten are only logged
+func readRepair(ctx context.Context, store sharding.ShardStore, objectID, versionID string, layout shardLayout, read, rebuilt [][]byte, cfg *config.Config, logger *zap.Logger) {
+	repaired := 0
+	for i, shard := range rebuilt {
+		if shard == nil || (read[i] != nil && bytes.Equal(read[i], shard)) {
+			continue
+		}
+		shardIdx := layout.base + i
+		location, ok := layout.locations[fmt.Sprintf("shard_%d", shardIdx)]
+		if !ok {
+			logger.Warn("No location recorded to repair shard", zap.Int("shard", shardIdx))
+			continue
+		}
+		// Versions stored before Merkle roots were recorded cannot be verified, so the rebuilt shard is trusted as-is
+		if layout.root != "" {
+			if err := layout.verify(i, shard); err != nil {
+				logger.Warn("Rebuilt shard does not match its proof, leaving it unrepaired", zap.Int("shard", shardIdx), zap.Error(err))
+				continue
+			}
+		}
+		err := withRetry(ctx, store, cfg, logger, func() error {
+			return store.StoreShard(ctx, objectID, versionID, shardIdx, shard, location)
+		})
+		if err != nil {
+			logger.Warn("Failed to repair shard on read", zap.Int("shard", shardIdx), zap.String("location", location), zap.Error(err))
+			continue
+		}
+		repaired++
+	}
+	if repaired > 0 {
+		logger.Info("Repaired shards on read", zap.String("object_id", objectID), zap.String("version_id", versionID), zap.Int("shards", repaired))
+	}
+}
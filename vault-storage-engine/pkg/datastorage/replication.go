@@ -0,0 +1,74 @@
+package datastorage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// readReplica reads the copies of a replicated version one at a time, until one decodes and matches its checksum
+// Copies that cannot be read, fail proof verification or do not decode are skipped, so any single good copy is enough
+// The plaintext is returned with the number of copies that were read
+func readReplica(ctx context.Context, store sharding.ShardStore, objectID, versionID string, layout shardLayout, progress shardProgress, decode func(shards [][]byte) ([]byte, error), cfg *config.Config, logger *zap.Logger) ([]byte, int, error) {
+	totalShards := layout.params.TotalShards()
+	verify := cfg.VerifyOnRead && layout.root != ""
+
+	read := 0
+	var decodeErr error
+	// Copies are identical, so every copy that failed before a good one is found can be rewritten from it on read repair
+	var failed []int
+	for i := 0; i < totalShards; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, read, fmt.Errorf("retrieve aborted: %w", err)
+		}
+		shardKey := fmt.Sprintf("shard_%d", i)
+		location, ok := layout.locations[shardKey]
+		if !ok {
+			logger.Warn("No location recorded for copy", zap.String("shard", shardKey))
+			continue
+		}
+
+		var shard []byte
+		err := withRetry(ctx, store, cfg, logger, func() error {
+			var err error
+			shard, err = store.RetrieveShard(ctx, objectID, versionID, i, location)
+			return err
+		})
+		if err == nil && verify {
+			err = layout.verify(i, shard)
+		}
+		if err != nil {
+			logger.Warn("Copy retrieval failed", zap.String("shard", shardKey), zap.String("location", location), zap.Error(err))
+			failed = append(failed, i)
+			continue
+		}
+		read++
+
+		copies := make([][]byte, totalShards)
+		copies[i] = shard
+		plainText, err := decode(copies)
+		if err != nil {
+			logger.Warn("Discarding corrupted copy", zap.String("shard", shardKey), zap.String("location", location), zap.Error(err))
+			decodeErr = err
+			failed = append(failed, i)
+			continue
+		}
+		progress.shardDone(0)
+		if transferOptionsFrom(ctx).ReadRepair && len(failed) > 0 {
+			good := make([][]byte, totalShards)
+			for _, j := range failed {
+				good[j] = shard
+			}
+			readRepair(ctx, store, objectID, versionID, layout, make([][]byte, totalShards), good, cfg, logger)
+		}
+		return plainText, read, nil
+	}
+
+	if decodeErr != nil {
+		return nil, read, fmt.Errorf("%w: none of the %d copies read could be decoded: %w", ErrCorrupted, read, decodeErr)
+	}
+	return nil, read, fmt.Errorf("%w: none of the %d copies could be read", ErrInsufficientShards, totalShards)
+}
@@ -1,6 +1,7 @@
 package datastorage
 
 import (
+	"context"
 	"time"
 
 	"go.uber.org/zap"
@@ -21,3 +22,23 @@ func Retry(attempts int, sleep time.Duration, logger *zap.Logger, fn func() erro
 	}
 	return err
 }
+
+// RetryTransient calls fn, retrying up to retries more times while it fails with an error isTransient accepts
+// Retries back off exponentially from sleep, and stop as soon as ctx is done
+func RetryTransient(ctx context.Context, retries int, sleep time.Duration, isTransient func(error) bool, logger *zap.Logger, fn func() error) error {
+	err := fn()
+	for i := 0; i < retries && err != nil && isTransient(err); i++ {
+		logger.Warn("Transient failure, retrying...", zap.Int("attempt", i+1), zap.Duration("backoff", sleep), zap.Error(err))
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		sleep *= 2
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// RollbackVersion makes the content of an earlier version current again
+// The target version is left untouched; its content is written as a brand-new version whose parent is the current head
+// The new version uses the target's redundancy scheme and shard locations, and its ID is returned
+func RollbackVersion(db *sql.DB, bucketID, objectID, targetVersionID string, store sharding.ShardStore, cfg *config.Config) (string, error) {
+	ctx := context.Background()
+	logger := zap.L()
+
+	target, err := bucket.GetObjectMetadata(db, objectID, targetVersionID)
+	if err != nil {
+		return "", err
+	}
+	if target.BucketID != bucketID {
+		return "", fmt.Errorf("%w: %s (version %s) in bucket %s", bucket.ErrVersionNotFound, objectID, targetVersionID, bucketID)
+	}
+
+	params := target.EncodingParams()
+	locations, err := targetLocations(target)
+	if err != nil {
+		return "", err
+	}
+
+	// The object's own filename is reused so the new version is registered against the existing object
+	filename, err := getObjectFilename(db, objectID)
+	if err != nil {
+		return "", err
+	}
+
+	r, _, err := RetrieveDataStream(ctx, db, bucketID, objectID, targetVersionID, store, cfg, logger)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve target version: %w", err)
+	}
+	defer r.Close()
+
+	// Chunked versions are streamed straight back into a new chunked version, so they are never held in memory
+	if len(target.Chunks) > 0 {
+		size := int64(-1)
+		if n, err := strconv.ParseInt(target.Filesize, 10, 64); err == nil {
+			size = n
+		}
+		versionID, _, err := StoreDataStream(ctx, db, r, size, bucketID, objectID, filename, store, cfg, locations, params, logger)
+		if err != nil {
+			return "", fmt.Errorf("failed to store rolled back version: %w", err)
+		}
+		return versionID, nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve target version: %w", err)
+	}
+	versionID, _, _, err := StoreData(ctx, db, data, bucketID, objectID, filename, store, cfg, locations, params, logger)
+	if err != nil {
+		return "", fmt.Errorf("failed to store rolled back version: %w", err)
+	}
+	return versionID, nil
+}
+
+// targetLocations rebuilds the ordered list of locations a version's shards were written to
+// Chunked versions place every chunk on the same locations, so the first chunk is enough
+func targetLocations(metadata *bucket.VersionMetadata) ([]string, error) {
+	shardLocations := metadata.ShardLocations
+	if len(metadata.Chunks) > 0 {
+		shardLocations = metadata.Chunks[0].ShardLocations
+	}
+
+	locations := make([]string, metadata.EncodingParams().TotalShards())
+	for i := range locations {
+		location, ok := shardLocations[fmt.Sprintf("shard_%d", i)]
+		if !ok {
+			return nil, fmt.Errorf("no location recorded for shard %d", i)
+		}
+		locations[i] = location
+	}
+	return locations, nil
+}
@@ -0,0 +1,287 @@
+package datastorage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+)
+
+// RotationReport summarises the versions visited by a master key rotation
+type RotationReport struct {
+	// Rewrapped is the number of versions whose data key was (or, in a dry run, would be) re-wrapped
+	Rewrapped int
+	// AlreadyRotated is the number of versions whose data key is already wrapped with the new key
+	AlreadyRotated int
+	// Legacy is the number of versions encrypted with the master key directly, which rotation cannot migrate
+	Legacy int
+}
+
+// RotateMasterKey re-wraps the data key of every version with newKey
+// Only metadata is rewritten; shard data is never touched, since it is encrypted with the data keys
+// Each version is updated in its own transaction and versions already wrapped with newKey are skipped,
+// so an interrupted rotation can simply be run again
+// Versions stored before envelope encryption still depend on oldKey, and are reported as an error once the rest are rotated
+// The copies of metadata kept for deduplicated content are rotated too, so later references inherit the new wrapping
+// Master keys derived from a passphrase differ from bucket to bucket, so they are rotated with RotatePassphrase instead
+func RotateMasterKey(db *sql.DB, oldKey, newKey []byte) error {
+	report, err := rotateKeys(db, fixedKeys(oldKey, newKey), false)
+	if err != nil {
+		return err
+	}
+	if report.Legacy > 0 {
+		return fmt.Errorf("%d versions are encrypted with the old master key directly and still require it", report.Legacy)
+	}
+	return nil
+}
+
+// RotateMasterKeyDryRun reports what RotateMasterKey would do without writing anything
+func RotateMasterKeyDryRun(db *sql.DB, oldKey, newKey []byte) (*RotationReport, error) {
+	return rotateKeys(db, fixedKeys(oldKey, newKey), true)
+}
+
+// RotatePassphrase re-wraps the data key of every version, like RotateMasterKey, for master keys derived from a
+// passphrase: each version's key is unwrapped with the key oldPassphrase derives for its bucket, and wrapped with the
+// key newPassphrase derives with the same salt, so the buckets keep their salts and newPassphrase simply replaces
+// oldPassphrase in the config once it returns
+// Versions stored before envelope encryption still depend on oldPassphrase, and are reported as an error once the rest
+// are rotated
+func RotatePassphrase(db *sql.DB, oldPassphrase, newPassphrase string) error {
+	keys, err := passphraseKeys(oldPassphrase, newPassphrase)
+	if err != nil {
+		return err
+	}
+	report, err := rotateKeys(db, keys, false)
+	if err != nil {
+		return err
+	}
+	if report.Legacy > 0 {
+		return fmt.Errorf("%d versions are encrypted with a key derived from the old passphrase directly and still require it", report.Legacy)
+	}
+	return nil
+}
+
+// RotatePassphraseDryRun reports what RotatePassphrase would do without writing anything
+func RotatePassphraseDryRun(db *sql.DB, oldPassphrase, newPassphrase string) (*RotationReport, error) {
+	keys, err := passphraseKeys(oldPassphrase, newPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	return rotateKeys(db, keys, true)
+}
+
+// rotationKeys returns the master keys the data keys of a bucket are re-wrapped from and to
+type rotationKeys func(db bucket.Querier, bucketID string) (oldKey, newKey []byte, err error)
+
+// fixedKeys returns the rotationKeys of master keys shared by every bucket
+func fixedKeys(oldKey, newKey []byte) rotationKeys {
+	return func(bucket.Querier, string) ([]byte, []byte, error) {
+		return oldKey, newKey, nil
+	}
+}
+
+// passphraseKeys returns the rotationKeys of master keys derived for each bucket from a passphrase
+func passphraseKeys(oldPassphrase, newPassphrase string) (rotationKeys, error) {
+	if oldPassphrase == "" || newPassphrase == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	oldCfg := &config.Config{EncryptionPassphrase: oldPassphrase}
+	newCfg := &config.Config{EncryptionPassphrase: newPassphrase}
+	return func(db bucket.Querier, bucketID string) ([]byte, []byte, error) {
+		oldKey, err := bucket.GetBucketEncryptionKey(db, oldCfg, bucketID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get old encryption key: %w", err)
+		}
+		newKey, err := bucket.GetBucketEncryptionKey(db, newCfg, bucketID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get new encryption key: %w", err)
+		}
+		return oldKey, newKey, nil
+	}, nil
+}
+
+// versionRef identifies a single row of the versions table
+type versionRef struct {
+	bucketID  string
+	objectID  string
+	versionID string
+}
+
+func rotateKeys(db *sql.DB, keys rotationKeys, dryRun bool) (*RotationReport, error) {
+	versions, err := listAllVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RotationReport{}
+	for _, ref := range versions {
+		if err := rotateVersionKey(db, ref, keys, dryRun, report); err != nil {
+			return report, fmt.Errorf("failed to rotate key of object %s (version %s): %w", ref.objectID, ref.versionID, err)
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	checksums, err := listContentRefs(db)
+	if err != nil {
+		return report, err
+	}
+	for _, sum := range checksums {
+		if err := rotateContentRefKey(db, sum, keys); err != nil {
+			return report, fmt.Errorf("failed to rotate key of shared content %s: %w", sum, err)
+		}
+	}
+	return report, nil
+}
+
+// listContentRefs returns the checksum of every piece of deduplicated content
+func listContentRefs(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT checksum FROM content_refs`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list content references: %w", err)
+	}
+	defer rows.Close()
+
+	var checksums []string
+	for rows.Next() {
+		var sum string
+		if err := rows.Scan(&sum); err != nil {
+			return nil, fmt.Errorf("failed to scan content reference: %w", err)
+		}
+		checksums = append(checksums, sum)
+	}
+	return checksums, rows.Err()
+}
+
+// rotateContentRefKey re-wraps the data key recorded for a piece of deduplicated content inside its own transaction
+// The key is wrapped with the master key of the bucket the content was first stored in, which its metadata records
+func rotateContentRefKey(db *sql.DB, sum string, keys rotationKeys) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var metadataJSON string
+	err = tx.QueryRow(`SELECT metadata FROM content_refs WHERE checksum = ?`, sum).Scan(&metadataJSON)
+	if err == sql.ErrNoRows {
+		// The content was released since it was listed
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	var metadata bucket.VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	oldKey, newKey, err := keys(tx, metadata.BucketID)
+	if err != nil {
+		return err
+	}
+	if _, err := encryption.UnwrapKey(metadata.WrappedKey, newKey); err == nil {
+		return nil
+	}
+
+	dek, err := encryption.UnwrapKey(metadata.WrappedKey, oldKey)
+	if err != nil {
+		return err
+	}
+	metadata.WrappedKey, err = encryption.WrapKey(dek, newKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE content_refs SET metadata = ? WHERE checksum = ?`, updated, sum)
+	if err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	return tx.Commit()
+}
+
+// listAllVersions returns every version in the database
+// The list is read up front so no cursor is held open while versions are updated
+func listAllVersions(db *sql.DB) ([]versionRef, error) {
+	rows, err := db.Query(`SELECT bucket_id, object_id, version_id FROM versions`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []versionRef
+	for rows.Next() {
+		var ref versionRef
+		if err := rows.Scan(&ref.bucketID, &ref.objectID, &ref.versionID); err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+		versions = append(versions, ref)
+	}
+	return versions, rows.Err()
+}
+
+// rotateVersionKey re-wraps the data key of a single version inside its own transaction
+func rotateVersionKey(db *sql.DB, ref versionRef, keys rotationKeys, dryRun bool, report *RotationReport) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var metadataJSON string
+	err = tx.QueryRow(`SELECT metadata FROM versions WHERE object_id = ? AND version_id = ?`, ref.objectID, ref.versionID).Scan(&metadataJSON)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	var metadata bucket.VersionMetadata
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	if metadata.WrappedKey == "" {
+		report.Legacy++
+		return nil
+	}
+	oldKey, newKey, err := keys(tx, ref.bucketID)
+	if err != nil {
+		return err
+	}
+	// A key that already unwraps with the new master key was rotated by an earlier run
+	if _, err := encryption.UnwrapKey(metadata.WrappedKey, newKey); err == nil {
+		report.AlreadyRotated++
+		return nil
+	}
+
+	dek, err := encryption.UnwrapKey(metadata.WrappedKey, oldKey)
+	if err != nil {
+		return err
+	}
+	report.Rewrapped++
+	if dryRun {
+		return nil
+	}
+
+	metadata.WrappedKey, err = encryption.WrapKey(dek, newKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE versions SET metadata = ? WHERE object_id = ? AND version_id = ?`, updated, ref.objectID, ref.versionID)
+	if err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+	return tx.Commit()
+}
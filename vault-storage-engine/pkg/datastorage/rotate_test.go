@@ -0,0 +1,72 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// TestRotatePassphrase checks that every version, in every bucket and including deduplicated content, reads back
+// under the new passphrase once it is rotated, and that the old passphrase no longer unwraps them
+func TestRotatePassphrase(t *testing.T) {
+	db, cfg := newTestVault(t)
+	cfg.EncryptionKey = nil
+	cfg.EncryptionPassphrase = "old passphrase"
+	cfg.Dedup = true
+	store := sharding.NewMemoryShardStore()
+	ctx := context.Background()
+	if err := bucket.CreateBucket(db, "b2", "owner"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("content shared by both buckets")
+	stored := make(map[string]string)
+	for _, bucketID := range []string{"b1", "b2"} {
+		versionID, _, _, err := StoreData(ctx, db, data, bucketID, "o-"+bucketID, "f.txt", store, cfg, testLocations, erasurecoding.DefaultParams(), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[bucketID] = versionID
+	}
+
+	if err := RotatePassphrase(db, "old passphrase", "new passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := RotatePassphraseDryRun(db, "old passphrase", "new passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rewrapped != 0 || report.AlreadyRotated != len(stored) {
+		t.Fatalf("second rotation would rewrap %d and skip %d versions, want 0 and %d", report.Rewrapped, report.AlreadyRotated, len(stored))
+	}
+
+	cfg.EncryptionPassphrase = "new passphrase"
+	for bucketID, versionID := range stored {
+		got, _, err := RetrieveData(ctx, db, bucketID, "o-"+bucketID, versionID, store, cfg, zap.NewNop())
+		if err != nil {
+			t.Fatalf("bucket %s: %v", bucketID, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("bucket %s read back %q, want %q", bucketID, got, data)
+		}
+	}
+
+	// Content stored again is deduplicated against the rotated copy of its metadata
+	versionID, _, _, err := StoreData(ctx, db, data, "b1", "o-again", "f.txt", store, cfg, testLocations, erasurecoding.DefaultParams(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RetrieveData(ctx, db, "b1", "o-again", versionID, store, cfg, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.EncryptionPassphrase = "old passphrase"
+	if _, _, err := RetrieveData(ctx, db, "b1", "o-b1", stored["b1"], store, cfg, zap.NewNop()); err == nil {
+		t.Fatal("version still read back under the old passphrase")
+	}
+}
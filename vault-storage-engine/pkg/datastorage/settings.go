@@ -0,0 +1,30 @@
+package datastorage
+
+import (
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+)
+
+// bucketConfig returns what a version stored in a bucket is encoded with: cfg with the bucket's settings applied over
+// it, and params, falling back to the bucket's redundancy scheme and then the default one when params is the zero value
+func bucketConfig(db bucket.Querier, cfg *config.Config, bucketID string, params erasurecoding.EncodingParams) (*config.Config, erasurecoding.EncodingParams, error) {
+	if err := checkShardCompression(cfg); err != nil {
+		return nil, params, err
+	}
+	settings, err := bucket.GetBucketSettings(db, bucketID)
+	if err != nil {
+		return nil, params, err
+	}
+
+	if params == (erasurecoding.EncodingParams{}) {
+		params = settings.EncodingParams()
+	}
+	params = params.OrDefault()
+	if err := params.Validate(); err != nil {
+		return nil, params, fmt.Errorf("invalid encoding parameters: %w", err)
+	}
+	return settings.Apply(cfg), params, nil
+}
@@ -0,0 +1,71 @@
+package datastorage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+)
+
+// Stats describes how efficiently a version is stored, from its original size to the bytes its shards take up
+// Versions stored before the intermediate sizes were recorded report them, and the ratios derived from them, as zero
+type Stats struct {
+	OriginalSize   int64
+	CompressedSize int64
+	EncryptedSize  int64
+	// StoredSize is the combined size of every data and parity shard
+	StoredSize   int64
+	Compression  string
+	DataShards   int
+	ParityShards int
+	// Shared is set for deduplicated versions, whose shards belong to the version that first stored the content
+	Shared bool
+
+	// CompressionRatio is the compressed size over the original size; below 1 means compression saved space
+	CompressionRatio float64
+	// EncryptionOverhead is the number of bytes encryption added to the compressed payload
+	EncryptionOverhead int64
+	// RedundancyRatio is the stored size over the encrypted size, the cost of the parity shards and erasure padding
+	RedundancyRatio float64
+	// StorageRatio is the stored size over the original size, the end-to-end cost of storing the version
+	StorageRatio float64
+}
+
+// ObjectStats returns the storage efficiency of a version of an object
+// All sizes are read from the metadata recorded when the version was stored, so no shard is read
+func ObjectStats(db *sql.DB, bucketID, objectID, versionID string) (*Stats, error) {
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return nil, err
+	}
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	params := metadata.EncodingParams()
+	stats := &Stats{
+		OriginalSize:   versionSize(metadata),
+		CompressedSize: metadata.CompressedSize,
+		EncryptedSize:  metadata.EncryptedSize,
+		StoredSize:     metadata.StoredSize,
+		Compression:    metadata.Compression,
+		DataShards:     params.DataShards,
+		ParityShards:   params.ParityShards,
+		Shared:         metadata.ContentRef != "",
+	}
+	if stats.CompressedSize > 0 && stats.EncryptedSize > 0 {
+		stats.EncryptionOverhead = stats.EncryptedSize - stats.CompressedSize
+	}
+	stats.CompressionRatio = ratio(stats.CompressedSize, stats.OriginalSize)
+	stats.RedundancyRatio = ratio(stats.StoredSize, stats.EncryptedSize)
+	stats.StorageRatio = ratio(stats.StoredSize, stats.OriginalSize)
+	return stats, nil
+}
+
+// ratio returns n over d, or zero if either size is unknown
+func ratio(n, d int64) float64 {
+	if n <= 0 || d <= 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
@@ -1,17 +1,25 @@
 package datastorage
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"path/filepath"
+	"hash"
+	"io"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
 	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
 	"github.com/getvaultapp/vault-storage-engine/pkg/config"
 	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
 	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
 	"github.com/getvaultapp/vault-storage-engine/pkg/proofofinclusion"
 	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
 	"github.com/getvaultapp/vault-storage-engine/pkg/utils"
@@ -19,259 +27,942 @@ import (
 	"go.uber.org/zap"
 )
 
+// ErrInsufficientShards is returned when too few shards survive to reconstruct, or repair, an object
+var ErrInsufficientShards = errors.New("insufficient shards")
+
+// ErrPartialReconstruction is returned with the recoverable start of a version by a best-effort retrieval, as set with
+// TransferOptions.BestEffort, when a later chunk cannot be reconstructed
+var ErrPartialReconstruction = errors.New("object only partially reconstructed")
+
+// ErrObjectTooLarge is returned when an object being stored is larger than cfg.MaxObjectSize
+var ErrObjectTooLarge = errors.New("object too large")
+
+// ErrChecksumMismatch is returned when a reconstructed object does not match the checksum recorded when it was stored
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrSizeMismatch is returned, possibly wrapped, when a payload decompresses to fewer bytes than were recorded for it
+var ErrSizeMismatch = errors.New("decompressed size mismatch")
+
+// StoreError is returned by StoreData and StoreDataWithVersion when a store fails after shards were written, and
+// reports how far it got; the shards it wrote have already been deleted again, save for those listed in Cleanup
+// It wraps the error the store failed with, so errors.Is and errors.As see through it
+type StoreError struct {
+	Err error
+	// Written maps each shard written before the store failed, keyed "shard_<index>" as in ShardLocations, to its location
+	Written map[string]string
+	// Failed lists the indices of the shards that were not written, in order
+	Failed []int
+	// Cleanup reports the written shards that could not be deleted again, which are left behind; it is nil if every
+	// written shard was deleted
+	Cleanup *ShardCleanupError
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("%v (%d shards written, %d not written)", e.Err, len(e.Written), len(e.Failed))
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
 // StoreData stores an object inside a bucket
 // StoreData only works for a valid bucket, an invalid bucket would return an error
 // The files to be stored are provided an objectID and a versionID
 // The files to be treated are first compressed
-// After compression, they are encrypted
+// After compression, they are encrypted with a per-version data key, which is itself encrypted with the master key
 // Successful encrypted data is then sharded and sent to their respective locations
-func StoreData(db *sql.DB, data []byte, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, map[string]string, []string, error) {
-	// First check if the bucket exists
-	var bucketExists bool
+// params selects the redundancy scheme; the zero value uses the bucket's scheme, or the default one if it has none
+// The codec, compression level and cipher configured in cfg are overridden by those set with bucket.SetBucketSettings
+// The shards are produced by the erasure coder named by cfg.ErasureCoder, which is recorded so the version is always decoded with it
+// A version stored with a context from WithExpiration expires at the given time
+// A Progress callback set with WithTransferOptions is called as shards are written, with the size of data as the total
+// A store that would take the bucket over its quota fails with bucket.ErrQuotaExceeded, and data larger than
+// cfg.MaxObjectSize is rejected with ErrObjectTooLarge before it is compressed, as is user metadata set with
+// WithStoreOptions larger than cfg.MaxUserMetadataSize, with ErrMetadataTooLarge
+// The metadata is recorded in a single transaction once every shard is written; if anything fails, the transaction is
+// rolled back and the shards already written are deleted again, and once any shard was written the error is a
+// *StoreError reporting which
+// A principal set on ctx with audit.WithPrincipal needs acl.PermWrite on the object, or on the bucket for an object
+// that does not exist yet, and acl.ErrAccessDenied is returned otherwise
+// Stores, appends and deletes of the same object in this process run one at a time, as described for LockObject
+// A store under a StoreOptions.IdempotencyKey recorded for the object within cfg.IdempotencyWindow stores nothing,
+// and returns the version, shard locations and proofs of the store that recorded it
+func StoreData(ctx context.Context, db *sql.DB, data []byte, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, logger *zap.Logger) (string, map[string]string, []string, error) {
+	// Generate unique version ID
+	versionID := uuid.New().String()
 
-	// Check if the Bucket exists
-	query := "SELECT EXISTS(SELECT 1 FROM buckets WHERE bucket_id = ?)"
-	err := db.QueryRow(query, bucketID).Scan(&bucketExists)
+	return StoreDataWithVersion(ctx, db, data, bucketID, objectID, versionID, filePath, store, cfg, locations, params, logger)
+}
+
+// RetrieveData fetches an object from a bucket and reconstructs it
+// RetrieveData uses erasure-coding to implement fault-tolerance for lost shards
+// During retrieval, the shards are reconstructed with the erasure coder the version was stored with, regardless of the current config
+// As long as we have at least as many shards as the version has data shards, the reconstruction should be successful
+// The reconstrcuted data is decrypted, then decompressed
+// The result is checked against the checksum recorded when the object was stored
+// Every retrieval is recorded in the audit trail, attributed to the principal set on ctx
+// That principal needs acl.PermRead on the object, granted on it or on its bucket; so do the other retrieval functions
+// A Progress callback set with WithTransferOptions is called as shards are read, with the recorded file size as the total
+// With TransferOptions.ReadRepair, shards the reconstruction had to work around are rewritten before it returns, as they
+// are by the other retrieval functions
+func RetrieveData(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, string, error) {
+	data, _, err := retrieveData(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+	var filename string
+	if err == nil {
+		// Fetch filename from the database, since it follows renames of the object
+		filename, err = getObjectFilename(db, objectID)
+		if err != nil {
+			data = nil
+		}
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpRetrieve, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: int64(len(data))}, err)
+	return data, filename, err
+}
+
+// RetrieveWithMetadata retrieves a version like RetrieveData, and also returns the metadata it was reconstructed from
+// This saves callers that need the size, format or checksum of the version a second metadata lookup
+// The filename in the returned metadata is the object's current one, as RetrieveData returns, even if the object was
+// renamed after the version was stored
+func RetrieveWithMetadata(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, bucket.VersionMetadata, error) {
+	data, metadata, err := retrieveData(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+	if err == nil {
+		metadata.Filename, err = getObjectFilename(db, objectID)
+		if err != nil {
+			data = nil
+		}
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpRetrieve, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: int64(len(data))}, err)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to check if bucket exists, %w", err)
+		return nil, bucket.VersionMetadata{}, err
 	}
+	return data, *metadata, nil
+}
 
-	if !bucketExists {
-		return "", nil, nil, fmt.Errorf("bucket %s does not exists", bucketID)
+// RetrieveLatest retrieves the latest version of an object, as resolved by bucket.GetLatestMetadata, along with its metadata
+// A version stored concurrently may become the latest while the one resolved is being retrieved
+func RetrieveLatest(ctx context.Context, db *sql.DB, bucketID, objectID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, bucket.VersionMetadata, error) {
+	latest, err := bucket.GetLatestMetadata(db, bucketID, objectID)
+	if err != nil {
+		audit.Record(ctx, audit.Event{Operation: audit.OpRetrieve, BucketID: bucketID, ObjectID: objectID}, err)
+		return nil, bucket.VersionMetadata{}, err
 	}
+	return RetrieveWithMetadata(ctx, db, bucketID, objectID, latest.VersionID, store, cfg, logger)
+}
 
-	// Generate unique version ID
-	versionID := uuid.New().String()
+// retrieveData reconstructs a version for RetrieveData and RetrieveWithMetadata, which record it in the audit trail
+func retrieveData(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, *bucket.VersionMetadata, error) {
+	start := time.Now()
 
-	// Encrypt compressed data
-	key := cfg.EncryptionKey
-	cipherText, err := encryption.Encrypt(data, key)
-	if err != nil {
-		return "", nil, nil, fmt.Errorf("encryption failed: %w", err)
+	if err := authorize(ctx, db, bucketID, objectID, acl.PermRead); err != nil {
+		return nil, nil, err
+	}
+	// Objects in the trash cannot be retrieved until they are restored
+	if err := bucket.CheckObjectNotDeleted(db, objectID); err != nil {
+		return nil, nil, err
 	}
 
-	// Erasure code the encrypted data
-	shards, err := erasurecoding.Encode(cipherText)
+	// Fetch metadata
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("erasure coding failed: %w", err)
+		return nil, nil, fmt.Errorf("failed to retrieve metadata: %w", err)
 	}
 
-	// Generate Merkle proofs
-	tree, err := proofofinclusion.BuildMerkleTree(shards)
+	// The redundancy scheme is read from metadata, since objects may be encoded differently
+	params := metadata.EncodingParams()
+	size := versionSize(metadata)
+	progress := newProgressTracker(ctx, size)
+
+	if cfg.CacheBytes > 0 {
+		if data, ok := retrieveCache.get(bucketID, metadata); ok {
+			progress.complete()
+			metrics.ObserveRetrieve(bucketID, int64(len(data)), 0, time.Since(start))
+			return data, metadata, nil
+		}
+	}
+
+	key, err := versionKey(db, cfg, bucketID, metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Decrypt with the cipher the version was written with, regardless of the current config
+	payloadCipher, err := encryption.NewCipher(metadata.Cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	coder, err := erasurecoding.NewCoder(metadata.ErasureCoder, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Decompress with the codec the version was written with, regardless of the current config
+	compressor, err := versionCompressor(metadata)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+		return nil, nil, err
+	}
+	decode := func(shards [][]byte) ([]byte, error) {
+		return decodeVersion(shards, metadata, coder, payloadCipher, key, compressor, cfg)
 	}
 
-	// Store shards
-	shardLocations := make(map[string]string)
-	for idx, shard := range shards {
-		fmt.Printf("Storing shard %d, shard length: %d\n", idx, len(shard))
-		if idx >= len(locations) {
-			return "", nil, nil, fmt.Errorf("index out of range: idx=%d, locations length=%d", idx, len(locations))
+	// Deduplicated versions read the shards of the version that first stored the content
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+
+	// Replicated versions hold whole copies, so the first copy that decodes is enough
+	if metadata.StorageMode == bucket.StorageReplicated {
+		plainText, read, err := readReplica(ctx, store, shardObjectID, shardVersionID, versionLayout(metadata), progress.unit(size, 1), decode, cfg, logger)
+		if err != nil {
+			return nil, nil, err
 		}
-		location := locations[idx] // Use configured storage locations
-		err := store.StoreShard(objectID, versionID, idx, shard, location)
+		metrics.ObserveRetrieve(bucketID, int64(len(plainText)), read, time.Since(start))
+		retrieveCache.put(bucketID, metadata, plainText, cfg.CacheBytes)
+		return plainText, metadata, nil
+	}
+
+	// Retrieve shards, discarding any that fail proof verification
+	shards, missing := retrieveShards(ctx, store, shardObjectID, shardVersionID, versionLayout(metadata), progress.unit(size, params.TotalShards()), cfg, logger)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("retrieve aborted: %w", err)
+	}
+
+	// Check if we have enough shards to reconstruct
+	if missing > params.ParityShards {
+		return nil, nil, fmt.Errorf("%w for reconstruction", ErrInsufficientShards)
+	}
+
+	// Reconstruction fills in the missing shards, so count the ones actually read first
+	read := presentShards(shards)
+
+	// Fill in the missing shards before joining, so any DataShards of them are enough whichever indices survived
+	retrieved := append([][]byte(nil), shards...)
+	plainText, rebuilt, err := decodeShards(shards, versionLayout(metadata), coder, decode, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if transferOptionsFrom(ctx).ReadRepair {
+		readRepair(ctx, store, shardObjectID, shardVersionID, versionLayout(metadata), retrieved, rebuilt, cfg, logger)
+	}
+
+	progress.complete()
+	metrics.ObserveRetrieve(bucketID, int64(len(plainText)), read, time.Since(start))
+	retrieveCache.put(bucketID, metadata, plainText, cfg.CacheBytes)
+	return plainText, metadata, nil
+}
+
+// decodeVersion joins the reconstructed shards of a version stored as a single unit, then decrypts and decompresses them,
+// falling back on gzip for versions stored before their codec was recorded
+// The result is checked against the checksum recorded when the version was stored
+func decodeVersion(shards [][]byte, metadata *bucket.VersionMetadata, coder erasurecoding.ErasureCoder, payloadCipher encryption.Cipher, key []byte, compressor compression.Compressor, cfg *config.Config) ([]byte, error) {
+	// The exact ciphertext length is known for newer versions, so the erasure padding can be cut off rather than trimmed
+	var cipherText []byte
+	var err error
+	if metadata.EncryptedSize > 0 {
+		cipherText, err = coder.DecodeWithSize(shards, int(metadata.EncryptedSize))
+	} else {
+		cipherText, err = coder.Decode(shards)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erasure decoding failed: %w", err)
+	}
+
+	data, err := payloadCipher.Decrypt(cipherText, key)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	plainText, ok := legacyPayload(metadata, data, cfg)
+	if !ok {
+		plainText, err = decompressPayload(compressor, data, recordedSize(metadata), cfg)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to store shard %d: %w", idx, err)
+			return nil, err
 		}
-		shardLocations[fmt.Sprintf("shard_%d", idx)] = location
 	}
 
-	// Generate proof hashes
+	// Versions stored before checksums were recorded cannot be verified
+	if metadata.Checksum != "" {
+		if sum := checksum(plainText); sum != metadata.Checksum {
+			return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, metadata.Checksum, sum)
+		}
+	}
+	return plainText, nil
+}
+
+// StoreDataWithVersion is an alternative function to StoreData
+// It takes a pre-defined object version instead of defining it locally
+// This allows it cater for instances where a pre-defined object version has been provided
+// Every store is recorded in the audit trail, attributed to the principal set on ctx
+// The store holds the lock of the object, as taken by LockObject, for as long as it runs, and fails with
+// ErrObjectLockTimeout if another writer holds it for longer than cfg.ObjectLockTimeout
+func StoreDataWithVersion(ctx context.Context, db *sql.DB, data []byte, bucketID, objectID, versionID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, logger *zap.Logger) (string, map[string]string, []string, error) {
+	var stored string
+	var shardLocations map[string]string
 	var proofs []string
-	for _, shard := range shards {
-		proof, err := proofofinclusion.GetProof(tree, shard)
+	unlock, err := lockObject(ctx, objectID, cfg)
+	if err == nil {
+		stored, shardLocations, proofs, err = storeDataWithVersion(ctx, db, data, bucketID, objectID, versionID, filePath, store, cfg, locations, params, logger)
+		unlock()
+	}
+	// A store retried under an idempotency key returns the version the first one stored, rather than versionID
+	if stored != "" {
+		versionID = stored
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpStore, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: int64(len(data))}, err)
+	return stored, shardLocations, proofs, err
+}
+
+// storeDataWithVersion stores a version for StoreDataWithVersion, which records it in the audit trail
+func storeDataWithVersion(ctx context.Context, db *sql.DB, data []byte, bucketID, objectID, versionID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, logger *zap.Logger) (_ string, _ map[string]string, _ []string, err error) {
+	start := time.Now()
+
+	// First check if the bucket exists
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return "", nil, nil, err
+	}
+	if err := authorize(ctx, db, bucketID, objectID, acl.PermWrite); err != nil {
+		return "", nil, nil, err
+	}
+	// A retry of a store that already committed returns the version it created rather than storing another
+	prior, err := priorStore(ctx, db, cfg, bucketID, objectID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if prior != nil {
+		logger.Info("Store already committed under its idempotency key", zap.String("object_id", objectID), zap.String("version_id", prior.VersionID))
+		return prior.VersionID, prior.ShardLocations, utils.ConvertMapToSlice(prior.Proofs), nil
+	}
+
+	cfg, params, err = bucketConfig(db, cfg, bucketID, params)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := checkObjectSize(cfg, int64(len(data))); err != nil {
+		return "", nil, nil, err
+	}
+	if err := checkUserMetadata(ctx, cfg); err != nil {
+		return "", nil, nil, err
+	}
+	// Deduplicated versions still count in full towards the quota
+	if err := bucket.CheckBucketQuota(db, bucketID, int64(len(data))); err != nil {
+		return "", nil, nil, err
+	}
+	progress := newProgressTracker(ctx, int64(len(data)))
+
+	// Identical content already stored is referenced rather than stored again
+	// Looking it up needs the checksum up front; otherwise it is computed as the data is compressed
+	var sum string
+	if cfg.Dedup {
+		sum = checksum(data)
+		shared, err := bucket.AcquireContentRef(db, sum)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to get proof: %w", err)
+			return "", nil, nil, err
 		}
-		proofs = append(proofs, proof)
+		if shared != nil {
+			// The expiration time belongs to the version, not to the content it shares
+			shared.ExpiresAt = expirationFrom(ctx)
+			stored, shardLocations, proofs, err := storeReference(ctx, db, cfg, shared, bucketID, objectID, versionID, filePath, data, start)
+			if err == nil {
+				progress.complete()
+			}
+			return stored, shardLocations, proofs, err
+		}
+	}
+
+	// Until the metadata is committed nothing refers to the shards, so they are removed again on any failure,
+	// including a failure partway through writing them
+	metadata, cipherText, proofs, err := encodeVersion(ctx, db, data, sum, bucketID, objectID, versionID, filePath, store, cfg, locations, params, progress, logger)
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		cleanup := cleanupVersionShards(store, &metadata, logger)
+		// Versions that never got as far as erasure coding wrote no shards to report on
+		if total := metadata.DataShards + metadata.ParityShards; total > 0 && err != nil {
+			storeErr := &StoreError{Err: err, Written: metadata.ShardLocations, Cleanup: cleanup}
+			for i := 0; i < total; i++ {
+				if _, ok := metadata.ShardLocations[fmt.Sprintf("shard_%d", i)]; !ok {
+					storeErr.Failed = append(storeErr.Failed, i)
+				}
+			}
+			err = storeErr
+		}
+	}()
+	if err != nil {
+		return "", nil, nil, err
 	}
 
 	// Save object metadata in SQLite
+	// The content reference, version and object are recorded in a single transaction, so none of them outlive a failure
+	tx, err := db.Begin()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to begin transaction, %w", err)
+	}
+	defer tx.Rollback()
+
+	// The first version with this content owns its shards, which later identical versions reference
+	if cfg.Dedup {
+		ref := metadata
+		ref.ShardObjectID, ref.ShardVersionID = objectID, versionID
+		registered, err := bucket.AddContentRef(tx, metadata.Checksum, objectID, versionID, ref)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if registered {
+			metadata.ContentRef = metadata.Checksum
+		}
+	}
+
+	if err := recordStore(ctx, tx, cfg, bucketID, objectID, versionID); err != nil {
+		return "", nil, nil, err
+	}
+	if err := commitVersion(tx, bucketID, objectID, versionID, metadata, cipherText); err != nil {
+		return "", nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", nil, nil, fmt.Errorf("failed to commit version, %w", err)
+	}
+	committed = true
+
+	progress.complete()
+	metrics.ObserveStore(bucketID, int64(len(data)), metadata.CompressedSize, metadata.EncodingParams().TotalShards(), time.Since(start))
+	fmt.Printf("Stored %s as object %s (version %s) in bucket %s\n", filePath, objectID, versionID, bucketID)
+	return versionID, metadata.ShardLocations, proofs, nil
+}
+
+// encodeVersion compresses, encrypts and erasure codes data, writes its shards and returns the version metadata to record
+// The ciphertext and the proof of each shard are returned alongside the metadata
+// If writing fails, the locations of the shards already written and the redundancy scheme are returned in the metadata
+// so they can be cleaned up and reported
+// progress is credited with the bytes of data as its shards are written, and may be nil
+// sum is the checksum of data if the caller already has it; otherwise it is computed in the same pass that
+// compresses data
+func encodeVersion(ctx context.Context, db bucket.Querier, data []byte, sum string, bucketID, objectID, versionID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, progress *progressTracker, logger *zap.Logger) (bucket.VersionMetadata, []byte, []string, error) {
+	compressor, err := compression.NewWithLevel(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+
+	// Compress data, keeping it raw if compression does not help, and encrypt it with a fresh data key, which is
+	// stored wrapped with the master key
+	key, wrappedKey, err := newDataKey(db, cfg, bucketID)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+	payloadCipher, err := encryption.NewCipher(cfg.Cipher)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+	var plainHash hash.Hash
+	if sum == "" {
+		plainHash = sha256.New()
+	}
+	cipherText, payloadSize, compressed, err := sealPayload(compressor, payloadCipher, data, key, plainHash)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+	if plainHash != nil {
+		sum = hex.EncodeToString(plainHash.Sum(nil))
+	}
+	codec := compressor.Name()
+	if !compressed {
+		codec = compression.None
+	}
+
+	// Erasure code the encrypted data
+	mode, coderName, params := storageScheme(cfg, int64(len(data)), params)
+	coder, err := erasurecoding.NewCoder(coderName, params)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+	shards, err := coder.Encode(cipherText)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, fmt.Errorf("erasure coding failed: %w", err)
+	}
+
+	// Generate proof hashes, before any shard is written, so a hash algorithm that cannot be used leaves none behind
+	algorithm := hashAlgorithm(cfg.MerkleHash)
+	proofs, root, err := generateProofs(shards, algorithm)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+	hashes, err := shardHashes(shards, 0, algorithm)
+	if err != nil {
+		return bucket.VersionMetadata{}, nil, nil, err
+	}
+
+	// Store shards
+	// On failure the shards already written are returned so the caller can clean them up
+	shardLocations, err := storeShards(ctx, store, objectID, versionID, shards, locations, 0, progress.unit(int64(len(data)), len(shards)), cfg, logger)
+	if err != nil {
+		failed := bucket.VersionMetadata{ObjectID: objectID, VersionID: versionID, ShardLocations: shardLocations, DataShards: params.DataShards, ParityShards: params.ParityShards}
+		return failed, nil, nil, err
+	}
+
 	metadata := bucket.VersionMetadata{
 		BucketID:       bucketID,
 		ObjectID:       objectID,
 		VersionID:      versionID,
-		Filename:       filepath.Base(filePath),
-		Filesize:       "",
-		Format:         strings.TrimPrefix(filepath.Ext(filePath), "."),
-		CreationDate:   time.Now().Format(time.RFC3339),
+		Filesize:       strconv.Itoa(len(data)),
+		Checksum:       sum,
+		Compression:    codec,
+		Compressed:     compressed,
+		CompressedSize: int64(payloadSize),
+		EncryptedSize:  int64(len(cipherText)),
+		WrappedKey:     wrappedKey,
+		Cipher:         payloadCipher.Name(),
+		StoredSize:     shardBytes(shards),
+		CreationDate:   cfg.Now().Format(time.RFC3339),
+		ExpiresAt:      expirationFrom(ctx),
 		ShardLocations: shardLocations,
 		Proofs:         utils.ConvertSliceToMap(proofs),
+		MerkleRoot:     root,
+		ShardHashes:    hashes,
+		MerkleHash:     algorithm,
+		StorageMode:    mode,
+		ErasureCoder:   coder.Name(),
+		DataShards:     params.DataShards,
+		ParityShards:   params.ParityShards,
 	}
+	describeVersion(ctx, &metadata, filePath, data[:min(len(data), sniffLen)])
+	return metadata, cipherText, proofs, nil
+}
 
-	root_version, _ := bucket.GetRootVersion(db, objectID)
-	err = bucket.AddVersion(db, bucketID, objectID, versionID, root_version, metadata, cipherText)
-	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to add version to database: %w", err)
+// storageScheme returns the storage mode, erasure coder and redundancy scheme a version of size bytes is stored with
+// Objects below the erasure threshold are replicated instead, as splitting them costs more than it saves;
+// they get one copy per shard the scheme could lose, plus one, so they survive as many lost shards
+func storageScheme(cfg *config.Config, size int64, params erasurecoding.EncodingParams) (string, string, erasurecoding.EncodingParams) {
+	if size < cfg.ErasureMinSize {
+		return bucket.StorageReplicated, erasurecoding.Replication, erasurecoding.ReplicationParams(params.ParityShards + 1)
 	}
+	return bucket.StorageErasureCoded, cfg.ErasureCoder, params
+}
 
-	filename := filepath.Base(filePath)
-	// Ensure object exists in the database
-	err = bucket.AddObject(db, bucketID, objectID, filename)
-	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to register object in bucket: %w", err)
+// storeReference records a new version that shares the shards of identical content stored earlier
+// The version keeps the shared copy's redundancy scheme, locations and data key, whatever the caller asked for
+// The reference taken on the content is released again if the version cannot be recorded
+func storeReference(ctx context.Context, db *sql.DB, cfg *config.Config, shared *bucket.VersionMetadata, bucketID, objectID, versionID, filePath string, data []byte, start time.Time) (string, map[string]string, []string, error) {
+	metadata := *shared
+	metadata.BucketID = bucketID
+	metadata.ObjectID = objectID
+	metadata.VersionID = versionID
+	metadata.RootVersion = ""
+	metadata.CreationDate = cfg.Now().Format(time.RFC3339)
+	metadata.ContentRef = shared.Checksum
+	// The name and description belong to the version, not to the content it shares
+	describeVersion(ctx, &metadata, filePath, data[:min(len(data), sniffLen)])
+
+	if err := rewrapDataKey(db, cfg, &metadata, shared.BucketID, bucketID); err != nil {
+		bucket.ReleaseContentRef(db, shared.Checksum)
+		return "", nil, nil, err
+	}
+	if err := commitVersionTx(ctx, db, cfg, bucketID, objectID, versionID, metadata, []byte{}); err != nil {
+		bucket.ReleaseContentRef(db, shared.Checksum)
+		return "", nil, nil, err
 	}
 
-	fmt.Printf("Stored %s as object %s (version %s) in bucket %s\n", filePath, objectID, versionID, bucketID)
-	return versionID, shardLocations, proofs, nil
+	size, _ := strconv.ParseInt(metadata.Filesize, 10, 64)
+	metrics.ObserveStore(bucketID, size, metadata.CompressedSize, 0, time.Since(start))
+	fmt.Printf("Stored %s as object %s (version %s) in bucket %s, sharing the content of version %s\n", filePath, objectID, versionID, bucketID, metadata.ShardVersionID)
+	return versionID, metadata.ShardLocations, utils.ConvertMapToSlice(metadata.Proofs), nil
 }
 
-// RetrieveData fetches an object from a bucket and reconstructs it
-// RetrieveData uses erasure-coding to implement fault-tolerance for lost shards
-// During retrieval, the shards are reconstructed
-// As long as we have enough shards (in this case at least 4 of 6 shards) the reconstruction should be successful
-// The reconstrcuted data is decrypted, then decompressed
-func RetrieveData(db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) ([]byte, string, error) {
-	// Fetch metadata
-	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to retrieve metadata: %w", err)
+// Payloads are compressed exactly once, as plaintext, by the Compressor recorded in their version metadata; they are
+// then encrypted and erasure coded, and the shards are stored raw, as the coder produced them
+// Compressing shards as well would only spend time, since ciphertext does not compress, so the shard boundary only
+// accepts compression.None, and plaintext that is already compressed is never compressed again
+
+// checkShardCompression returns an error if cfg asks for shards to be compressed after erasure coding
+func checkShardCompression(cfg *config.Config) error {
+	if cfg.ShardCompression != "" && cfg.ShardCompression != compression.None {
+		return fmt.Errorf("unsupported shard compression %q: shards are stored raw once encrypted, and only the plaintext is compressed", cfg.ShardCompression)
 	}
+	return nil
+}
 
-	// Retrieve shards
-	totalShards := erasurecoding.DataShards + erasurecoding.ParityShards
-	shards := make([][]byte, totalShards)
-	missing := 0
+// compressPayload compresses data, falling back to the raw bytes when compression does not make it smaller
+// Already-compressed inputs such as images, video and archives usually grow when compressed again; inputs already
+// framed by a supported codec are stored raw without trying
+// The returned flag reports whether the payload is compressed
+func compressPayload(compressor compression.Compressor, data []byte) ([]byte, bool, error) {
+	if compressor.Name() == compression.None || compression.Detect(data) != compression.None {
+		return data, false, nil
+	}
+	compressed, err := compressor.Compress(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(compressed) >= len(data) {
+		return data, false, nil
+	}
+	return compressed, true, nil
+}
 
-	for shardKey, location := range metadata.ShardLocations {
-		shardIdxStr := strings.TrimPrefix(shardKey, "shard_")
-		shardIdx, err := strconv.Atoi(shardIdxStr)
+// sealPayload compresses data as compressPayload does and encrypts the payload, returning the ciphertext along with
+// the size of the payload and whether it is compressed
+// If hash is not nil, data is written to it as it is compressed, so checksumming the plaintext takes no pass of its own
+// For ciphers that encrypt in place, data is compressed straight into the buffer it is then encrypted in, so the
+// payload and the ciphertext share one copy rather than each taking one of their own
+func sealPayload(compressor compression.Compressor, payloadCipher encryption.Cipher, data, key []byte, hash io.Writer) ([]byte, int, bool, error) {
+	if hash == nil {
+		hash = io.Discard
+	}
+	inPlace, ok := payloadCipher.(encryption.InPlaceCipher)
+	if !ok {
+		hash.Write(data)
+		payload, compressed, err := compressPayload(compressor, data)
 		if err != nil {
-			logger.Warn("Invalid shard index", zap.String("shardKey", shardKey), zap.Error(err))
-			missing++
-			continue
+			return nil, 0, false, fmt.Errorf("compression failed: %w", err)
 		}
-		shard, err := store.RetrieveShard(objectID, versionID, shardIdx, location)
+		cipherText, err := payloadCipher.Encrypt(payload, key)
 		if err != nil {
-			logger.Warn("Shard retrieval failed", zap.String("shard", shardKey), zap.String("location", location))
-			missing++
-		} else {
-			shards[shardIdx] = shard
+			return nil, 0, false, fmt.Errorf("encryption failed: %w", err)
 		}
+		return cipherText, len(payload), compressed, nil
 	}
 
-	// Check if we have enough shards to reconstruct
-	if missing > erasurecoding.ParityShards {
-		return nil, "", fmt.Errorf("insufficient shards for reconstruction")
+	header := inPlace.HeaderSize()
+	buf, compressed, err := compressInto(compressor, data, header, payloadCipher.Overhead()-header, hash)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("compression failed: %w", err)
 	}
-
-	// Reconstruct file
-	cipherText, err := erasurecoding.Decode(shards)
+	payloadSize := len(buf) - header
+	cipherText, err := inPlace.EncryptInPlace(buf, key)
 	if err != nil {
-		return nil, "", fmt.Errorf("erasure decoding failed: %w", err)
+		return nil, 0, false, fmt.Errorf("encryption failed: %w", err)
+	}
+	return cipherText, payloadSize, compressed, nil
+}
+
+// compressInto returns a buffer of header bytes followed by the payload of data, compressed if that makes it smaller
+// and raw otherwise, leaving room for tail more bytes where it can
+// Compressors that stream write into the buffer directly, and are stopped as soon as their output grows as large as
+// data; the buffer never grows beyond the room the raw payload needs, and is reused for it then
+// data is also written to hash, block by block alongside the compressor where it streams
+func compressInto(compressor compression.Compressor, data []byte, header, tail int, hash io.Writer) ([]byte, bool, error) {
+	room := header + len(data) + tail
+	raw := func(buf []byte) []byte {
+		if cap(buf) < room {
+			buf = make([]byte, header, room)
+		}
+		return append(buf[:header], data...)
+	}
+	if compressor.Name() == compression.None || compression.Detect(data) != compression.None {
+		hash.Write(data)
+		return raw(nil), false, nil
+	}
+
+	streamer, ok := compressor.(compression.StreamCompressor)
+	if !ok {
+		hash.Write(data)
+		payload, compressed, err := compressPayload(compressor, data)
+		if err != nil {
+			return nil, false, err
+		}
+		if !compressed {
+			return raw(nil), false, nil
+		}
+		return append(make([]byte, header, header+len(payload)+tail), payload...), true, nil
 	}
 
-	// Decrypt file
-	key, err := bucket.GetEncryptionKey(cfg)
+	w := &boundedWriter{buf: make([]byte, header, min(room, header+64<<10)), limit: header + len(data) - 1, max: room}
+	zw, err := streamer.NewWriter(w)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to get encryption key: %w", err)
+		return nil, false, err
+	}
+	// Each block is hashed and compressed while it is still in cache; once the compressor is stopped, the rest of
+	// data is only hashed
+	for off := 0; off < len(data); off += hashBlockSize {
+		block := data[off:min(off+hashBlockSize, len(data))]
+		hash.Write(block)
+		if _, err = zw.Write(block); err != nil {
+			hash.Write(data[off+len(block):])
+			break
+		}
+	}
+	// The writer is closed even after a failed write, so it releases what it holds
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if w.full {
+		return raw(w.buf), false, nil
 	}
-	data, err := encryption.Decrypt(cipherText, key)
 	if err != nil {
-		return nil, "", fmt.Errorf("decryption failed: %w", err)
+		return nil, false, err
 	}
+	return w.buf, true, nil
+}
 
-	plainText := data
+// hashBlockSize is the size of the blocks compressInto hashes and compresses data in
+const hashBlockSize = 64 << 10
 
-	// Fetch filename from the database
-	var filename string
-	err = db.QueryRow(`SELECT filename FROM objects WHERE id = ?`, objectID).Scan(&filename)
+// errPayloadTooLarge stops a streaming compressor whose output is no smaller than its input
+var errPayloadTooLarge = errors.New("compressed payload is not smaller than the raw data")
+
+// boundedWriter appends to a buffer until it would pass limit bytes, failing every write from then on
+// The buffer doubles as it fills, but never grows beyond max bytes of capacity
+type boundedWriter struct {
+	buf   []byte
+	limit int
+	max   int
+	full  bool
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if w.full || len(w.buf)+len(p) > w.limit {
+		w.full = true
+		return 0, errPayloadTooLarge
+	}
+	if len(w.buf)+len(p) > cap(w.buf) {
+		grown := make([]byte, len(w.buf), min(max(2*cap(w.buf), len(w.buf)+len(p)), w.max))
+		copy(grown, w.buf)
+		w.buf = grown
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// checksum returns the hex-encoded SHA-256 of an object's original content
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// presentShards returns the number of shards that were successfully retrieved
+func presentShards(shards [][]byte) int {
+	n := 0
+	for _, shard := range shards {
+		if shard != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// reconstructShards rebuilds the missing shards of a unit in place
+// Running out of usable shards, for example because some were truncated, is reported as ErrInsufficientShards
+func reconstructShards(shards [][]byte, coder erasurecoding.ErasureCoder) error {
+	err := coder.Reconstruct(shards)
+	if errors.Is(err, erasurecoding.ErrTooFewShards) {
+		return fmt.Errorf("%w for reconstruction: %v", ErrInsufficientShards, err)
+	}
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to retrieve filename: %w", err)
+		return fmt.Errorf("erasure reconstruction failed: %w", err)
 	}
+	return nil
+}
 
-	return plainText, filename, nil
+// versionCompressor returns the compressor the payload of a version was written with, as recorded in its metadata
+// Payloads that compression did not shrink were stored raw, and are passed through as they are; versions flagged as
+// compressed without naming their codec predate the choice of codec, when gzip was the only one, and so are gzip
+func versionCompressor(metadata *bucket.VersionMetadata) (compression.Compressor, error) {
+	if !metadata.IsCompressed() {
+		return compression.NoneCompressor{}, nil
+	}
+	if metadata.Compression == "" {
+		return compression.GzipCompressor{}, nil
+	}
+	return compression.New(metadata.Compression)
 }
 
-// StoreDataWithVersion is an alternative function to StoreData
-// It takes a pre-defined object version instead of defining it locally
-// This allows it cater for instances where a pre-defined object version has been provided
-func StoreDataWithVersion(db *sql.DB, data []byte, bucketID, objectID, versionID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, logger *zap.Logger) (string, map[string]string, []string, error) {
-	// First check if the bucket exists
+// legacyPayload decompresses the payload of a version that records neither a codec nor whether it is compressed, as
+// versions written before either was recorded do, if it is framed as gzip, the codec of those versions, and reports
+// false otherwise so the payload is read raw
+// A payload that fails to decompress to the recorded size, or to match the recorded checksum, is also left to be read
+// raw, since it may be an uncompressed object that just happens to be gzip data itself
+func legacyPayload(metadata *bucket.VersionMetadata, data []byte, cfg *config.Config) ([]byte, bool) {
+	if metadata.Compression != "" || metadata.Compressed || compression.Detect(data) != compression.Gzip {
+		return nil, false
+	}
+	plainText, err := decompressPayload(compression.GzipCompressor{}, data, recordedSize(metadata), cfg)
+	if err != nil || (metadata.Checksum != "" && checksum(plainText) != metadata.Checksum) {
+		return nil, false
+	}
+	return plainText, true
+}
+
+// decompressPayload decompresses a payload recorded to hold size bytes, which it must decompress to exactly, failing
+// with compression.ErrDecompressionTooLarge as soon as it grows past them; payloads whose size was not recorded, with
+// a negative size, are held to cfg.MaxDecompressedSize, or cfg.MaxObjectSize when that is not set, instead
+func decompressPayload(compressor compression.Compressor, data []byte, size int64, cfg *config.Config) ([]byte, error) {
+	limit := size
+	if size < 0 {
+		limit = cfg.MaxDecompressedSize
+		if limit == 0 {
+			limit = cfg.MaxObjectSize
+		}
+		if limit == 0 {
+			limit = -1
+		}
+	}
+	plainText, err := compression.DecompressLimit(compressor, data, limit)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	if size >= 0 && int64(len(plainText)) != size {
+		return nil, fmt.Errorf("%w: decompressed to %d bytes, %d recorded", ErrSizeMismatch, len(plainText), size)
+	}
+	return plainText, nil
+}
+
+// recordedSize returns the size recorded for a version, or -1 for versions stored before sizes were recorded
+func recordedSize(metadata *bucket.VersionMetadata) int64 {
+	size, err := strconv.ParseInt(metadata.Filesize, 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// shardBytes returns the total number of bytes across all shards
+func shardBytes(shards [][]byte) int64 {
+	var total int64
+	for _, shard := range shards {
+		total += int64(len(shard))
+	}
+	return total
+}
+
+// checkObjectSize returns an error wrapping ErrObjectTooLarge if an object of size bytes exceeds cfg.MaxObjectSize
+func checkObjectSize(cfg *config.Config, size int64) error {
+	if cfg.MaxObjectSize > 0 && size > cfg.MaxObjectSize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrObjectTooLarge, size, cfg.MaxObjectSize)
+	}
+	return nil
+}
+
+// checkBucketExists returns an error unless the bucket is present in the database
+func checkBucketExists(db *sql.DB, bucketID string) error {
 	var bucketExists bool
 
 	// Check if the Bucket exists
 	query := "SELECT EXISTS(SELECT 1 FROM buckets WHERE bucket_id = ?)"
 	err := db.QueryRow(query, bucketID).Scan(&bucketExists)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to check if bucket exists, %w", err)
+		return fmt.Errorf("failed to check if bucket exists, %w", err)
 	}
 
 	if !bucketExists {
-		return "", nil, nil, fmt.Errorf("bucket %s does not exists", bucketID)
-	}
-
-	// Encrypt compressed data
-	key := cfg.EncryptionKey
-	cipherText, err := encryption.Encrypt(data, key)
-	if err != nil {
-		return "", nil, nil, fmt.Errorf("encryption failed: %w", err)
+		return fmt.Errorf("%w: %s", bucket.ErrBucketNotFound, bucketID)
 	}
+	return nil
+}
 
-	// Erasure code the encrypted data
-	shards, err := erasurecoding.Encode(cipherText)
-	if err != nil {
-		return "", nil, nil, fmt.Errorf("erasure coding failed: %w", err)
+// hashAlgorithm returns the name of a Merkle hash algorithm as configured or recorded, where the empty name stands for
+// proofofinclusion.DefaultHashAlgorithm, which versions stored before the algorithm was recorded all use
+func hashAlgorithm(name string) string {
+	if name == "" {
+		return proofofinclusion.DefaultHashAlgorithm
 	}
+	return name
+}
 
+// generateProofs builds a Merkle tree over the shards with the named hash algorithm and returns a proof of inclusion
+// for each, along with the tree's root
+func generateProofs(shards [][]byte, algorithm string) ([]string, string, error) {
 	// Generate Merkle proofs
-	tree, err := proofofinclusion.BuildMerkleTree(shards)
+	tree, err := proofofinclusion.BuildMerkleTree(shards, algorithm)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to build Merkle tree: %w", err)
+		return nil, "", fmt.Errorf("failed to build Merkle tree: %w", err)
 	}
 
-	// Store shards
-	shardLocations := make(map[string]string)
-	for idx, shard := range shards {
-		fmt.Printf("Storing shard %d, shard length: %d\n", idx, len(shard))
-		if idx >= len(locations) {
-			return "", nil, nil, fmt.Errorf("index out of range: idx=%d, locations length=%d", idx, len(locations))
-		}
-		location := locations[idx] // Use configured storage locations
-		err := store.StoreShard(objectID, versionID, idx, shard, location)
-		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to store shard %d: %w", idx, err)
-		}
-		shardLocations[fmt.Sprintf("shard_%d", idx)] = location
-	}
-
-	// Generate proof hashes
 	var proofs []string
 	for _, shard := range shards {
 		proof, err := proofofinclusion.GetProof(tree, shard)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to get proof: %w", err)
+			return nil, "", fmt.Errorf("failed to get proof: %w", err)
 		}
 		proofs = append(proofs, proof)
 	}
+	return proofs, proofofinclusion.GetRoot(tree), nil
+}
 
-	// Save object metadata in SQLite
-	metadata := bucket.VersionMetadata{
-		BucketID:       bucketID,
-		ObjectID:       objectID,
-		VersionID:      versionID,
-		Filename:       filepath.Base(filePath),
-		Filesize:       "",
-		Format:         strings.TrimPrefix(filepath.Ext(filePath), "."),
-		CreationDate:   time.Now().Format(time.RFC3339),
-		ShardLocations: shardLocations,
-		Proofs:         utils.ConvertSliceToMap(proofs),
+// shardHashes returns the hex-encoded Merkle leaf hash of each shard under the named hash algorithm, keyed
+// "shard_<index>" with indices counted from base
+func shardHashes(shards [][]byte, base int, algorithm string) (map[string]string, error) {
+	hashes := make(map[string]string, len(shards))
+	for i, shard := range shards {
+		hash, err := proofofinclusion.HashShard(shard, algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash shard %d: %w", base+i, err)
+		}
+		hashes[fmt.Sprintf("shard_%d", base+i)] = hex.EncodeToString(hash)
 	}
+	return hashes, nil
+}
 
-	root_version, _ := bucket.GetRootVersion(db, objectID)
-	err = bucket.AddVersion(db, bucketID, objectID, versionID, root_version, metadata, cipherText)
+// commitVersion records the version metadata and registers the object in its bucket
+// db must be a transaction, which the version chain is locked in until it ends, so concurrent stores of one object
+// each take the version before them as their parent
+// An object in the trash takes no new versions until it is restored or purged
+func commitVersion(db bucket.Querier, bucketID, objectID, versionID string, metadata bucket.VersionMetadata, data []byte) error {
+	// The current head becomes the parent; the first version of an object has none
+	root_version, parent, err := bucket.ResolveVersionChain(db, objectID)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to add version to database: %w", err)
+		return err
+	}
+	if err := bucket.CheckObjectNotDeleted(db, objectID); err != nil {
+		return err
+	}
+	metadata.ParentVersion = parent
+	err = bucket.AddVersion(db, bucketID, objectID, versionID, root_version, metadata, data)
+	if err != nil {
+		return fmt.Errorf("failed to add version to database: %w", err)
 	}
 
-	filename := filepath.Base(filePath)
 	// Ensure object exists in the database
-	err = bucket.AddObject(db, bucketID, objectID, filename)
+	err = bucket.AddObject(db, bucketID, objectID, metadata.Filename)
+	if err != nil {
+		return fmt.Errorf("failed to register object in bucket: %w", err)
+	}
+	return nil
+}
+
+// commitVersionTx records the version metadata and registers the object in its bucket in a single transaction, along
+// with the idempotency key set on ctx, if any
+func commitVersionTx(ctx context.Context, db *sql.DB, cfg *config.Config, bucketID, objectID, versionID string, metadata bucket.VersionMetadata, data []byte) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("failed to register object in bucket: %w", err)
+		return fmt.Errorf("failed to begin transaction, %w", err)
 	}
+	defer tx.Rollback()
 
-	fmt.Printf("Stored %s as object %s (version %s) in bucket %s\n", filePath, objectID, versionID, bucketID)
-	return versionID, shardLocations, proofs, nil
+	if err := recordStore(ctx, tx, cfg, bucketID, objectID, versionID); err != nil {
+		return err
+	}
+	if err := commitVersion(tx, bucketID, objectID, versionID, metadata, data); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit version, %w", err)
+	}
+	return nil
+}
+
+// cleanupVersionShards removes the shards written for a version that was not committed, and returns the shards that
+// could not be removed, or nil if there were none
+// Any shards no location is recorded for were never written, and are skipped
+func cleanupVersionShards(store sharding.ShardStore, metadata *bucket.VersionMetadata, logger *zap.Logger) *ShardCleanupError {
+	if len(metadata.AllShardLocations()) == 0 {
+		return nil
+	}
+	cleanup := &ShardCleanupError{}
+	// Any content reference was rolled back with the version, so the shards are deleted without consulting the database
+	owned := *metadata
+	owned.ContentRef = ""
+	deleteVersionShards(nil, &owned, store, cleanup, logger)
+	if len(cleanup.Failed) > 0 {
+		logger.Warn("failed to clean up shards of uncommitted version", zap.String("object_id", metadata.ObjectID), zap.String("version_id", metadata.VersionID), zap.Error(cleanup))
+		return cleanup
+	}
+	return nil
+}
+
+// getObjectFilename fetches the filename of an object from the database
+func getObjectFilename(db *sql.DB, objectID string) (string, error) {
+	var filename string
+	err := db.QueryRow(`SELECT filename FROM objects WHERE id = ?`, objectID).Scan(&filename)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w: %s", bucket.ErrObjectNotFound, objectID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve filename: %w", err)
+	}
+	return filename, nil
 }
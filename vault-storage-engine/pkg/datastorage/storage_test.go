@@ -0,0 +1,180 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+var testLocations = []string{"l1", "l2", "l3", "l4", "l5", "l6", "l7", "l8", "l9", "l10", "l11", "l12", "l13", "l14"}
+
+// newTestVault opens a fresh database holding the bucket b1, along with a config storing gzip-compressed versions
+// as single units
+func newTestVault(t *testing.T) (*sql.DB, *config.Config) {
+	t.Helper()
+	db, err := bucket.InitDBWithOptions(filepath.Join(t.TempDir(), "metadata.db"), bucket.DBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := bucket.CreateBucket(db, "b1", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		EncryptionKey:    bytes.Repeat([]byte{1}, 32),
+		Compression:      compression.Gzip,
+		CompressionLevel: -1,
+		ShardConcurrency: 3,
+	}
+	return db, cfg
+}
+
+// TestShardsStoredRaw checks that the shards handed to the shard store are exactly the erasure coding of the
+// ciphertext, with nothing applied to them afterwards, and that the ciphertext holds the plaintext compressed once
+func TestShardsStoredRaw(t *testing.T) {
+	db, cfg := newTestVault(t)
+	store := sharding.NewMemoryShardStore()
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("compressible content "), 500)
+
+	versionID, _, _, err := StoreData(ctx, db, data, "b1", "o1", "f.txt", store, cfg, testLocations, erasurecoding.DefaultParams(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := bucket.GetObjectMetadata(db, "o1", versionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.Compressed || metadata.Compression != compression.Gzip {
+		t.Fatalf("version recorded compressed %v with %q, want gzip", metadata.Compressed, metadata.Compression)
+	}
+
+	params := metadata.EncodingParams()
+	stored := make([][]byte, params.TotalShards())
+	for i := range stored {
+		stored[i], err = store.RetrieveShard(ctx, "o1", versionID, i, metadata.ShardLocations[fmt.Sprintf("shard_%d", i)])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	coder, err := erasurecoding.NewCoder(metadata.ErasureCoder, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText, err := coder.DecodeWithSize(append([][]byte(nil), stored...), int(metadata.EncryptedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := coder.Encode(cipherText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range stored {
+		if !bytes.Equal(stored[i], encoded[i]) {
+			t.Fatalf("shard %d differs from the erasure coding of the ciphertext", i)
+		}
+	}
+
+	key, err := versionKey(db, cfg, "b1", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadCipher, err := encryption.NewCipher(metadata.Cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := payloadCipher.Decrypt(cipherText, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(payload)) != metadata.CompressedSize {
+		t.Fatalf("payload is %d bytes, %d recorded", len(payload), metadata.CompressedSize)
+	}
+	plainText, err := compression.GzipCompressor{}.Decompress(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainText, data) {
+		t.Fatal("payload does not decompress to the stored data")
+	}
+}
+
+// TestNoDoubleCompression checks that plaintext already framed by a supported codec is stored as it is, with every
+// cipher, rather than compressed a second time
+func TestNoDoubleCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible content "), 500)
+	key := bytes.Repeat([]byte{2}, encryption.KeySize)
+
+	for _, codec := range []string{compression.Gzip, compression.Zstd} {
+		compressor, err := compression.New(codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		precompressed, err := compressor.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{encryption.AESCFB, encryption.AESGCM, encryption.ChaCha20Poly1305} {
+			t.Run(codec+"/"+name, func(t *testing.T) {
+				payload, compressed, err := compressPayload(compressor, precompressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed || !bytes.Equal(payload, precompressed) {
+					t.Fatal("compressPayload compressed a payload that was already compressed")
+				}
+
+				payloadCipher, err := encryption.NewCipher(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cipherText, size, compressed, err := sealPayload(compressor, payloadCipher, precompressed, key, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed || size != len(precompressed) {
+					t.Fatalf("sealPayload compressed a payload that was already compressed: %d bytes from %d", size, len(precompressed))
+				}
+				got, err := payloadCipher.Decrypt(cipherText, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, precompressed) {
+					t.Fatal("sealed payload does not decrypt to the input")
+				}
+			})
+		}
+	}
+}
+
+// TestStoreRejectsShardCompression checks that a store asked to compress its shards fails without recording anything
+func TestStoreRejectsShardCompression(t *testing.T) {
+	db, cfg := newTestVault(t)
+	store := sharding.NewMemoryShardStore()
+	cfg.ShardCompression = compression.Gzip
+
+	_, _, _, err := StoreData(context.Background(), db, []byte("data"), "b1", "o1", "f.txt", store, cfg, testLocations, erasurecoding.DefaultParams(), zap.NewNop())
+	if err == nil {
+		t.Fatal("store with shard compression succeeded")
+	}
+	exists, err := bucket.ObjectExists(db, "b1", "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("object was recorded")
+	}
+}
@@ -0,0 +1,561 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/acl"
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/compression"
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/encryption"
+	"github.com/getvaultapp/vault-storage-engine/pkg/erasurecoding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/metrics"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"github.com/getvaultapp/vault-storage-engine/pkg/utils"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// StoreDataStream stores an object read from r inside a bucket
+// Unlike StoreData it never holds the whole object in memory
+// The source is read in chunks of cfg.ChunkSize bytes, and each chunk is compressed, encrypted and erasure coded independently
+// The shard locations of every chunk are recorded in the version metadata
+// size is the expected length of the source; a source of a different length is rejected
+// A size of -1 stands for a source whose length is not known up front, such as a pipe, which is read to its end; as the
+// chunks are stored one at a time, the size is never needed up front, and the length read is the one recorded
+// Every store is recorded in the audit trail, attributed to the principal set on ctx, whose access is checked as in StoreData
+// A Progress callback set with WithTransferOptions is called as shards are written, with size as the total, and with
+// the length read as the total of its final call for a source of unknown size
+// A store that would take the bucket over its quota fails with bucket.ErrQuotaExceeded
+// A source that turns out larger than cfg.MaxObjectSize, or than the quota left for a source of unknown size, is
+// abandoned, with ErrObjectTooLarge or bucket.ErrQuotaExceeded, as soon as the chunk crossing the limit is read,
+// whatever size says, and the shards already written are deleted again
+// The lock of the object is held for as long as the store runs, and an idempotency key is honoured, as for StoreData;
+// a retried store returns the version and chunks the first one stored without reading r
+func StoreDataStream(ctx context.Context, db *sql.DB, r io.Reader, size int64, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, logger *zap.Logger) (string, []bucket.ChunkMetadata, error) {
+	var versionID string
+	var chunks []bucket.ChunkMetadata
+	unlock, err := lockObject(ctx, objectID, cfg)
+	if err == nil {
+		versionID, chunks, err = storeDataStream(ctx, db, r, size, bucketID, objectID, filePath, store, cfg, locations, params, logger)
+		unlock()
+	}
+	var stored int64
+	if err == nil {
+		for _, chunk := range chunks {
+			stored += chunk.Size
+		}
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpStore, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: stored}, err)
+	return versionID, chunks, err
+}
+
+// storeDataStream stores a streamed version for StoreDataStream, which records it in the audit trail
+func storeDataStream(ctx context.Context, db *sql.DB, r io.Reader, size int64, bucketID, objectID, filePath string, store sharding.ShardStore, cfg *config.Config, locations []string, params erasurecoding.EncodingParams, logger *zap.Logger) (string, []bucket.ChunkMetadata, error) {
+	start := time.Now()
+
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return "", nil, err
+	}
+	if err := authorize(ctx, db, bucketID, objectID, acl.PermWrite); err != nil {
+		return "", nil, err
+	}
+	// A retried store is answered without reading the source at all
+	prior, err := priorStore(ctx, db, cfg, bucketID, objectID)
+	if err != nil {
+		return "", nil, err
+	}
+	if prior != nil {
+		logger.Info("Store already committed under its idempotency key", zap.String("object_id", objectID), zap.String("version_id", prior.VersionID))
+		return prior.VersionID, prior.Chunks, nil
+	}
+
+	cfg, params, err = bucketConfig(db, cfg, bucketID, params)
+	if err != nil {
+		return "", nil, err
+	}
+	coder, err := erasurecoding.NewCoder(cfg.ErasureCoder, params)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkUserMetadata(ctx, cfg); err != nil {
+		return "", nil, err
+	}
+
+	// A source of unknown size is checked against the quota left as it is read instead, and again once it has been
+	var used, quota int64
+	if size >= 0 {
+		if err := checkObjectSize(cfg, size); err != nil {
+			return "", nil, err
+		}
+		if err := bucket.CheckBucketQuota(db, bucketID, size); err != nil {
+			return "", nil, err
+		}
+	} else {
+		used, quota, err = bucket.GetBucketUsage(db, bucketID)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	compressor, err := compression.NewWithLevel(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Every chunk is encrypted with the same per-version data key and cipher, each under a nonce of its own
+	key, wrappedKey, err := newDataKey(db, cfg, bucketID)
+	if err != nil {
+		return "", nil, err
+	}
+	payloadCipher, err := encryption.NewCipher(cfg.Cipher)
+	if err != nil {
+		return "", nil, err
+	}
+
+	chunkSize := cfg.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = config.DefaultChunkSize
+	}
+
+	// Generate unique version ID
+	versionID := uuid.New().String()
+	totalShards := params.TotalShards()
+	progress := newProgressTracker(ctx, size)
+
+	// A single buffer is reused for every chunk so peak memory is bounded by the chunk size
+	buf := make([]byte, chunkSize)
+	var chunks []bucket.ChunkMetadata
+	// Until the metadata is committed nothing refers to the shards, so every shard written is removed again on any failure
+	committed := false
+	defer func() {
+		if !committed {
+			cleanupVersionShards(store, &bucket.VersionMetadata{ObjectID: objectID, VersionID: versionID, Chunks: chunks}, logger)
+		}
+	}()
+	var total, compressedSize, encryptedSize, storedSize int64
+	anyCompressed := false
+	sum := sha256.New()
+	var head []byte
+
+	for idx := 0; ; idx++ {
+		if err := ctx.Err(); err != nil {
+			return "", nil, fmt.Errorf("store aborted before chunk %d: %w", idx, err)
+		}
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return "", nil, fmt.Errorf("failed to read chunk %d: %w", idx, readErr)
+		}
+		if n == 0 {
+			break
+		}
+		total += int64(n)
+		// The source may be longer than size claims, so the limit is enforced on what is actually read
+		if err := checkObjectSize(cfg, total); err != nil {
+			return "", nil, fmt.Errorf("store aborted at chunk %d: %w", idx, err)
+		}
+		if quota > 0 && used+total > quota {
+			return "", nil, fmt.Errorf("store aborted at chunk %d: %w: bucket %s uses %d of %d bytes, cannot store %d more",
+				idx, bucket.ErrQuotaExceeded, bucketID, used, quota, total)
+		}
+		// The buffer is reused for every chunk, so the start of the data is kept aside for describeVersion
+		if idx == 0 {
+			head = bytes.Clone(buf[:min(n, sniffLen)])
+		}
+
+		chunk, err := storeChunk(ctx, buf[:n], idx, objectID, versionID, store, cfg, locations, coder, compressor, payloadCipher, key, idx*totalShards, sum, progress, logger)
+		if err != nil {
+			// The shards of the failed chunk that were written are cleaned up with the rest
+			chunks = append(chunks, chunk)
+			return "", nil, err
+		}
+		chunks = append(chunks, chunk)
+		compressedSize += chunk.EncryptedSize - int64(payloadCipher.Overhead())
+		anyCompressed = anyCompressed || !chunk.Uncompressed
+		encryptedSize += chunk.EncryptedSize
+		storedSize += chunk.StoredSize
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	if size >= 0 && total != size {
+		return "", nil, fmt.Errorf("size mismatch: expected %d bytes, read %d bytes", size, total)
+	}
+	if size < 0 {
+		// Other stores may have used up the quota while the source was read
+		if err := bucket.CheckBucketQuota(db, bucketID, total); err != nil {
+			return "", nil, err
+		}
+		progress.resolve(total)
+	}
+
+	// Chunks are compressed independently, so the codec is only recorded if at least one chunk used it
+	codec := compressor.Name()
+	if !anyCompressed {
+		codec = compression.None
+	}
+
+	// Save object metadata in SQLite
+	metadata := bucket.VersionMetadata{
+		BucketID:       bucketID,
+		ObjectID:       objectID,
+		VersionID:      versionID,
+		Filesize:       strconv.FormatInt(total, 10),
+		Checksum:       hex.EncodeToString(sum.Sum(nil)),
+		Compression:    codec,
+		Compressed:     anyCompressed,
+		CompressedSize: compressedSize,
+		EncryptedSize:  encryptedSize,
+		WrappedKey:     wrappedKey,
+		Cipher:         payloadCipher.Name(),
+		StoredSize:     storedSize,
+		CreationDate:   cfg.Now().Format(time.RFC3339),
+		ExpiresAt:      expirationFrom(ctx),
+		ShardLocations: map[string]string{},
+		Proofs:         map[string]string{},
+		StorageMode:    bucket.StorageErasureCoded,
+		ErasureCoder:   coder.Name(),
+		DataShards:     params.DataShards,
+		ParityShards:   params.ParityShards,
+		ChunkSize:      chunkSize,
+		Chunks:         chunks,
+	}
+	describeVersion(ctx, &metadata, filePath, head)
+
+	// The shards hold the data, so no copy of the ciphertext is kept in SQLite
+	if err := commitVersionTx(ctx, db, cfg, bucketID, objectID, versionID, metadata, []byte{}); err != nil {
+		return "", nil, err
+	}
+	committed = true
+
+	progress.complete()
+	metrics.ObserveStore(bucketID, total, compressedSize, len(chunks)*totalShards, time.Since(start))
+	fmt.Printf("Stored %s as object %s (version %s) in bucket %s in %d chunks\n", filePath, objectID, versionID, bucketID, len(chunks))
+	return versionID, chunks, nil
+}
+
+// storeChunk compresses, encrypts, erasure codes and stores a single chunk of a streamed object
+// The chunk is written to hash as it is compressed, unless hash is nil
+// progress is credited with the bytes of the chunk as its shards are written
+func storeChunk(ctx context.Context, data []byte, idx int, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, locations []string, coder erasurecoding.ErasureCoder, compressor compression.Compressor, payloadCipher encryption.Cipher, key []byte, base int, hash io.Writer, progress *progressTracker, logger *zap.Logger) (bucket.ChunkMetadata, error) {
+	cipherText, _, compressed, err := sealPayload(compressor, payloadCipher, data, key, hash)
+	if err != nil {
+		return bucket.ChunkMetadata{}, fmt.Errorf("chunk %d: %w", idx, err)
+	}
+
+	shards, err := coder.Encode(cipherText)
+	if err != nil {
+		return bucket.ChunkMetadata{}, fmt.Errorf("erasure coding of chunk %d failed: %w", idx, err)
+	}
+
+	algorithm := hashAlgorithm(cfg.MerkleHash)
+	proofs, root, err := generateProofs(shards, algorithm)
+	if err != nil {
+		return bucket.ChunkMetadata{}, err
+	}
+	hashes, err := shardHashes(shards, base, algorithm)
+	if err != nil {
+		return bucket.ChunkMetadata{}, err
+	}
+
+	shardLocations, err := storeShards(ctx, store, objectID, versionID, shards, locations, base, progress.unit(int64(len(data)), len(shards)), cfg, logger)
+	if err != nil {
+		return bucket.ChunkMetadata{Index: idx, ShardLocations: shardLocations}, fmt.Errorf("failed to store chunk %d: %w", idx, err)
+	}
+
+	return bucket.ChunkMetadata{
+		Index:          idx,
+		Size:           int64(len(data)),
+		EncryptedSize:  int64(len(cipherText)),
+		Uncompressed:   !compressed,
+		StoredSize:     shardBytes(shards),
+		ShardLocations: shardLocations,
+		Proofs:         utils.ConvertSliceToMap(proofs),
+		MerkleRoot:     root,
+		ShardHashes:    hashes,
+		MerkleHash:     algorithm,
+	}, nil
+}
+
+// RetrieveDataStream fetches an object from a bucket and returns a reader over its content
+// Chunks are reconstructed lazily as the reader is consumed, so only one chunk is held in memory at a time
+// The object's checksum is verified once the reader reaches the end, which then returns ErrChecksumMismatch instead of io.EOF on a mismatch
+// Objects that were not stored in chunks are reconstructed with RetrieveData
+// With TransferOptions.BestEffort, the reader ends at the first chunk that cannot be reconstructed, returning an error
+// wrapping ErrPartialReconstruction there instead of the chunk's own error
+// Every retrieval is recorded in the audit trail when the reader is opened, with the size of the whole object
+// A Progress callback set with WithTransferOptions is called as shards are read, with the recorded file size as the total
+func RetrieveDataStream(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (io.ReadCloser, string, error) {
+	r, filename, size, err := retrieveDataStream(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+	audit.Record(ctx, audit.Event{Operation: audit.OpRetrieve, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: size}, err)
+	return r, filename, err
+}
+
+// retrieveDataStream opens a reader for RetrieveDataStream, which records it in the audit trail
+// The size of the object is returned alongside the reader
+func retrieveDataStream(ctx context.Context, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (io.ReadCloser, string, int64, error) {
+	if err := authorize(ctx, db, bucketID, objectID, acl.PermRead); err != nil {
+		return nil, "", 0, err
+	}
+	if err := bucket.CheckObjectNotDeleted(db, objectID); err != nil {
+		return nil, "", 0, err
+	}
+	metadata, err := bucket.GetObjectMetadata(db, objectID, versionID)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to retrieve metadata: %w", err)
+	}
+
+	if len(metadata.Chunks) == 0 {
+		data, _, err := retrieveData(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		filename, err := getObjectFilename(db, objectID)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), filename, int64(len(data)), nil
+	}
+
+	key, err := versionKey(db, cfg, bucketID, metadata)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	// Decompress and decrypt with the codec and cipher the version was written with, regardless of the current config
+	compressor, err := compression.New(metadata.Compression)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	payloadCipher, err := encryption.NewCipher(metadata.Cipher)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	coder, err := erasurecoding.NewCoder(metadata.ErasureCoder, metadata.EncodingParams())
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	filename, err := getObjectFilename(db, objectID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	var size int64
+	for _, chunk := range metadata.Chunks {
+		size += chunk.Size
+	}
+
+	// Deduplicated versions read the shards of the version that first stored the content
+	shardObjectID, shardVersionID := metadata.ShardOwner()
+	return &chunkReader{
+		ctx:        ctx,
+		objectID:   shardObjectID,
+		versionID:  shardVersionID,
+		chunks:     metadata.Chunks,
+		coder:      coder,
+		compressor: compressor,
+		cipher:     payloadCipher,
+		progress:   newProgressTracker(ctx, versionSize(metadata)),
+		bestEffort: transferOptionsFrom(ctx).BestEffort,
+		store:      store,
+		key:        key,
+		cfg:        cfg,
+		logger:     logger,
+		checksum:   metadata.Checksum,
+		sum:        sha256.New(),
+	}, filename, size, nil
+}
+
+// WriteObjectTo retrieves an object like RetrieveDataStream and writes its content to w, returning the bytes written
+// Chunked versions are written a chunk at a time as they are reconstructed, so only one chunk is held in memory;
+// versions that were not stored in chunks are reconstructed whole first, as RetrieveData does
+// An error past the first chunk leaves w holding part of the object, so callers serving it over HTTP can only abort
+// the response at that point
+// Every retrieval is recorded in the audit trail, with the bytes actually written
+func WriteObjectTo(ctx context.Context, w io.Writer, db *sql.DB, bucketID, objectID, versionID string, store sharding.ShardStore, cfg *config.Config, logger *zap.Logger) (int64, error) {
+	r, _, _, err := retrieveDataStream(ctx, db, bucketID, objectID, versionID, store, cfg, logger)
+	var written int64
+	if err == nil {
+		// Both readers implement io.WriterTo, so the content is written without an extra copy
+		written, err = io.Copy(w, r)
+		r.Close()
+	}
+	audit.Record(ctx, audit.Event{Operation: audit.OpRetrieve, BucketID: bucketID, ObjectID: objectID, VersionID: versionID, Bytes: written}, err)
+	return written, err
+}
+
+// chunkReader reconstructs the chunks of a streamed version one at a time
+type chunkReader struct {
+	ctx        context.Context
+	objectID   string
+	versionID  string
+	chunks     []bucket.ChunkMetadata
+	coder      erasurecoding.ErasureCoder
+	compressor compression.Compressor
+	cipher     encryption.Cipher
+	progress   *progressTracker
+	bestEffort bool
+	store      sharding.ShardStore
+	key        []byte
+	cfg        *config.Config
+	logger     *zap.Logger
+	next       int
+	recovered  int64
+	current    bytes.Reader
+	closed     bool
+	checksum   string
+	sum        hash.Hash
+}
+
+// Read implements io.Reader
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.closed {
+		return 0, errors.New("read on closed object stream")
+	}
+	for cr.current.Len() == 0 {
+		data, err := cr.nextChunk()
+		if err != nil {
+			return 0, err
+		}
+		cr.current.Reset(data)
+	}
+	return cr.current.Read(p)
+}
+
+// WriteTo implements io.WriterTo, writing each chunk to w as soon as it is reconstructed rather than copying it
+// through an intermediate buffer
+// The checksum is only verified once the last chunk is written, so w may already hold most of a corrupted object
+// when ErrChecksumMismatch is returned
+func (cr *chunkReader) WriteTo(w io.Writer) (int64, error) {
+	if cr.closed {
+		return 0, errors.New("read on closed object stream")
+	}
+	// Whatever a previous Read left of the current chunk comes first
+	written, err := cr.current.WriteTo(w)
+	if err != nil {
+		return written, err
+	}
+	for {
+		data, err := cr.nextChunk()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// nextChunk reconstructs the next chunk of the version, or returns io.EOF once every chunk has been
+// The whole object is checked against the checksum recorded when it was stored before io.EOF is returned
+func (cr *chunkReader) nextChunk() ([]byte, error) {
+	if cr.next >= len(cr.chunks) {
+		if cr.checksum != "" {
+			if got := hex.EncodeToString(cr.sum.Sum(nil)); got != cr.checksum {
+				return nil, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, cr.checksum, got)
+			}
+		}
+		cr.progress.complete()
+		return nil, io.EOF
+	}
+	chunk := cr.chunks[cr.next]
+	progress := cr.progress.unit(chunk.Size, cr.coder.Params().TotalShards())
+	data, err := decodeChunk(cr.ctx, chunk, cr.objectID, cr.versionID, cr.store, cr.cipher, cr.key, cr.coder, cr.compressor, progress, cr.cfg, cr.logger)
+	if err != nil {
+		if cr.bestEffort && chunkLost(err) {
+			return nil, partialError(cr.recovered, err)
+		}
+		return nil, err
+	}
+	cr.sum.Write(data)
+	cr.recovered += int64(len(data))
+	cr.next++
+	return data, nil
+}
+
+// Close implements io.Closer
+func (cr *chunkReader) Close() error {
+	cr.closed = true
+	cr.current.Reset(nil)
+	return nil
+}
+
+// decodeChunk retrieves and reconstructs a single chunk of a streamed version
+// progress is credited as the chunk's shards are read
+func decodeChunk(ctx context.Context, chunk bucket.ChunkMetadata, objectID, versionID string, store sharding.ShardStore, payloadCipher encryption.Cipher, key []byte, coder erasurecoding.ErasureCoder, compressor compression.Compressor, progress shardProgress, cfg *config.Config, logger *zap.Logger) ([]byte, error) {
+	params := coder.Params()
+	shards, missing := retrieveShards(ctx, store, objectID, versionID, chunkLayout(chunk, params), progress, cfg, logger)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("retrieve of chunk %d aborted: %w", chunk.Index, err)
+	}
+	if missing > params.ParityShards {
+		return nil, fmt.Errorf("%w for reconstruction of chunk %d", ErrInsufficientShards, chunk.Index)
+	}
+	retrieved := append([][]byte(nil), shards...)
+	plainText, rebuilt, err := decodeShards(shards, chunkLayout(chunk, params), coder, func(shards [][]byte) ([]byte, error) {
+		return decodeChunkShards(shards, chunk, payloadCipher, key, coder, compressor)
+	}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", chunk.Index, err)
+	}
+	if transferOptionsFrom(ctx).ReadRepair {
+		readRepair(ctx, store, objectID, versionID, chunkLayout(chunk, params), retrieved, rebuilt, cfg, logger)
+	}
+	return plainText, nil
+}
+
+// chunkLost reports whether err from decodeChunk means the chunk cannot be reconstructed from the shards that are left,
+// which a best-effort retrieval stops at, rather than the retrieval being aborted or misconfigured
+func chunkLost(err error) bool {
+	return errors.Is(err, ErrInsufficientShards) || errors.Is(err, ErrCorrupted)
+}
+
+// partialError reports that a best-effort retrieval stopped at err, with only the first recovered bytes returned
+func partialError(recovered int64, err error) error {
+	return fmt.Errorf("%w, %d bytes recovered: %w", ErrPartialReconstruction, recovered, err)
+}
+
+// decodeChunkShards joins the reconstructed shards of a chunk, then decrypts and decompresses them
+func decodeChunkShards(shards [][]byte, chunk bucket.ChunkMetadata, payloadCipher encryption.Cipher, key []byte, coder erasurecoding.ErasureCoder, compressor compression.Compressor) ([]byte, error) {
+	// The ciphertext size is known exactly, so the erasure padding is cut off rather than trimmed
+	// Chunks written before compression was added hold the plain chunk behind the IV
+	encryptedSize := chunk.EncryptedSize
+	if encryptedSize == 0 {
+		encryptedSize = chunk.Size + int64(payloadCipher.Overhead())
+	}
+	cipherText, err := coder.DecodeWithSize(shards, int(encryptedSize))
+	if err != nil {
+		return nil, fmt.Errorf("erasure decoding failed: %w", err)
+	}
+
+	data, err := payloadCipher.Decrypt(cipherText, key)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	// Chunks that compression did not shrink were stored raw
+	if chunk.Uncompressed {
+		compressor = compression.NoneCompressor{}
+	}
+	// The size of every chunk is recorded, so no configured limit is needed
+	return decompressPayload(compressor, data, chunk.Size, nil)
+}
@@ -0,0 +1,55 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/audit"
+	"github.com/getvaultapp/vault-storage-engine/pkg/bucket"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// PurgeDeleted permanently removes every object moved to the trash at or before before, along with its shards
+// It returns the number of objects reclaimed
+// Retention is per bucket, so a caller purging past it passes the current time less the longest retention in use;
+// objects restored, or locked by a concurrent writer, before they are claimed are skipped, as are objects with a
+// version under a retention lock at now
+// The metadata is removed before the shards, so an object can never be restored once its shards are going
+func PurgeDeleted(db *sql.DB, store sharding.ShardStore, before, now time.Time) (int, error) {
+	logger := zap.L()
+
+	deleted, err := bucket.ListDeletedObjects(db, before)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	cleanup := &ShardCleanupError{}
+	for _, candidate := range deleted {
+		versions, err := bucket.ClaimDeletedObject(db, candidate.BucketID, candidate.ObjectID, before, now)
+		if err != nil {
+			return purged, err
+		}
+		if versions == nil {
+			continue
+		}
+
+		var size int64
+		for i := range versions {
+			if _, err := deleteVersionShards(db, &versions[i], store, cleanup, logger); err != nil {
+				return purged, err
+			}
+			size += versionSize(&versions[i])
+		}
+		purged++
+		audit.Record(context.Background(), audit.Event{Operation: audit.OpPurge, BucketID: candidate.BucketID, ObjectID: candidate.ObjectID, Bytes: size}, nil)
+		logger.Info("Purged deleted object", zap.String("object_id", candidate.ObjectID), zap.Time("deleted_at", candidate.DeletedAt))
+	}
+
+	if len(cleanup.Failed) > 0 {
+		return purged, cleanup
+	}
+	return purged, nil
+}
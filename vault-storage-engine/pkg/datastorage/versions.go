@@ -0,0 +1,99 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/getvaultapp/vault-storage-engine/pkg/config"
+	"github.com/getvaultapp/vault-storage-engine/pkg/sharding"
+	"go.uber.org/zap"
+)
+
+// VersionErrors reports the versions RetrieveVersions could not reconstruct, keyed by version ID
+type VersionErrors map[string]error
+
+func (e VersionErrors) Error() string {
+	versionIDs := make([]string, 0, len(e))
+	for versionID := range e {
+		versionIDs = append(versionIDs, versionID)
+	}
+	sort.Strings(versionIDs)
+
+	msgs := make([]string, len(versionIDs))
+	for i, versionID := range versionIDs {
+		msgs[i] = fmt.Sprintf("version %s: %v", versionID, e[versionID])
+	}
+	return fmt.Sprintf("failed to retrieve %d versions: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e VersionErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// RetrieveVersions reconstructs several versions of an object concurrently and returns their content keyed by version ID
+// A version that fails does not fail the others: the versions that were reconstructed are returned alongside a
+// VersionErrors holding the error of each version that was not, and the error is nil only if every version was
+// Up to cfg.ShardConcurrency versions are reconstructed at a time, chunked ones included, and each is recorded in the
+// audit trail as its own retrieval
+func RetrieveVersions(db *sql.DB, bucketID, objectID string, versionIDs []string, store sharding.ShardStore, cfg *config.Config) (map[string][]byte, error) {
+	ctx := context.Background()
+	logger := zap.L()
+
+	if err := checkBucketExists(db, bucketID); err != nil {
+		return nil, err
+	}
+	concurrency := cfg.ShardConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string][]byte, len(versionIDs))
+		failed  = make(VersionErrors)
+		seen    = make(map[string]bool, len(versionIDs))
+		workers = make(chan struct{}, concurrency)
+	)
+
+	for _, versionID := range versionIDs {
+		// A version asked for twice is only reconstructed once
+		if seen[versionID] {
+			continue
+		}
+		seen[versionID] = true
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(versionID string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			var buf bytes.Buffer
+			_, err := WriteObjectTo(ctx, &buf, db, bucketID, objectID, versionID, store, cfg, logger)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[versionID] = err
+				return
+			}
+			results[versionID] = buf.Bytes()
+		}(versionID)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return results, failed
+	}
+	return results, nil
+}
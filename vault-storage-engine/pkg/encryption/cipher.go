@@ -0,0 +1,151 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Supported payload cipher names, as recorded in version metadata
+const (
+	AESCFB           = "aes-cfb"
+	AESGCM           = "aes-gcm"
+	ChaCha20Poly1305 = "chacha20poly1305"
+)
+
+// Cipher encrypts and decrypts whole payloads with a data-encryption key
+type Cipher interface {
+	Name() string
+	Encrypt(data, key []byte) ([]byte, error)
+	Decrypt(data, key []byte) ([]byte, error)
+	// Overhead is the number of bytes the ciphertext adds to the plaintext
+	Overhead() int
+}
+
+// InPlaceCipher is implemented by ciphers that can encrypt a payload within the buffer that holds it, so the plaintext
+// and ciphertext never take up memory of their own at the same time
+type InPlaceCipher interface {
+	// HeaderSize is the number of bytes the ciphertext carries ahead of the encrypted payload
+	HeaderSize() int
+	// EncryptInPlace encrypts the plaintext in buf[HeaderSize():] and fills in the header, returning the same
+	// ciphertext Encrypt would; it reuses buf's storage, growing into its spare capacity if the cipher appends a tag,
+	// and only copies the ciphertext elsewhere if there is not enough of it
+	EncryptInPlace(buf, key []byte) ([]byte, error)
+}
+
+// NewCipher returns the Cipher for a cipher name
+// An empty name selects AES-CFB, which every version stored before the cipher was recorded uses
+func NewCipher(name string) (Cipher, error) {
+	switch name {
+	case "", AESCFB:
+		return CFBCipher{}, nil
+	case AESGCM:
+		return AEADCipher{name: AESGCM, newAEAD: newGCM}, nil
+	case ChaCha20Poly1305:
+		return AEADCipher{name: ChaCha20Poly1305, newAEAD: chacha20poly1305.New}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %s", name)
+	}
+}
+
+// CFBCipher encrypts payloads with AES in CFB mode, with the IV prepended
+// It provides no integrity protection of its own; corruption is caught by the shard proofs and the object checksum
+type CFBCipher struct{}
+
+func (CFBCipher) Name() string { return AESCFB }
+
+func (CFBCipher) Encrypt(data, key []byte) ([]byte, error) { return Encrypt(data, key) }
+
+func (CFBCipher) Decrypt(data, key []byte) ([]byte, error) { return Decrypt(data, key) }
+
+func (CFBCipher) Overhead() int { return aes.BlockSize }
+
+func (CFBCipher) HeaderSize() int { return aes.BlockSize }
+
+func (CFBCipher) EncryptInPlace(buf, key []byte) ([]byte, error) {
+	if len(buf) < aes.BlockSize {
+		return nil, fmt.Errorf("buffer too short for IV")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	iv := buf[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(buf[aes.BlockSize:], buf[aes.BlockSize:])
+	return buf, nil
+}
+
+// AEADCipher encrypts payloads with an authenticated cipher, with a random nonce prepended
+// Decryption fails if the ciphertext was modified or the wrong key is used
+// A nonce is never derived from the key or the data: every call to Encrypt draws a fresh one from crypto/rand, so
+// encrypting the same payload twice yields different ciphertexts
+// Random 96-bit nonces stay safe for up to 2^32 payloads under one key, far more than the chunks or parts of a
+// version, which are the most payloads a data key is ever used for
+type AEADCipher struct {
+	name    string
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func (c AEADCipher) Name() string { return c.name }
+
+func (c AEADCipher) Encrypt(data, key []byte) ([]byte, error) {
+	aead, err := c.newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s cipher: %w", c.name, err)
+	}
+
+	// Reusing a nonce under the same key would reveal the keystream and allow forgeries, so a failure to draw a
+	// fresh one is an error rather than a reason to fall back to a fixed nonce
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (c AEADCipher) HeaderSize() int { return chacha20poly1305.NonceSize }
+
+func (c AEADCipher) EncryptInPlace(buf, key []byte) ([]byte, error) {
+	aead, err := c.newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s cipher: %w", c.name, err)
+	}
+	if len(buf) < aead.NonceSize() {
+		return nil, fmt.Errorf("buffer too short for nonce")
+	}
+
+	nonce := buf[:aead.NonceSize()]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	// The sealed payload is written over the plaintext, which starts right after the nonce
+	return aead.Seal(nonce, nonce, buf[aead.NonceSize():], nil), nil
+}
+
+func (c AEADCipher) Decrypt(data, key []byte) ([]byte, error) {
+	aead, err := c.newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s cipher: %w", c.name, err)
+	}
+
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Overhead is the same for AES-GCM and ChaCha20-Poly1305: a 12-byte nonce and a 16-byte tag
+func (c AEADCipher) Overhead() int { return chacha20poly1305.NonceSize + chacha20poly1305.Overhead }
@@ -0,0 +1,100 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEncryptFreshNonce checks that each cipher draws a fresh nonce or IV per call, so encrypting the same plaintext
+// twice under the same key yields different ciphertexts that both decrypt back to it
+func TestEncryptFreshNonce(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	plainText := []byte("the same plaintext, encrypted twice")
+
+	for _, name := range []string{AESCFB, AESGCM, ChaCha20Poly1305} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCipher(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := c.Encrypt(plainText, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := c.Encrypt(plainText, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(first, second) {
+				t.Fatalf("encrypting the same plaintext twice gave the same ciphertext %x", first)
+			}
+			for _, cipherText := range [][]byte{first, second} {
+				got, err := c.Decrypt(cipherText, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, plainText) {
+					t.Fatalf("decrypted to %q, want %q", got, plainText)
+				}
+			}
+		})
+	}
+}
+
+// TestCFBEncryptFreshIV checks the package-level Encrypt, which CFBCipher wraps, the same way
+func TestCFBEncryptFreshIV(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	plainText := []byte("the same plaintext, encrypted twice")
+
+	first, err := Encrypt(plainText, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Encrypt(plainText, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Fatalf("encrypting the same plaintext twice gave the same ciphertext %x", first)
+	}
+	for _, cipherText := range [][]byte{first, second} {
+		got, err := Decrypt(cipherText, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plainText) {
+			t.Fatalf("decrypted to %q, want %q", got, plainText)
+		}
+	}
+}
+
+// TestWrapKeyFreshNonce checks that wrapping the same data key twice under the same master key gives different
+// wrapped keys that both unwrap back to it
+func TestWrapKeyFreshNonce(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{9}, KeySize)
+	dek, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := WrapKey(dek, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := WrapKey(dek, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("wrapping the same key twice gave the same wrapped key %s", first)
+	}
+	for _, wrapped := range []string{first, second} {
+		got, err := UnwrapKey(wrapped, masterKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, dek) {
+			t.Fatalf("unwrapped to %x, want %x", got, dek)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package encryption
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
+
+	"golang.org/x/crypto/argon2"
 )
 
-// Encrypt encrypts data using AES
+// Encrypt encrypts data using AES in CFB mode
+// A fresh random IV is drawn for every call and prepended to the ciphertext, where Decrypt splits it off again
 func Encrypt(data, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -45,7 +48,103 @@ func Decrypt(data, key []byte) ([]byte, error) {
 	stream := cipher.NewCFBDecrypter(block, iv)
 	stream.XORKeyStream(ciphertext, ciphertext)
 
-	//return ciphertext, nil
+	// CFB does not pad, so the plaintext is returned as-is; trimming zero bytes would corrupt binary data
+	return ciphertext, nil
+}
+
+// KeySize is the length in bytes of the data-encryption keys generated by GenerateKey
+const KeySize = 32
+
+// GenerateKey returns a random data-encryption key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// SaltSize is the length in bytes of the salts generated by GenerateSalt, and the shortest salt DeriveKey accepts
+const SaltSize = 16
+
+// Argon2id cost parameters of DeriveKey, following the second recommended option of RFC 9106
+// Changing them changes every key derived, so data stored under the old parameters could no longer be read
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+// GenerateSalt returns a random salt for DeriveKey
+func GenerateSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// DeriveKey derives a master key of KeySize bytes from a passphrase and salt with Argon2id
+// The same passphrase and salt always derive the same key, so the salt must be kept for as long as the data it protects
+// Derivation is deliberately slow and memory-hard, at around 64 MiB per call, to make guessing passphrases expensive
+func DeriveKey(passphrase string, salt []byte) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	if len(salt) < SaltSize {
+		return nil, fmt.Errorf("salt too short: %d bytes, need at least %d", len(salt), SaltSize)
+	}
+	return argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, KeySize), nil
+}
+
+// WrapKey encrypts a data-encryption key with the master key and returns it hex-encoded
+// AES-GCM is used so that unwrapping with the wrong master key is detected rather than yielding a garbage key
+// Every wrap draws a fresh random nonce, since the master key wraps the data key of every version
+func WrapKey(dek, masterKey []byte) (string, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, dek, nil)), nil
+}
+
+// UnwrapKey decrypts a data-encryption key produced by WrapKey
+func UnwrapKey(wrapped string, masterKey []byte) ([]byte, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	dek, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	return dek, nil
+}
 
-	return bytes.Trim(ciphertext, "\x00"), nil
+// newGCM creates an AES-GCM cipher for the given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
 }
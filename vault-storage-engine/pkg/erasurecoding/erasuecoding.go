@@ -2,18 +2,75 @@ package erasurecoding
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 
 	"github.com/klauspost/reedsolomon"
 )
 
+// ErrTooFewShards is returned when fewer than DataShards usable shards are present
+var ErrTooFewShards = reedsolomon.ErrTooFewShards
+
+// ErrParityMismatch is returned when the data and parity shards of a unit are inconsistent, which means one of them is corrupted
+var ErrParityMismatch = errors.New("shards failed parity verification")
+
+// Default redundancy scheme, used when no EncodingParams are provided
 var (
 	DataShards   = 4
 	ParityShards = 2
 )
 
+// EncodingParams describes the redundancy scheme an object is encoded with
+type EncodingParams struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+}
+
+// DefaultParams returns the default redundancy scheme
+func DefaultParams() EncodingParams {
+	return EncodingParams{DataShards: DataShards, ParityShards: ParityShards}
+}
+
+// OrDefault returns the default redundancy scheme if no shard counts are set
+// This keeps objects stored before the scheme was recorded in metadata readable
+func (p EncodingParams) OrDefault() EncodingParams {
+	if p.DataShards == 0 && p.ParityShards == 0 {
+		return DefaultParams()
+	}
+	return p
+}
+
+// TotalShards returns the number of data and parity shards together
+func (p EncodingParams) TotalShards() int {
+	return p.DataShards + p.ParityShards
+}
+
+// Overhead returns the storage multiplier of a redundancy scheme, the bytes stored for every byte of payload
+// It is (data+parity)/data, ignoring the padding that rounds each shard up; it is 0 without any data shards
+func Overhead(dataShards, parityShards int) float64 {
+	if dataShards <= 0 {
+		return 0
+	}
+	return float64(dataShards+parityShards) / float64(dataShards)
+}
+
+// Validate checks that the shard counts describe a usable scheme
+func (p EncodingParams) Validate() error {
+	if p.DataShards <= 0 {
+		return fmt.Errorf("invalid data shard count: %d", p.DataShards)
+	}
+	if p.ParityShards < 0 {
+		return fmt.Errorf("invalid parity shard count: %d", p.ParityShards)
+	}
+	if p.TotalShards() > 256 {
+		return fmt.Errorf("too many shards: %d data + %d parity exceeds 256", p.DataShards, p.ParityShards)
+	}
+	return nil
+}
+
 // Encode splits and encodes the data into shards.
-func Encode(data []byte) ([][]byte, error) {
-	enc, err := reedsolomon.New(DataShards, ParityShards)
+func Encode(data []byte, params EncodingParams) ([][]byte, error) {
+	enc, err := reedsolomon.New(params.DataShards, params.ParityShards)
 	if err != nil {
 		return nil, err
 	}
@@ -28,17 +85,18 @@ func Encode(data []byte) ([][]byte, error) {
 }
 
 // Decode reconstructs the original data from shards.
-func Decode(shards [][]byte) ([]byte, error) {
-	enc, err := reedsolomon.New(DataShards, ParityShards)
+func Decode(shards [][]byte, params EncodingParams) ([]byte, error) {
+	enc, err := reedsolomon.New(params.DataShards, params.ParityShards)
 	if err != nil {
 		return nil, err
 	}
+	discardMismatchedShards(shards)
 	if err = enc.Reconstruct(shards); err != nil {
 		return nil, err
 	}
 	// Join shards back into a single byte slice.
 	var buf bytes.Buffer
-	if err = enc.Join(&buf, shards, len(shards[0])*DataShards); err != nil {
+	if err = enc.Join(&buf, shards, len(shards[0])*params.DataShards); err != nil {
 		return nil, err
 	}
 
@@ -46,3 +104,69 @@ func Decode(shards [][]byte) ([]byte, error) {
 
 	return bytes.Trim(buf.Bytes(), "\x00"), nil
 }
+
+// DecodeWithSize reconstructs the original data from shards when its exact length is known.
+// Unlike Decode it never trims bytes, so data that legitimately ends in zeros is preserved.
+func DecodeWithSize(shards [][]byte, size int, params EncodingParams) ([]byte, error) {
+	enc, err := reedsolomon.New(params.DataShards, params.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	discardMismatchedShards(shards)
+	if err = enc.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = enc.Join(&buf, shards, size); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Reconstruct rebuilds every missing shard, data and parity alike, in place.
+// Missing shards must be nil; any params.DataShards shards are enough, whichever indices they are at.
+// Present shards whose length differs from the others are treated as missing and rebuilt too.
+func Reconstruct(shards [][]byte, params EncodingParams) error {
+	if len(shards) != params.TotalShards() {
+		return fmt.Errorf("expected %d shards, got %d", params.TotalShards(), len(shards))
+	}
+	enc, err := reedsolomon.New(params.DataShards, params.ParityShards)
+	if err != nil {
+		return err
+	}
+	discardMismatchedShards(shards)
+	if err = enc.Reconstruct(shards); err != nil {
+		return err
+	}
+	ok, err := enc.Verify(shards)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrParityMismatch
+	}
+	return nil
+}
+
+// discardMismatchedShards sets shards whose length differs from the most common shard length to nil.
+// Every shard of a unit has the same length, so a truncated or padded shard is treated as missing
+// rather than failing the whole reconstruction.
+func discardMismatchedShards(shards [][]byte) {
+	counts := make(map[int]int)
+	for _, shard := range shards {
+		if len(shard) > 0 {
+			counts[len(shard)]++
+		}
+	}
+	size, best := 0, 0
+	for length, n := range counts {
+		if n > best || (n == best && length > size) {
+			size, best = length, n
+		}
+	}
+	for i, shard := range shards {
+		if len(shard) != size {
+			shards[i] = nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package erasurecoding
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Replication is the name of the coder that stores whole copies of the data, as recorded in version metadata
+const Replication = "replication"
+
+// ReplicationCoder stores the data as identical copies, one per shard.
+// It is meant for objects so small that splitting them is pure overhead; any single copy is enough to recover the data.
+// Its params always have one data shard, with every parity shard being another copy.
+type ReplicationCoder struct {
+	params EncodingParams
+}
+
+// NewReplicationCoder creates a new ReplicationCoder for params, which must have exactly one data shard.
+func NewReplicationCoder(params EncodingParams) (*ReplicationCoder, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if params.DataShards != 1 {
+		return nil, fmt.Errorf("invalid data shard count for replication: %d, must be 1", params.DataShards)
+	}
+	return &ReplicationCoder{params: params}, nil
+}
+
+// ReplicationParams returns the scheme that stores copies copies of the data.
+func ReplicationParams(copies int) EncodingParams {
+	return EncodingParams{DataShards: 1, ParityShards: copies - 1}
+}
+
+func (c *ReplicationCoder) Name() string { return Replication }
+
+func (c *ReplicationCoder) Params() EncodingParams { return c.params }
+
+func (c *ReplicationCoder) Encode(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("cannot replicate empty data")
+	}
+	shards := make([][]byte, c.params.TotalShards())
+	for i := range shards {
+		shards[i] = bytes.Clone(data)
+	}
+	return shards, nil
+}
+
+func (c *ReplicationCoder) Decode(shards [][]byte) ([]byte, error) {
+	shard, err := c.copyOf(shards)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(shard), nil
+}
+
+func (c *ReplicationCoder) DecodeWithSize(shards [][]byte, size int) ([]byte, error) {
+	shard, err := c.copyOf(shards)
+	if err != nil {
+		return nil, err
+	}
+	if len(shard) < size {
+		return nil, fmt.Errorf("copy holds %d bytes, expected %d", len(shard), size)
+	}
+	return bytes.Clone(shard[:size]), nil
+}
+
+// Reconstruct replaces every missing copy with one of the surviving copies.
+// Surviving copies that differ from each other are reported as ErrParityMismatch.
+func (c *ReplicationCoder) Reconstruct(shards [][]byte) error {
+	shard, err := c.copyOf(shards)
+	if err != nil {
+		return err
+	}
+	for _, other := range shards {
+		if other != nil && !bytes.Equal(other, shard) {
+			return ErrParityMismatch
+		}
+	}
+	for i := range shards {
+		if shards[i] == nil {
+			shards[i] = bytes.Clone(shard)
+		}
+	}
+	return nil
+}
+
+// copyOf returns the first surviving copy among shards.
+func (c *ReplicationCoder) copyOf(shards [][]byte) ([]byte, error) {
+	if len(shards) != c.params.TotalShards() {
+		return nil, fmt.Errorf("expected %d shards, got %d", c.params.TotalShards(), len(shards))
+	}
+	for _, shard := range shards {
+		if shard != nil {
+			return shard, nil
+		}
+	}
+	return nil, ErrTooFewShards
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "vault"
+	subsystem = "storage"
+)
+
+// Collectors for storage operations, split by bucket
+// They record values whether or not they have been registered, so RegisterMetrics is only needed to expose them
+var (
+	objectsStored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "objects_stored_total",
+		Help:      "Number of object versions stored.",
+	}, []string{"bucket"})
+
+	objectsRetrieved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "objects_retrieved_total",
+		Help:      "Number of object versions retrieved.",
+	}, []string{"bucket"})
+
+	bytesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "bytes_processed_total",
+		Help:      "Number of original object bytes stored or retrieved.",
+	}, []string{"bucket", "operation"})
+
+	shardsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "shards_written_total",
+		Help:      "Number of shards written to shard stores, including repaired shards.",
+	}, []string{"bucket"})
+
+	shardsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "shards_read_total",
+		Help:      "Number of shards read from shard stores.",
+	}, []string{"bucket"})
+
+	shardsRepaired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "shards_repaired_total",
+		Help:      "Number of missing or corrupted shards rebuilt by repair.",
+	}, []string{"bucket"})
+
+	compressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "compression_ratio",
+		Help:      "Ratio of original to stored payload size for each stored object.",
+		Buckets:   []float64{1, 1.25, 1.5, 2, 3, 5, 10, 20},
+	}, []string{"bucket"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "cache_lookups_total",
+		Help:      "Number of lookups in the cache of retrieved object versions, by whether they hit.",
+	}, []string{"bucket", "result"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of storage operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"bucket", "operation"})
+)
+
+// RegisterMetrics registers the storage collectors with reg
+func RegisterMetrics(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		objectsStored,
+		objectsRetrieved,
+		bytesProcessed,
+		shardsWritten,
+		shardsRead,
+		shardsRepaired,
+		compressionRatio,
+		cacheLookups,
+		operationDuration,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return fmt.Errorf("failed to register storage metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// ObserveStore records a successful store of an object version
+// size is the original object size and payloadSize the size after compression
+func ObserveStore(bucketID string, size, payloadSize int64, shards int, elapsed time.Duration) {
+	objectsStored.WithLabelValues(bucketID).Inc()
+	bytesProcessed.WithLabelValues(bucketID, "store").Add(float64(size))
+	shardsWritten.WithLabelValues(bucketID).Add(float64(shards))
+	if payloadSize > 0 {
+		compressionRatio.WithLabelValues(bucketID).Observe(float64(size) / float64(payloadSize))
+	}
+	operationDuration.WithLabelValues(bucketID, "store").Observe(elapsed.Seconds())
+}
+
+// ObserveRetrieve records a successful retrieval of an object version
+func ObserveRetrieve(bucketID string, size int64, shards int, elapsed time.Duration) {
+	objectsRetrieved.WithLabelValues(bucketID).Inc()
+	bytesProcessed.WithLabelValues(bucketID, "retrieve").Add(float64(size))
+	shardsRead.WithLabelValues(bucketID).Add(float64(shards))
+	operationDuration.WithLabelValues(bucketID, "retrieve").Observe(elapsed.Seconds())
+}
+
+// ObserveRepair records a successful repair of an object version
+func ObserveRepair(bucketID string, repaired int, elapsed time.Duration) {
+	shardsRepaired.WithLabelValues(bucketID).Add(float64(repaired))
+	shardsWritten.WithLabelValues(bucketID).Add(float64(repaired))
+	operationDuration.WithLabelValues(bucketID, "repair").Observe(elapsed.Seconds())
+}
+
+// ObserveCacheLookup records a lookup in the cache of retrieved object versions
+func ObserveCacheLookup(bucketID string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(bucketID, result).Inc()
+}
@@ -0,0 +1,150 @@
+package proofofinclusion
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrProofMismatch is returned when a shard or shard hash does not match its exported proof
+var ErrProofMismatch = errors.New("shard failed proof verification")
+
+// InclusionProof is a portable record of the Merkle proofs of an object version's shards, meant to be exported as JSON
+// and checked by third parties with VerifyExportedProof
+// A leaf is the hash of the lowercase hex encoding of a shard, and a node the hash of its left child followed by its
+// right child; proofs are comma-separated "side:hash" steps from the leaf up, where side is 1 if the sibling hash sits
+// to the right and 0 if it sits to the left
+// HashAlgorithm names the hash of every leaf and node, as passed to NewHash, unless a shard names one of its own
+type InclusionProof struct {
+	BucketID      string `json:"bucket_id"`
+	ObjectID      string `json:"object_id"`
+	VersionID     string `json:"version_id"`
+	HashAlgorithm string `json:"hash_algorithm"`
+	// MerkleRoot is the root over every shard of the version, and is empty for streamed versions, whose chunks each
+	// have a root of their own
+	MerkleRoot string       `json:"merkle_root,omitempty"`
+	Shards     []ShardProof `json:"shards"`
+}
+
+// ShardProof is the proof of inclusion of a single shard
+type ShardProof struct {
+	// Index is the shard index across the whole version
+	Index int `json:"index"`
+	// Hash is the hex-encoded leaf hash of the shard, and is empty if it could not be recovered from the recorded proofs
+	Hash       string `json:"hash,omitempty"`
+	Proof      string `json:"proof"`
+	MerkleRoot string `json:"merkle_root"`
+	// HashAlgorithm overrides the algorithm of the whole proof for this shard, for versions whose chunks were stored
+	// under different hash policies
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+}
+
+// LeafHashes recovers the hex-encoded leaf hashes of a tree built with the named algorithm from the proofs of its
+// leaves, given in leaf order
+// Only proofs are recorded when shards are stored, but the first step of each proof is the hash of a neighbouring leaf,
+// so every leaf hash that appears there and verifies under the leaf's own proof is recovered
+// Leaves whose proof is empty, or whose hash cannot be recovered, are returned as empty strings
+func LeafHashes(root string, proofs []string, algorithm string) []string {
+	var candidates [][]byte
+	for _, proof := range proofs {
+		step, _, _ := strings.Cut(proof, ",")
+		if _, siblingHex, ok := strings.Cut(step, ":"); ok {
+			if sibling, err := hex.DecodeString(siblingHex); err == nil {
+				candidates = append(candidates, sibling)
+			}
+		}
+	}
+
+	hashes := make([]string, len(proofs))
+	for i, proof := range proofs {
+		if proof == "" {
+			continue
+		}
+		for _, candidate := range candidates {
+			if ok, err := VerifyProof(root, candidate, proof, algorithm); err == nil && ok {
+				hashes[i] = hex.EncodeToString(candidate)
+				break
+			}
+		}
+	}
+	return hashes
+}
+
+// VerifyExportedProof checks an exported InclusionProof, given as JSON, against the shards a third party holds
+// shards is indexed by shard index, and shards that are not held may be left nil
+// Every shard hash recorded in the proof is checked against its Merkle root, and every shard given is checked
+// against both its recorded hash and its proof; a shard given at an index the proof has no entry for fails
+func VerifyExportedProof(data []byte, shards [][]byte) error {
+	var exported InclusionProof
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return fmt.Errorf("failed to decode proof: %w", err)
+	}
+	// An empty algorithm is not taken for the default here, since every exported proof names its own
+	if _, err := NewHash(exported.HashAlgorithm); err != nil || exported.HashAlgorithm == "" {
+		return fmt.Errorf("unsupported hash algorithm: %q", exported.HashAlgorithm)
+	}
+	if len(exported.Shards) == 0 {
+		return fmt.Errorf("proof has no shards")
+	}
+
+	proven := make(map[int]bool, len(exported.Shards))
+	for _, shardProof := range exported.Shards {
+		if proven[shardProof.Index] {
+			return fmt.Errorf("proof has shard %d more than once", shardProof.Index)
+		}
+		proven[shardProof.Index] = true
+		if shardProof.HashAlgorithm == "" {
+			shardProof.HashAlgorithm = exported.HashAlgorithm
+		} else if _, err := NewHash(shardProof.HashAlgorithm); err != nil {
+			return fmt.Errorf("unsupported hash algorithm for shard %d: %q", shardProof.Index, shardProof.HashAlgorithm)
+		}
+
+		var recorded []byte
+		if shardProof.Hash != "" {
+			var err error
+			recorded, err = hex.DecodeString(shardProof.Hash)
+			if err != nil {
+				return fmt.Errorf("invalid hash for shard %d: %w", shardProof.Index, err)
+			}
+			if err := verifyLeaf(shardProof, recorded); err != nil {
+				return err
+			}
+		}
+
+		if shardProof.Index < 0 || shardProof.Index >= len(shards) || shards[shardProof.Index] == nil {
+			continue
+		}
+		shardHash, err := HashShard(shards[shardProof.Index], shardProof.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		if recorded != nil && !bytes.Equal(shardHash, recorded) {
+			return fmt.Errorf("%w: shard %d does not match its recorded hash", ErrProofMismatch, shardProof.Index)
+		}
+		if err := verifyLeaf(shardProof, shardHash); err != nil {
+			return err
+		}
+	}
+
+	for i, shard := range shards {
+		if shard != nil && !proven[i] {
+			return fmt.Errorf("%w: no proof for shard %d", ErrProofMismatch, i)
+		}
+	}
+	return nil
+}
+
+// verifyLeaf checks that a leaf hash is included under the Merkle root of a shard proof
+func verifyLeaf(shardProof ShardProof, leaf []byte) error {
+	ok, err := VerifyProof(shardProof.MerkleRoot, leaf, shardProof.Proof, shardProof.HashAlgorithm)
+	if err != nil {
+		return fmt.Errorf("failed to verify proof of shard %d: %w", shardProof.Index, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: shard %d is not included under its Merkle root", ErrProofMismatch, shardProof.Index)
+	}
+	return nil
+}
@@ -1,21 +1,64 @@
 package proofofinclusion
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"strings"
 
 	"github.com/cbergoon/merkletree"
+	"golang.org/x/crypto/blake2b"
 )
 
+// Hash algorithms a Merkle tree can be built with
+const (
+	SHA256  = "sha256"
+	SHA512  = "sha512"
+	BLAKE2b = "blake2b"
+)
+
+// DefaultHashAlgorithm is the hash used when none is configured, and the one every tree built before the algorithm
+// was recorded uses
+const DefaultHashAlgorithm = SHA256
+
+// NewHash returns the constructor of the named hash algorithm, which is used for both the leaves and the nodes of a
+// tree; the empty name stands for DefaultHashAlgorithm
+func NewHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "", SHA256:
+		return sha256.New, nil
+	case SHA512:
+		return sha512.New, nil
+	case BLAKE2b:
+		return newBLAKE2b, nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %q", algorithm)
+	}
+}
+
+// newBLAKE2b returns an unkeyed BLAKE2b-512 hash, which cannot fail to be created without a key
+func newBLAKE2b() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
 // Content represents the content stored in the Merkle tree
+// Algorithm names the hash the content is hashed with, as passed to NewHash
 type Content struct {
-	X string
+	X         string
+	Algorithm string
 }
 
 // CalculateHash hashes the values of a Content
 func (c Content) CalculateHash() ([]byte, error) {
-	h := sha256.New()
+	newHash, err := NewHash(c.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h := newHash()
 	if _, err := h.Write([]byte(c.X)); err != nil {
 		return nil, fmt.Errorf("failed to hash content: %w", err)
 	}
@@ -27,14 +70,18 @@ func (c Content) Equals(other merkletree.Content) (bool, error) {
 	return c.X == other.(Content).X, nil
 }
 
-// BuildMerkleTree builds a Merkle tree from the given shards
-func BuildMerkleTree(shards [][]byte) (*merkletree.MerkleTree, error) {
+// BuildMerkleTree builds a Merkle tree from the given shards, hashing its leaves and nodes with the named algorithm
+func BuildMerkleTree(shards [][]byte, algorithm string) (*merkletree.MerkleTree, error) {
+	newHash, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
 	var list []merkletree.Content
 	for _, shard := range shards {
-		list = append(list, Content{X: hex.EncodeToString(shard)})
+		list = append(list, Content{X: hex.EncodeToString(shard), Algorithm: algorithm})
 	}
 
-	tree, err := merkletree.NewTree(list)
+	tree, err := merkletree.NewTreeWithHashStrategy(list, newHash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Merkle tree: %w", err)
 	}
@@ -42,12 +89,71 @@ func BuildMerkleTree(shards [][]byte) (*merkletree.MerkleTree, error) {
 	return tree, nil
 }
 
+// GetRoot returns the hex-encoded Merkle root of the tree
+func GetRoot(tree *merkletree.MerkleTree) string {
+	return hex.EncodeToString(tree.MerkleRoot())
+}
+
+// HashShard returns the leaf hash of a shard, as used in a Merkle tree built with the named algorithm
+func HashShard(shard []byte, algorithm string) ([]byte, error) {
+	return Content{X: hex.EncodeToString(shard), Algorithm: algorithm}.CalculateHash()
+}
+
 // GetProof generates a proof of inclusion for a given shard
+// The proof is the Merkle path from the shard up to the root, encoded as comma-separated "side:hash" steps,
+// where side is 1 if the sibling hash sits to the right and 0 if it sits to the left
 func GetProof(tree *merkletree.MerkleTree, shard []byte) (string, error) {
-	proof, _, err := tree.GetMerklePath(Content{X: hex.EncodeToString(shard)})
+	path, index, err := tree.GetMerklePath(Content{X: hex.EncodeToString(shard)})
 	if err != nil {
 		return "", fmt.Errorf("failed to get Merkle proof: %w", err)
 	}
+	if len(path) == 0 {
+		return "", fmt.Errorf("failed to get Merkle proof: shard not in tree")
+	}
+
+	steps := make([]string, len(path))
+	for i, sibling := range path {
+		steps[i] = fmt.Sprintf("%d:%s", index[i], hex.EncodeToString(sibling))
+	}
+	return strings.Join(steps, ","), nil
+}
+
+// VerifyProof checks that a shard with the given leaf hash is included under the hex-encoded Merkle root of a tree
+// built with the named algorithm
+func VerifyProof(root string, shardHash []byte, proof, algorithm string) (bool, error) {
+	newHash, err := NewHash(algorithm)
+	if err != nil {
+		return false, err
+	}
+	expected, err := hex.DecodeString(root)
+	if err != nil {
+		return false, fmt.Errorf("invalid Merkle root: %w", err)
+	}
+
+	current := shardHash
+	for _, step := range strings.Split(proof, ",") {
+		side, siblingHex, ok := strings.Cut(step, ":")
+		if !ok {
+			return false, fmt.Errorf("unsupported proof format")
+		}
+		sibling, err := hex.DecodeString(siblingHex)
+		if err != nil {
+			return false, fmt.Errorf("invalid proof hash: %w", err)
+		}
+
+		h := newHash()
+		switch side {
+		case "1":
+			h.Write(current)
+			h.Write(sibling)
+		case "0":
+			h.Write(sibling)
+			h.Write(current)
+		default:
+			return false, fmt.Errorf("invalid proof step side: %s", side)
+		}
+		current = h.Sum(nil)
+	}
 
-	return hex.EncodeToString(proof[len(proof)-1]), nil // Corrected to retrieve the last element in the proof path
+	return bytes.Equal(current, expected), nil
 }
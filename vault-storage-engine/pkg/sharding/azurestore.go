@@ -0,0 +1,150 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// AzureBlobShardStore is an Azure Blob Storage implementation of ShardStore
+// Each storage location maps to a blob name prefix inside a single container
+type AzureBlobShardStore struct {
+	client *container.Client
+	// AccessTier is the tier shards are uploaded to; when empty, the account's default tier is used
+	AccessTier blob.AccessTier
+}
+
+var _ ShardStore = (*AzureBlobShardStore)(nil)
+
+// NewAzureBlobShardStore creates a new AzureBlobShardStore
+// accessTier is "hot", "cool" or "cold", in any case, or empty for the account's default tier
+// The archive tier is rejected, since archived blobs cannot be read until they are rehydrated
+func NewAzureBlobShardStore(client *container.Client, accessTier string) (*AzureBlobShardStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("azure container client is required")
+	}
+
+	tier, err := parseAccessTier(accessTier)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobShardStore{
+		client:     client,
+		AccessTier: tier,
+	}, nil
+}
+
+// parseAccessTier maps a configured access tier name to its blob access tier
+func parseAccessTier(name string) (blob.AccessTier, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return "", nil
+	case "hot":
+		return blob.AccessTierHot, nil
+	case "cool":
+		return blob.AccessTierCool, nil
+	case "cold":
+		return blob.AccessTierCold, nil
+	default:
+		return "", fmt.Errorf("unsupported azure access tier: %s", name)
+	}
+}
+
+// blobName maps a location and shard to a blob name
+// Locations are treated as name prefixes, so "/mnt/disk1/shards" becomes "mnt/disk1/shards/..."
+func (s *AzureBlobShardStore) blobName(location, name string) string {
+	return path.Join(strings.TrimPrefix(location, "/"), name)
+}
+
+// StoreShard uploads a shard to Azure Blob Storage
+func (s *AzureBlobShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	name := s.blobName(location, shardName(objectID, versionID, shardIdx))
+	opts := &blockblob.UploadBufferOptions{}
+	if s.AccessTier != "" {
+		opts.AccessTier = &s.AccessTier
+	}
+	if _, err := s.client.NewBlockBlobClient(name).UploadBuffer(ctx, shard, opts); err != nil {
+		return fmt.Errorf("failed to upload shard %s to azure: %w", name, err)
+	}
+	return nil
+}
+
+// RetrieveShard downloads a shard from Azure Blob Storage
+func (s *AzureBlobShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	name := s.blobName(location, shardName(objectID, versionID, shardIdx))
+	resp, err := s.client.NewBlobClient(name).DownloadStream(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrShardNotFound, s.client.URL(), name)
+		}
+		return nil, fmt.Errorf("failed to download shard %s from azure: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	shard, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard %s from azure: %w", name, err)
+	}
+	return shard, nil
+}
+
+// DeleteShardByVersion removes a single shard of a particular version_id
+func (s *AzureBlobShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	name := s.blobName(location, shardName(objectID, versionID, shardIdx))
+
+	_, err := s.client.NewBlobClient(name).Delete(context.TODO(), nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("failed to delete shard %s from azure: %w", name, err)
+	}
+	return nil
+}
+
+// IsTransient reports whether an Azure error is worth retrying, such as throttling and 5xx responses
+// The client already retries these itself, so a failure that reaches the store has exhausted those retries
+func (s *AzureBlobShardStore) IsTransient(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= 500
+	}
+	return false
+}
+
+// DeleteShard removes all shards of the same object_id under a location
+func (s *AzureBlobShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	prefix := s.blobName(location, shardPrefix(objectID))
+
+	pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to list shards with prefix %s: %w", prefix, err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+			_, err := s.client.NewBlobClient(*item.Name).Delete(context.TODO(), nil)
+			if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+				return fmt.Errorf("failed to delete shard %s from azure: %w", *item.Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCSShardStore is a Google Cloud Storage implementation of ShardStore
+// Each storage location maps to an object name prefix inside a single GCS bucket
+type GCSShardStore struct {
+	client *storage.Client
+	// ownsClient is set when the store built its own client, which Close then closes
+	ownsClient bool
+	Bucket     string
+}
+
+var _ ShardStore = (*GCSShardStore)(nil)
+
+// NewGCSShardStore creates a new GCSShardStore
+// If client is nil, one is built from the application default credentials
+func NewGCSShardStore(bucket string, client *storage.Client) (*GCSShardStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("gcs bucket name is required")
+	}
+
+	ownsClient := client == nil
+	if ownsClient {
+		var err error
+		client, err = storage.NewClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+	}
+
+	return &GCSShardStore{
+		client:     client,
+		ownsClient: ownsClient,
+		Bucket:     bucket,
+	}, nil
+}
+
+// Close closes the GCS client if the store created it
+func (s *GCSShardStore) Close() error {
+	if !s.ownsClient {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// objectName maps a location and shard to a GCS object name
+// Locations are treated as name prefixes, so "/mnt/disk1/shards" becomes "mnt/disk1/shards/..."
+func (s *GCSShardStore) objectName(location, name string) string {
+	return path.Join(strings.TrimPrefix(location, "/"), name)
+}
+
+// StoreShard uploads a shard to GCS
+func (s *GCSShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	name := s.objectName(location, shardName(objectID, versionID, shardIdx))
+	w := s.client.Bucket(s.Bucket).Object(name).NewWriter(ctx)
+	if _, err := w.Write(shard); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to upload shard %s to gcs: %w", name, err)
+	}
+	// The upload is only committed once the writer is closed
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload shard %s to gcs: %w", name, err)
+	}
+	return nil
+}
+
+// RetrieveShard downloads a shard from GCS
+func (s *GCSShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	name := s.objectName(location, shardName(objectID, versionID, shardIdx))
+	r, err := s.client.Bucket(s.Bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("%w: gs://%s/%s", ErrShardNotFound, s.Bucket, name)
+		}
+		return nil, fmt.Errorf("failed to download shard %s from gcs: %w", name, err)
+	}
+	defer r.Close()
+
+	shard, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard %s from gcs: %w", name, err)
+	}
+	return shard, nil
+}
+
+// CopyShard copies a shard to another object and version inside the GCS bucket, without downloading it
+func (s *GCSShardStore) CopyShard(ctx context.Context, srcObjectID, srcVersionID, dstObjectID, dstVersionID string, shardIdx int, location string) error {
+	srcName := s.objectName(location, shardName(srcObjectID, srcVersionID, shardIdx))
+	dstName := s.objectName(location, shardName(dstObjectID, dstVersionID, shardIdx))
+	bucket := s.client.Bucket(s.Bucket)
+	if _, err := bucket.Object(dstName).CopierFrom(bucket.Object(srcName)).Run(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("%w: gs://%s/%s", ErrShardNotFound, s.Bucket, srcName)
+		}
+		return fmt.Errorf("failed to copy shard %s to %s in gcs: %w", srcName, dstName, err)
+	}
+	return nil
+}
+
+// DeleteShardByVersion removes a single shard of a particular version_id
+func (s *GCSShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	name := s.objectName(location, shardName(objectID, versionID, shardIdx))
+
+	err := s.client.Bucket(s.Bucket).Object(name).Delete(context.TODO())
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete shard %s from gcs: %w", name, err)
+	}
+	return nil
+}
+
+// IsTransient reports whether a GCS error is worth retrying, using the client library's own classification
+func (s *GCSShardStore) IsTransient(err error) bool {
+	return storage.ShouldRetry(err)
+}
+
+// DeleteShard removes all shards of the same object_id under a location
+func (s *GCSShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	prefix := s.objectName(location, shardPrefix(objectID))
+	bkt := s.client.Bucket(s.Bucket)
+
+	it := bkt.Objects(context.TODO(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list shards with prefix %s: %w", prefix, err)
+		}
+		err = bkt.Object(attrs.Name).Delete(context.TODO())
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("failed to delete shard %s from gcs: %w", attrs.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPTimeout bounds every request of an HTTPShardStore created without its own client
+const DefaultHTTPTimeout = 30 * time.Second
+
+// HTTPShardStore is an implementation of ShardStore that talks to a shard server over HTTP
+// Shards are stored with PUT {base}/{location}/{objectID}/{idx} and retrieved with GET of the same URL, with the object
+// ID path-escaped as a single segment
+// The version is passed as the version query parameter, so versions of an object never collide
+// Deletes use DELETE, of the same URL for a single shard and of {base}/{location}/{objectID} for every shard of an object
+type HTTPShardStore struct {
+	BaseURL string
+	client  *http.Client
+	// ownsClient is set when the store created its own client, whose idle connections Close then closes
+	ownsClient bool
+}
+
+var _ ShardStore = (*HTTPShardStore)(nil)
+
+// HTTPStatusError is returned by an HTTPShardStore when the shard server answers with a non-2xx status
+type HTTPStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s: unexpected status %d", e.Method, e.URL, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: unexpected status %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// NewHTTPShardStore creates a new HTTPShardStore
+// If client is nil, one is created that times requests out after DefaultHTTPTimeout
+func NewHTTPShardStore(baseURL string, client *http.Client) (*HTTPShardStore, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("shard server base url is required")
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid shard server base url: %w", err)
+	}
+	ownsClient := client == nil
+	if ownsClient {
+		client = &http.Client{Timeout: DefaultHTTPTimeout}
+	}
+	return &HTTPShardStore{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		client:     client,
+		ownsClient: ownsClient,
+	}, nil
+}
+
+// Close closes the idle connections of the HTTP client if the store created it
+func (s *HTTPShardStore) Close() error {
+	if s.ownsClient {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// shardURL maps a location and shard to its URL on the shard server
+// Locations are treated as path prefixes, so "/mnt/disk1/shards" becomes "{base}/mnt/disk1/shards/..."
+func (s *HTTPShardStore) shardURL(location, objectID, versionID string, shardIdx int) (string, error) {
+	segment, err := objectSegment(objectID)
+	if err != nil {
+		return "", err
+	}
+	shardURL, err := url.JoinPath(s.BaseURL, strings.TrimPrefix(location, "/"), segment, strconv.Itoa(shardIdx))
+	if err != nil {
+		return "", fmt.Errorf("failed to build shard url: %w", err)
+	}
+	return shardURL + "?" + url.Values{"version": {versionID}}.Encode(), nil
+}
+
+// objectSegment returns an object ID escaped as a single segment of a shard URL, so slashes in it can neither move
+// the shard under another location nor make two shards share a URL
+// The dot segments are rejected outright, since they would still be resolved against the location once escaped
+func objectSegment(objectID string) (string, error) {
+	if objectID == "" || objectID == "." || objectID == ".." {
+		return "", fmt.Errorf("invalid object id %q", objectID)
+	}
+	return url.PathEscape(objectID), nil
+}
+
+// do sends a request to the shard server and returns the response body
+// Non-2xx responses are returned as an HTTPStatusError, which also wraps ErrShardNotFound for 404 responses
+func (s *HTTPShardStore) do(ctx context.Context, method, target string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	// Client errors already name the method and URL
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response of %s %s: %w", method, target, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		statusErr := &HTTPStatusError{Method: method, URL: target, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %w", ErrShardNotFound, statusErr)
+		}
+		return nil, statusErr
+	}
+	return data, nil
+}
+
+// StoreShard uploads a shard to the shard server
+func (s *HTTPShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	target, err := s.shardURL(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do(ctx, http.MethodPut, target, shard); err != nil {
+		return fmt.Errorf("failed to upload shard: %w", err)
+	}
+	return nil
+}
+
+// RetrieveShard downloads a shard from the shard server
+func (s *HTTPShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	target, err := s.shardURL(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := s.do(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download shard: %w", err)
+	}
+	return shard, nil
+}
+
+// DeleteShardByVersion removes a single shard of a particular version_id
+func (s *HTTPShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	target, err := s.shardURL(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.do(context.TODO(), http.MethodDelete, target, nil); err != nil && !errors.Is(err, ErrShardNotFound) {
+		return fmt.Errorf("failed to delete shard: %w", err)
+	}
+	return nil
+}
+
+// DeleteShard removes all shards of the same object_id under a location
+func (s *HTTPShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	segment, err := objectSegment(objectID)
+	if err != nil {
+		return err
+	}
+	target, err := url.JoinPath(s.BaseURL, strings.TrimPrefix(location, "/"), segment)
+	if err != nil {
+		return fmt.Errorf("failed to build shard url: %w", err)
+	}
+
+	if _, err := s.do(context.TODO(), http.MethodDelete, target, nil); err != nil && !errors.Is(err, ErrShardNotFound) {
+		return fmt.Errorf("failed to delete shards: %w", err)
+	}
+	return nil
+}
+
+// IsTransient reports whether a failed request is worth retrying, such as throttling, 5xx responses and timeouts
+func (s *HTTPShardStore) IsTransient(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && urlErr.Timeout()
+}
@@ -0,0 +1,133 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// MemoryShardStore is an in-memory implementation of ShardStore
+// It is intended for tests, and can inject errors into, or drop, individual shards to simulate failing disks
+type MemoryShardStore struct {
+	mu     sync.Mutex
+	shards map[string][]byte
+	faults map[string]error
+}
+
+// NewMemoryShardStore creates a new, empty MemoryShardStore
+func NewMemoryShardStore() *MemoryShardStore {
+	return &MemoryShardStore{
+		shards: make(map[string][]byte),
+		faults: make(map[string]error),
+	}
+}
+
+// memoryKey returns the key a shard is held under, mirroring the path it would have in a LocalShardStore
+func memoryKey(objectID, versionID string, shardIdx int, location string) string {
+	return path.Join(location, shardName(objectID, versionID, shardIdx))
+}
+
+// ShardPath implements ShardLocator with the key the shard is held under
+func (store *MemoryShardStore) ShardPath(objectID, versionID string, shardIdx int, location string) (string, error) {
+	return memoryKey(objectID, versionID, shardIdx, location), nil
+}
+
+// StoreShard stores a copy of a shard in memory
+func (store *MemoryShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key := memoryKey(objectID, versionID, shardIdx, location)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.faults[key]; err != nil {
+		return err
+	}
+	store.shards[key] = append([]byte(nil), shard...)
+	return nil
+}
+
+// RetrieveShard returns a copy of a shard held in memory
+func (store *MemoryShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := memoryKey(objectID, versionID, shardIdx, location)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.faults[key]; err != nil {
+		return nil, err
+	}
+	shard, ok := store.shards[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrShardNotFound, key)
+	}
+	return append([]byte(nil), shard...), nil
+}
+
+// Only delete shards of a particular version_id
+func (store *MemoryShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	key := memoryKey(objectID, versionID, shardIdx, location)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.faults[key]; err != nil {
+		return err
+	}
+	delete(store.shards, key)
+	return nil
+}
+
+// Delete all shards of the same object_id
+func (store *MemoryShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	prefix := path.Join(location, shardPrefix(objectID))
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for key := range store.shards {
+		if strings.HasPrefix(key, prefix) {
+			delete(store.shards, key)
+		}
+	}
+	return nil
+}
+
+// InjectError makes every operation on the given shard fail with err until ClearFaults is called
+func (store *MemoryShardStore) InjectError(objectID, versionID string, shardIdx int, location string, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.faults[memoryKey(objectID, versionID, shardIdx, location)] = err
+}
+
+// DropShard discards a stored shard, as if the disk holding it had been lost
+func (store *MemoryShardStore) DropShard(objectID, versionID string, shardIdx int, location string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.shards, memoryKey(objectID, versionID, shardIdx, location))
+}
+
+// ClearFaults removes every injected error
+func (store *MemoryShardStore) ClearFaults() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.faults = make(map[string]error)
+}
+
+// Len returns the number of shards held in memory
+func (store *MemoryShardStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.shards)
+}
+
+var _ ShardStore = (*MemoryShardStore)(nil)
@@ -0,0 +1,142 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MultiShardStore mirrors every shard to several underlying stores, for example a local disk and a cloud bucket
+// Writes succeed once WriteQuorum stores have accepted the shard, and reads fall back through the stores in order
+type MultiShardStore struct {
+	Stores      []ShardStore
+	WriteQuorum int
+}
+
+var _ ShardStore = (*MultiShardStore)(nil)
+
+// NewMultiShardStore creates a new MultiShardStore over stores
+// A writeQuorum of zero or less requires every store to accept each write
+func NewMultiShardStore(writeQuorum int, stores ...ShardStore) (*MultiShardStore, error) {
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("at least one shard store is required")
+	}
+	if writeQuorum <= 0 {
+		writeQuorum = len(stores)
+	}
+	if writeQuorum > len(stores) {
+		return nil, fmt.Errorf("write quorum %d exceeds the number of stores (%d)", writeQuorum, len(stores))
+	}
+	return &MultiShardStore{Stores: stores, WriteQuorum: writeQuorum}, nil
+}
+
+// StoreShard writes a shard to every store at once and succeeds if at least WriteQuorum of them accept it
+// Every write is attempted even once the quorum is met, so healthy stores always end up with a copy
+func (m *MultiShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	return m.writeAll(shardIdx, func(store ShardStore) error {
+		return store.StoreShard(ctx, objectID, versionID, shardIdx, shard, location)
+	})
+}
+
+// CopyShard copies a shard within every store at once, server-side where the store supports it
+// Like StoreShard, it succeeds if at least WriteQuorum of the stores complete the copy
+func (m *MultiShardStore) CopyShard(ctx context.Context, srcObjectID, srcVersionID, dstObjectID, dstVersionID string, shardIdx int, location string) error {
+	return m.writeAll(shardIdx, func(store ShardStore) error {
+		return CopyShard(ctx, store, srcObjectID, srcVersionID, dstObjectID, dstVersionID, shardIdx, location)
+	})
+}
+
+// writeAll runs a write against every store at once and succeeds if at least WriteQuorum of them succeed
+func (m *MultiShardStore) writeAll(shardIdx int, write func(store ShardStore) error) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(m.Stores))
+	)
+	for i, store := range m.Stores {
+		wg.Add(1)
+		go func(i int, store ShardStore) {
+			defer wg.Done()
+			if err := write(store); err != nil {
+				errs[i] = fmt.Errorf("store %d: %w", i, err)
+			}
+		}(i, store)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded < m.WriteQuorum {
+		return fmt.Errorf("shard %d written to %d of %d stores, %d required: %w", shardIdx, succeeded, len(m.Stores), m.WriteQuorum, errors.Join(errs...))
+	}
+	return nil
+}
+
+// RetrieveShard reads a shard from the first store that returns it
+// ErrShardNotFound is only returned if no store holds the shard
+func (m *MultiShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	var errs []error
+	notFound := true
+	for i, store := range m.Stores {
+		shard, err := store.RetrieveShard(ctx, objectID, versionID, shardIdx, location)
+		if err == nil {
+			return shard, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		notFound = notFound && errors.Is(err, ErrShardNotFound)
+		errs = append(errs, fmt.Errorf("store %d: %w", i, err))
+	}
+	if notFound {
+		return nil, fmt.Errorf("%w in any of %d stores", ErrShardNotFound, len(m.Stores))
+	}
+	return nil, fmt.Errorf("failed to retrieve shard %d from any store: %w", shardIdx, errors.Join(errs...))
+}
+
+// DeleteShardByVersion removes a single shard of a particular version_id from every store
+func (m *MultiShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	var errs []error
+	for i, store := range m.Stores {
+		if err := store.DeleteShardByVersion(objectID, versionID, shardIdx, location); err != nil {
+			errs = append(errs, fmt.Errorf("store %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteShard removes all shards of the same object_id under a location from every store
+func (m *MultiShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	var errs []error
+	for i, store := range m.Stores {
+		if err := store.DeleteShard(objectID, shardIdx, location); err != nil {
+			errs = append(errs, fmt.Errorf("store %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every underlying store that implements Closer, even once one of them fails to close
+func (m *MultiShardStore) Close() error {
+	var errs []error
+	for i, store := range m.Stores {
+		if err := Close(store); err != nil {
+			errs = append(errs, fmt.Errorf("store %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// IsTransient reports whether any underlying store classifies err as transient
+func (m *MultiShardStore) IsTransient(err error) bool {
+	for _, store := range m.Stores {
+		if IsTransient(store, err) {
+			return true
+		}
+	}
+	return false
+}
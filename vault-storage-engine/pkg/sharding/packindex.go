@@ -0,0 +1,260 @@
+package sharding
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A pack index is kept beside each pack, as objectID.pack.idx, so reads find a shard without walking the record
+// headers of the pack; it is only a cache of them, rebuilt by scanning the pack whenever it is missing, damaged or
+// does not match the pack it sits beside
+// It holds the size and modification time the pack had when it was written, the end of the last complete record, and
+// a table of every shard in the pack sorted by a hash of its key, which RetrieveShard binary searches with a read per
+// step; the keys themselves follow the table, for the writers that need the whole index, and a checksum covers both
+
+// packIndexMagic starts every pack index, and changes with its format
+const packIndexMagic = "VAULTPX1"
+
+// packIndexHeaderSize is the size of a pack index header: its magic, the size, modification time and end of the pack,
+// the number of shards and the checksum of the rest of the index
+const packIndexHeaderSize = 8 + 8 + 8 + 8 + 4 + 4
+
+// packSlotSize is the size of an entry of the table of a pack index: the hash of its key, and the start of its record
+// and the length of its data in the pack
+const packSlotSize = 8 + 8 + 8
+
+// packIndexPath returns the path of the index of the pack at path
+func packIndexPath(path string) string {
+	return path + ".idx"
+}
+
+// packKeyHash returns the hash a shard is sorted by in the table of a pack index
+func packKeyHash(key packKey) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key.versionID))
+	var idx [4]byte
+	binary.LittleEndian.PutUint32(idx[:], uint32(key.shardIdx))
+	h.Write(idx[:])
+	return h.Sum64()
+}
+
+// packSlot is an entry of the table of a pack index
+type packSlot struct {
+	hash       uint64
+	start      int64
+	dataLength int64
+}
+
+// encodePackIndex returns the index of a pack holding idx, whose file had the given info once idx was written to it
+func encodePackIndex(idx packIndex, info os.FileInfo) []byte {
+	keys := make([]packKey, 0, len(idx.entries))
+	for key := range idx.entries {
+		keys = append(keys, key)
+	}
+	slots := make([]packSlot, len(keys))
+	for i, key := range keys {
+		entry := idx.entries[key]
+		slots[i] = packSlot{hash: packKeyHash(key), start: entry.start, dataLength: entry.length}
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := slots[order[i]], slots[order[j]]
+		return a.hash < b.hash || (a.hash == b.hash && a.start < b.start)
+	})
+
+	buf := make([]byte, packIndexHeaderSize, packIndexHeaderSize+len(keys)*packSlotSize)
+	copy(buf, packIndexMagic)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(info.ModTime().UnixNano()))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(idx.end))
+	binary.LittleEndian.PutUint32(buf[32:], uint32(len(keys)))
+	for _, i := range order {
+		buf = binary.LittleEndian.AppendUint64(buf, slots[i].hash)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(slots[i].start))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(slots[i].dataLength))
+	}
+	for _, i := range order {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(keys[i].shardIdx))
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(keys[i].versionID)))
+		buf = append(buf, keys[i].versionID...)
+	}
+	binary.LittleEndian.PutUint32(buf[36:], crc32.ChecksumIEEE(buf[packIndexHeaderSize:]))
+	return buf
+}
+
+// packIndexHeader is the header of a pack index
+type packIndexHeader struct {
+	end   int64
+	count int
+	crc   uint32
+}
+
+// decodePackIndexHeader parses the header of a pack index, and reports whether it is the index of the pack with info
+func decodePackIndexHeader(header []byte, info os.FileInfo) (packIndexHeader, bool) {
+	if len(header) < packIndexHeaderSize || string(header[:8]) != packIndexMagic {
+		return packIndexHeader{}, false
+	}
+	size := int64(binary.LittleEndian.Uint64(header[8:]))
+	modTime := int64(binary.LittleEndian.Uint64(header[16:]))
+	if size != info.Size() || modTime != info.ModTime().UnixNano() {
+		return packIndexHeader{}, false
+	}
+	h := packIndexHeader{
+		end:   int64(binary.LittleEndian.Uint64(header[24:])),
+		count: int(binary.LittleEndian.Uint32(header[32:])),
+		crc:   binary.LittleEndian.Uint32(header[36:]),
+	}
+	if h.end > size {
+		return packIndexHeader{}, false
+	}
+	return h, true
+}
+
+// readPackIndex reads the whole index of the pack at path, whose file has info, and reports whether there is one that
+// is intact and matches the pack
+func readPackIndex(path string, info os.FileInfo) (packIndex, bool) {
+	buf, err := os.ReadFile(packIndexPath(path))
+	if err != nil {
+		return packIndex{}, false
+	}
+	h, ok := decodePackIndexHeader(buf, info)
+	if !ok || crc32.ChecksumIEEE(buf[packIndexHeaderSize:]) != h.crc {
+		return packIndex{}, false
+	}
+	table := buf[packIndexHeaderSize:]
+	if h.count > len(table)/packSlotSize {
+		return packIndex{}, false
+	}
+	keys := table[h.count*packSlotSize:]
+
+	idx := packIndex{entries: make(map[packKey]packEntry, h.count), end: h.end}
+	for i := 0; i < h.count; i++ {
+		slot := table[i*packSlotSize:]
+		start := int64(binary.LittleEndian.Uint64(slot[8:]))
+		dataLength := int64(binary.LittleEndian.Uint64(slot[16:]))
+		if len(keys) < 4+2 {
+			return packIndex{}, false
+		}
+		shardIdx := int(binary.LittleEndian.Uint32(keys))
+		versionLength := int(binary.LittleEndian.Uint16(keys[4:]))
+		if len(keys) < 4+2+versionLength {
+			return packIndex{}, false
+		}
+		key := packKey{versionID: string(keys[6 : 6+versionLength]), shardIdx: shardIdx}
+		keys = keys[6+versionLength:]
+
+		size := packHeaderSize + int64(versionLength) + dataLength
+		if start < int64(len(packMagic)) || dataLength < 0 || start+size > h.end {
+			return packIndex{}, false
+		}
+		idx.entries[key] = packEntry{offset: start + size - dataLength, length: dataLength, start: start, size: size}
+		idx.live += size
+	}
+	return idx, true
+}
+
+// lookupPackIndex finds the candidates for a shard in the index of the pack at path, whose file has info, by binary
+// searching its table, and reports whether there is an index that matches the pack at all
+// Keys are only known by their hash, so every shard sharing it is returned, for the caller to tell apart by the
+// record headers in the pack
+func lookupPackIndex(path string, info os.FileInfo, key packKey) ([]packSlot, bool) {
+	f, err := os.Open(packIndexPath(path))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	header := make([]byte, packIndexHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, false
+	}
+	h, ok := decodePackIndexHeader(header, info)
+	if !ok {
+		return nil, false
+	}
+
+	hash := packKeyHash(key)
+	slot := make([]byte, packSlotSize)
+	readSlot := func(i int) (packSlot, error) {
+		if _, err := f.ReadAt(slot, packIndexHeaderSize+int64(i)*packSlotSize); err != nil {
+			return packSlot{}, err
+		}
+		return packSlot{
+			hash:       binary.LittleEndian.Uint64(slot),
+			start:      int64(binary.LittleEndian.Uint64(slot[8:])),
+			dataLength: int64(binary.LittleEndian.Uint64(slot[16:])),
+		}, nil
+	}
+
+	var readErr error
+	first := sort.Search(h.count, func(i int) bool {
+		s, err := readSlot(i)
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return s.hash >= hash
+	})
+	if readErr != nil {
+		return nil, false
+	}
+	var candidates []packSlot
+	for i := first; i < h.count; i++ {
+		s, err := readSlot(i)
+		if err != nil {
+			return nil, false
+		}
+		if s.hash != hash {
+			break
+		}
+		candidates = append(candidates, s)
+	}
+	return candidates, true
+}
+
+// writePackIndex replaces the index of the pack at path with idx, which must describe the pack as it is now
+// The index is only a cache, so it is never synced, and failing to write it is not an error: a pack whose index is
+// missing or out of date is scanned again the next time it is opened
+func writePackIndex(path string, idx packIndex) {
+	info, err := os.Stat(path)
+	if err != nil {
+		os.Remove(packIndexPath(path))
+		return
+	}
+	if err := writeFileAtomic(packIndexPath(path), filepath.Dir(path), encodePackIndex(idx, info), false); err != nil {
+		os.Remove(packIndexPath(path))
+	}
+}
+
+// readPackRecord reads the data of the shard whose record starts at start in the pack in f, of packSize bytes, and
+// reports whether a record of that shard, holding dataLength bytes, really starts there
+func readPackRecord(f *os.File, packSize int64, key packKey, start, dataLength int64) ([]byte, bool, error) {
+	size := packHeaderSize + int64(len(key.versionID)) + dataLength
+	if start < int64(len(packMagic)) || dataLength < 0 || dataLength > packSize || start+size > packSize {
+		return nil, false, nil
+	}
+	record := make([]byte, size)
+	if _, err := f.ReadAt(record, start); err != nil {
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to read shard from pack: %w", err)
+	}
+	if record[0] != packShard ||
+		int(binary.LittleEndian.Uint32(record[1:])) != key.shardIdx ||
+		int(binary.LittleEndian.Uint16(record[5:])) != len(key.versionID) ||
+		int64(binary.LittleEndian.Uint64(record[7:])) != dataLength ||
+		string(record[packHeaderSize:packHeaderSize+len(key.versionID)]) != key.versionID {
+		return nil, false, nil
+	}
+	return record[size-dataLength:], true, nil
+}
@@ -0,0 +1,491 @@
+package sharding
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// PackedLocalShardStore is a local implementation of ShardStore that keeps every shard of an object in a location,
+// across all its versions, in a single objectID.pack file in the location's directory, rather than a file per shard,
+// so storing millions of small objects does not take a file, and an inode, for every one of their shards
+// A pack is a log of records: storing a shard appends it, replacing a shard appends the new copy, and deleting one
+// appends a marker; the index of where each shard's record starts is written beside the pack with every change, so
+// RetrieveShard seeks straight to its shard by way of it, and the record headers are only scanned to rebuild an index
+// that is missing or out of date
+// Packs are rewritten without the records of replaced and deleted shards once those take up more than the live ones,
+// and removed once the object has no shards left in them
+// Shards stored through another store, or another process, writing the same directory are not safe from being lost, so
+// each BasePath must only be written through one PackedLocalShardStore at a time; reads are safe from anywhere
+type PackedLocalShardStore struct {
+	BasePath string
+	// Durable flushes every change to a pack, and the directory entry naming a new pack, to disk before it returns,
+	// so acknowledged writes survive a power loss
+	Durable bool
+	// Naming is the scheme packs are named with, as for LocalShardStore, NamingPlain when empty
+	Naming string
+
+	mu    sync.Mutex
+	locks map[string]*packLock
+}
+
+var _ ShardStore = (*PackedLocalShardStore)(nil)
+
+// NewPackedLocalShardStore creates a new PackedLocalShardStore
+func NewPackedLocalShardStore(basePath string) *PackedLocalShardStore {
+	return &PackedLocalShardStore{BasePath: basePath}
+}
+
+// Close implements Closer; a PackedLocalShardStore holds no open files between calls, so there is nothing to release
+func (store *PackedLocalShardStore) Close() error {
+	return nil
+}
+
+// packMagic starts every pack, so files that are not packs are never read as one
+const packMagic = "VAULTPK1"
+
+// Kinds of pack records
+const (
+	packShard   byte = 1
+	packDeleted byte = 2
+)
+
+// packHeaderSize is the size of a record header: its kind, the shard index, and the lengths of the version ID and the
+// data that follow it
+const packHeaderSize = 1 + 4 + 2 + 8
+
+// packKey names a shard within a pack
+type packKey struct {
+	versionID string
+	shardIdx  int
+}
+
+// packEntry is where the latest copy of a shard is in a pack
+type packEntry struct {
+	// offset and length locate the shard's data
+	offset int64
+	length int64
+	// start and size locate its whole record
+	start int64
+	size  int64
+}
+
+// packIndex is the index of a pack
+type packIndex struct {
+	entries map[packKey]packEntry
+	// end is the end of the last complete record, and 0 for a pack that does not even have its magic yet
+	end int64
+	// live is the size of the records of the shards in entries
+	live int64
+}
+
+// apply updates the index with a record written at start
+func (idx *packIndex) apply(kind byte, key packKey, start, dataLength int64) {
+	size := packHeaderSize + int64(len(key.versionID)) + dataLength
+	if prev, ok := idx.entries[key]; ok {
+		idx.live -= prev.size
+		delete(idx.entries, key)
+	}
+	if kind == packShard {
+		idx.entries[key] = packEntry{offset: start + size - dataLength, length: dataLength, start: start, size: size}
+		idx.live += size
+	}
+	idx.end = start + size
+}
+
+// dead returns the size of the records of replaced and deleted shards
+func (idx *packIndex) dead() int64 {
+	if idx.end == 0 {
+		return 0
+	}
+	return idx.end - int64(len(packMagic)) - idx.live
+}
+
+// scanPack builds the index of the pack in f from its record headers
+// A record cut short, as a crash while it was being appended would leave it, ends the pack, and is overwritten by the
+// next record appended; any other damage to the headers is an error, rather than losing the records after it
+func scanPack(f *os.File) (packIndex, error) {
+	idx := packIndex{entries: make(map[packKey]packEntry)}
+	info, err := f.Stat()
+	if err != nil {
+		return idx, fmt.Errorf("failed to stat shard pack: %w", err)
+	}
+	size := info.Size()
+	if size < int64(len(packMagic)) {
+		return idx, nil
+	}
+	magic := make([]byte, len(packMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return idx, fmt.Errorf("failed to read shard pack: %w", err)
+	}
+	if string(magic) != packMagic {
+		return idx, fmt.Errorf("%s is not a shard pack", f.Name())
+	}
+	idx.end = int64(len(packMagic))
+
+	header := make([]byte, packHeaderSize)
+	for idx.end+packHeaderSize <= size {
+		if _, err := f.ReadAt(header, idx.end); err != nil {
+			return idx, fmt.Errorf("failed to read shard pack: %w", err)
+		}
+		kind := header[0]
+		shardIdx := int(binary.LittleEndian.Uint32(header[1:]))
+		versionLength := int64(binary.LittleEndian.Uint16(header[5:]))
+		dataLength := binary.LittleEndian.Uint64(header[7:])
+		// A crash can leave the space for a record it was appending zeroed rather than written
+		if kind == 0 {
+			break
+		}
+		if kind != packShard && kind != packDeleted {
+			return idx, fmt.Errorf("corrupt shard pack %s: unknown record kind %d at offset %d", f.Name(), kind, idx.end)
+		}
+		if dataLength > uint64(size) || idx.end+packHeaderSize+versionLength+int64(dataLength) > size {
+			break
+		}
+		versionID := make([]byte, versionLength)
+		if _, err := f.ReadAt(versionID, idx.end+packHeaderSize); err != nil {
+			return idx, fmt.Errorf("failed to read shard pack: %w", err)
+		}
+		idx.apply(kind, packKey{versionID: string(versionID), shardIdx: shardIdx}, idx.end, int64(dataLength))
+	}
+	return idx, nil
+}
+
+// encodePackRecord returns a record of the given kind for a shard
+func encodePackRecord(kind byte, key packKey, data []byte) []byte {
+	record := make([]byte, packHeaderSize, packHeaderSize+len(key.versionID)+len(data))
+	record[0] = kind
+	binary.LittleEndian.PutUint32(record[1:], uint32(key.shardIdx))
+	binary.LittleEndian.PutUint16(record[5:], uint16(len(key.versionID)))
+	binary.LittleEndian.PutUint64(record[7:], uint64(len(data)))
+	record = append(record, key.versionID...)
+	return append(record, data...)
+}
+
+// appendPackRecord appends a record to the pack in f after the last complete record, and updates idx to match
+func appendPackRecord(f *os.File, idx *packIndex, kind byte, key packKey, data []byte) error {
+	at, start := idx.end, idx.end
+	var buf []byte
+	if idx.end == 0 {
+		buf = append(buf, packMagic...)
+		start = int64(len(packMagic))
+	}
+	buf = append(buf, encodePackRecord(kind, key, data)...)
+	// Drop whatever a record cut short left behind, so it is not taken for part of the next one
+	if err := f.Truncate(at); err != nil {
+		return fmt.Errorf("failed to truncate shard pack: %w", err)
+	}
+	if _, err := f.WriteAt(buf, at); err != nil {
+		return fmt.Errorf("failed to write shard to pack: %w", err)
+	}
+	idx.apply(kind, key, start, int64(len(data)))
+	return nil
+}
+
+// packLock serializes the changes made to one pack
+type packLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockPack locks the pack at path against changes by any other call, and returns the function that unlocks it
+func (store *PackedLocalShardStore) lockPack(path string) func() {
+	store.mu.Lock()
+	if store.locks == nil {
+		store.locks = make(map[string]*packLock)
+	}
+	lock, ok := store.locks[path]
+	if !ok {
+		lock = &packLock{}
+		store.locks[path] = lock
+	}
+	lock.refs++
+	store.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		store.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(store.locks, path)
+		}
+		store.mu.Unlock()
+	}
+}
+
+// packPath returns the path of the pack holding an object's shards under a location
+func (store *PackedLocalShardStore) packPath(location, objectID string) (string, error) {
+	name, err := namedObjectID(store.Naming, objectID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(store.BasePath, location, name+".pack"), nil
+}
+
+// ShardPath implements ShardLocator with the path of the shard's pack and the name of the shard within it
+func (store *PackedLocalShardStore) ShardPath(objectID, versionID string, shardIdx int, location string) (string, error) {
+	path, err := store.packPath(location, objectID)
+	if err != nil {
+		return "", err
+	}
+	return path + ":" + shardName(objectID, versionID, shardIdx), nil
+}
+
+// checkPackKey returns an error if a shard cannot be recorded in a pack
+func checkPackKey(versionID string, shardIdx int) error {
+	if len(versionID) > math.MaxUint16 {
+		return fmt.Errorf("invalid version id: longer than %d bytes", math.MaxUint16)
+	}
+	if shardIdx < 0 || shardIdx > math.MaxUint32 {
+		return fmt.Errorf("invalid shard index %d", shardIdx)
+	}
+	return nil
+}
+
+// updatePack applies update to the pack at path, which is created first if create is set, and then compacts it
+// Packs that do not exist are left alone when create is not set
+func (store *PackedLocalShardStore) updatePack(path string, create bool, update func(f *os.File, idx *packIndex) error) error {
+	unlock := store.lockPack(path)
+	defer unlock()
+
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		if !create && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open shard pack: %w", err)
+	}
+	defer f.Close()
+
+	idx, err := loadPackIndex(path, f)
+	if err != nil {
+		return err
+	}
+	created := idx.end == 0
+	if err := update(f, &idx); err != nil {
+		return err
+	}
+	if store.Durable {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync shard pack: %w", err)
+		}
+		if created {
+			if err := syncDir(filepath.Dir(path)); err != nil {
+				return fmt.Errorf("failed to sync shard directory: %w", err)
+			}
+		}
+	}
+	if err := store.compactPack(path, f, &idx); err != nil {
+		return err
+	}
+	if len(idx.entries) > 0 {
+		writePackIndex(path, idx)
+	}
+	return nil
+}
+
+// loadPackIndex returns the index of the pack at path, open in f, from the index beside it, or by scanning the pack
+// when that is missing or does not match it
+func loadPackIndex(path string, f *os.File) (packIndex, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return packIndex{}, fmt.Errorf("failed to stat shard pack: %w", err)
+	}
+	if idx, ok := readPackIndex(path, info); ok {
+		return idx, nil
+	}
+	return scanPack(f)
+}
+
+// compactPack removes the pack at path once it holds no shards, and rewrites it with only the latest copy of each
+// shard once the records of replaced and deleted shards take up more of it than those do, updating idx to match
+// A rewritten pack replaces the old one by rename, so reads that opened the old pack still find every shard in it
+func (store *PackedLocalShardStore) compactPack(path string, f *os.File, idx *packIndex) error {
+	if len(idx.entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete shard pack: %w", err)
+		}
+		os.Remove(packIndexPath(path))
+		if store.Durable {
+			if err := syncDir(filepath.Dir(path)); err != nil {
+				return fmt.Errorf("failed to sync shard directory: %w", err)
+			}
+		}
+		return nil
+	}
+	if idx.dead() <= idx.live {
+		return nil
+	}
+
+	// Shards keep the order they were stored in
+	keys := make([]packKey, 0, len(idx.entries))
+	for key := range idx.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return idx.entries[keys[i]].start < idx.entries[keys[j]].start })
+
+	buf := make([]byte, 0, int64(len(packMagic))+idx.live)
+	buf = append(buf, packMagic...)
+	compacted := packIndex{entries: make(map[packKey]packEntry, len(keys))}
+	for _, key := range keys {
+		entry := idx.entries[key]
+		data := make([]byte, entry.length)
+		if _, err := f.ReadAt(data, entry.offset); err != nil {
+			return fmt.Errorf("failed to read shard pack: %w", err)
+		}
+		compacted.apply(packShard, key, int64(len(buf)), entry.length)
+		buf = append(buf, encodePackRecord(packShard, key, data)...)
+	}
+	if err := writeFileAtomic(path, filepath.Dir(path), buf, store.Durable); err != nil {
+		return err
+	}
+	*idx = compacted
+	return nil
+}
+
+// StoreShard stores a shard in the pack of its object under the location
+// A shard stored again replaces the copy stored before, which is dropped from the pack when it is next compacted
+func (store *PackedLocalShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkPackKey(versionID, shardIdx); err != nil {
+		return err
+	}
+	path, err := store.packPath(location, objectID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for shard pack: %w", err)
+	}
+	return store.updatePack(path, true, func(f *os.File, idx *packIndex) error {
+		return appendPackRecord(f, idx, packShard, packKey{versionID: versionID, shardIdx: shardIdx}, shard)
+	})
+}
+
+// RetrieveShard reads a shard from the pack of its object under the location, seeking straight to its record by way
+// of the pack's index
+// The record found is checked to be the shard's before it is returned, so an index left behind by a pack that has
+// since changed is never trusted; the pack is scanned instead, and the index rebuilt from the scan
+func (store *PackedLocalShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, err := store.packPath(location, objectID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s in %s", ErrShardNotFound, shardName(objectID, versionID, shardIdx), path)
+		}
+		return nil, fmt.Errorf("failed to open shard pack: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat shard pack: %w", err)
+	}
+
+	key := packKey{versionID: versionID, shardIdx: shardIdx}
+	if candidates, ok := lookupPackIndex(path, info, key); ok {
+		for _, candidate := range candidates {
+			shard, found, err := readPackRecord(f, info.Size(), key, candidate.start, candidate.dataLength)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				return shard, nil
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("%w: %s in %s", ErrShardNotFound, shardName(objectID, versionID, shardIdx), path)
+		}
+	}
+
+	idx, err := scanPack(f)
+	if err != nil {
+		return nil, err
+	}
+	store.rebuildPackIndex(path, info, idx)
+	entry, ok := idx.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s in %s", ErrShardNotFound, shardName(objectID, versionID, shardIdx), path)
+	}
+	shard := make([]byte, entry.length)
+	if _, err := f.ReadAt(shard, entry.offset); err != nil {
+		return nil, fmt.Errorf("failed to read shard from pack: %w", err)
+	}
+	return shard, nil
+}
+
+// rebuildPackIndex writes idx, scanned from the pack at path while its file had info, as the index of the pack, unless
+// the pack has changed since
+func (store *PackedLocalShardStore) rebuildPackIndex(path string, info os.FileInfo, idx packIndex) {
+	unlock := store.lockPack(path)
+	defer unlock()
+	current, err := os.Stat(path)
+	if err != nil || !os.SameFile(info, current) || current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		return
+	}
+	writePackIndex(path, idx)
+}
+
+// Only delete shards of a particular version_id
+func (store *PackedLocalShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	path, err := store.packPath(location, objectID)
+	if err != nil {
+		return err
+	}
+	key := packKey{versionID: versionID, shardIdx: shardIdx}
+	return store.updatePack(path, false, func(f *os.File, idx *packIndex) error {
+		if _, ok := idx.entries[key]; !ok {
+			return nil
+		}
+		// The last shard of a pack needs no record of its deletion, since the pack is removed along with it
+		if len(idx.entries) == 1 {
+			delete(idx.entries, key)
+			idx.live = 0
+			return nil
+		}
+		return appendPackRecord(f, idx, packDeleted, key, nil)
+	})
+}
+
+// Delete all shards of the same object_id
+func (store *PackedLocalShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	path, err := store.packPath(location, objectID)
+	if err != nil {
+		return err
+	}
+	unlock := store.lockPack(path)
+	defer unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete shard pack %s: %w", path, err)
+	}
+	os.Remove(packIndexPath(path))
+	if store.Durable {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("failed to sync shard directory: %w", err)
+		}
+	}
+	return nil
+}
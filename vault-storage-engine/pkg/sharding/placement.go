@@ -0,0 +1,58 @@
+package sharding
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Supported placement strategy names, as set in the config
+const (
+	RoundRobin = "round-robin"
+	Hash       = "hash"
+)
+
+// Placement decides which storage location hosts each shard of an erasure-coded unit
+// shardIdx is the index of the shard within its unit, so every chunk of a version is placed the same way
+type Placement interface {
+	Assign(shardIdx, totalShards int, locations []string) string
+}
+
+// NewPlacement returns the Placement for a strategy name
+// An empty name selects round-robin, which places shards one-to-one when there are as many locations as shards
+func NewPlacement(name string) (Placement, error) {
+	switch name {
+	case "", RoundRobin:
+		return RoundRobinPlacement{}, nil
+	case Hash:
+		return HashPlacement{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported placement strategy: %s", name)
+	}
+}
+
+// RoundRobinPlacement deals shards out to the locations in order, wrapping around when there are fewer locations than shards
+type RoundRobinPlacement struct{}
+
+func (RoundRobinPlacement) Assign(shardIdx, totalShards int, locations []string) string {
+	return locations[shardIdx%len(locations)]
+}
+
+// HashPlacement picks the location with the highest hash of the location and shard index (rendezvous hashing)
+// Adding or removing a location only moves the shards that the location gains or loses
+type HashPlacement struct{}
+
+func (HashPlacement) Assign(shardIdx, totalShards int, locations []string) string {
+	var (
+		best      string
+		bestScore uint64
+	)
+	for i, location := range locations {
+		sum := sha256.Sum256([]byte(location + "\x00" + strconv.Itoa(shardIdx)))
+		if score := binary.BigEndian.Uint64(sum[:8]); i == 0 || score > bestScore {
+			best, bestScore = location, score
+		}
+	}
+	return best
+}
@@ -1,37 +1,181 @@
 package sharding
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	// Uncomment and import AWS SDK packages if you intend to implement S3 integration.
-	// "github.com/aws/aws-sdk-go/aws"
-	// "github.com/aws/aws-sdk-go/aws/session"
-	// "github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-// S3ShardStore is a skeleton for an S3-based shard store.
+// S3ShardStore is an S3-backed implementation of ShardStore
+// Each storage location maps to a key prefix inside a single S3 bucket
 type S3ShardStore struct {
-	// client *s3.S3
-	Bucket   string
-	Endpoint string
+	client *s3.Client
+	Bucket string
+	Region string
 }
 
-func NewS3ShardStore(bucket, endpoint string) *S3ShardStore {
-	// Initialize AWS session and S3 client here.
+var _ ShardStore = (*S3ShardStore)(nil)
+
+// NewS3ShardStore creates a new S3ShardStore
+// If client is nil, one is built from the default AWS credential chain for the given region
+func NewS3ShardStore(bucket, region string, client *s3.Client) (*S3ShardStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 bucket name is required")
+	}
+
+	if client == nil {
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		client = s3.NewFromConfig(awsCfg)
+	}
+
 	return &S3ShardStore{
-		Bucket:   bucket,
-		Endpoint: endpoint,
+		client: client,
+		Bucket: bucket,
+		Region: region,
+	}, nil
+}
+
+// shardKey maps a location and shard to an S3 object key
+// Locations are treated as key prefixes, so "/mnt/disk1/shards" becomes "mnt/disk1/shards/..."
+func (s *S3ShardStore) shardKey(location, name string) string {
+	return path.Join(strings.TrimPrefix(location, "/"), name)
+}
+
+// StoreShard uploads a shard to S3
+func (s *S3ShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	key := s.shardKey(location, shardName(objectID, versionID, shardIdx))
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(shard),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload shard %s to s3: %w", key, err)
+	}
+	return nil
+}
+
+// RetrieveShard downloads a shard from S3
+func (s *S3ShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	key := s.shardKey(location, shardName(objectID, versionID, shardIdx))
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%w: s3://%s/%s", ErrShardNotFound, s.Bucket, key)
+		}
+		return nil, fmt.Errorf("failed to download shard %s from s3: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	shard, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard %s from s3: %w", key, err)
+	}
+	return shard, nil
+}
+
+// CopyShard copies a shard to another object and version inside the S3 bucket, without downloading it
+func (s *S3ShardStore) CopyShard(ctx context.Context, srcObjectID, srcVersionID, dstObjectID, dstVersionID string, shardIdx int, location string) error {
+	srcKey := s.shardKey(location, shardName(srcObjectID, srcVersionID, shardIdx))
+	dstKey := s.shardKey(location, shardName(dstObjectID, dstVersionID, shardIdx))
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(url.PathEscape(s.Bucket + "/" + srcKey)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return fmt.Errorf("%w: s3://%s/%s", ErrShardNotFound, s.Bucket, srcKey)
+		}
+		return fmt.Errorf("failed to copy shard %s to %s in s3: %w", srcKey, dstKey, err)
 	}
+	return nil
 }
 
-func (s *S3ShardStore) StoreShard(dataID string, index int, shard []byte) error {
-	// Implement S3 PutObject logic here.
-	fmt.Printf("S3: Stored shard %d for DataID: %s in bucket %s\n", index, dataID, s.Bucket)
+// DeleteShardByVersion removes a single shard of a particular version_id
+func (s *S3ShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	key := s.shardKey(location, shardName(objectID, versionID, shardIdx))
+
+	// S3 already treats deleting a missing key as a success
+	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete shard %s from s3: %w", key, err)
+	}
 	return nil
 }
 
-func (s *S3ShardStore) RetrieveShard(dataID string, index int) ([]byte, error) {
-	// Implement S3 GetObject logic here.
-	fmt.Printf("S3: Retrieved shard %d for DataID: %s from bucket %s\n", index, dataID, s.Bucket)
-	// Return a dummy value for demonstration.
-	return []byte("dummy"), nil
+// DeleteShard removes all shards of the same object_id under a location
+func (s *S3ShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	prefix := s.shardKey(location, shardPrefix(objectID))
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to list shards with prefix %s: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete shard %s from s3: %w", aws.ToString(obj.Key), err)
+			}
+		}
+	}
+	return nil
+}
+
+// IsTransient reports whether an S3 error is worth retrying, such as throttling, 5xx responses and connection failures
+func (s *S3ShardStore) IsTransient(err error) bool {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusTooManyRequests {
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// isS3NotFound reports whether err means the requested key does not exist
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+		return true
+	}
+	return false
 }
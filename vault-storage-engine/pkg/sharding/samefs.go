@@ -0,0 +1,49 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CheckSameFilesystem returns an error if tempPath and basePath are on different filesystems, so a LocalShardStore
+// staging shards in tempPath could never rename them into place under basePath
+// Directories that do not exist yet are created by the store under their nearest existing parent, so that is what is
+// compared for them; platforms that do not report device IDs pass the check, and fail on the first store instead
+func CheckSameFilesystem(tempPath, basePath string) error {
+	tempDevice, ok, err := pathDevice(tempPath)
+	if err != nil || !ok {
+		return err
+	}
+	baseDevice, ok, err := pathDevice(basePath)
+	if err != nil || !ok {
+		return err
+	}
+	if tempDevice != baseDevice {
+		return fmt.Errorf("temporary shard directory %s is not on the same filesystem as %s", tempPath, basePath)
+	}
+	return nil
+}
+
+// pathDevice returns the device ID of path, or of its nearest existing parent, and reports whether the platform
+// records one
+func pathDevice(path string) (uint64, bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			device, ok := fileDevice(info)
+			return device, ok, nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, fs.ErrNotExist) || parent == path {
+			return 0, false, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		path = parent
+	}
+}
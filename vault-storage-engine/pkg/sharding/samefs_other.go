@@ -0,0 +1,10 @@
+//go:build !unix
+
+package sharding
+
+import "os"
+
+// fileDevice reports that device IDs are not known on this platform
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package sharding
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the ID of the device info's file is on
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
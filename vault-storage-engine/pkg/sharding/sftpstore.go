@@ -0,0 +1,282 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPShardStore is an SFTP implementation of ShardStore for remote disks that are only reachable over SSH
+// Each storage location maps to a directory under BasePath on the remote host
+// A single SFTP session is shared by all operations, and is reopened on the next operation if the connection drops
+type SFTPShardStore struct {
+	BasePath string
+	// Naming is the scheme shard files are named with, NamingPlain when empty, as for LocalShardStore
+	Naming string
+	dial   func() (*ssh.Client, error)
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+var _ ShardStore = (*SFTPShardStore)(nil)
+
+// NewSFTPShardStore creates a new SFTPShardStore over an existing SSH connection
+// A dropped SFTP session is reopened over the same connection, but the connection itself is never redialled
+func NewSFTPShardStore(conn *ssh.Client, basePath string) (*SFTPShardStore, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("ssh client is required")
+	}
+	store := &SFTPShardStore{BasePath: basePath, conn: conn}
+	if _, err := store.session(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// DialSFTPShardStore creates a new SFTPShardStore that connects to addr itself
+// The connection is redialled whenever it drops, so long-running operations survive a restarted node
+func DialSFTPShardStore(addr string, sshCfg *ssh.ClientConfig, basePath string) (*SFTPShardStore, error) {
+	store := &SFTPShardStore{
+		BasePath: basePath,
+		dial: func() (*ssh.Client, error) {
+			return ssh.Dial("tcp", addr, sshCfg)
+		},
+	}
+	if _, err := store.session(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// session returns the shared SFTP session, opening it (and dialling, if the store owns its connection) when needed
+func (s *SFTPShardStore) session() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to sftp host: %w", err)
+		}
+		s.conn = conn
+	}
+	client, err := sftp.NewClient(s.conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sftp session: %w", err)
+	}
+	s.client = client
+	return client, nil
+}
+
+// release drops client if err shows its connection was lost, so the next operation opens a fresh session
+func (s *SFTPShardStore) release(client *sftp.Client, err error) {
+	if !isConnectionLost(err) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != client {
+		// Another operation has already replaced the session
+		return
+	}
+	s.client.Close()
+	s.client = nil
+	if s.dial != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Close ends the SFTP session, and the SSH connection if the store dialled it
+func (s *SFTPShardStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.client != nil {
+		err = s.client.Close()
+		s.client = nil
+	}
+	if s.dial != nil && s.conn != nil {
+		err = errors.Join(err, s.conn.Close())
+		s.conn = nil
+	}
+	return err
+}
+
+// shardPath maps a location and shard to a path on the remote host
+// Object and version IDs that could name a file outside the location, by containing a path separator, are rejected
+func (s *SFTPShardStore) shardPath(location, objectID, versionID string, shardIdx int) (string, error) {
+	name, err := namedObjectID(s.Naming, objectID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkFileNamePart(versionID); err != nil {
+		return "", fmt.Errorf("invalid version id %q: %w", versionID, err)
+	}
+	return path.Join(s.BasePath, location, shardName(name, versionID, shardIdx)), nil
+}
+
+// StoreShard writes a shard to the remote host, creating its directory as needed
+func (s *SFTPShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	shardPath, err := s.shardPath(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return err
+	}
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+
+	err = writeRemoteFile(client, shardPath, shard)
+	s.release(client, err)
+	return err
+}
+
+// writeRemoteFile writes data to a file on the remote host, creating its directory as needed
+func writeRemoteFile(client *sftp.Client, shardPath string, data []byte) error {
+	if err := client.MkdirAll(path.Dir(shardPath)); err != nil {
+		return fmt.Errorf("failed to create directory for shard: %w", err)
+	}
+	f, err := client.Create(shardPath)
+	if err != nil {
+		return fmt.Errorf("failed to create shard file %s: %w", shardPath, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write shard to file %s: %w", shardPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write shard to file %s: %w", shardPath, err)
+	}
+	return nil
+}
+
+// RetrieveShard reads a shard from the remote host
+func (s *SFTPShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	shardPath, err := s.shardPath(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+
+	shard, err := readRemoteFile(client, shardPath)
+	s.release(client, err)
+	return shard, err
+}
+
+// readRemoteFile reads a whole file from the remote host
+func readRemoteFile(client *sftp.Client, shardPath string) ([]byte, error) {
+	f, err := client.Open(shardPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: sftp:%s", ErrShardNotFound, shardPath)
+		}
+		return nil, fmt.Errorf("failed to open shard file %s: %w", shardPath, err)
+	}
+	defer f.Close()
+
+	shard, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard from file %s: %w", shardPath, err)
+	}
+	return shard, nil
+}
+
+// DeleteShardByVersion removes a single shard of a particular version_id
+func (s *SFTPShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	shardPath, err := s.shardPath(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return err
+	}
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+
+	err = client.Remove(shardPath)
+	s.release(client, err)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete shard file %s: %w", shardPath, err)
+	}
+	return nil
+}
+
+// DeleteShard removes all shards of the same object_id under a location
+func (s *SFTPShardStore) DeleteShard(objectID string, shardIdx int, location string) error {
+	if location == "" {
+		return fmt.Errorf("invalid storage location")
+	}
+	name, err := namedObjectID(s.Naming, objectID)
+	if err != nil {
+		return err
+	}
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+	shardDir := path.Join(s.BasePath, location)
+
+	files, err := client.ReadDir(shardDir)
+	if err != nil {
+		s.release(client, err)
+		return fmt.Errorf("failed to read shard directory: %w", err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), shardPrefix(name)) {
+			continue
+		}
+		shardPath := path.Join(shardDir, file.Name())
+		err := client.Remove(shardPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.release(client, err)
+			return fmt.Errorf("failed to delete shard file %s: %w", shardPath, err)
+		}
+	}
+	return nil
+}
+
+// IsTransient reports whether an SFTP error is worth retrying
+// Only a lost connection is transient; the retried operation runs on a freshly opened session
+func (s *SFTPShardStore) IsTransient(err error) bool {
+	return isConnectionLost(err)
+}
+
+// isConnectionLost reports whether err means the SFTP session or the SSH connection under it has gone away
+func isConnectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
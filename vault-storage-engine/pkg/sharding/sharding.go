@@ -1,23 +1,127 @@
 package sharding
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
+// ErrShardNotFound is returned by a ShardStore when the requested shard does not exist
+// RetrieveData treats it as a missing shard rather than a hard failure
+var ErrShardNotFound = errors.New("shard not found")
+
 // ShardStore is an interface for storing shards
 type ShardStore interface {
-	StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error
-	RetrieveShard(objectID, versionID string, shardIdx int, location string) ([]byte, error)
+	StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error
+	RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error)
 	DeleteShard(objectID string, shardIdx int, location string) error
+	// DeleteShardByVersion removes a single shard of a version; a shard that is already gone counts as deleted, so
+	// cleanups that are retried or race each other succeed, and every store reports it the same way
 	DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error
 }
 
+// TransientClassifier is implemented by stores that can tell transient failures, such as throttling, apart from permanent ones
+type TransientClassifier interface {
+	IsTransient(err error) bool
+}
+
+// IsTransient reports whether a failed operation on store is worth retrying
+// Missing shards and cancelled contexts are never transient, and errors from stores that cannot classify them are not retried
+func IsTransient(store ShardStore, err error) bool {
+	if err == nil || errors.Is(err, ErrShardNotFound) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	classifier, ok := store.(TransientClassifier)
+	return ok && classifier.IsTransient(err)
+}
+
+// ShardCopier is implemented by stores that can copy a shard within a location without downloading it, such as cloud object stores
+type ShardCopier interface {
+	CopyShard(ctx context.Context, srcObjectID, srcVersionID, dstObjectID, dstVersionID string, shardIdx int, location string) error
+}
+
+// CopyShard copies a shard within its location to another object and version
+// Stores that implement ShardCopier copy it server-side; for any other store the shard is read and written back
+func CopyShard(ctx context.Context, store ShardStore, srcObjectID, srcVersionID, dstObjectID, dstVersionID string, shardIdx int, location string) error {
+	if copier, ok := store.(ShardCopier); ok {
+		return copier.CopyShard(ctx, srcObjectID, srcVersionID, dstObjectID, dstVersionID, shardIdx, location)
+	}
+	shard, err := store.RetrieveShard(ctx, srcObjectID, srcVersionID, shardIdx, location)
+	if err != nil {
+		return err
+	}
+	return store.StoreShard(ctx, dstObjectID, dstVersionID, shardIdx, shard, location)
+}
+
+// ShardLocator is implemented by stores that can tell where they keep a shard, such as the path of its file
+// Two shards a store would keep at the same place overwrite each other, so writers check the places are distinct
+type ShardLocator interface {
+	ShardPath(objectID, versionID string, shardIdx int, location string) (string, error)
+}
+
+// ShardPath returns where store keeps a shard, for stores that implement ShardLocator, and the shard's name under its
+// location for any other store
+func ShardPath(store ShardStore, objectID, versionID string, shardIdx int, location string) (string, error) {
+	if locator, ok := store.(ShardLocator); ok {
+		return locator.ShardPath(objectID, versionID, shardIdx, location)
+	}
+	return path.Join(location, shardName(objectID, versionID, shardIdx)), nil
+}
+
+// Closer is implemented by stores that hold connections or clients to release once they are no longer used
+// A closed store must not be used again
+type Closer interface {
+	Close() error
+}
+
+// Close releases whatever store holds, for stores that implement Closer, and does nothing for any other store
+// Stores only close the clients they created themselves; a client passed to a constructor is left to its owner
+func Close(store ShardStore) error {
+	if closer, ok := store.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// shardName returns the name a shard is stored under inside its location
+// The version is recorded with each shard so versions of an object never collide
+func shardName(objectID, versionID string, shardIdx int) string {
+	return fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx)
+}
+
+// shardPrefix returns the name prefix shared by every shard of an object, across all versions
+func shardPrefix(objectID string) string {
+	return objectID + "-v("
+}
+
+// Shard file naming schemes of a LocalShardStore
+const (
+	// NamingPlain names shard files after the object ID as it is, and rejects object IDs that are not valid in a file name
+	NamingPlain = "plain"
+	// NamingHex names shard files after the hex encoding of the object ID, so any object ID can be stored
+	NamingHex = "hex"
+)
+
 // LocalShardStore is a local implementation of ShardStore
 type LocalShardStore struct {
 	BasePath string
+	// Durable flushes every shard, and the directory entry naming it, to disk before StoreShard returns,
+	// so acknowledged writes survive a power loss
+	Durable bool
+	// Naming is the scheme shard files are named with, NamingPlain when empty
+	// Shards are only found under the scheme they were stored with, so it cannot be changed once shards are stored
+	Naming string
+	// TempPath is the directory shards are staged in before they are renamed into place, the shard's own directory
+	// when empty
+	// It must be on the same filesystem as BasePath, since shards could not be renamed into place otherwise; writes
+	// staged on another filesystem fail rather than being copied
+	TempPath string
 }
 
 // NewLocalShardStore creates a new LocalShardStore
@@ -25,41 +129,218 @@ func NewLocalShardStore(basePath string) *LocalShardStore {
 	return &LocalShardStore{BasePath: basePath}
 }
 
+// Close implements Closer; a LocalShardStore holds no open files between calls, so there is nothing to release
+func (store *LocalShardStore) Close() error {
+	return nil
+}
+
+// shardPath returns the path of a shard file under a location
+// Object and version IDs that could name a file outside the location, by containing a path separator, are rejected
+func (store *LocalShardStore) shardPath(location, objectID, versionID string, shardIdx int) (string, error) {
+	name, err := store.fileObjectID(objectID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkFileNamePart(versionID); err != nil {
+		return "", fmt.Errorf("invalid version id %q: %w", versionID, err)
+	}
+	return filepath.Join(store.BasePath, location, shardName(name, versionID, shardIdx)), nil
+}
+
+// ShardPath implements ShardLocator with the path of the shard's file
+func (store *LocalShardStore) ShardPath(objectID, versionID string, shardIdx int, location string) (string, error) {
+	return store.shardPath(location, objectID, versionID, shardIdx)
+}
+
+// fileObjectID returns the form of an object ID that shard files are named with under the store's naming scheme
+func (store *LocalShardStore) fileObjectID(objectID string) (string, error) {
+	return namedObjectID(store.Naming, objectID)
+}
+
+// namedObjectID returns the form of an object ID that files are named with under a naming scheme
+func namedObjectID(naming, objectID string) (string, error) {
+	switch naming {
+	case "", NamingPlain:
+		if err := checkFileNamePart(objectID); err != nil {
+			return "", fmt.Errorf("invalid object id %q: %w", objectID, err)
+		}
+		return objectID, nil
+	case NamingHex:
+		return hex.EncodeToString([]byte(objectID)), nil
+	default:
+		return "", fmt.Errorf("unsupported shard naming: %s", naming)
+	}
+}
+
+// checkFileNamePart returns an error if s cannot safely be made part of a single file name
+// Path separators would place the file in another directory, and NUL bytes are not valid in paths at all
+func checkFileNamePart(s string) error {
+	if strings.ContainsRune(s, '/') || strings.ContainsRune(s, filepath.Separator) {
+		return fmt.Errorf("contains a path separator")
+	}
+	if strings.ContainsRune(s, 0) {
+		return fmt.Errorf("contains a NUL byte")
+	}
+	return nil
+}
+
 // StoreShard stores a shard locally
-func (store *LocalShardStore) StoreShard(objectID, versionID string, shardIdx int, shard []byte, location string) error {
+// The shard is written to a temporary file, in TempPath or else the same directory, and renamed into place, so readers
+// never see a partial shard
+func (store *LocalShardStore) StoreShard(ctx context.Context, objectID, versionID string, shardIdx int, shard []byte, location string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	// Record versions with each shard
-	shardPath := filepath.Join(store.BasePath, location, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
-	err := os.MkdirAll(filepath.Dir(shardPath), 0755)
+	shardPath, err := store.shardPath(location, objectID, versionID, shardIdx)
 	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(shardPath), 0755); err != nil {
 		return fmt.Errorf("failed to create directory for shard: %w", err)
 	}
 
-	err = os.WriteFile(shardPath, shard, 0644)
+	tempDir := filepath.Dir(shardPath)
+	if store.TempPath != "" {
+		tempDir = store.TempPath
+		if err := os.MkdirAll(tempDir, 0755); err != nil {
+			return fmt.Errorf("failed to create temporary shard directory: %w", err)
+		}
+	}
+	return writeFileAtomic(shardPath, tempDir, shard, store.Durable)
+}
+
+// writeFileAtomic replaces path with data by writing it to a temporary file in tempDir and renaming that over path
+// When durable is set, the file is synced before the rename and its directory after it, so the rename is on disk too
+func writeFileAtomic(path, tempDir string, data []byte, durable bool) error {
+	dir := filepath.Dir(path)
+	// The leading dot keeps temporary files out of shard name prefix matches
+	tmp, err := os.CreateTemp(tempDir, "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
+		return fmt.Errorf("failed to create temporary shard file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
 		return fmt.Errorf("failed to write shard to file: %w", err)
 	}
+	if err := tmp.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to set shard file permissions: %w", err)
+	}
+	if durable {
+		if err := tmp.Sync(); err != nil {
+			return fmt.Errorf("failed to sync shard file: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close shard file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("temporary shard directory %s is not on the same filesystem as %s: %w", tempDir, dir, err)
+		}
+		return fmt.Errorf("failed to move shard into place: %w", err)
+	}
+	committed = true
+
+	if durable {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("failed to sync shard directory: %w", err)
+		}
+	}
 	return nil
 }
 
+// syncDir flushes the entries of a directory to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 // RetrieveShard retrieves a shard locally
-func (store *LocalShardStore) RetrieveShard(objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+func (store *LocalShardStore) RetrieveShard(ctx context.Context, objectID, versionID string, shardIdx int, location string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	// Record version with each shard
-	shardPath := filepath.Join(store.BasePath, location, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
+	shardPath, err := store.shardPath(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return nil, err
+	}
 	shard, err := os.ReadFile(shardPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrShardNotFound, shardPath)
+		}
 		return nil, fmt.Errorf("failed to read shard from file: %w", err)
 	}
 	return shard, nil
 }
 
+// CopyShard implements ShardCopier by hard linking the shard under the name of its copy, so the copy takes no space
+// Shards are only ever replaced by renaming a new file over them, never rewritten in place, so either name can be
+// replaced or deleted without affecting the other; filesystems that cannot link shards get a copy of the file instead
+func (store *LocalShardStore) CopyShard(ctx context.Context, srcObjectID, srcVersionID, dstObjectID, dstVersionID string, shardIdx int, location string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	srcPath, err := store.shardPath(location, srcObjectID, srcVersionID, shardIdx)
+	if err != nil {
+		return err
+	}
+	dstPath, err := store.shardPath(location, dstObjectID, dstVersionID, shardIdx)
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(srcPath, dstPath)
+	// A copy left by an earlier attempt is replaced, as StoreShard would replace it
+	if os.IsExist(err) {
+		if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to replace shard file: %w", err)
+		}
+		err = os.Link(srcPath, dstPath)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrShardNotFound, srcPath)
+		}
+		shard, readErr := store.RetrieveShard(ctx, srcObjectID, srcVersionID, shardIdx, location)
+		if readErr != nil {
+			return readErr
+		}
+		return store.StoreShard(ctx, dstObjectID, dstVersionID, shardIdx, shard, location)
+	}
+	if store.Durable {
+		if err := syncDir(filepath.Dir(dstPath)); err != nil {
+			return fmt.Errorf("failed to sync shard directory: %w", err)
+		}
+	}
+	return nil
+}
+
 // Only delete shards of a particular version_id
 func (store *LocalShardStore) DeleteShardByVersion(objectID, versionID string, shardIdx int, location string) error {
 	if location == "" {
 		return fmt.Errorf("invalid storage location")
 	}
-	shardPath := filepath.Join(store.BasePath, location, fmt.Sprintf("%s-v(%s)_shard_%d", objectID, versionID, shardIdx))
+	shardPath, err := store.shardPath(location, objectID, versionID, shardIdx)
+	if err != nil {
+		return err
+	}
 
-	err := os.Remove(shardPath)
+	err = os.Remove(shardPath)
 	if err != nil {
 		// Let's check if the shard does not exists
 		if os.IsNotExist(err) {
@@ -76,6 +357,10 @@ func (store *LocalShardStore) DeleteShard(objectID string, shardIdx int, locatio
 		return fmt.Errorf("invalid storage location")
 	}
 
+	name, err := store.fileObjectID(objectID)
+	if err != nil {
+		return err
+	}
 	shardDir := filepath.Join(store.BasePath, location)
 
 	// Read all files in the directory
@@ -86,7 +371,7 @@ func (store *LocalShardStore) DeleteShard(objectID string, shardIdx int, locatio
 
 	// Iterate and delete matching shards
 	for _, file := range files {
-		if strings.HasPrefix(file.Name(), objectID+"-v(") {
+		if strings.HasPrefix(file.Name(), shardPrefix(name)) {
 			shardPath := filepath.Join(shardDir, file.Name())
 
 			err := os.Remove(shardPath)
@@ -11,3 +11,16 @@ func ConvertSliceToMap(slice []string) map[string]string {
 	}
 	return result
 }
+
+// Helper function to convert a map built by ConvertSliceToMap back to a slice
+func ConvertMapToSlice(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for i := 0; ; i++ {
+		v, ok := m[fmt.Sprintf("key_%d", i)]
+		if !ok {
+			break
+		}
+		result = append(result, v)
+	}
+	return result
+}
@@ -19,8 +19,12 @@ func RunCli() {
 	defer logger.Sync()
 
 	cfg := config.LoadConfig()
+	// The locations stores write to are checked along with the config, before any command runs
+	if err := object_cli.ValidateLayout(cfg); err != nil {
+		log.Fatalf("invalid storage layout: %v", err)
+	}
 
-	db, err := bucket.InitDB()
+	db, err := bucket.InitDBWithOptions("metadata.db", bucket.DBOptions{WAL: cfg.DBWAL, BusyTimeout: cfg.DBBusyTimeout})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -73,7 +77,7 @@ func RunCli() {
 			},
 			{
 				Name:  "delete-object",
-				Usage: "Deletes an all versions of an object. Usage: delete-object <bucket_id> <object_id> <initial_object_id>",
+				Usage: "Deletes all versions of an object. Usage: delete-object <bucket_id> <object_id>",
 				Action: func(c *cli.Context) error {
 					return object_cli.DeleteObject(c, db, cfg, logger)
 				},